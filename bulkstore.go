@@ -0,0 +1,464 @@
+package netdicom
+
+// This file implements BulkStore, which sends a set of DICOM files over
+// parallel associations.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	dicom "github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomtag"
+	"github.com/grailbio/go-dicom/dicomuid"
+	"github.com/grailbio/go-netdicom/dimse"
+)
+
+// Defaults of BulkStoreParams.
+const (
+	DefaultBulkStoreMaxAttempts     = 3
+	DefaultBulkStoreRetryBackoff    = time.Second
+	DefaultBulkStoreMaxRetryBackoff = time.Minute
+)
+
+// maxBulkStoreSOPClasses is the max number of SOP classes proposed in one
+// association. Each takes one presentation context, and an association can
+// have at most 128 of them.
+const maxBulkStoreSOPClasses = 128
+
+// BulkStoreParams defines parameters for BulkStore.
+type BulkStoreParams struct {
+	// Paths lists the DICOM files and directories to send. Directories are
+	// walked recursively. A file named DICOMDIR isn't sent; the files it
+	// references are sent instead. Each file must be in the DICOM file
+	// format, i.e., start with the 128-byte preamble and the metadata.
+	Paths []string
+
+	// Addr is the host:port of the provider.
+	Addr string
+
+	// User is the template of the parameters of each association. SOPClasses
+	// and TransferSyntaxes are ignored; they are derived from the files.
+	User ServiceUserParams
+
+	// Parallelism is the number of associations used concurrently. If <= 0,
+	// one association is used.
+	Parallelism int
+
+	// MaxAttempts is the max number of times a file is sent. A file is sent
+	// again if the provider responds with an out-of-resources status (A7xx),
+	// or if the association couldn't be established or ended before the
+	// response. Other failures, e.g., an unreadable file, a SOP class the
+	// provider rejected, or another failure status, are final. If <= 0,
+	// DefaultBulkStoreMaxAttempts is used.
+	MaxAttempts int
+
+	// RetryBackoff is the delay before the first retry of a file. The delay
+	// doubles on each subsequent retry, up to MaxRetryBackoff. If <= 0,
+	// DefaultBulkStoreRetryBackoff and DefaultBulkStoreMaxRetryBackoff are
+	// used.
+	RetryBackoff    time.Duration
+	MaxRetryBackoff time.Duration
+
+	// Progress, if non-nil, is called after each attempt to send a file.
+	// Calls are serialized.
+	Progress func(BulkStoreProgress)
+}
+
+// BulkStoreResult is the outcome of sending one file.
+type BulkStoreResult struct {
+	Path string
+
+	// Read from the file's metadata. Empty if the file couldn't be read.
+	SOPClassUID       string
+	SOPInstanceUID    string
+	TransferSyntaxUID string
+
+	// Status is the status of the last C-STORE response. It is
+	// dimse.Success if the file was stored, or if no response was received.
+	Status dimse.Status
+
+	// Warning is true if the file was stored, but the provider responded
+	// with a warning status.
+	Warning bool
+
+	// Err is nil iff the file was stored.
+	Err error
+
+	// Attempts is the number of times the file was sent. It is zero if the
+	// file couldn't be read.
+	Attempts int
+
+	// Elapsed is the time spent on sending the file, including retries.
+	Elapsed time.Duration
+}
+
+// BulkStoreProgress is reported to BulkStoreParams.Progress.
+type BulkStoreProgress struct {
+	// Result is the outcome of the attempt. Result.Attempts is the attempt
+	// number.
+	Result BulkStoreResult
+
+	// Retrying is true if the file will be sent again.
+	Retrying bool
+
+	// Done is the number of files finished so far, out of Total.
+	Done, Total int
+}
+
+// bulkStoreGroup is a set of files sent on the same kind of association.
+type bulkStoreGroup struct {
+	transferSyntaxUID string
+	sopClasses        []string
+}
+
+type bulkStoreFile struct {
+	index  int // Index in the results.
+	path   string
+	group  *bulkStoreGroup
+	result BulkStoreResult
+}
+
+type bulkStore struct {
+	params BulkStoreParams
+	logger *logger
+
+	mu      sync.Mutex
+	done    int // Guarded by mu.
+	total   int
+	results []BulkStoreResult
+}
+
+// BulkStore sends the DICOM files found in params.Paths to params.Addr using
+// C-STORE. The files are grouped by transfer syntax and SOP class, so that
+// each association proposes the transfer syntax of its files first. Files are
+// sent over params.Parallelism associations, and transient failures are
+// retried with backoff.
+//
+// It returns one result per file, in the order the files were found. The
+// error is non-nil only if params are invalid. Cancelling ctx stops sending;
+// files not stored by then report ctx.Err().
+func BulkStore(ctx context.Context, params BulkStoreParams) ([]BulkStoreResult, error) {
+	if params.Addr == "" {
+		return nil, fmt.Errorf("dicom.BulkStore: empty Addr")
+	}
+	if params.Parallelism <= 0 {
+		params.Parallelism = 1
+	}
+	if params.MaxAttempts <= 0 {
+		params.MaxAttempts = DefaultBulkStoreMaxAttempts
+	}
+	if params.RetryBackoff <= 0 {
+		params.RetryBackoff = DefaultBulkStoreRetryBackoff
+	}
+	if params.MaxRetryBackoff <= 0 {
+		params.MaxRetryBackoff = DefaultBulkStoreMaxRetryBackoff
+	}
+	if _, err := validateDeflateLevel(params.User.DeflateLevel); err != nil {
+		return nil, err
+	}
+	b := &bulkStore{
+		params: params,
+		logger: newLogger(params.User.Logger, params.User.Redaction, "bulkstore", newUID("bulk")),
+	}
+	files := b.scan()
+	b.total = len(files)
+	b.results = make([]BulkStoreResult, len(files))
+	var pending []*bulkStoreFile
+	for _, f := range files {
+		if f.result.Err != nil {
+			b.finish(f)
+			continue
+		}
+		pending = append(pending, f)
+	}
+	groupBulkStoreFiles(pending)
+	b.logger.info("Start bulk store", "files", len(files), "sendable", len(pending), "parallelism", params.Parallelism)
+
+	// The files are queued in group order, so a worker switches
+	// associations only when it moves on to the next group.
+	ch := make(chan *bulkStoreFile, len(pending))
+	for _, f := range pending {
+		ch <- f
+	}
+	close(ch)
+	var wg sync.WaitGroup
+	for i := 0; i < params.Parallelism; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b.runWorker(ctx, ch)
+		}()
+	}
+	wg.Wait()
+	return b.results, nil
+}
+
+// scan finds the files to send and reads their metadata.
+func (b *bulkStore) scan() []*bulkStoreFile {
+	var files []*bulkStoreFile
+	seen := map[string]bool{}
+	add := func(path string, err error) {
+		path = filepath.Clean(path)
+		if seen[path] {
+			return
+		}
+		seen[path] = true
+		f := &bulkStoreFile{index: len(files), path: path}
+		f.result.Path = path
+		if err == nil {
+			err = readBulkStoreMeta(f)
+		}
+		f.result.Err = err
+		files = append(files, f)
+	}
+	addDICOMDIR := func(path string) {
+		refs, err := readDICOMDIR(path)
+		if err != nil {
+			add(path, err)
+			return
+		}
+		for _, ref := range refs {
+			add(ref, nil)
+		}
+	}
+	for _, root := range b.params.Paths {
+		err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				add(path, err)
+				return nil
+			}
+			if info.IsDir() {
+				return nil
+			}
+			if strings.EqualFold(info.Name(), "DICOMDIR") {
+				addDICOMDIR(path)
+				return nil
+			}
+			add(path, nil)
+			return nil
+		})
+		if err != nil {
+			add(root, err)
+		}
+	}
+	return files
+}
+
+// readBulkStoreMeta fills the UIDs in f.result from the file's metadata.
+func readBulkStoreMeta(f *bulkStoreFile) error {
+	in, err := os.Open(f.path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	meta, err := readPart10Header(in)
+	if err != nil {
+		return fmt.Errorf("%s: %v", f.path, err)
+	}
+	r := &f.result
+	if r.SOPClassUID, err = getMetaString(meta, dicomtag.MediaStorageSOPClassUID); err != nil {
+		return fmt.Errorf("%s: %v", f.path, err)
+	}
+	if r.SOPInstanceUID, err = getMetaString(meta, dicomtag.MediaStorageSOPInstanceUID); err != nil {
+		return fmt.Errorf("%s: %v", f.path, err)
+	}
+	if r.TransferSyntaxUID, err = getMetaString(meta, dicomtag.TransferSyntaxUID); err != nil {
+		return fmt.Errorf("%s: %v", f.path, err)
+	}
+	return nil
+}
+
+// readDICOMDIR returns the paths of the files referenced by a DICOMDIR file.
+func readDICOMDIR(path string) ([]string, error) {
+	ds, err := dicom.ReadDataSetFromFile(path, dicom.ReadOptions{DropPixelData: true})
+	if err != nil {
+		return nil, err
+	}
+	seq, err := ds.FindElementByTag(dicomtag.DirectoryRecordSequence)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	dir := filepath.Dir(path)
+	var refs []string
+	for _, v := range seq.Value {
+		item, ok := v.(*dicom.Element)
+		if !ok {
+			continue
+		}
+		for _, iv := range item.Value {
+			elem, ok := iv.(*dicom.Element)
+			if !ok || elem.Tag != dicomtag.ReferencedFileID {
+				continue
+			}
+			components, err := elem.GetStrings()
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", path, err)
+			}
+			refs = append(refs, filepath.Join(append([]string{dir}, components...)...))
+		}
+	}
+	return refs, nil
+}
+
+// groupBulkStoreFiles sorts the files by transfer syntax and SOP class, and
+// assigns each a group. A group covers one transfer syntax, and at most
+// maxBulkStoreSOPClasses SOP classes.
+func groupBulkStoreFiles(files []*bulkStoreFile) {
+	sort.SliceStable(files, func(i, j int) bool {
+		ri, rj := files[i].result, files[j].result
+		if ri.TransferSyntaxUID != rj.TransferSyntaxUID {
+			return ri.TransferSyntaxUID < rj.TransferSyntaxUID
+		}
+		return ri.SOPClassUID < rj.SOPClassUID
+	})
+	var group *bulkStoreGroup
+	for _, f := range files {
+		r := f.result
+		if group == nil || group.transferSyntaxUID != r.TransferSyntaxUID ||
+			(group.sopClasses[len(group.sopClasses)-1] != r.SOPClassUID && len(group.sopClasses) >= maxBulkStoreSOPClasses) {
+			group = &bulkStoreGroup{transferSyntaxUID: r.TransferSyntaxUID}
+		}
+		if n := len(group.sopClasses); n == 0 || group.sopClasses[n-1] != r.SOPClassUID {
+			group.sopClasses = append(group.sopClasses, r.SOPClassUID)
+		}
+		f.group = group
+	}
+}
+
+// transferSyntaxes lists the transfer syntaxes proposed for the group. See
+// StoreTransferSyntaxes.
+func (g *bulkStoreGroup) transferSyntaxes() []string {
+	return StoreTransferSyntaxes(g.transferSyntaxUID)
+}
+
+func (b *bulkStore) newServiceUser(ctx context.Context, g *bulkStoreGroup) (*ServiceUser, error) {
+	params := b.params.User
+	params.SOPClasses = g.sopClasses
+	params.TransferSyntaxes = g.transferSyntaxes()
+	su, err := NewServiceUser(params)
+	if err != nil {
+		return nil, err
+	}
+	b.logger.debug("Opening association",
+		"transfer_syntax", dicomuid.UIDString(g.transferSyntaxUID),
+		"sop_classes", len(g.sopClasses))
+	su.ConnectContext(ctx, b.params.Addr)
+	return su, nil
+}
+
+// runWorker sends the files read from "ch", one at a time. It keeps the
+// association open while consecutive files belong to the same group.
+func (b *bulkStore) runWorker(ctx context.Context, ch chan *bulkStoreFile) {
+	var su *ServiceUser
+	var group *bulkStoreGroup
+	release := func() {
+		if su != nil {
+			su.Release()
+			su = nil
+		}
+	}
+	defer release()
+	for f := range ch {
+		start := time.Now()
+		backoff := b.params.RetryBackoff
+		r := &f.result
+		for {
+			if err := ctx.Err(); err != nil {
+				r.Err = err
+				break
+			}
+			if su == nil || group != f.group {
+				release()
+				var err error
+				if su, err = b.newServiceUser(ctx, f.group); err != nil {
+					r.Err = err
+					break
+				}
+				group = f.group
+			}
+			r.Attempts++
+			retry := b.classifyResult(r, su.CStoreFileContext(ctx, f.path))
+			if r.Err != nil && r.Status.Status == dimse.StatusSuccess {
+				// The association failed. Start a new one for the
+				// next attempt.
+				release()
+			}
+			if !retry || r.Attempts >= b.params.MaxAttempts {
+				break
+			}
+			b.logger.info("Retrying C-STORE", "path", f.path, "attempt", r.Attempts,
+				"backoff", backoff, LogKeyError, r.Err)
+			r.Elapsed = time.Since(start)
+			b.report(f, true)
+			select {
+			case <-ctx.Done():
+			case <-time.After(backoff):
+			}
+			if backoff *= 2; backoff > b.params.MaxRetryBackoff {
+				backoff = b.params.MaxRetryBackoff
+			}
+		}
+		r.Elapsed = time.Since(start)
+		b.finish(f)
+	}
+}
+
+// classifyResult fills r.Status, r.Warning and r.Err from the outcome of
+// CStoreFile. It returns true if the file should be sent again.
+func (b *bulkStore) classifyResult(r *BulkStoreResult, err error) bool {
+	r.Status, r.Warning, r.Err = dimse.Success, false, err
+	if err == nil {
+		return false
+	}
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) {
+		// No response. Only a failed association is worth another
+		// attempt.
+		return IsAssociationError(err)
+	}
+	r.Status = statusErr.Status
+	code := statusErr.Status.Status
+	if code.IsWarning() {
+		r.Warning, r.Err = true, nil
+		return false
+	}
+	return code&0xff00 == dimse.CStoreOutOfResources
+}
+
+// report calls the progress callback for the latest attempt of "f".
+func (b *bulkStore) report(f *bulkStoreFile, retrying bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.reportLocked(f, retrying)
+}
+
+// REQUIRES: b.mu is locked.
+func (b *bulkStore) reportLocked(f *bulkStoreFile, retrying bool) {
+	if b.params.Progress != nil {
+		b.params.Progress(BulkStoreProgress{
+			Result:   f.result,
+			Retrying: retrying,
+			Done:     b.done,
+			Total:    b.total,
+		})
+	}
+}
+
+// finish records the final result of "f".
+func (b *bulkStore) finish(f *bulkStoreFile) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.results[f.index] = f.result
+	b.done++
+	if f.result.Err != nil {
+		b.logger.warn("Failed to store file", "path", f.path, "attempts", f.result.Attempts, LogKeyError, f.result.Err)
+	}
+	b.reportLocked(f, false)
+}
@@ -0,0 +1,198 @@
+package netdicom_test
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomtag"
+	"github.com/grailbio/go-dicom/dicomuid"
+	"github.com/grailbio/go-netdicom"
+	"github.com/grailbio/go-netdicom/dimse"
+	"github.com/grailbio/go-netdicom/netdicomtest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newBulkStoreDir creates a directory holding copies of the test files, and a
+// file that isn't DICOM.
+func newBulkStoreDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "bulkstore")
+	require.NoError(t, err)
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "sub"), 0755))
+	for _, name := range []string{"IM-0001-0003.dcm", "reportsi.dcm"} {
+		data, err := ioutil.ReadFile(filepath.Join("testdata", name))
+		require.NoError(t, err)
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "sub", name), data, 0644))
+	}
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "README"), []byte("not dicom"), 0644))
+	return dir
+}
+
+func bulkStoreParams(addr string, paths ...string) netdicom.BulkStoreParams {
+	return netdicom.BulkStoreParams{
+		Paths:        paths,
+		Addr:         addr,
+		User:         netdicom.ServiceUserParams{CalledAETitle: "PACS", CallingAETitle: "SCU"},
+		Parallelism:  2,
+		RetryBackoff: time.Millisecond,
+	}
+}
+
+func TestBulkStore(t *testing.T) {
+	pacs, addr := netdicomtest.StartPACS(t, netdicomtest.Params{AETitle: "PACS"})
+	dir := newBulkStoreDir(t)
+	defer os.RemoveAll(dir)
+
+	var events []netdicom.BulkStoreProgress
+	params := bulkStoreParams(addr, dir)
+	params.Progress = func(p netdicom.BulkStoreProgress) { events = append(events, p) }
+	results, err := netdicom.BulkStore(context.Background(), params)
+	require.NoError(t, err)
+	require.Len(t, results, 3)
+	stored := 0
+	for _, r := range results {
+		if filepath.Base(r.Path) == "README" {
+			assert.Error(t, r.Err)
+			assert.Equal(t, 0, r.Attempts)
+			continue
+		}
+		require.NoError(t, r.Err, r.Path)
+		assert.Equal(t, 1, r.Attempts)
+		assert.NotEmpty(t, r.SOPInstanceUID)
+		stored++
+	}
+	assert.Equal(t, 2, stored)
+	assert.Len(t, pacs.Stored(), 2)
+	require.Len(t, events, 3)
+	assert.Equal(t, 3, events[2].Done)
+	assert.Equal(t, 3, events[2].Total)
+}
+
+func TestBulkStoreRetryStatus(t *testing.T) {
+	pacs, addr := netdicomtest.StartPACS(t, netdicomtest.Params{AETitle: "PACS"})
+	pacs.SetScript(netdicomtest.Script{
+		FailOp:     1,
+		FailStatus: dimse.Status{Status: dimse.CStoreOutOfResources},
+	})
+	retries := 0
+	params := bulkStoreParams(addr, "testdata/reportsi.dcm")
+	params.Progress = func(p netdicom.BulkStoreProgress) {
+		if p.Retrying {
+			assert.Equal(t, dimse.CStoreOutOfResources, p.Result.Status.Status)
+			retries++
+		}
+	}
+	results, err := netdicom.BulkStore(context.Background(), params)
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	require.NoError(t, results[0].Err)
+	assert.Equal(t, 2, results[0].Attempts)
+	assert.Equal(t, 1, retries)
+	assert.Len(t, pacs.Stored(), 1)
+}
+
+func TestBulkStoreRetryAbort(t *testing.T) {
+	pacs, addr := netdicomtest.StartPACS(t, netdicomtest.Params{AETitle: "PACS"})
+	pacs.SetScript(netdicomtest.Script{AbortOp: 1})
+	results, err := netdicom.BulkStore(context.Background(), bulkStoreParams(addr, "testdata/reportsi.dcm"))
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	require.NoError(t, results[0].Err)
+	assert.Equal(t, 2, results[0].Attempts)
+}
+
+func TestBulkStorePermanentFailure(t *testing.T) {
+	pacs, addr := netdicomtest.StartPACS(t, netdicomtest.Params{AETitle: "PACS"})
+	pacs.SetScript(netdicomtest.Script{
+		FailOp:     1,
+		FailStatus: dimse.Status{Status: dimse.CStoreCannotUnderstand},
+	})
+	results, err := netdicom.BulkStore(context.Background(), bulkStoreParams(addr, "testdata/reportsi.dcm"))
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	assert.Error(t, results[0].Err)
+	assert.Equal(t, dimse.CStoreCannotUnderstand, results[0].Status.Status)
+	assert.Equal(t, 1, results[0].Attempts)
+}
+
+func TestBulkStoreWarning(t *testing.T) {
+	pacs, addr := netdicomtest.StartPACS(t, netdicomtest.Params{AETitle: "PACS"})
+	pacs.SetScript(netdicomtest.Script{
+		FailOp:     1,
+		FailStatus: dimse.Status{Status: 0xb000},
+	})
+	results, err := netdicom.BulkStore(context.Background(), bulkStoreParams(addr, "testdata/reportsi.dcm"))
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	require.NoError(t, results[0].Err)
+	assert.True(t, results[0].Warning)
+	assert.Equal(t, dimse.StatusCode(0xb000), results[0].Status.Status)
+	assert.Equal(t, 1, results[0].Attempts)
+}
+
+// TestBulkStoreRejectedSOPClass checks that a file whose SOP class the
+// provider rejects fails without being sent again.
+// TestBulkStoreCompressed checks that a compressed file is proposed, and sent,
+// in its own transfer syntax, even if the destination prefers another one.
+func TestBulkStoreCompressed(t *testing.T) {
+	const jpeg2000 = "1.2.840.10008.1.2.4.91"
+	pacs, addr := netdicomtest.StartPACS(t, netdicomtest.Params{
+		AETitle: "PACS",
+		Provider: func(params *netdicom.ServiceProviderParams) {
+			params.TransferSyntaxes = []string{dicomuid.ExplicitVRLittleEndian, dicomuid.ImplicitVRLittleEndian}
+		},
+	})
+	results, err := netdicom.BulkStore(context.Background(), bulkStoreParams(addr, "testdata/IM-0001-0003.dcm"))
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	require.NoError(t, results[0].Err)
+	stored := pacs.Stored()
+	require.Len(t, stored, 1)
+	assert.Equal(t, jpeg2000, stored[0].TransferSyntaxUID)
+}
+
+func TestBulkStoreRejectedSOPClass(t *testing.T) {
+	mux := netdicom.NewServiceMux()
+	mux.HandleCEcho(func(netdicom.ConnectionState) dimse.Status { return dimse.Success })
+	p, err := netdicom.NewServiceProvider(netdicom.ServiceProviderParams{AETitle: "PACS", Mux: mux}, "127.0.0.1:0")
+	require.NoError(t, err)
+	go p.Run()
+	t.Cleanup(func() { p.Close() })
+
+	params := bulkStoreParams(p.ListenAddr().String(), "testdata/reportsi.dcm")
+	params.MaxAttempts = 3
+	results, err := netdicom.BulkStore(context.Background(), params)
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	assert.Error(t, results[0].Err)
+	assert.Equal(t, 1, results[0].Attempts)
+}
+
+// TestBulkStoreDICOMDIR checks that a DICOMDIR is replaced by the files it
+// references.
+func TestBulkStoreDICOMDIR(t *testing.T) {
+	pacs, addr := netdicomtest.StartPACS(t, netdicomtest.Params{AETitle: "PACS"})
+	dir := newBulkStoreDir(t)
+	defer os.RemoveAll(dir)
+	dicomdir := filepath.Join(dir, "DICOMDIR")
+	require.NoError(t, dicom.WriteDataSetToFile(dicomdir, &dicom.DataSet{Elements: []*dicom.Element{
+		dicom.MustNewElement(dicomtag.MediaStorageSOPClassUID, "1.2.840.10008.1.3.10"),
+		dicom.MustNewElement(dicomtag.MediaStorageSOPInstanceUID, "1.2.3.4"),
+		dicom.MustNewElement(dicomtag.TransferSyntaxUID, dicomuid.ExplicitVRLittleEndian),
+		dicom.MustNewElement(dicomtag.DirectoryRecordSequence,
+			dicom.MustNewElement(dicomtag.Item,
+				dicom.MustNewElement(dicomtag.ReferencedFileID, "sub", "reportsi.dcm"))),
+	}}))
+
+	results, err := netdicom.BulkStore(context.Background(), bulkStoreParams(addr, dicomdir))
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	require.NoError(t, results[0].Err)
+	assert.Equal(t, filepath.Join(dir, "sub", "reportsi.dcm"), results[0].Path)
+	assert.Len(t, pacs.Stored(), 1)
+}
@@ -0,0 +1,188 @@
+package netdicom
+
+// This file implements the C-GET variants of ServiceUser that parse the
+// received datasets, or write them to files.
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomtag"
+	"github.com/grailbio/go-netdicom/dimse"
+)
+
+// CGetProgress is the progress of a C-GET, as reported by the provider in a
+// C-GET-RSP. The counts are those of the C-STORE sub-operations. P3.4
+// C.4.3.1.3.
+type CGetProgress struct {
+	Remaining int
+	Completed int
+	Failed    int
+	Warning   int
+	// Final is true for the final response. Remaining is usually 0 then.
+	Final bool
+}
+
+// CGetDataSets is similar to CGetQuery, but passes each dataset to "cb"
+// parsed by ParseCStoreData, i.e., with the file meta information filled in.
+// If non-nil, "progress" is called for every C-GET-RSP.
+//
+// If a dataset can't be parsed, the sub-operation fails with
+// dimse.CStoreCannotUnderstand, and the C-GET continues. CGetDataSets then
+// returns the first such error.
+func (su *ServiceUser) CGetDataSets(ctx context.Context, query QRQuery, progress func(CGetProgress),
+	cb func(ds *dicom.DataSet) dimse.Status) error {
+	if err := validateQRQuery(qrOpCGet, query); err != nil {
+		return err
+	}
+	var firstErr error
+	conn := su.peerConnState()
+	err := su.cget(ctx, query, progress,
+		func(transferSyntaxUID, sopClassUID, sopInstanceUID string, data []byte) dimse.Status {
+			ds, err := ParseCStoreData(conn, transferSyntaxUID, sopClassUID, sopInstanceUID, data)
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				return dimse.Status{Status: dimse.CStoreCannotUnderstand, ErrorComment: err.Error()}
+			}
+			return cb(ds)
+		})
+	if firstErr != nil {
+		return firstErr
+	}
+	return err
+}
+
+// CGetPathFunc returns the path of a dataset written by CGetToDir, relative
+// to CGetDirParams.Dir. The dataset is as passed by CGetDataSets. The path
+// may contain subdirectories, but it can't leave Dir.
+type CGetPathFunc func(ds *dicom.DataSet) (string, error)
+
+// CGetPathFlat is a CGetPathFunc that names the files
+// "<SOPInstanceUID>.dcm".
+func CGetPathFlat(ds *dicom.DataSet) (string, error) {
+	uid, err := findUID(ds, dicomtag.MediaStorageSOPInstanceUID)
+	if err != nil {
+		return "", err
+	}
+	return uid + ".dcm", nil
+}
+
+// CGetPathByStudy is a CGetPathFunc that names the files
+// "<StudyInstanceUID>/<SeriesInstanceUID>/<SOPInstanceUID>.dcm".
+func CGetPathByStudy(ds *dicom.DataSet) (string, error) {
+	var uids []string
+	for _, tag := range []dicomtag.Tag{dicomtag.StudyInstanceUID, dicomtag.SeriesInstanceUID, dicomtag.MediaStorageSOPInstanceUID} {
+		uid, err := findUID(ds, tag)
+		if err != nil {
+			return "", err
+		}
+		uids = append(uids, uid)
+	}
+	return filepath.Join(uids[0], uids[1], uids[2]+".dcm"), nil
+}
+
+func findUID(ds *dicom.DataSet, tag dicomtag.Tag) (string, error) {
+	elem, err := ds.FindElementByTag(tag)
+	if err != nil {
+		return "", err
+	}
+	uid, err := elem.GetString()
+	if err != nil {
+		return "", err
+	}
+	if uid = strings.TrimRight(uid, "\x00 "); uid == "" {
+		return "", fmt.Errorf("empty %s", dicomtag.DebugString(tag))
+	}
+	return uid, nil
+}
+
+// CGetDirParams defines parameters for CGetToDir.
+type CGetDirParams struct {
+	// Dir is the root of the directory tree. It is created if needed.
+	// Required.
+	Dir string
+
+	// Path chooses the path of each file. If nil, CGetPathFlat is used.
+	Path CGetPathFunc
+
+	// Progress, if non-nil, is called for every C-GET-RSP.
+	Progress func(CGetProgress)
+}
+
+// CGetToDir is similar to CGetQuery, but writes each dataset as a DICOM Part 10
+// file under params.Dir, as by WriteCStoreFile. It returns the paths of the
+// files written, in the order they were received.
+//
+// If a dataset can't be parsed or written, the sub-operation fails with
+// dimse.CStoreOutOfResources, and the C-GET continues. CGetToDir then returns
+// the first such error, along with the paths of the files written.
+func (su *ServiceUser) CGetToDir(ctx context.Context, query QRQuery, params CGetDirParams) ([]string, error) {
+	if params.Dir == "" {
+		return nil, fmt.Errorf("dicom.CGetToDir: Dir must be set")
+	}
+	if params.Path == nil {
+		params.Path = CGetPathFlat
+	}
+	if err := validateQRQuery(qrOpCGet, query); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(params.Dir, 0755); err != nil {
+		return nil, fmt.Errorf("dicom.CGetToDir: %v", err)
+	}
+	var paths []string
+	var firstErr error
+	conn := su.peerConnState()
+	write := func(transferSyntaxUID, sopClassUID, sopInstanceUID string, data []byte) error {
+		ds, err := ParseCStoreData(conn, transferSyntaxUID, sopClassUID, sopInstanceUID, data)
+		if err != nil {
+			return err
+		}
+		rel, err := params.Path(ds)
+		if err != nil {
+			return fmt.Errorf("dicom.CGetToDir(%s): %v", sopInstanceUID, err)
+		}
+		rel = filepath.Clean(rel)
+		if filepath.IsAbs(rel) || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("dicom.CGetToDir(%s): path %q is outside of %s", sopInstanceUID, rel, params.Dir)
+		}
+		path := filepath.Join(params.Dir, rel)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return fmt.Errorf("dicom.CGetToDir(%s): %v", sopInstanceUID, err)
+		}
+		if err := WriteCStoreFile(path, conn, transferSyntaxUID, sopClassUID, sopInstanceUID, data); err != nil {
+			return err
+		}
+		paths = append(paths, path)
+		return nil
+	}
+	err := su.cget(ctx, query, params.Progress,
+		func(transferSyntaxUID, sopClassUID, sopInstanceUID string, data []byte) dimse.Status {
+			if err := write(transferSyntaxUID, sopClassUID, sopInstanceUID, data); err != nil {
+				su.logger.error("Failed to write C-GET dataset", "sop_instance", sopInstanceUID, LogKeyError, err)
+				if firstErr == nil {
+					firstErr = err
+				}
+				return dimse.Status{Status: dimse.CStoreOutOfResources, ErrorComment: err.Error()}
+			}
+			return dimse.Success
+		})
+	if firstErr != nil {
+		return paths, firstErr
+	}
+	return paths, err
+}
+
+// peerConnState describes the provider, as the sender of the C-STORE
+// sub-operations of a C-GET.
+func (su *ServiceUser) peerConnState() ConnectionState {
+	return ConnectionState{
+		CallingAETitle: su.params.CalledAETitle,
+		CalledAETitle:  su.params.CallingAETitle,
+	}
+}
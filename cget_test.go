@@ -0,0 +1,124 @@
+package netdicom
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomtag"
+	"github.com/grailbio/go-netdicom/dimse"
+	"github.com/grailbio/go-netdicom/sopclass"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startCGetTest starts a provider whose C-GET returns "n" instances, and
+// connects a user to it.
+func startCGetTest(t *testing.T, n int) *ServiceUser {
+	p, err := NewServiceProvider(ServiceProviderParams{
+		AETitle: "ARCHIVE",
+		CGet: func(conn ConnectionState, transferSyntaxUID, sopClassUID string, filters []*dicom.Element, ch chan CMoveResult) {
+			for i := 0; i < n; i++ {
+				ch <- CMoveResult{Remaining: n - 1 - i, DataSet: newCMoveDataSet(ctImageStorage, fmt.Sprintf("1.2.3.%d", i))}
+			}
+			close(ch)
+		},
+	}, "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { p.Close() })
+	go p.Run()
+	su, err := NewServiceUser(ServiceUserParams{CalledAETitle: "ARCHIVE", SOPClasses: sopclass.QRGetClasses})
+	require.NoError(t, err)
+	su.Connect(p.ListenAddr().String())
+	return su
+}
+
+var cgetTestQuery = QRQuery{
+	Model: QRModelStudyRoot,
+	Level: QRLevelStudy,
+	Keys:  []*dicom.Element{dicom.MustNewElement(dicomtag.StudyInstanceUID, "1.2.3")},
+}
+
+func TestCGetDataSets(t *testing.T) {
+	su := startCGetTest(t, 3)
+	defer su.Release()
+	var uids []string
+	var progress []CGetProgress
+	err := su.CGetDataSets(context.Background(), cgetTestQuery,
+		func(p CGetProgress) { progress = append(progress, p) },
+		func(ds *dicom.DataSet) dimse.Status {
+			// The callback runs outside the test goroutine, so it can't use
+			// require.
+			elem, err := ds.FindElementByTag(dicomtag.MediaStorageSOPInstanceUID)
+			if !assert.NoError(t, err) {
+				return dimse.Status{Status: dimse.CStoreCannotUnderstand}
+			}
+			uids = append(uids, elem.MustGetString())
+			elem, err = ds.FindElementByTag(dicomtag.SourceApplicationEntityTitle)
+			if assert.NoError(t, err) {
+				assert.Equal(t, "ARCHIVE", elem.MustGetString())
+			}
+			_, err = ds.FindElementByTag(dicomtag.TransferSyntaxUID)
+			assert.NoError(t, err)
+			return dimse.Success
+		})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1.2.3.0", "1.2.3.1", "1.2.3.2"}, uids)
+
+	// The pending responses count the sub-operations done so far.
+	require.True(t, len(progress) >= 2, "progress: %+v", progress)
+	for _, p := range progress[:len(progress)-1] {
+		assert.False(t, p.Final)
+		assert.Equal(t, 3, p.Remaining+p.Completed)
+	}
+	assert.Equal(t, CGetProgress{Completed: 3, Final: true}, progress[len(progress)-1])
+}
+
+func TestCGetToDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cget")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	su := startCGetTest(t, 2)
+	defer su.Release()
+	var final CGetProgress
+	paths, err := su.CGetToDir(context.Background(), cgetTestQuery, CGetDirParams{
+		Dir:      dir,
+		Path:     CGetPathByStudy,
+		Progress: func(p CGetProgress) { final = p },
+	})
+	require.NoError(t, err)
+	require.Equal(t, 2, len(paths))
+	assert.Equal(t, 2, final.Completed)
+	for i, path := range paths {
+		ds, err := dicom.ReadDataSetFromFile(path, dicom.ReadOptions{})
+		require.NoError(t, err)
+		study, err := findUID(ds, dicomtag.StudyInstanceUID)
+		require.NoError(t, err)
+		series, err := findUID(ds, dicomtag.SeriesInstanceUID)
+		require.NoError(t, err)
+		assert.Equal(t, filepath.Join(dir, study, series, fmt.Sprintf("1.2.3.%d.dcm", i)), path)
+		checkFileBodiesEqual(t, mustReadDICOMFile("testdata/reportsi.dcm"), ds)
+	}
+
+	// A path outside of the directory fails the sub-operation.
+	paths, err = su.CGetToDir(context.Background(), cgetTestQuery, CGetDirParams{
+		Dir: dir,
+		Path: func(ds *dicom.DataSet) (string, error) {
+			uid, err := findUID(ds, dicomtag.MediaStorageSOPInstanceUID)
+			if uid == "1.2.3.1" {
+				return "../escape.dcm", nil
+			}
+			return uid + ".dcm", err
+		},
+		Progress: func(p CGetProgress) { final = p },
+	})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "outside")
+	assert.Equal(t, []string{filepath.Join(dir, "1.2.3.0.dcm")}, paths)
+	assert.Equal(t, CGetProgress{Completed: 1, Failed: 1, Final: true}, final)
+}
@@ -0,0 +1,353 @@
+package netdicom
+
+// This file implements the C-STORE sub-operations of C-MOVE and C-GET on the
+// provider side.
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomio"
+	"github.com/grailbio/go-dicom/dicomtag"
+	"github.com/grailbio/go-dicom/dicomuid"
+	"github.com/grailbio/go-netdicom/dimse"
+)
+
+// moveOriginator identifies the C-MOVE request that a C-STORE sub-operation
+// is part of. P3.7 9.1.1.1.
+type moveOriginator struct {
+	aeTitle   string
+	messageID dimse.MessageID
+}
+
+// cmoveSubOps sends the datasets of one C-MOVE request to the move
+// destination. The sub-operations share associations: at most maxAssocs are
+// open at a time. Each association proposes the SOP classes and transfer
+// syntaxes of the datasets seen so far in the request. A dataset whose SOP
+// class or transfer syntax none of the idle associations accepted causes a
+// new one to be opened, replacing an idle one if maxAssocs are open. Thread
+// safe.
+type cmoveSubOps struct {
+	ctx         context.Context
+	params      ServiceProviderParams
+	destAETitle string
+	dest        MoveDestination
+	originator  moveOriginator
+	maxAssocs   int
+
+	mu               sync.Mutex
+	numAssocs        int // # of open associations, both idle and busy.
+	idle             []*cmoveAssociation
+	sopClasses       []string
+	transferSyntaxes []string
+	// uncompressed is true if some dataset seen so far is uncompressed, or
+	// has no TransferSyntaxUID.
+	uncompressed bool
+	// declined records the SOP class and transfer syntax pairs,
+	// sopClassUID+"|"+transferSyntaxUID, for which a new association
+	// accepted another transfer syntax. Opening yet another one wouldn't
+	// help, so these datasets are sent over any association that accepted
+	// the SOP class.
+	declined map[string]bool
+}
+
+// cmoveAssociation is an association to the move destination.
+type cmoveAssociation struct {
+	su         *ServiceUser
+	sopClasses map[string]bool // The proposed SOP classes.
+	// accepted maps the accepted SOP classes to their transfer syntaxes.
+	accepted map[string]string
+}
+
+// canCarry checks if the association can send a dataset of the given SOP
+// class and transfer syntax, as negotiated with the destination. The UIDs are
+// compared exactly, since sameTransferSyntax equates compressed syntaxes with
+// Explicit VR Little Endian. REQUIRES: ops.mu is held.
+func (ops *cmoveSubOps) canCarry(assoc *cmoveAssociation, sopClassUID, transferSyntaxUID string) bool {
+	if !assoc.sopClasses[sopClassUID] {
+		return false
+	}
+	accepted, ok := assoc.accepted[sopClassUID]
+	if !ok || transferSyntaxUID == "" {
+		// If the destination rejected the SOP class, store fails fast.
+		return true
+	}
+	return accepted == transferSyntaxUID || ops.declined[sopClassUID+"|"+transferSyntaxUID]
+}
+
+func newCMoveSubOps(ctx context.Context, params ServiceProviderParams, destAETitle string, dest MoveDestination, originator moveOriginator) *cmoveSubOps {
+	maxAssocs := params.CMoveMaxAssociations
+	if maxAssocs <= 0 {
+		maxAssocs = 1
+	}
+	return &cmoveSubOps{
+		ctx:         ctx,
+		params:      params,
+		destAETitle: destAETitle,
+		dest:        dest,
+		originator:  originator,
+		maxAssocs:   maxAssocs,
+		declined:    map[string]bool{},
+	}
+}
+
+// store sends "ds" to the destination. At most maxAssocs calls may run
+// concurrently.
+func (ops *cmoveSubOps) store(ds *dicom.DataSet) error {
+	sopClassUID, err := getMetaString(ds.Elements, dicomtag.MediaStorageSOPClassUID)
+	if err != nil {
+		return err
+	}
+	// Datasets without TransferSyntaxUID are re-encoded in whatever syntax
+	// is negotiated.
+	transferSyntaxUID, _ := getMetaString(ds.Elements, dicomtag.TransferSyntaxUID)
+	if transferSyntaxUID != "" {
+		// Keep the UID as is: canonicalization would map compressed
+		// syntaxes to Explicit VR Little Endian.
+		if _, err := dicomio.CanonicalTransferSyntaxUID(transferSyntaxUID); err != nil {
+			return err
+		}
+	}
+	assoc, err := ops.acquire(sopClassUID, transferSyntaxUID)
+	if err != nil {
+		return err
+	}
+	if _, err := assoc.su.cm.lookupByAbstractSyntaxUID(sopClassUID); err != nil {
+		// The destination rejected the SOP class.
+		ops.release(assoc, nil)
+		return err
+	}
+	err = assoc.su.cstore(ops.ctx, ds, ops.originator)
+	ops.release(assoc, err)
+	return err
+}
+
+// acquire returns an idle association that can carry a dataset of the given
+// SOP class and transfer syntax, opening one if needed.
+func (ops *cmoveSubOps) acquire(sopClassUID, transferSyntaxUID string) (*cmoveAssociation, error) {
+	ops.mu.Lock()
+	ops.sopClasses = appendIfMissing(ops.sopClasses, sopClassUID)
+	if transferSyntaxUID != "" {
+		ops.transferSyntaxes = appendIfMissing(ops.transferSyntaxes, transferSyntaxUID)
+	}
+	if transferSyntaxUID == "" || isUncompressedTransferSyntax(transferSyntaxUID) {
+		ops.uncompressed = true
+	}
+	for i, assoc := range ops.idle {
+		if ops.canCarry(assoc, sopClassUID, transferSyntaxUID) {
+			ops.idle = append(ops.idle[:i], ops.idle[i+1:]...)
+			ops.mu.Unlock()
+			return assoc, nil
+		}
+	}
+	var evicted *cmoveAssociation
+	if ops.numAssocs >= ops.maxAssocs {
+		// Since at most maxAssocs stores run at a time, some association
+		// is idle.
+		doassert(len(ops.idle) > 0)
+		evicted = ops.idle[0]
+		ops.idle = ops.idle[1:]
+		ops.numAssocs--
+	}
+	ops.numAssocs++
+	sopClasses := append([]string(nil), ops.sopClasses...)
+	transferSyntaxes := ops.proposedTransferSyntaxes(transferSyntaxUID)
+	ops.mu.Unlock()
+
+	if evicted != nil {
+		evicted.su.Release()
+	}
+	assoc, err := ops.open(sopClasses, transferSyntaxes)
+	if err != nil {
+		ops.mu.Lock()
+		ops.numAssocs--
+		ops.mu.Unlock()
+		return nil, err
+	}
+	if accepted, ok := assoc.accepted[sopClassUID]; ok && transferSyntaxUID != "" && accepted != transferSyntaxUID {
+		ops.mu.Lock()
+		ops.declined[sopClassUID+"|"+transferSyntaxUID] = true
+		ops.mu.Unlock()
+	}
+	return assoc, nil
+}
+
+// proposedTransferSyntaxes returns the transfer syntaxes to propose on a new
+// association opened for a dataset in "transferSyntaxUID": the ones in
+// ServiceProviderParams.TransferSyntaxes, or if it is empty, the ones of the
+// datasets seen so far, starting with "transferSyntaxUID". Implicit VR Little
+// Endian, which every SCP accepts, is added if some of the datasets are
+// uncompressed, and thus can be re-encoded in it. REQUIRES: ops.mu is held.
+func (ops *cmoveSubOps) proposedTransferSyntaxes(transferSyntaxUID string) []string {
+	var uids []string
+	if len(ops.params.TransferSyntaxes) > 0 {
+		uids = append(uids, ops.params.TransferSyntaxes...)
+		for _, uid := range ops.transferSyntaxes {
+			uids = appendIfMissing(uids, uid)
+		}
+		return uids
+	}
+	if transferSyntaxUID != "" {
+		uids = append(uids, transferSyntaxUID)
+	}
+	for _, uid := range ops.transferSyntaxes {
+		uids = appendIfMissing(uids, uid)
+	}
+	if ops.uncompressed {
+		uids = appendIfMissing(uids, dicomuid.ImplicitVRLittleEndian)
+	}
+	return uids
+}
+
+func (ops *cmoveSubOps) open(sopClasses, transferSyntaxes []string) (*cmoveAssociation, error) {
+	callingAETitle := ops.dest.CallingAETitle
+	if callingAETitle == "" {
+		callingAETitle = ops.params.AETitle
+	}
+	su, err := NewServiceUser(ServiceUserParams{
+		CalledAETitle:    ops.destAETitle,
+		CallingAETitle:   callingAETitle,
+		TLSConfig:        ops.dest.TLSConfig,
+		SOPClasses:       sopClasses,
+		TransferSyntaxes: transferSyntaxes,
+		Logger:           ops.params.Logger,
+		Redaction:        ops.params.Redaction,
+		Metrics:          ops.params.Metrics,
+		Tracer:           ops.params.Tracer,
+		DeflateLevel:     ops.params.DeflateLevel,
+	})
+	if err != nil {
+		return nil, err
+	}
+	su.ConnectContext(ops.ctx, ops.dest.HostPort)
+	if err := su.waitUntilReady(); err != nil {
+		su.Release()
+		return nil, err
+	}
+	assoc := &cmoveAssociation{
+		su:         su,
+		sopClasses: map[string]bool{},
+		accepted:   map[string]string{},
+	}
+	for _, uid := range sopClasses {
+		assoc.sopClasses[uid] = true
+		if context, err := su.cm.lookupByAbstractSyntaxUID(uid); err == nil {
+			assoc.accepted[uid] = context.transferSyntaxUID
+		}
+	}
+	return assoc, nil
+}
+
+// release returns the association to the idle list. If the sub-operation
+// failed other than by a C-STORE status, the association is assumed to be
+// broken, and is closed.
+func (ops *cmoveSubOps) release(assoc *cmoveAssociation, err error) {
+	var statusErr *StatusError
+	if err != nil && !errors.As(err, &statusErr) {
+		assoc.su.Release()
+		ops.mu.Lock()
+		ops.numAssocs--
+		ops.mu.Unlock()
+		return
+	}
+	ops.mu.Lock()
+	ops.idle = append(ops.idle, assoc)
+	ops.mu.Unlock()
+}
+
+// close releases all the associations. REQUIRES: no store is running.
+func (ops *cmoveSubOps) close() {
+	ops.mu.Lock()
+	idle := ops.idle
+	ops.idle = nil
+	ops.numAssocs = 0
+	ops.mu.Unlock()
+	for _, assoc := range idle {
+		assoc.su.Release()
+	}
+}
+
+// subOpStats counts the C-STORE sub-operations of a C-MOVE or C-GET request,
+// for its responses. P3.4 C.4.2.1.5.
+type subOpStats struct {
+	completed, failed, warning uint16
+	// remaining is the number of datasets yet to be produced by the
+	// callback, as of the last one. -1 if unknown.
+	remaining  int
+	failedUIDs []string
+}
+
+// add records the outcome of a sub-operation. A C-STORE that ends with a
+// warning status counts as a warning, and other errors as failures.
+func (s *subOpStats) add(ds *dicom.DataSet, err error) {
+	var statusErr *StatusError
+	switch {
+	case err == nil:
+		s.completed++
+	case errors.As(err, &statusErr) && statusErr.Status.Status.IsWarning():
+		s.warning++
+	default:
+		s.failed++
+		uid, uidErr := getMetaString(ds.Elements, dicomtag.MediaStorageSOPInstanceUID)
+		if uidErr != nil {
+			uid, _ = getMetaString(ds.Elements, dicomtag.SOPInstanceUID)
+		}
+		if uid != "" {
+			s.failedUIDs = append(s.failedUIDs, uid)
+		}
+	}
+}
+
+// numRemaining returns the NumberOfRemainingSuboperations, given that
+// "inFlight" sub-operations are running.
+func (s *subOpStats) numRemaining(inFlight int) uint16 {
+	if s.remaining < 0 {
+		return 0 // Unknown, so omitted.
+	}
+	return uint16(s.remaining + inFlight)
+}
+
+// finalStatus returns the status of the final response. "err" is the error
+// that stopped the request, if any.
+func (s *subOpStats) finalStatus(err error) dimse.Status {
+	if err != nil {
+		var e *StatusError
+		if errors.As(err, &e) {
+			return e.Status
+		}
+		return dimse.Status{Status: dimse.CMoveUnableToProcess, ErrorComment: err.Error()}
+	}
+	switch {
+	case s.failed > 0 && s.completed == 0 && s.warning == 0:
+		return dimse.Status{Status: dimse.CMoveOutOfResourcesUnableToPerformSubOperations,
+			ErrorComment: "All sub-operations failed"}
+	case s.failed > 0 || s.warning > 0:
+		return dimse.Status{Status: dimse.CMoveSubOperationsCompleteWithFailures}
+	}
+	return dimse.Success
+}
+
+// finalPayload returns the dataset of the final response: the Failed SOP
+// Instance UID List, or nil if no sub-operation failed.
+func (s *subOpStats) finalPayload(transferSyntaxUID string, deflateLevel int) ([]byte, error) {
+	if len(s.failedUIDs) == 0 {
+		return nil, nil
+	}
+	values := make([]interface{}, len(s.failedUIDs))
+	for i, uid := range s.failedUIDs {
+		values[i] = uid
+	}
+	elem := &dicom.Element{Tag: dicomtag.FailedSOPInstanceUIDList, VR: "UI", Value: values}
+	return writeElementsToBytes([]*dicom.Element{elem}, transferSyntaxUID, deflateLevel)
+}
+
+func appendIfMissing(list []string, s string) []string {
+	for _, v := range list {
+		if v == s {
+			return list
+		}
+	}
+	return append(list, s)
+}
@@ -0,0 +1,539 @@
+package netdicom
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomtag"
+	"github.com/grailbio/go-dicom/dicomuid"
+	"github.com/grailbio/go-netdicom/dimse"
+	"github.com/grailbio/go-netdicom/pdu"
+	"github.com/grailbio/go-netdicom/sopclass"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	ctImageStorage = "1.2.840.10008.5.1.4.1.1.2"
+	mrImageStorage = "1.2.840.10008.5.1.4.1.1.4"
+)
+
+// cstoreTap records the associations and the C-STORE requests received by a
+// move destination.
+type cstoreTap struct {
+	mu         sync.Mutex
+	numAssocs  int
+	sopClasses [][]string // Abstract syntaxes proposed, per association.
+	// Transfer syntaxes proposed, per association.
+	transferSyntaxes [][]string
+	requests         []*dimse.CStoreRq
+}
+
+func (tap *cstoreTap) factory(info WireTapInfo) (WireTap, error) {
+	tap.mu.Lock()
+	tap.numAssocs++
+	tap.mu.Unlock()
+	return &cstoreTapConn{tap: tap}, nil
+}
+
+type cstoreTapConn struct {
+	tap       *cstoreTap
+	mu        sync.Mutex
+	assembler dimse.CommandAssembler
+}
+
+func (c *cstoreTapConn) TapPDU(dir PDUDirection, data []byte) {
+	if dir != PDUReceived {
+		return
+	}
+	v, err := pdu.ReadPDU(bytes.NewReader(data), DefaultMaxPDUSize)
+	if err != nil {
+		panic(err)
+	}
+	tap := c.tap
+	switch v := v.(type) {
+	case *pdu.AAssociate:
+		var sopClasses, transferSyntaxes []string
+		for _, item := range v.Items {
+			if pc, ok := item.(*pdu.PresentationContextItem); ok {
+				for _, sub := range pc.Items {
+					switch sub := sub.(type) {
+					case *pdu.AbstractSyntaxSubItem:
+						sopClasses = append(sopClasses, sub.Name)
+					case *pdu.TransferSyntaxSubItem:
+						if len(sopClasses) == 1 {
+							transferSyntaxes = append(transferSyntaxes, sub.Name)
+						}
+					}
+				}
+			}
+		}
+		tap.mu.Lock()
+		tap.sopClasses = append(tap.sopClasses, sopClasses)
+		tap.transferSyntaxes = append(tap.transferSyntaxes, transferSyntaxes)
+		tap.mu.Unlock()
+	case *pdu.PDataTf:
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		_, msg, _, err := c.assembler.AddDataPDU(v)
+		if err != nil {
+			panic(err)
+		}
+		if rq, ok := msg.(*dimse.CStoreRq); ok {
+			tap.mu.Lock()
+			tap.requests = append(tap.requests, rq)
+			tap.mu.Unlock()
+		}
+	}
+}
+
+func (c *cstoreTapConn) Close() error { return nil }
+
+// runCMove sends a C-MOVE request over "su", and returns the final response
+// and its dataset.
+func runCMove(t *testing.T, su *ServiceUser, dest string, filter []*dicom.Element) (*dimse.CMoveRsp, []*dicom.Element) {
+	require.NoError(t, su.waitUntilReady())
+	context, payload, err := encodeQRPayload(qrOpCMove,
+		QRQuery{Model: QRModelStudyRoot, Level: QRLevelStudy, Keys: filter}, su.cm, su.logger)
+	require.NoError(t, err)
+	cs, err := su.disp.newCommand(su.cm, context)
+	require.NoError(t, err)
+	defer su.disp.deleteCommand(cs)
+	cs.sendMessage(&dimse.CMoveRq{
+		AffectedSOPClassUID: context.abstractSyntaxUID,
+		MessageID:           cs.messageID,
+		MoveDestination:     dest,
+		CommandDataSetType:  dimse.CommandDataSetTypeNonNull,
+	}, payload)
+	for event := range cs.upcallCh {
+		resp, ok := event.command.(*dimse.CMoveRsp)
+		require.True(t, ok, "unexpected response %v", event.command)
+		if resp.Status.Status != dimse.StatusPending {
+			var elems []*dicom.Element
+			if resp.HasData() {
+				elems, err = readElementsInBytes(event.data, context.transferSyntaxUID)
+				require.NoError(t, err)
+			}
+			return resp, elems
+		}
+	}
+	t.Fatal("connection closed")
+	return nil, nil
+}
+
+// newCMoveDataSet returns a copy of testdata/reportsi.dcm with the given SOP
+// class and instance UIDs.
+func newCMoveDataSet(sopClassUID, sopInstanceUID string) *dicom.DataSet {
+	return newCMoveDataSetInSyntax(sopClassUID, sopInstanceUID, "")
+}
+
+// newCMoveDataSetInSyntax is newCMoveDataSet, but also sets the
+// TransferSyntaxUID, unless it is empty.
+func newCMoveDataSetInSyntax(sopClassUID, sopInstanceUID, transferSyntaxUID string) *dicom.DataSet {
+	ds := mustReadDICOMFile("testdata/reportsi.dcm")
+	for i, elem := range ds.Elements {
+		switch {
+		case elem.Tag == dicomtag.MediaStorageSOPClassUID:
+			ds.Elements[i] = dicom.MustNewElement(elem.Tag, sopClassUID)
+		case elem.Tag == dicomtag.MediaStorageSOPInstanceUID:
+			ds.Elements[i] = dicom.MustNewElement(elem.Tag, sopInstanceUID)
+		case elem.Tag == dicomtag.TransferSyntaxUID && transferSyntaxUID != "":
+			ds.Elements[i] = dicom.MustNewElement(elem.Tag, transferSyntaxUID)
+		}
+	}
+	return ds
+}
+
+// cmoveTestResult is the outcome of testCMoveSubOps.
+type cmoveTestResult struct {
+	tap    *cstoreTap
+	stored []string // SOPInstanceUIDs received by the destination.
+	// Transfer syntaxes of the datasets received by the destination.
+	storedSyntaxes []string
+	resp           *dimse.CMoveRsp
+	elems          []*dicom.Element // The dataset of resp.
+}
+
+// testCMoveSubOps moves the datasets from a provider, configured by
+// "configure", to another provider, listed in RemoteAEs as "DEST". The C-MOVE
+// request is sent by "MOVESCU" to move the datasets to "moveDestination". The
+// destination responds to C-STORE with the status found in "destStatus", or
+// with success.
+func testCMoveSubOps(t *testing.T, datasets []*dicom.DataSet, moveDestination string,
+	destStatus map[string]dimse.Status, configure func(params *ServiceProviderParams)) cmoveTestResult {
+	return testCMoveSubOpsToDest(t, datasets, moveDestination, destStatus, nil, configure)
+}
+
+// testCMoveSubOpsToDest is testCMoveSubOps, but the destination accepts only
+// "destTransferSyntaxes", if nonempty.
+func testCMoveSubOpsToDest(t *testing.T, datasets []*dicom.DataSet, moveDestination string,
+	destStatus map[string]dimse.Status, destTransferSyntaxes []string, configure func(params *ServiceProviderParams)) cmoveTestResult {
+	tap := &cstoreTap{}
+	var mu sync.Mutex
+	var stored, storedSyntaxes []string
+	dest, err := NewServiceProvider(ServiceProviderParams{
+		AETitle: "DEST",
+		CStore: func(conn ConnectionState, transferSyntaxUID, sopClassUID, sopInstanceUID string, data []byte) dimse.Status {
+			mu.Lock()
+			stored = append(stored, sopInstanceUID)
+			storedSyntaxes = append(storedSyntaxes, transferSyntaxUID)
+			mu.Unlock()
+			if status, ok := destStatus[sopInstanceUID]; ok {
+				return status
+			}
+			return dimse.Success
+		},
+		WireTap:          tap.factory,
+		TransferSyntaxes: destTransferSyntaxes,
+	}, "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { dest.Close() })
+	go dest.Run()
+
+	params := ServiceProviderParams{
+		AETitle:   "SOURCE",
+		RemoteAEs: map[string]string{"DEST": dest.ListenAddr().String()},
+		CMove: func(conn ConnectionState, transferSyntaxUID, sopClassUID string, filters []*dicom.Element, ch chan CMoveResult) {
+			for i, ds := range datasets {
+				ch <- CMoveResult{Remaining: len(datasets) - i - 1, Path: fmt.Sprint(i), DataSet: ds}
+			}
+			close(ch)
+		},
+	}
+	if configure != nil {
+		configure(&params)
+	}
+	source, err := NewServiceProvider(params, "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { source.Close() })
+	go source.Run()
+
+	su, err := NewServiceUser(ServiceUserParams{
+		CallingAETitle: "MOVESCU",
+		SOPClasses:     sopclass.QRMoveClasses})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(source.ListenAddr().String())
+	resp, elems := runCMove(t, su, moveDestination, []*dicom.Element{dicom.MustNewElement(dicomtag.StudyInstanceUID, "1.2.3")})
+	return cmoveTestResult{tap: tap, stored: stored, storedSyntaxes: storedSyntaxes, resp: resp, elems: elems}
+}
+
+func TestCMoveSharesAssociation(t *testing.T) {
+	var datasets []*dicom.DataSet
+	for i := 0; i < 5; i++ {
+		datasets = append(datasets, newCMoveDataSet(ctImageStorage, fmt.Sprintf("1.2.3.%d", i)))
+	}
+	r := testCMoveSubOps(t, datasets, "DEST", nil, nil)
+	tap, stored, resp, messageID := r.tap, r.stored, r.resp, r.resp.MessageIDBeingRespondedTo
+	assert.Equal(t, dimse.StatusSuccess, resp.Status.Status)
+	assert.Equal(t, uint16(5), resp.NumberOfCompletedSuboperations)
+	assert.Equal(t, []string{"1.2.3.0", "1.2.3.1", "1.2.3.2", "1.2.3.3", "1.2.3.4"}, stored)
+
+	tap.mu.Lock()
+	defer tap.mu.Unlock()
+	assert.Equal(t, 1, tap.numAssocs)
+	assert.Equal(t, [][]string{{ctImageStorage}}, tap.sopClasses)
+	require.Equal(t, 5, len(tap.requests))
+	for _, rq := range tap.requests {
+		assert.Equal(t, "MOVESCU", rq.MoveOriginatorApplicationEntityTitle)
+		assert.Equal(t, messageID, rq.MoveOriginatorMessageID)
+	}
+}
+
+func TestCMoveNewSOPClass(t *testing.T) {
+	datasets := []*dicom.DataSet{
+		newCMoveDataSet(ctImageStorage, "1.2.3.0"),
+		newCMoveDataSet(mrImageStorage, "1.2.3.1"),
+		newCMoveDataSet(ctImageStorage, "1.2.3.2"),
+		newCMoveDataSet(mrImageStorage, "1.2.3.3"),
+	}
+	r := testCMoveSubOps(t, datasets, "DEST", nil, nil)
+	tap, stored, resp := r.tap, r.stored, r.resp
+	assert.Equal(t, dimse.StatusSuccess, resp.Status.Status)
+	assert.Equal(t, uint16(4), resp.NumberOfCompletedSuboperations)
+	assert.Equal(t, 4, len(stored))
+
+	tap.mu.Lock()
+	defer tap.mu.Unlock()
+	// The second association covers both SOP classes, so it carries the rest.
+	assert.Equal(t, 2, tap.numAssocs)
+	assert.Equal(t, [][]string{
+		{ctImageStorage},
+		{ctImageStorage, mrImageStorage},
+	}, tap.sopClasses)
+}
+
+func TestCMoveAcceptedTransferSyntax(t *testing.T) {
+	// The destination prefers Implicit VR Little Endian, so it doesn't accept
+	// the syntax of the datasets. The association is reused nonetheless, and
+	// the datasets re-encoded.
+	var datasets []*dicom.DataSet
+	for i := 0; i < 3; i++ {
+		datasets = append(datasets, newCMoveDataSetInSyntax(ctImageStorage, fmt.Sprintf("1.2.3.%d", i), dicomuid.ExplicitVRLittleEndian))
+	}
+	r := testCMoveSubOpsToDest(t, datasets, "DEST", nil, []string{dicomuid.ImplicitVRLittleEndian}, nil)
+	assert.Equal(t, dimse.StatusSuccess, r.resp.Status.Status)
+	assert.Equal(t, 3, len(r.stored))
+
+	r.tap.mu.Lock()
+	defer r.tap.mu.Unlock()
+	assert.Equal(t, 1, r.tap.numAssocs)
+	assert.Equal(t, [][]string{{dicomuid.ExplicitVRLittleEndian, dicomuid.ImplicitVRLittleEndian}}, r.tap.transferSyntaxes)
+}
+
+func TestCMoveCompressed(t *testing.T) {
+	// Compressed datasets can't be re-encoded, so Implicit VR Little Endian
+	// isn't proposed for them, even if the destination prefers it.
+	const jpegBaseline = "1.2.840.10008.1.2.4.50"
+	datasets := []*dicom.DataSet{
+		newCMoveDataSetInSyntax(ctImageStorage, "1.2.3.0", jpegBaseline),
+		newCMoveDataSetInSyntax(ctImageStorage, "1.2.3.1", jpegBaseline),
+	}
+	r := testCMoveSubOpsToDest(t, datasets, "DEST", nil, []string{dicomuid.ImplicitVRLittleEndian}, nil)
+	assert.Equal(t, dimse.StatusSuccess, r.resp.Status.Status)
+	assert.Equal(t, 2, len(r.stored))
+
+	assert.Equal(t, []string{jpegBaseline, jpegBaseline}, r.storedSyntaxes)
+
+	r.tap.mu.Lock()
+	defer r.tap.mu.Unlock()
+	assert.Equal(t, 1, r.tap.numAssocs)
+	assert.Equal(t, [][]string{{jpegBaseline}}, r.tap.transferSyntaxes)
+}
+
+func TestCMoveParallel(t *testing.T) {
+	var datasets []*dicom.DataSet
+	for i := 0; i < 20; i++ {
+		datasets = append(datasets, newCMoveDataSet(ctImageStorage, fmt.Sprintf("1.2.3.%d", i)))
+	}
+	r := testCMoveSubOps(t, datasets, "DEST", nil, func(params *ServiceProviderParams) {
+		params.CMoveMaxAssociations = 3
+	})
+	tap, stored, resp := r.tap, r.stored, r.resp
+	assert.Equal(t, dimse.StatusSuccess, resp.Status.Status)
+	assert.Equal(t, uint16(20), resp.NumberOfCompletedSuboperations)
+	assert.Equal(t, 20, len(stored))
+
+	tap.mu.Lock()
+	defer tap.mu.Unlock()
+	assert.True(t, tap.numAssocs >= 1 && tap.numAssocs <= 3, "%d associations", tap.numAssocs)
+}
+
+func TestCMoveUnknownDestination(t *testing.T) {
+	datasets := []*dicom.DataSet{newCMoveDataSet(ctImageStorage, "1.2.3.0")}
+	r := testCMoveSubOps(t, datasets, "NOSUCHAE", nil, nil)
+	tap, stored, resp := r.tap, r.stored, r.resp
+	assert.Equal(t, dimse.CMoveMoveDestinationUnknown, resp.Status.Status)
+	assert.Equal(t, 0, len(stored))
+	assert.Equal(t, 0, tap.numAssocs)
+}
+
+func TestCMoveResolveDestination(t *testing.T) {
+	datasets := []*dicom.DataSet{newCMoveDataSet(ctImageStorage, "1.2.3.0")}
+	// Each AE may only move to itself. MOVESCU is an alias of DEST.
+	resolve := func(params *ServiceProviderParams) {
+		destAddr := params.RemoteAEs["DEST"]
+		params.RemoteAEs = nil
+		params.ResolveMoveDestination = func(conn ConnectionState, moveDestination string) (MoveDestination, error) {
+			if moveDestination != conn.CallingAETitle {
+				return MoveDestination{}, &StatusError{Status: dimse.Status{Status: dimse.StatusNotAuthorized}}
+			}
+			return MoveDestination{HostPort: destAddr, CallingAETitle: "SOURCE2"}, nil
+		}
+	}
+	r := testCMoveSubOps(t, datasets, "DEST", nil, resolve)
+	tap, stored, resp := r.tap, r.stored, r.resp
+	assert.Equal(t, dimse.StatusNotAuthorized, resp.Status.Status)
+	assert.Equal(t, 0, len(stored))
+	assert.Equal(t, 0, tap.numAssocs)
+
+	r = testCMoveSubOps(t, datasets, "MOVESCU", nil, resolve)
+	tap, stored, resp = r.tap, r.stored, r.resp
+	assert.Equal(t, dimse.StatusSuccess, resp.Status.Status)
+	assert.Equal(t, []string{"1.2.3.0"}, stored)
+	assert.Equal(t, 1, tap.numAssocs)
+}
+
+// newTestTLSConfigs returns the TLS configs of a server with a self-signed
+// certificate for 127.0.0.1, and of a client that trusts it.
+func newTestTLSConfigs(t *testing.T) (server, client *tls.Config) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "netdicom test"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	roots := x509.NewCertPool()
+	roots.AddCert(cert)
+	server = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}}}
+	client = &tls.Config{RootCAs: roots}
+	return server, client
+}
+
+// TestCMoveTLS runs a C-MOVE over TLS, with the sub-operations sent over TLS
+// too: the user connects with ServiceUserParams.TLSConfig, and the source
+// connects to the destination with MoveDestination.TLSConfig.
+func TestCMoveTLS(t *testing.T) {
+	serverTLS, clientTLS := newTestTLSConfigs(t)
+	var mu sync.Mutex
+	var stored []string
+	var tlsConns []bool // Whether each association was over TLS.
+	recordTLS := func(conn ConnectionState) {
+		mu.Lock()
+		tlsConns = append(tlsConns, conn.TLS.HandshakeComplete)
+		mu.Unlock()
+	}
+	dest, err := NewServiceProvider(ServiceProviderParams{
+		AETitle:   "DEST",
+		TLSConfig: serverTLS,
+		CStore: func(conn ConnectionState, transferSyntaxUID, sopClassUID, sopInstanceUID string, data []byte) dimse.Status {
+			recordTLS(conn)
+			mu.Lock()
+			stored = append(stored, sopInstanceUID)
+			mu.Unlock()
+			return dimse.Success
+		},
+	}, "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { dest.Close() })
+	go dest.Run()
+
+	source, err := NewServiceProvider(ServiceProviderParams{
+		AETitle:   "SOURCE",
+		TLSConfig: serverTLS,
+		ResolveMoveDestination: func(conn ConnectionState, moveDestination string) (MoveDestination, error) {
+			return MoveDestination{HostPort: dest.ListenAddr().String(), TLSConfig: clientTLS}, nil
+		},
+		CMove: func(conn ConnectionState, transferSyntaxUID, sopClassUID string, filters []*dicom.Element, ch chan CMoveResult) {
+			recordTLS(conn)
+			ch <- CMoveResult{Remaining: 0, Path: "0", DataSet: newCMoveDataSet(ctImageStorage, "1.2.3.0")}
+			close(ch)
+		},
+	}, "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { source.Close() })
+	go source.Run()
+
+	su, err := NewServiceUser(ServiceUserParams{
+		CallingAETitle: "MOVESCU",
+		SOPClasses:     sopclass.QRMoveClasses,
+		TLSConfig:      clientTLS,
+	})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(source.ListenAddr().String())
+	resp, _ := runCMove(t, su, "DEST", []*dicom.Element{dicom.MustNewElement(dicomtag.StudyInstanceUID, "1.2.3")})
+	assert.Equal(t, dimse.StatusSuccess, resp.Status.Status)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"1.2.3.0"}, stored)
+	assert.Equal(t, []bool{true, true}, tlsConns)
+}
+
+func TestCMoveSubOpFailures(t *testing.T) {
+	var datasets []*dicom.DataSet
+	for i := 0; i < 4; i++ {
+		datasets = append(datasets, newCMoveDataSet(ctImageStorage, fmt.Sprintf("1.2.3.%d", i)))
+	}
+	r := testCMoveSubOps(t, datasets, "DEST", map[string]dimse.Status{
+		"1.2.3.1": {Status: dimse.CStoreOutOfResources},
+		"1.2.3.2": {Status: 0xb007}, // Warning: dataset doesn't match SOP class.
+	}, nil)
+	assert.Equal(t, dimse.CMoveSubOperationsCompleteWithFailures, r.resp.Status.Status)
+	assert.Equal(t, uint16(2), r.resp.NumberOfCompletedSuboperations)
+	assert.Equal(t, uint16(1), r.resp.NumberOfFailedSuboperations)
+	assert.Equal(t, uint16(1), r.resp.NumberOfWarningSuboperations)
+	assert.Equal(t, uint16(0), r.resp.NumberOfRemainingSuboperations)
+	elem, err := dicom.FindElementByTag(r.elems, dicomtag.FailedSOPInstanceUIDList)
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{"1.2.3.1"}, elem.Value)
+	// A failed C-STORE doesn't break the association.
+	assert.Equal(t, 1, r.tap.numAssocs)
+}
+
+func TestCMoveAllSubOpsFailed(t *testing.T) {
+	datasets := []*dicom.DataSet{
+		newCMoveDataSet(ctImageStorage, "1.2.3.0"),
+		newCMoveDataSet(ctImageStorage, "1.2.3.1"),
+	}
+	r := testCMoveSubOps(t, datasets, "DEST", map[string]dimse.Status{
+		"1.2.3.0": {Status: dimse.CStoreCannotUnderstand},
+		"1.2.3.1": {Status: dimse.CStoreCannotUnderstand},
+	}, nil)
+	assert.Equal(t, dimse.CMoveOutOfResourcesUnableToPerformSubOperations, r.resp.Status.Status)
+	assert.Equal(t, uint16(2), r.resp.NumberOfFailedSuboperations)
+	elem, err := dicom.FindElementByTag(r.elems, dicomtag.FailedSOPInstanceUIDList)
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{"1.2.3.0", "1.2.3.1"}, elem.Value)
+}
+
+func TestCMoveCallbackError(t *testing.T) {
+	r := testCMoveSubOps(t, nil, "DEST", nil, func(params *ServiceProviderParams) {
+		params.CMove = func(conn ConnectionState, transferSyntaxUID, sopClassUID string, filters []*dicom.Element, ch chan CMoveResult) {
+			ch <- CMoveResult{Remaining: 2, DataSet: newCMoveDataSet(ctImageStorage, "1.2.3.0")}
+			ch <- CMoveResult{Err: fmt.Errorf("disk error")}
+			close(ch)
+		}
+	})
+	assert.Equal(t, dimse.CMoveUnableToProcess, r.resp.Status.Status)
+	assert.Equal(t, uint16(1), r.resp.NumberOfCompletedSuboperations)
+	assert.Equal(t, uint16(2), r.resp.NumberOfRemainingSuboperations)
+	assert.Nil(t, r.elems)
+}
+
+func TestCGetSubOpFailures(t *testing.T) {
+	p, err := NewServiceProvider(ServiceProviderParams{
+		CGet: func(conn ConnectionState, transferSyntaxUID, sopClassUID string, filters []*dicom.Element, ch chan CMoveResult) {
+			for i := 0; i < 3; i++ {
+				ch <- CMoveResult{Remaining: 2 - i, DataSet: newCMoveDataSet(ctImageStorage, fmt.Sprintf("1.2.3.%d", i))}
+			}
+			close(ch)
+		},
+	}, ":0")
+	require.NoError(t, err)
+	go p.Run()
+	su, err := NewServiceUser(ServiceUserParams{SOPClasses: sopclass.QRGetClasses})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(p.ListenAddr().String())
+	var final CGetProgress
+	query := QRQuery{Model: QRModelStudyRoot, Level: QRLevelStudy,
+		Keys: []*dicom.Element{dicom.MustNewElement(dicomtag.StudyInstanceUID, "1.2.3")}}
+	err = su.cget(context.Background(), query, func(p CGetProgress) { final = p },
+		func(transferSyntaxUID, sopClassUID, sopInstanceUID string, data []byte) dimse.Status {
+			if sopInstanceUID == "1.2.3.1" {
+				return dimse.Status{Status: dimse.CStoreOutOfResources}
+			}
+			return dimse.Success
+		})
+	var statusErr *StatusError
+	require.True(t, errors.As(err, &statusErr), "%v", err)
+	assert.Equal(t, dimse.CMoveSubOperationsCompleteWithFailures, statusErr.Status.Status)
+	assert.Equal(t, CGetProgress{Completed: 2, Failed: 1, Final: true}, final)
+}
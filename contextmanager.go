@@ -1,10 +1,10 @@
 package netdicom
 
 import (
+	"compress/flate"
 	"fmt"
 
 	"github.com/grailbio/go-dicom"
-	"github.com/grailbio/go-dicom/dicomlog"
 	"github.com/grailbio/go-dicom/dicomuid"
 	"github.com/grailbio/go-netdicom/pdu"
 )
@@ -25,7 +25,8 @@ type contextManagerEntry struct {
 // handshake.  ContextID values are 1, 3, 5, etc.  One contextManager is created
 // per association.
 type contextManager struct {
-	label string // for diagnostics only.
+	label  string // for diagnostics only.
+	logger *logger
 
 	// The two maps are inverses of each other.
 	contextIDToAbstractSyntaxNameMap map[byte]*contextManagerEntry
@@ -39,26 +40,52 @@ type contextManager struct {
 	// Implementation version, virtually meaningless since its format isn't standardiszed.
 	peerImplementationVersionName string
 
+	// AE titles from the A-ASSOCIATE-RQ pdu. Set before the handshake
+	// completes.
+	callingAETitle, calledAETitle string
+
 	// tmpRequests used only on the client (requestor) side. It holds the
 	// contextid->presentationcontext mapping generated from the
 	// A_ASSOCIATE_RQ PDU. Once an A_ASSOCIATE_AC PDU arrives, tmpRequests
 	// is matched against the response PDU and
 	// contextid->{abstractsyntax,transfersyntax} mappings are filled.
 	tmpRequests map[byte]*pdu.PresentationContextItem
+
+	// Transfer syntaxes preferred by the provider, in order. Used only on
+	// the provider side. If empty, the first syntax proposed by the user is
+	// picked.
+	preferredTransferSyntaxes []string
+
+	// acceptAbstractSyntax, if non-nil, reports whether the provider
+	// supports a SOP class. Presentation contexts of the other SOP classes
+	// are rejected. Used only on the provider side. If nil, every SOP class
+	// is accepted.
+	acceptAbstractSyntax func(sopClassUID string) bool
+
+	// Compression level of the datasets sent in Deflated Explicit VR Little
+	// Endian.
+	deflateLevel int
 }
 
 // Create an empty contextManager
-func newContextManager(label string) *contextManager {
+func newContextManager(label string, logger *logger) *contextManager {
 	c := &contextManager{
-		label: label,
+		label:                            label,
+		logger:                           logger,
 		contextIDToAbstractSyntaxNameMap: make(map[byte]*contextManagerEntry),
 		abstractSyntaxNameToContextIDMap: make(map[string]*contextManagerEntry),
 		peerMaxPDUSize:                   16384, // The default value used by Osirix & pynetdicom.
 		tmpRequests:                      make(map[byte]*pdu.PresentationContextItem),
+		deflateLevel:                     flate.DefaultCompression,
 	}
 	return c
 }
 
+// aeTitles returns the calling and called AE titles of the association.
+func (m *contextManager) aeTitles() (string, string) {
+	return m.callingAETitle, m.calledAETitle
+}
+
 // Called by the user (client) to produce a list to be embedded in an
 // A_REQUEST_RQ.Items. The PDU is sent when running as a service user (client).
 // maxPDUSize is the maximum PDU size, in bytes, that the clients is willing to
@@ -109,12 +136,12 @@ func (m *contextManager) onAssociateRequest(requestItems []pdu.SubItem) ([]pdu.S
 		switch ri := requestItem.(type) {
 		case *pdu.ApplicationContextItem:
 			if ri.Name != pdu.DICOMApplicationContextItemName {
-				dicomlog.Vprintf(0, "dicom.onAssociateRequest(%s): Found illegal applicationcontextname. Expect %v, found %v",
-					m.label, ri.Name, pdu.DICOMApplicationContextItemName)
+				m.logger.warn("Found illegal application context name",
+					"expected", pdu.DICOMApplicationContextItemName, "found", ri.Name)
 			}
 		case *pdu.PresentationContextItem:
 			var sopUID string
-			var pickedTransferSyntaxUID string
+			var proposedTransferSyntaxUIDs []string
 			for _, subItem := range ri.Items {
 				switch c := subItem.(type) {
 				case *pdu.AbstractSyntaxSubItem:
@@ -124,28 +151,36 @@ func (m *contextManager) onAssociateRequest(requestItems []pdu.SubItem) ([]pdu.S
 					}
 					sopUID = c.Name
 				case *pdu.TransferSyntaxSubItem:
-					// Just pick the first syntax UID proposed by the client.
-					if pickedTransferSyntaxUID == "" {
-						pickedTransferSyntaxUID = c.Name
-					}
+					proposedTransferSyntaxUIDs = append(proposedTransferSyntaxUIDs, c.Name)
 				default:
 					return nil, fmt.Errorf("dicom.onAssociateRequest: Unknown subitem in PresentationContext: %s",
 						subItem.String())
 				}
 			}
+			pickedTransferSyntaxUID := m.pickTransferSyntax(proposedTransferSyntaxUIDs)
 			if sopUID == "" || pickedTransferSyntaxUID == "" {
 				return nil, fmt.Errorf("dicom.onAssociateRequest: SOP or transfersyntax not found in PresentationContext: %v",
 					ri.String())
 			}
+			result := pdu.PresentationContextAccepted
+			if m.acceptAbstractSyntax != nil && !m.acceptAbstractSyntax(sopUID) {
+				result = pdu.PresentationContextProviderRejectionAbstractSyntaxNotSupported
+			}
+			// P3.8 9.3.3.2: the transfer syntax subitem is present, but
+			// not significant, in a rejected context.
 			responses = append(responses, &pdu.PresentationContextItem{
 				Type:      pdu.ItemTypePresentationContextResponse,
 				ContextID: ri.ContextID,
-				Result:    0, // accepted
+				Result:    result,
 				Items:     []pdu.SubItem{&pdu.TransferSyntaxSubItem{Name: pickedTransferSyntaxUID}}})
-			dicomlog.Vprintf(2, "dicom.onAssociateRequest(%s): Provider(%p): addmapping %v %v %v",
-				m.label, m, sopUID, pickedTransferSyntaxUID, ri.ContextID)
-			// TODO(saito) Callback the service provider instead of accepting the sopclass blindly.
-			addContextMapping(m, sopUID, pickedTransferSyntaxUID, ri.ContextID, pdu.PresentationContextAccepted)
+			if result == pdu.PresentationContextAccepted {
+				m.logger.debug("Accept presentation context",
+					"sop_class", sopUID, "transfer_syntax", pickedTransferSyntaxUID, "context", ri.ContextID)
+			} else {
+				m.logger.info("Reject presentation context",
+					"sop_class", sopUID, "context", ri.ContextID, "result", result.String())
+			}
+			addContextMapping(m, sopUID, pickedTransferSyntaxUID, ri.ContextID, result)
 		case *pdu.UserInformationItem:
 			for _, subItem := range ri.Items {
 				switch c := subItem.(type) {
@@ -163,12 +198,34 @@ func (m *contextManager) onAssociateRequest(requestItems []pdu.SubItem) ([]pdu.S
 	responses = append(responses,
 		&pdu.UserInformationItem{
 			Items: []pdu.SubItem{&pdu.UserInformationMaximumLengthItem{MaximumLengthReceived: uint32(DefaultMaxPDUSize)}}})
-	dicomlog.Vprintf(1, "dicom.onAssociateRequest(%s): Received associate request, #contexts:%v, maxPDU:%v, implclass:%v, version:%v",
-		m.label, len(m.contextIDToAbstractSyntaxNameMap),
-		m.peerMaxPDUSize, m.peerImplementationClassUID, m.peerImplementationVersionName)
+	m.logger.info("Received associate request",
+		"contexts", len(m.contextIDToAbstractSyntaxNameMap),
+		"peer_max_pdu", m.peerMaxPDUSize,
+		"peer_impl_class", m.peerImplementationClassUID,
+		"peer_impl_version", m.peerImplementationVersionName)
 	return responses, nil
 }
 
+// pickTransferSyntax picks the transfer syntax of a presentation context from
+// the ones proposed by the user. It returns the first of
+// m.preferredTransferSyntaxes that is proposed, or if none is, the first one
+// proposed. It returns "" if "proposed" is empty. The UIDs are compared
+// exactly, since sameTransferSyntax equates every compressed syntax with
+// Explicit VR Little Endian.
+func (m *contextManager) pickTransferSyntax(proposed []string) string {
+	for _, preferred := range m.preferredTransferSyntaxes {
+		for _, uid := range proposed {
+			if uid == preferred {
+				return uid
+			}
+		}
+	}
+	if len(proposed) == 0 {
+		return ""
+	}
+	return proposed[0]
+}
+
 // Called by the user (client) to when A_ASSOCIATE_AC PDU arrives from the provider.
 func (m *contextManager) onAssociateResponse(responses []pdu.SubItem) error {
 	for _, responseItem := range responses {
@@ -211,7 +268,10 @@ func (m *contextManager) onAssociateResponse(responses []pdu.SubItem) error {
 				return fmt.Errorf("dicom.onAssociateResponse(%s): The A-ASSOCIATE request lacks the abstract syntax item for tag %v (this shouldn't happen)", m.label, ri.ContextID)
 			}
 			if ri.Result != pdu.PresentationContextAccepted {
-				dicomlog.Vprintf(0, "dicom.onAssociateResponse(%s): Abstract syntax %v, transfer syntax %v was rejected by the server: %s", m.label, dicomuid.UIDString(sopUID), dicomuid.UIDString(pickedTransferSyntaxUID), ri.Result.String())
+				m.logger.warn("Presentation context rejected by the server",
+					"sop_class", dicomuid.UIDString(sopUID),
+					"transfer_syntax", dicomuid.UIDString(pickedTransferSyntaxUID),
+					"result", ri.Result.String())
 			}
 			if !found {
 				// Generally, we expect the server to pick a
@@ -221,11 +281,10 @@ func (m *contextManager) onAssociateResponse(responses []pdu.SubItem) error {
 				// the point of reporting the list in
 				// A-ASSOCIATE-RQ, but that's only one of
 				// DICOM's pointless complexities.
-				dicomlog.Vprintf(0, "dicom.onAssociateResponse(%s): The server picked TransferSyntaxUID '%s' for %s, which is not in the list proposed, %v",
-					m.label,
-					dicomuid.UIDString(pickedTransferSyntaxUID),
-					dicomuid.UIDString(sopUID),
-					request.Items)
+				m.logger.warn("The server picked a transfer syntax not in the list proposed",
+					"transfer_syntax", dicomuid.UIDString(pickedTransferSyntaxUID),
+					"sop_class", dicomuid.UIDString(sopUID),
+					"proposed", subItemsString(request.Items))
 			}
 			addContextMapping(m, sopUID, pickedTransferSyntaxUID, ri.ContextID, ri.Result)
 		case *pdu.UserInformationItem:
@@ -242,10 +301,11 @@ func (m *contextManager) onAssociateResponse(responses []pdu.SubItem) error {
 			}
 		}
 	}
-	dicomlog.Vprintf(1, "dicom.onAssociateResponse(%s): Received associate response, #contexts:%v, maxPDU:%v, implclass:%v, version:%v",
-		m.label,
-		len(m.contextIDToAbstractSyntaxNameMap),
-		m.peerMaxPDUSize, m.peerImplementationClassUID, m.peerImplementationVersionName)
+	m.logger.info("Received associate response",
+		"contexts", len(m.contextIDToAbstractSyntaxNameMap),
+		"peer_max_pdu", m.peerMaxPDUSize,
+		"peer_impl_class", m.peerImplementationClassUID,
+		"peer_impl_version", m.peerImplementationVersionName)
 	return nil
 }
 
@@ -256,9 +316,10 @@ func addContextMapping(
 	transferSyntaxUID string,
 	contextID byte,
 	result pdu.PresentationContextResult) {
-	dicomlog.Vprintf(2, "dicom.addContextMapping(%v): Map context %d -> %s, %s",
-		m.label, contextID, dicomuid.UIDString(abstractSyntaxUID),
-		dicomuid.UIDString(transferSyntaxUID))
+	m.logger.debug("Map context",
+		"context", contextID,
+		"sop_class", dicomuid.UIDString(abstractSyntaxUID),
+		"transfer_syntax", dicomuid.UIDString(transferSyntaxUID))
 	doassert(result >= 0 && result <= 4, result)
 	doassert(contextID%2 == 1, contextID)
 	if result == 0 {
@@ -311,3 +372,14 @@ func (m *contextManager) lookupByContextID(contextID byte) (contextManagerEntry,
 	}
 	return *e, nil
 }
+
+func subItemsString(items []pdu.SubItem) string {
+	s := "["
+	for i, item := range items {
+		if i > 0 {
+			s += ", "
+		}
+		s += item.String()
+	}
+	return s + "]"
+}
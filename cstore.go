@@ -1,90 +1,265 @@
 package netdicom
 
 import (
+	"bufio"
+	"context"
+	"encoding/binary"
 	"fmt"
+	"io"
+	"io/ioutil"
 
 	"github.com/grailbio/go-dicom"
 	"github.com/grailbio/go-dicom/dicomio"
-	"github.com/grailbio/go-dicom/dicomlog"
 	"github.com/grailbio/go-dicom/dicomtag"
 	"github.com/grailbio/go-dicom/dicomuid"
 	"github.com/grailbio/go-netdicom/dimse"
 )
 
 // Helper function used by C-{STORE,GET,MOVE} to send a dataset using C-STORE
-// over an already-established association.
-func runCStoreOnAssociation(upcallCh chan upcallEvent, downcallCh chan stateEvent,
-	cm *contextManager,
-	messageID dimse.MessageID,
-	ds *dicom.DataSet) error {
-	var getElement = func(tag dicomtag.Tag) (string, error) {
-		elem, err := ds.FindElementByTag(tag)
-		if err != nil {
-			return "", fmt.Errorf("dicom.cstore: data lacks %s: %v", tag.String(), err)
-		}
-		s, err := elem.GetString()
-		if err != nil {
-			return "", err
-		}
-		return s, nil
+// over an already-established association. "cs" must be a new command created
+// by serviceDispatcher.newCommand. Its context is replaced by the one for the
+// dataset's SOP class. "ctx" is the parent of the C-STORE span.
+func runCStoreOnAssociation(ctx context.Context, cs *serviceCommandState, ds *dicom.DataSet) (err error) {
+	cs.startSpan(ctx, "dicom.C-STORE")
+	defer func() { cs.endSpan(err) }()
+	sopInstanceUID, err := getMetaString(ds.Elements, dicomtag.MediaStorageSOPInstanceUID)
+	if err != nil {
+		return fmt.Errorf("dicom.cstore: data lacks SOPInstanceUID: %v", err)
+	}
+	sopClassUID, err := getMetaString(ds.Elements, dicomtag.MediaStorageSOPClassUID)
+	if err != nil {
+		return fmt.Errorf("dicom.cstore: data lacks MediaStorageSOPClassUID: %v", err)
+	}
+	logger := cs.cm.logger.with(LogKeyMessageID, cs.messageID, LogKeyCommand, "C-STORE-RQ")
+	context, err := cs.cm.lookupByAbstractSyntaxUID(sopClassUID)
+	if err != nil {
+		logger.error("SOP class not found in context", "sop_class", sopClassUID, LogKeyError, err)
+		return err
 	}
-	sopInstanceUID, err := getElement(dicomtag.MediaStorageSOPInstanceUID)
+	logger.info("Sending dataset",
+		"transfer_syntax", dicomuid.UIDString(context.transferSyntaxUID),
+		"sop_class", dicomuid.UIDString(sopClassUID),
+		"sop_instance", sopInstanceUID)
+	body, err := encodeCStoreBody(ds.Elements, context.transferSyntaxUID, cs.cm.deflateLevel)
+	if err != nil {
+		logger.error("Body encoder failed", LogKeyError, err)
+		return err
+	}
+	return sendCStoreRq(cs, context, sopClassUID, sopInstanceUID, body, nil)
+}
+
+// runCStoreStreamOnAssociation is similar to runCStoreOnAssociation, but the
+// dataset is given as the metadata elements and a reader for the rest of the
+// dataset, encoded in the TransferSyntaxUID found in "meta". If the transfer
+// syntax is the one negotiated for the SOP class, "body" is streamed to the
+// network without being parsed. Otherwise, if it is uncompressed, it is read
+// into memory and re-encoded. Compressed data can't be re-encoded, so it is
+// an error.
+func runCStoreStreamOnAssociation(ctx context.Context, cs *serviceCommandState, meta []*dicom.Element, body io.Reader) (err error) {
+	cs.startSpan(ctx, "dicom.C-STORE")
+	defer func() { cs.endSpan(err) }()
+	sopInstanceUID, err := getMetaString(meta, dicomtag.MediaStorageSOPInstanceUID)
 	if err != nil {
 		return fmt.Errorf("dicom.cstore: data lacks SOPInstanceUID: %v", err)
 	}
-	sopClassUID, err := getElement(dicomtag.MediaStorageSOPClassUID)
+	sopClassUID, err := getMetaString(meta, dicomtag.MediaStorageSOPClassUID)
 	if err != nil {
 		return fmt.Errorf("dicom.cstore: data lacks MediaStorageSOPClassUID: %v", err)
 	}
-	dicomlog.Vprintf(1, "dicom.cstore(%s): DICOM abstractsyntax: %s, sopinstance: %s", cm.label, dicomuid.UIDString(sopClassUID), sopInstanceUID)
-	context, err := cm.lookupByAbstractSyntaxUID(sopClassUID)
+	transferSyntaxUID, err := getMetaString(meta, dicomtag.TransferSyntaxUID)
+	if err != nil {
+		return fmt.Errorf("dicom.cstore: data lacks TransferSyntaxUID: %v", err)
+	}
+	logger := cs.cm.logger.with(LogKeyMessageID, cs.messageID, LogKeyCommand, "C-STORE-RQ")
+	context, err := cs.cm.lookupByAbstractSyntaxUID(sopClassUID)
 	if err != nil {
-		dicomlog.Vprintf(0, "dicom.cstore(%s): sop class %v not found in context %v", cm.label, sopClassUID, err)
+		logger.error("SOP class not found in context", "sop_class", sopClassUID, LogKeyError, err)
 		return err
 	}
-	dicomlog.Vprintf(1, "dicom.cstore(%s): using transfersyntax %s to send sop class %s, instance %s",
-		cm.label,
-		dicomuid.UIDString(context.transferSyntaxUID),
-		dicomuid.UIDString(sopClassUID),
-		sopInstanceUID)
-	bodyEncoder := dicomio.NewBytesEncoderWithTransferSyntax(context.transferSyntaxUID)
-	for _, elem := range ds.Elements {
-		if elem.Tag.Group == dicomtag.MetadataGroup {
-			continue
+	if transferSyntaxUID != context.transferSyntaxUID {
+		if !isUncompressedTransferSyntax(transferSyntaxUID) {
+			return fmt.Errorf("dicom.cstore: data is in compressed transfer syntax %s, but %s was negotiated for SOP class %s",
+				dicomuid.UIDString(transferSyntaxUID), dicomuid.UIDString(context.transferSyntaxUID), dicomuid.UIDString(sopClassUID))
+		}
+		logger.info("Transfer syntax differs from the negotiated one; re-encoding dataset",
+			"transfer_syntax", dicomuid.UIDString(transferSyntaxUID),
+			"negotiated_transfer_syntax", dicomuid.UIDString(context.transferSyntaxUID),
+			"sop_instance", sopInstanceUID)
+		data, err := ioutil.ReadAll(body)
+		if err != nil {
+			return err
+		}
+		elems, err := readElementsInBytes(data, transferSyntaxUID)
+		if err != nil {
+			return err
 		}
-		dicom.WriteElement(bodyEncoder, elem)
+		encoded, err := encodeCStoreBody(elems, context.transferSyntaxUID, cs.cm.deflateLevel)
+		if err != nil {
+			logger.error("Body encoder failed", LogKeyError, err)
+			return err
+		}
+		return sendCStoreRq(cs, context, sopClassUID, sopInstanceUID, encoded, nil)
 	}
-	if err := bodyEncoder.Error(); err != nil {
-		dicomlog.Vprintf(0, "dicom.cstore(%s): body encoder failed: %v", cm.label, err)
+	logger.info("Streaming dataset",
+		"transfer_syntax", dicomuid.UIDString(context.transferSyntaxUID),
+		"sop_class", dicomuid.UIDString(sopClassUID),
+		"sop_instance", sopInstanceUID)
+	in := bufio.NewReader(body)
+	if _, err := in.Peek(1); err != nil {
+		if err == io.EOF {
+			err = fmt.Errorf("dicom.cstore: empty dataset")
+		}
 		return err
 	}
-	downcallCh <- stateEvent{
-		event: evt09,
-		dimsePayload: &stateEventDIMSEPayload{
-			abstractSyntaxName: sopClassUID,
-			command: &dimse.CStoreRq{
-				AffectedSOPClassUID:    sopClassUID,
-				MessageID:              messageID,
-				CommandDataSetType:     dimse.CommandDataSetTypeNonNull,
-				AffectedSOPInstanceUID: sopInstanceUID,
-			},
-			data: bodyEncoder.Bytes(),
-		},
+	return sendCStoreRq(cs, context, sopClassUID, sopInstanceUID, nil, in)
+}
+
+// sendCStoreRq sends a C-STORE request and waits for the response. The data
+// payload is either "body", or if it is nil, read from "bodyReader".
+func sendCStoreRq(cs *serviceCommandState, context contextManagerEntry,
+	sopClassUID, sopInstanceUID string, body []byte, bodyReader io.Reader) error {
+	cm := cs.cm
+	logger := cm.logger.with(LogKeyMessageID, cs.messageID, LogKeyCommand, "C-STORE-RQ")
+	cs.context = context
+	cs.setSpanContext(sopClassUID)
+	cs.setSpanAttribute(TraceAttrSOPInstance, sopInstanceUID)
+	rq := &dimse.CStoreRq{
+		AffectedSOPClassUID:    sopClassUID,
+		MessageID:              cs.messageID,
+		CommandDataSetType:     dimse.CommandDataSetTypeNonNull,
+		AffectedSOPInstanceUID: sopInstanceUID,
+
+		MoveOriginatorApplicationEntityTitle: cs.moveOriginator.aeTitle,
+		MoveOriginatorMessageID:              cs.moveOriginator.messageID,
+	}
+	readErrCh := make(chan error, 1)
+	if bodyReader != nil {
+		cs.sendMessageStream(rq, bodyReader, func(err error) { readErrCh <- err })
+	} else {
+		cs.sendMessage(rq, body)
 	}
 	for {
-		dicomlog.Vprintf(0, "dicom.cstore(%s): Start reading resp w/ messageID:%v", cm.label, messageID)
-		event, ok := <-upcallCh
+		logger.debug("Start reading response")
+		event, ok := <-cs.upcallCh
 		if !ok {
-			return fmt.Errorf("dicom.cstore(%s): Connection closed while waiting for C-STORE response", cm.label)
+			select {
+			case err := <-readErrCh:
+				return fmt.Errorf("dicom.cstore(%s): failed to read dataset: %v", cm.label, err)
+			default:
+			}
+			return &associationError{msg: fmt.Sprintf("dicom.cstore(%s): Connection closed while waiting for C-STORE response", cm.label)}
+		}
+		if logger.debugEnabled() {
+			logger.debug("Received response", "detail", event.command.String())
 		}
-		dicomlog.Vprintf(1, "dicom.cstore(%s): resp event: %v", cm.label, event.command)
 		doassert(event.eventType == upcallEventData)
 		doassert(event.command != nil)
 		resp, ok := event.command.(*dimse.CStoreRsp)
 		doassert(ok) // TODO(saito)
 		if resp.Status.Status != 0 {
-			return fmt.Errorf("dicom.cstore(%s): failed: %v", cm.label, resp.String())
+			logger.warn("C-STORE failed", "detail", resp.String())
+			return fmt.Errorf("dicom.cstore(%s): failed: %w", cm.label, &StatusError{Status: resp.Status})
 		}
 		return nil
 	}
 }
+
+// getMetaString finds the element with the given tag and returns its string
+// value.
+func getMetaString(elems []*dicom.Element, tag dicomtag.Tag) (string, error) {
+	elem, err := dicom.FindElementByTag(elems, tag)
+	if err != nil {
+		return "", fmt.Errorf("dicom.cstore: data lacks %s: %v", tag.String(), err)
+	}
+	return elem.GetString()
+}
+
+// encodeCStoreBody encodes the non-metadata elements in the transfer syntax.
+func encodeCStoreBody(elems []*dicom.Element, transferSyntaxUID string, deflateLevel int) ([]byte, error) {
+	var body []*dicom.Element
+	for _, elem := range elems {
+		if elem.Tag.Group != dicomtag.MetadataGroup {
+			body = append(body, elem)
+		}
+	}
+	return writeElementsToBytes(body, transferSyntaxUID, deflateLevel)
+}
+
+// StoreTransferSyntaxes returns the transfer syntaxes to propose for sending
+// a dataset encoded in "transferSyntaxUID": that syntax first, then, if it is
+// uncompressed, the other uncompressed syntaxes of
+// dicomio.StandardTransferSyntaxes, into which C-STORE re-encodes the dataset
+// without loss. A compressed dataset, e.g., JPEG or RLE, is sent as is, since
+// re-encoding it would corrupt the encapsulated pixel data.
+func StoreTransferSyntaxes(transferSyntaxUID string) []string {
+	syntaxes := []string{transferSyntaxUID}
+	if !isUncompressedTransferSyntax(transferSyntaxUID) {
+		return syntaxes
+	}
+	for _, uid := range dicomio.StandardTransferSyntaxes {
+		if !sameTransferSyntax(uid, transferSyntaxUID) {
+			syntaxes = append(syntaxes, uid)
+		}
+	}
+	return syntaxes
+}
+
+// isUncompressedTransferSyntax checks if the transfer syntax is one of
+// dicomio.StandardTransferSyntaxes. Unlike sameTransferSyntax, it doesn't
+// canonicalize the UID, since dicomio maps compressed syntaxes to Explicit VR
+// Little Endian.
+func isUncompressedTransferSyntax(uid string) bool {
+	for _, standard := range dicomio.StandardTransferSyntaxes {
+		if uid == standard {
+			return true
+		}
+	}
+	return false
+}
+
+// sameTransferSyntax checks if the two UIDs denote the same transfer syntax.
+func sameTransferSyntax(uid0, uid1 string) bool {
+	c0, err := dicomio.CanonicalTransferSyntaxUID(uid0)
+	if err != nil {
+		return false
+	}
+	c1, err := dicomio.CanonicalTransferSyntaxUID(uid1)
+	if err != nil {
+		return false
+	}
+	return c0 == c1
+}
+
+// maxPart10MetaLength is the max size of the metadata elements accepted by
+// readPart10Header. Real files have a few hundred bytes.
+const maxPart10MetaLength = 1 << 20
+
+// readPart10Header reads the preamble and the metadata elements of a DICOM
+// Part 10 file. On return, "in" is positioned at the start of the dataset,
+// i.e., just after the metadata elements.
+func readPart10Header(in io.Reader) ([]*dicom.Element, error) {
+	// 128-byte preamble, "DICM", then (0002,0000) MetaElementGroupLength in
+	// explicit VR little endian.
+	var header [128 + 4 + 12]byte
+	if _, err := io.ReadFull(in, header[:]); err != nil {
+		return nil, fmt.Errorf("dicom.cstore: failed to read file header: %v", err)
+	}
+	if string(header[128:132]) != "DICM" {
+		return nil, fmt.Errorf("dicom.cstore: keyword 'DICM' not found in the header")
+	}
+	groupLength := header[132:]
+	if binary.LittleEndian.Uint16(groupLength[0:2]) != dicomtag.MetadataGroup ||
+		binary.LittleEndian.Uint16(groupLength[2:4]) != 0 ||
+		string(groupLength[4:6]) != "UL" {
+		return nil, fmt.Errorf("dicom.cstore: file header doesn't start with MetaElementGroupLength")
+	}
+	length := binary.LittleEndian.Uint32(groupLength[8:12])
+	if length > maxPart10MetaLength {
+		return nil, fmt.Errorf("dicom.cstore: metadata too large (%d bytes)", length)
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(in, data); err != nil {
+		return nil, fmt.Errorf("dicom.cstore: failed to read metadata: %v", err)
+	}
+	return readElementsInBytes(data, dicomuid.ExplicitVRLittleEndian)
+}
@@ -0,0 +1,221 @@
+package netdicom
+
+// This file implements the buffer that streams the dataset of an incoming
+// C-STORE request from the state machine to the handler.
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// DefaultCStoreMemoryThreshold is the default value of
+// ServiceProviderParams.CStoreMemoryThreshold.
+const DefaultCStoreMemoryThreshold = 16 << 20
+
+// ErrCStoreTooLarge is returned by the reader passed to CStoreStreamCallback
+// once the dataset exceeds ServiceProviderParams.CStoreMaxObjectSize. The
+// provider then responds with dimse.CStoreOutOfResources, regardless of the
+// status returned by the callback.
+var ErrCStoreTooLarge = errors.New("dicom.cstore: dataset exceeds the max object size")
+
+// cstoreSpoolOptions are the ServiceProviderParams fields that control
+// cstoreSpool.
+type cstoreSpoolOptions struct {
+	enabled         bool   // If false, C-STORE data is assembled in memory.
+	memoryThreshold int64  // Max unread bytes kept in memory.
+	spillDir        string // Directory of the spill files. "" disables spilling.
+	maxObjectSize   int64  // Max dataset size. 0 means unlimited.
+}
+
+func newCStoreSpoolOptions(params ServiceProviderParams) cstoreSpoolOptions {
+	opts := cstoreSpoolOptions{
+		enabled:         params.CStoreStream != nil || params.CStoreMaxObjectSize > 0 || params.CStoreSpillDir != "",
+		memoryThreshold: params.CStoreMemoryThreshold,
+		spillDir:        params.CStoreSpillDir,
+		maxObjectSize:   params.CStoreMaxObjectSize,
+	}
+	if opts.memoryThreshold <= 0 {
+		opts.memoryThreshold = DefaultCStoreMemoryThreshold
+	}
+	return opts
+}
+
+// cstoreSpool is a pipe between the state machine, which writes the data
+// fragments of a C-STORE request as they arrive, and the handler, which reads
+// them. Up to opts.memoryThreshold bytes of unread data are kept in memory.
+// Beyond that, the data is appended to a temp file if opts.spillDir is set.
+// Otherwise, Write blocks until the handler catches up, which stops the state
+// machine from reading the network.
+//
+// The handler must call release once it is done.
+type cstoreSpool struct {
+	opts cstoreSpoolOptions
+
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	mem      [][]byte // Unread in-memory fragments.
+	memBytes int64    // Sum of len(mem[*]).
+
+	// Spill file. Once created, all the subsequent data goes there. The
+	// file holds the data in [fileRead, fileWrite).
+	file      *os.File
+	fileRead  int64
+	fileWrite int64
+
+	size     int64 // Total bytes written.
+	tooLarge bool  // size exceeded opts.maxObjectSize.
+	closed   bool  // All the fragments have been written.
+	err      error // Set if the association ended before closed.
+	released bool  // The handler is done; discard the data.
+}
+
+func newCStoreSpool(opts cstoreSpoolOptions) *cstoreSpool {
+	s := &cstoreSpool{opts: opts}
+	s.cond = sync.NewCond(&s.mu)
+	return s
+}
+
+// Write is called by the state machine for each fragment. It implements
+// io.Writer.
+func (s *cstoreSpool) Write(data []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.released || s.tooLarge {
+		return len(data), nil
+	}
+	s.size += int64(len(data))
+	if s.opts.maxObjectSize > 0 && s.size > s.opts.maxObjectSize {
+		s.tooLarge = true
+		s.discardLocked()
+		s.cond.Broadcast()
+		return len(data), nil
+	}
+	if s.file == nil && s.memBytes+int64(len(data)) > s.opts.memoryThreshold && s.opts.spillDir != "" {
+		file, err := ioutil.TempFile(s.opts.spillDir, "cstore")
+		if err != nil {
+			return 0, fmt.Errorf("dicom.cstore: failed to create spill file: %v", err)
+		}
+		s.file = file
+	}
+	if s.file != nil {
+		n, err := s.file.WriteAt(data, s.fileWrite)
+		s.fileWrite += int64(n)
+		s.cond.Broadcast()
+		if err != nil {
+			return n, fmt.Errorf("dicom.cstore: failed to write spill file: %v", err)
+		}
+		return n, nil
+	}
+	// Block until the handler reads enough. A fragment larger than the
+	// threshold is accepted once the buffer is empty.
+	for s.memBytes > 0 && s.memBytes+int64(len(data)) > s.opts.memoryThreshold && !s.released {
+		s.cond.Wait()
+	}
+	if s.released {
+		return len(data), nil
+	}
+	// The caller may reuse "data".
+	s.mem = append(s.mem, append([]byte(nil), data...))
+	s.memBytes += int64(len(data))
+	s.cond.Broadcast()
+	return len(data), nil
+}
+
+// Close is called by the state machine after the last fragment.
+func (s *cstoreSpool) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	s.cond.Broadcast()
+	s.mu.Unlock()
+	return nil
+}
+
+// abort is called when the association ends. It is a noop if Close has been
+// called.
+func (s *cstoreSpool) abort(err error) {
+	s.mu.Lock()
+	if !s.closed && s.err == nil {
+		s.err = err
+		s.cond.Broadcast()
+	}
+	s.mu.Unlock()
+}
+
+// Read is called by the handler. It implements io.Reader.
+func (s *cstoreSpool) Read(buf []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for {
+		if s.tooLarge {
+			return 0, ErrCStoreTooLarge
+		}
+		if len(s.mem) > 0 {
+			n := copy(buf, s.mem[0])
+			if n == len(s.mem[0]) {
+				s.mem[0] = nil
+				s.mem = s.mem[1:]
+			} else {
+				s.mem[0] = s.mem[0][n:]
+			}
+			s.memBytes -= int64(n)
+			s.cond.Broadcast()
+			return n, nil
+		}
+		if s.file != nil && s.fileRead < s.fileWrite {
+			if int64(len(buf)) > s.fileWrite-s.fileRead {
+				buf = buf[:s.fileWrite-s.fileRead]
+			}
+			n, err := s.file.ReadAt(buf, s.fileRead)
+			s.fileRead += int64(n)
+			if err == io.EOF && n > 0 {
+				err = nil
+			}
+			return n, err
+		}
+		if s.closed {
+			return 0, io.EOF
+		}
+		if s.err != nil {
+			return 0, s.err
+		}
+		s.cond.Wait()
+	}
+}
+
+// wait blocks until all the fragments are written, or the association ends.
+// It returns the total number of bytes, and whether they exceeded the max
+// object size.
+func (s *cstoreSpool) wait() (size int64, tooLarge bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for !s.closed && s.err == nil {
+		s.cond.Wait()
+	}
+	return s.size, s.tooLarge, s.err
+}
+
+// release is called by the handler once it stops reading. The data that
+// arrives later is discarded.
+func (s *cstoreSpool) release() {
+	s.mu.Lock()
+	s.released = true
+	s.discardLocked()
+	s.cond.Broadcast()
+	s.mu.Unlock()
+}
+
+// REQUIRES: s.mu is locked.
+func (s *cstoreSpool) discardLocked() {
+	s.mem = nil
+	s.memBytes = 0
+	if s.file != nil {
+		s.file.Close()
+		os.Remove(s.file.Name())
+		s.file = nil
+	}
+}
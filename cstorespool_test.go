@@ -0,0 +1,327 @@
+package netdicom
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomtag"
+	"github.com/grailbio/go-dicom/dicomuid"
+	"github.com/grailbio/go-netdicom/dimse"
+	"github.com/grailbio/go-netdicom/sopclass"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCStoreSpoolBackpressure(t *testing.T) {
+	s := newCStoreSpool(cstoreSpoolOptions{memoryThreshold: 4})
+	_, err := s.Write([]byte("abc"))
+	require.NoError(t, err)
+	written := make(chan struct{})
+	go func() {
+		s.Write([]byte("def"))
+		s.Close()
+		close(written)
+	}()
+	select {
+	case <-written:
+		t.Fatal("Write should block until the reader catches up")
+	case <-time.After(50 * time.Millisecond):
+	}
+	data, err := ioutil.ReadAll(s)
+	require.NoError(t, err)
+	assert.Equal(t, "abcdef", string(data))
+	<-written
+	size, tooLarge, err := s.wait()
+	require.NoError(t, err)
+	assert.Equal(t, int64(6), size)
+	assert.False(t, tooLarge)
+	s.release()
+}
+
+func TestCStoreSpoolSpill(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cstorespool")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	s := newCStoreSpool(cstoreSpoolOptions{memoryThreshold: 4, spillDir: dir})
+	for _, v := range []string{"abc", "def", "ghi"} {
+		_, err := s.Write([]byte(v))
+		require.NoError(t, err)
+	}
+	require.NoError(t, s.Close())
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, files, 1)
+
+	data, err := ioutil.ReadAll(s)
+	require.NoError(t, err)
+	assert.Equal(t, "abcdefghi", string(data))
+	s.release()
+	files, err = ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, files, 0)
+}
+
+func TestCStoreSpoolTooLarge(t *testing.T) {
+	s := newCStoreSpool(cstoreSpoolOptions{memoryThreshold: 100, maxObjectSize: 5})
+	_, err := s.Write([]byte("abc"))
+	require.NoError(t, err)
+	_, err = s.Write([]byte("def"))
+	require.NoError(t, err)
+	_, err = ioutil.ReadAll(s)
+	assert.Equal(t, ErrCStoreTooLarge, err)
+	s.Close()
+	_, tooLarge, err := s.wait()
+	require.NoError(t, err)
+	assert.True(t, tooLarge)
+}
+
+func TestCStoreSpoolAbort(t *testing.T) {
+	s := newCStoreSpool(cstoreSpoolOptions{memoryThreshold: 100})
+	_, err := s.Write([]byte("abc"))
+	require.NoError(t, err)
+	s.abort(errors.New("foohah"))
+	data, err := ioutil.ReadAll(s)
+	assert.Equal(t, "abc", string(data))
+	assert.EqualError(t, err, "foohah")
+}
+
+func TestCStoreSpoolRelease(t *testing.T) {
+	s := newCStoreSpool(cstoreSpoolOptions{memoryThreshold: 4})
+	_, err := s.Write([]byte("abcd"))
+	require.NoError(t, err)
+	// The reader gives up, so the blocked writer must proceed.
+	written := make(chan struct{})
+	go func() {
+		s.Write([]byte("efgh"))
+		close(written)
+	}()
+	s.release()
+	<-written
+}
+
+// streamTestBody is the dataset sent by the C-STORE streaming tests. The
+// provider doesn't parse it, so it needn't be valid. At 10MB, it is sent in
+// three P-DATA-TF PDUs.
+var streamTestBody = bytes.Repeat([]byte("0123456789"), 1<<20)
+
+// newStreamTestUser runs a provider with "params" over net.Pipe, and returns a
+// user connected to it. The caller must Release the user.
+func newStreamTestUser(t *testing.T, params ServiceProviderParams) *ServiceUser {
+	serverConn, clientConn := net.Pipe()
+	go RunProviderForConn(serverConn, params)
+	su, err := NewServiceUser(ServiceUserParams{SOPClasses: sopclass.StorageClasses})
+	require.NoError(t, err)
+	su.SetConn(clientConn)
+	return su
+}
+
+// storeBody sends "body" as the dataset of instance "sopInstanceUID".
+func storeBody(su *ServiceUser, sopInstanceUID string, body []byte) error {
+	return su.CStoreReader([]*dicom.Element{
+		dicom.MustNewElement(dicomtag.MediaStorageSOPClassUID, ctImageStorage),
+		dicom.MustNewElement(dicomtag.MediaStorageSOPInstanceUID, sopInstanceUID),
+		dicom.MustNewElement(dicomtag.TransferSyntaxUID, dicomuid.ImplicitVRLittleEndian),
+	}, bytes.NewReader(body))
+}
+
+// requireStatus checks that "err" reports the C-STORE status.
+func requireStatus(t *testing.T, err error, status dimse.StatusCode) {
+	var statusErr *StatusError
+	require.True(t, errors.As(err, &statusErr), "error: %v", err)
+	assert.Equal(t, status, statusErr.Status.Status)
+}
+
+func TestCStoreStream(t *testing.T) {
+	var mu sync.Mutex
+	received := map[string][]byte{}
+	su := newStreamTestUser(t, ServiceProviderParams{
+		CStoreStream: func(conn ConnectionState, transferSyntaxUID, sopClassUID, sopInstanceUID string, data io.Reader) dimse.Status {
+			assert.Equal(t, dicomuid.ImplicitVRLittleEndian, transferSyntaxUID)
+			assert.Equal(t, ctImageStorage, sopClassUID)
+			// Instance "partial" reads only the start of the dataset.
+			if sopInstanceUID == "partial" {
+				data = io.LimitReader(data, 10)
+			}
+			body, err := ioutil.ReadAll(data)
+			assert.NoError(t, err)
+			mu.Lock()
+			received[sopInstanceUID] = body
+			mu.Unlock()
+			return dimse.Success
+		},
+	})
+	defer su.Release()
+	for _, uid := range []string{"1.2.3", "partial", "1.2.4"} {
+		require.NoError(t, storeBody(su, uid, streamTestBody), uid)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	// The rest of "partial" is discarded, and doesn't corrupt the next
+	// request.
+	assert.True(t, bytes.Equal(streamTestBody, received["1.2.3"]))
+	assert.Equal(t, streamTestBody[:10], received["partial"])
+	assert.True(t, bytes.Equal(streamTestBody, received["1.2.4"]))
+}
+
+func TestCStoreStreamMaxObjectSize(t *testing.T) {
+	small := streamTestBody[:1000]
+	for _, stream := range []bool{true, false} {
+		t.Run(fmt.Sprintf("stream=%v", stream), func(t *testing.T) {
+			var mu sync.Mutex
+			var stored []string
+			params := ServiceProviderParams{CStoreMaxObjectSize: 1 << 20}
+			if stream {
+				params.CStoreStream = func(conn ConnectionState, transferSyntaxUID, sopClassUID, sopInstanceUID string, data io.Reader) dimse.Status {
+					body, err := ioutil.ReadAll(data)
+					if sopInstanceUID == "large" {
+						assert.Equal(t, ErrCStoreTooLarge, err)
+					} else {
+						assert.NoError(t, err)
+						assert.Equal(t, small, body)
+					}
+					mu.Lock()
+					stored = append(stored, sopInstanceUID)
+					mu.Unlock()
+					// The provider overrides the status.
+					return dimse.Success
+				}
+			} else {
+				params.CStore = func(conn ConnectionState, transferSyntaxUID, sopClassUID, sopInstanceUID string, data []byte) dimse.Status {
+					assert.Equal(t, small, data)
+					mu.Lock()
+					stored = append(stored, sopInstanceUID)
+					mu.Unlock()
+					return dimse.Success
+				}
+			}
+			su := newStreamTestUser(t, params)
+			defer su.Release()
+			requireStatus(t, storeBody(su, "large", streamTestBody), dimse.CStoreOutOfResources)
+			// The association survives.
+			require.NoError(t, storeBody(su, "small", small))
+			mu.Lock()
+			defer mu.Unlock()
+			if stream {
+				assert.Equal(t, []string{"large", "small"}, stored)
+			} else {
+				// CStore isn't called on a dataset that is too large.
+				assert.Equal(t, []string{"small"}, stored)
+			}
+		})
+	}
+}
+
+func TestCStoreStreamSpill(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cstorespool")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	var received []byte
+	su := newStreamTestUser(t, ServiceProviderParams{
+		CStoreMemoryThreshold: 1 << 20,
+		CStoreSpillDir:        dir,
+		CStoreStream: func(conn ConnectionState, transferSyntaxUID, sopClassUID, sopInstanceUID string, data io.Reader) dimse.Status {
+			// Fall behind until the provider spills the data.
+			deadline := time.Now().Add(10 * time.Second)
+			for {
+				files, err := ioutil.ReadDir(dir)
+				assert.NoError(t, err)
+				if len(files) > 0 {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Error("the data wasn't spilled")
+					break
+				}
+				time.Sleep(time.Millisecond)
+			}
+			body, err := ioutil.ReadAll(data)
+			assert.NoError(t, err)
+			received = body
+			return dimse.Success
+		},
+	})
+	defer su.Release()
+	require.NoError(t, storeBody(su, "1.2.3", streamTestBody))
+	assert.True(t, bytes.Equal(streamTestBody, received))
+	// The spill file is removed before the response is sent.
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, files)
+}
+
+// countingTap counts the bytes of the P-DATA-TF PDUs received.
+type countingTap struct {
+	mu    sync.Mutex
+	bytes int
+}
+
+func (tap *countingTap) TapPDU(dir PDUDirection, data []byte) {
+	if dir == PDUReceived && data[0] == 4 { // P-DATA-TF
+		tap.mu.Lock()
+		tap.bytes += len(data)
+		tap.mu.Unlock()
+	}
+}
+
+func (tap *countingTap) Close() error { return nil }
+
+func (tap *countingTap) received() int {
+	tap.mu.Lock()
+	defer tap.mu.Unlock()
+	return tap.bytes
+}
+
+func TestCStoreStreamBackpressure(t *testing.T) {
+	tap := &countingTap{}
+	started := make(chan struct{})
+	proceed := make(chan struct{})
+	var received []byte
+	su := newStreamTestUser(t, ServiceProviderParams{
+		CStoreMemoryThreshold: 1 << 20,
+		WireTap:               func(WireTapInfo) (WireTap, error) { return tap, nil },
+		CStoreStream: func(conn ConnectionState, transferSyntaxUID, sopClassUID, sopInstanceUID string, data io.Reader) dimse.Status {
+			close(started)
+			<-proceed
+			body, err := ioutil.ReadAll(data)
+			assert.NoError(t, err)
+			received = body
+			return dimse.Success
+		},
+	})
+	defer su.Release()
+	// The dataset is sent in 4MB PDUs, a few of which the provider reads
+	// ahead of the callback.
+	body := bytes.Repeat(streamTestBody, 4)
+	done := make(chan error, 1)
+	go func() { done <- storeBody(su, "1.2.3", body) }()
+
+	// While the callback doesn't read, the provider stops reading the
+	// network once the buffer is full, so the user can't send the whole
+	// dataset.
+	<-started
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case err := <-done:
+		t.Fatalf("C-STORE finished while the callback was blocked: %v", err)
+	default:
+	}
+	// At most, one PDU is in the buffer, one is being written to it, one is
+	// being read, and netCh holds the rest. The command PDU is small.
+	maxReceived := (spoolingNetChSize+3)*(DefaultMaxPDUSize+12) + 1024
+	require.True(t, maxReceived < len(body))
+	assert.True(t, tap.received() <= maxReceived, "received %d bytes", tap.received())
+
+	close(proceed)
+	require.NoError(t, <-done)
+	assert.True(t, bytes.Equal(body, received))
+	assert.True(t, tap.received() > len(body))
+}
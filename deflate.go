@@ -0,0 +1,65 @@
+package netdicom
+
+// This file implements the Deflated Explicit VR Little Endian transfer syntax
+// (PS3.5 A.5). A dataset in this syntax is encoded in explicit VR little
+// endian, then compressed with raw deflate (RFC 1951, without the zlib
+// header).
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/grailbio/go-dicom/dicomuid"
+)
+
+// isDeflatedTransferSyntax checks if "uid" is Deflated Explicit VR Little
+// Endian.
+func isDeflatedTransferSyntax(uid string) bool {
+	return sameTransferSyntax(uid, dicomuid.DeflatedExplicitVRLittleEndian)
+}
+
+// validateDeflateLevel checks the DeflateLevel field of ServiceUserParams or
+// ServiceProviderParams, and returns the compression level to use.
+func validateDeflateLevel(level int) (int, error) {
+	if level == 0 {
+		return flate.DefaultCompression, nil
+	}
+	if level < flate.HuffmanOnly || level > flate.BestCompression {
+		return 0, fmt.Errorf("dicom.deflate: invalid compression level %d", level)
+	}
+	return level, nil
+}
+
+// deflateDataSet compresses an encoded dataset. The result is padded to an
+// even length, as required by PS3.5 A.5.
+func deflateDataSet(data []byte, level int) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, level)
+	if err != nil {
+		return nil, fmt.Errorf("dicom.deflate: %v", err)
+	}
+	if _, err := w.Write(data); err != nil {
+		return nil, fmt.Errorf("dicom.deflate: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		return nil, fmt.Errorf("dicom.deflate: %v", err)
+	}
+	if buf.Len()%2 == 1 {
+		buf.WriteByte(0)
+	}
+	return buf.Bytes(), nil
+}
+
+// inflateDataSet reverses deflateDataSet. The padding after the end of the
+// deflate stream is ignored.
+func inflateDataSet(data []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+	inflated, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("dicom.inflate: %v", err)
+	}
+	return inflated, nil
+}
@@ -0,0 +1,55 @@
+package netdicom
+
+import (
+	"bytes"
+	"compress/flate"
+	"testing"
+
+	"github.com/grailbio/go-dicom/dicomuid"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeflateDataSet(t *testing.T) {
+	for _, n := range []int{0, 1, 2, 1000, 100000} {
+		data := bytes.Repeat([]byte("abcdefg"), n)
+		deflated, err := deflateDataSet(data, flate.BestCompression)
+		require.NoError(t, err)
+		assert.Equal(t, 0, len(deflated)%2, "size %d", n)
+		inflated, err := inflateDataSet(deflated)
+		require.NoError(t, err)
+		assert.Equal(t, data, inflated)
+	}
+	_, err := inflateDataSet([]byte("garbage"))
+	assert.Error(t, err)
+}
+
+func TestValidateDeflateLevel(t *testing.T) {
+	level, err := validateDeflateLevel(0)
+	require.NoError(t, err)
+	assert.Equal(t, flate.DefaultCompression, level)
+	level, err = validateDeflateLevel(flate.BestSpeed)
+	require.NoError(t, err)
+	assert.Equal(t, flate.BestSpeed, level)
+	_, err = validateDeflateLevel(10)
+	assert.Error(t, err)
+}
+
+func TestPickTransferSyntax(t *testing.T) {
+	proposed := []string{dicomuid.ImplicitVRLittleEndian, dicomuid.DeflatedExplicitVRLittleEndian}
+	cm := newContextManager("test", newLogger(nil, nil))
+	assert.Equal(t, dicomuid.ImplicitVRLittleEndian, cm.pickTransferSyntax(proposed))
+	assert.Equal(t, "", cm.pickTransferSyntax(nil))
+
+	cm.preferredTransferSyntaxes = []string{dicomuid.DeflatedExplicitVRLittleEndian, dicomuid.ImplicitVRLittleEndian}
+	assert.Equal(t, dicomuid.DeflatedExplicitVRLittleEndian, cm.pickTransferSyntax(proposed))
+	cm.preferredTransferSyntaxes = []string{dicomuid.ExplicitVRBigEndian}
+	assert.Equal(t, dicomuid.ImplicitVRLittleEndian, cm.pickTransferSyntax(proposed))
+
+	// A compressed syntax doesn't stand in for the uncompressed one the
+	// provider prefers.
+	const jpegBaseline = "1.2.840.10008.1.2.4.50"
+	cm.preferredTransferSyntaxes = []string{dicomuid.ExplicitVRLittleEndian}
+	assert.Equal(t, dicomuid.ExplicitVRLittleEndian,
+		cm.pickTransferSyntax([]string{jpegBaseline, dicomuid.ExplicitVRLittleEndian}))
+}
@@ -10,6 +10,7 @@ package dimse
 import (
 	"encoding/binary"
 	"fmt"
+	"io"
 	"sort"
 
 	dicom "github.com/grailbio/go-dicom"
@@ -184,19 +185,28 @@ const (
 	CStoreDataSetDoesNotMatchSOPClass StatusCode = 0xa900
 
 	// C-FIND-specific status codes.
-	CFindUnableToProcess StatusCode = 0xc000
+	CFindUnableToProcess                StatusCode = 0xc000
+	CFindIdentifierDoesNotMatchSOPClass StatusCode = 0xa900
 
 	// C-MOVE/C-GET-specific status codes.
 	CMoveOutOfResourcesUnableToCalculateNumberOfMatches StatusCode = 0xa701
 	CMoveOutOfResourcesUnableToPerformSubOperations     StatusCode = 0xa702
 	CMoveMoveDestinationUnknown                         StatusCode = 0xa801
 	CMoveDataSetDoesNotMatchSOPClass                    StatusCode = 0xa900
+	CMoveUnableToProcess                                StatusCode = 0xc000
+	CMoveSubOperationsCompleteWithFailures              StatusCode = 0xb000
 
 	// Warning codes.
 	StatusAttributeValueOutOfRange StatusCode = 0x0116
 	StatusAttributeListError       StatusCode = 0x0107
 )
 
+// IsWarning reports whether the code denotes a warning, i.e., the operation
+// was done, but not as requested. P3.7 C.
+func (c StatusCode) IsWarning() bool {
+	return c&0xf000 == 0xb000 || c == StatusAttributeValueOutOfRange || c == StatusAttributeListError
+}
+
 // ReadMessage constructs a typed dimse.Message object, given a set of
 // dicom.Elements,
 func ReadMessage(d *dicomio.Decoder) Message {
@@ -253,10 +263,18 @@ func EncodeMessage(e *dicomio.Encoder, v Message) {
 // CommandAssembler is a helper that assembles a DIMSE command message and data
 // payload from a sequence of P_DATA_TF PDUs.
 type CommandAssembler struct {
+	// NewDataSink, if non-nil, is called once a command with a data payload
+	// is assembled. If it returns a non-nil writer, the data fragments are
+	// written to it as they arrive, and it is closed after the last fragment,
+	// instead of being accumulated. In that case AddDataPDU never returns the
+	// command; NewDataSink is responsible for delivering it.
+	NewDataSink func(contextID byte, command Message) io.WriteCloser
+
 	contextID      byte
 	commandBytes   []byte
 	command        Message
 	dataBytes      []byte
+	dataSink       io.WriteCloser
 	readAllCommand bool
 
 	readAllData bool
@@ -282,7 +300,13 @@ func (a *CommandAssembler) AddDataPDU(pdu *pdu.PDataTf) (byte, Message, []byte,
 				a.readAllCommand = true
 			}
 		} else {
-			a.dataBytes = append(a.dataBytes, item.Value...)
+			if a.dataSink != nil {
+				if _, err := a.dataSink.Write(item.Value); err != nil {
+					return 0, nil, nil, err
+				}
+			} else {
+				a.dataBytes = append(a.dataBytes, item.Value...)
+			}
 			if item.Last {
 				if a.readAllData {
 					return 0, nil, nil, fmt.Errorf("P_DATA_TF: found >1 data chunks with the Last bit set")
@@ -300,14 +324,28 @@ func (a *CommandAssembler) AddDataPDU(pdu *pdu.PDataTf) (byte, Message, []byte,
 		if err := d.Finish(); err != nil {
 			return 0, nil, nil, err
 		}
+		if a.command.HasData() && a.NewDataSink != nil {
+			if a.dataSink = a.NewDataSink(a.contextID, a.command); a.dataSink != nil {
+				// Flush the fragments that arrived with the command.
+				if _, err := a.dataSink.Write(a.dataBytes); err != nil {
+					return 0, nil, nil, err
+				}
+				a.dataBytes = nil
+			}
+		}
 	}
 	if a.command.HasData() && !a.readAllData {
 		return 0, nil, nil, nil
 	}
+	if a.dataSink != nil {
+		err := a.dataSink.Close()
+		*a = CommandAssembler{NewDataSink: a.NewDataSink}
+		return 0, nil, nil, err
+	}
 	contextID := a.contextID
 	command := a.command
 	dataBytes := a.dataBytes
-	*a = CommandAssembler{}
+	*a = CommandAssembler{NewDataSink: a.NewDataSink}
 	return contextID, command, dataBytes, nil
 	// TODO(saito) Verify that there's no unread items after the last command&data.
 }
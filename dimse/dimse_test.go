@@ -2,10 +2,12 @@ package dimse_test
 
 import (
 	"encoding/binary"
+	"io"
 	"testing"
 
 	"github.com/grailbio/go-dicom/dicomio"
 	"github.com/grailbio/go-netdicom/dimse"
+	"github.com/grailbio/go-netdicom/pdu"
 )
 
 func testDIMSE(t *testing.T, v dimse.Message) {
@@ -53,3 +55,60 @@ func TestCEchoRsp(t *testing.T) {
 		dimse.Status{Status: dimse.StatusCode(0x2345)},
 		nil})
 }
+
+type sink struct {
+	data   []byte
+	closed bool
+}
+
+func (s *sink) Write(data []byte) (int, error) {
+	s.data = append(s.data, data...)
+	return len(data), nil
+}
+
+func (s *sink) Close() error {
+	s.closed = true
+	return nil
+}
+
+func TestCommandAssemblerDataSink(t *testing.T) {
+	e := dicomio.NewBytesEncoder(nil, dicomio.UnknownVR)
+	dimse.EncodeMessage(e, &dimse.CStoreRq{
+		AffectedSOPClassUID:    "1.2.3",
+		MessageID:              0x1234,
+		CommandDataSetType:     dimse.CommandDataSetTypeNonNull,
+		AffectedSOPInstanceUID: "3.4.5",
+	})
+	var s sink
+	var sinkCommand dimse.Message
+	a := dimse.CommandAssembler{
+		NewDataSink: func(contextID byte, command dimse.Message) io.WriteCloser {
+			sinkCommand = command
+			return &s
+		},
+	}
+	pdus := []*pdu.PDataTf{
+		{Items: []pdu.PresentationDataValueItem{
+			{ContextID: 1, Command: true, Last: true, Value: e.Bytes()},
+			{ContextID: 1, Command: false, Last: false, Value: []byte("foo")},
+		}},
+		{Items: []pdu.PresentationDataValueItem{
+			{ContextID: 1, Command: false, Last: true, Value: []byte("bar")},
+		}},
+	}
+	for _, p := range pdus {
+		_, command, data, err := a.AddDataPDU(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if command != nil || data != nil {
+			t.Errorf("AddDataPDU returned %v, %v", command, data)
+		}
+	}
+	if sinkCommand == nil || sinkCommand.GetMessageID() != 0x1234 {
+		t.Errorf("Wrong command: %v", sinkCommand)
+	}
+	if string(s.data) != "foobar" || !s.closed {
+		t.Errorf("Wrong sink state: %q, %v", s.data, s.closed)
+	}
+}
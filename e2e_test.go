@@ -1,8 +1,11 @@
 package netdicom
 
 import (
+	"bytes"
+	"compress/flate"
 	"errors"
 	"flag"
+	"io"
 	"io/ioutil"
 	"log"
 	"os"
@@ -25,8 +28,9 @@ import (
 
 var provider *ServiceProvider
 
-var cstoreData []byte            // data received by the cstore handler
-var cstoreStatus = dimse.Success // status returned by the cstore handler
+var cstoreData []byte              // data received by the cstore handler
+var cstoreTransferSyntaxUID string // transfer syntax of cstoreData
+var cstoreStatus = dimse.Success   // status returned by the cstore handler
 var nEchoRequests int
 var once sync.Once
 
@@ -70,6 +74,7 @@ func onCStoreRequest(
 		})
 	e.WriteBytes(data)
 	cstoreData = e.Bytes()
+	cstoreTransferSyntaxUID = transferSyntaxUID
 	log.Printf("Received C-STORE request, %d bytes", len(cstoreData))
 	return cstoreStatus
 }
@@ -203,6 +208,103 @@ func TestStore(t *testing.T) {
 	checkFileBodiesEqual(t, dataset, out)
 }
 
+func TestStoreDeflated(t *testing.T) {
+	dataset := mustReadDICOMFile("testdata/IM-0001-0003.dcm")
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses:       sopclass.StorageClasses,
+		TransferSyntaxes: []string{dicomuid.DeflatedExplicitVRLittleEndian},
+		DeflateLevel:     flate.BestCompression,
+	})
+	require.NoError(t, err)
+	su.Connect(provider.ListenAddr().String())
+	defer su.Release()
+	require.NoError(t, su.CStore(dataset))
+	require.Equal(t, dicomuid.DeflatedExplicitVRLittleEndian, cstoreTransferSyntaxUID)
+
+	// The handler receives the compressed dataset.
+	in := bytes.NewReader(cstoreData)
+	_, err = readPart10Header(in)
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(in)
+	require.NoError(t, err)
+	elems, err := readElementsInBytes(body, cstoreTransferSyntaxUID)
+	require.NoError(t, err)
+	checkFileBodiesEqual(t, dataset, &dicom.DataSet{Elements: elems})
+}
+
+// jpeg2000 is the transfer syntax of testdata/IM-0001-0003.dcm.
+const jpeg2000 = "1.2.840.10008.1.2.4.91"
+
+// newJPEG2000User creates a ServiceUser that proposes JPEG 2000 only, so that
+// testdata/IM-0001-0003.dcm can be streamed as is.
+func newJPEG2000User(t *testing.T) *ServiceUser {
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses:       sopclass.StorageClasses,
+		TransferSyntaxes: []string{jpeg2000},
+	})
+	require.NoError(t, err)
+	su.Connect(provider.ListenAddr().String())
+	return su
+}
+
+func TestStoreFile(t *testing.T) {
+	dataset := mustReadDICOMFile("testdata/IM-0001-0003.dcm")
+	su := newJPEG2000User(t)
+	defer su.Release()
+	require.NoError(t, su.CStoreFile("testdata/IM-0001-0003.dcm"))
+	assert.Equal(t, jpeg2000, cstoreTransferSyntaxUID)
+	out, err := getCStoreData()
+	require.NoError(t, err)
+	checkFileBodiesEqual(t, dataset, out)
+}
+
+type errReader struct{ err error }
+
+func (r errReader) Read([]byte) (int, error) { return 0, r.err }
+
+func TestStoreReaderError(t *testing.T) {
+	dataset := mustReadDICOMFile("testdata/IM-0001-0003.dcm")
+	var meta []*dicom.Element
+	for _, elem := range dataset.Elements {
+		if elem.Tag.Group == dicomtag.MetadataGroup {
+			meta = append(meta, elem)
+		}
+	}
+	su := newJPEG2000User(t)
+	defer su.Release()
+	body := io.MultiReader(strings.NewReader("foo"), errReader{errors.New("Foohah")})
+	err := su.CStoreReader(meta, body)
+	require.Error(t, err)
+	require.True(t, strings.Contains(err.Error(), "Foohah"), err)
+}
+
+func TestStoreReaderCompressedMismatch(t *testing.T) {
+	dataset := mustReadDICOMFile("testdata/IM-0001-0003.dcm")
+	var meta []*dicom.Element
+	for _, elem := range dataset.Elements {
+		if elem.Tag.Group == dicomtag.MetadataGroup {
+			meta = append(meta, elem)
+		}
+	}
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses:       sopclass.StorageClasses,
+		TransferSyntaxes: []string{dicomuid.ExplicitVRLittleEndian},
+	})
+	require.NoError(t, err)
+	su.Connect(provider.ListenAddr().String())
+	defer su.Release()
+	cstoreData = nil
+	// The JPEG 2000 data can't be sent, nor re-encoded, as Explicit VR Little
+	// Endian.
+	f, err := os.Open("testdata/IM-0001-0003.dcm")
+	require.NoError(t, err)
+	defer f.Close()
+	err = su.CStoreReader(meta, f)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "compressed")
+	assert.Nil(t, cstoreData)
+}
+
 // Arrange so that the cstore server returns an error. The client should detect
 // that.
 func TestStoreFailure0(t *testing.T) {
@@ -0,0 +1,388 @@
+// Package federation fans a C-FIND out to several upstream AEs, and merges
+// their results.
+//
+// A Finder sends the query to every upstream in parallel, over one
+// association per upstream. At the study, series and image levels, matches
+// reported by several upstreams are merged into one result, keyed by the
+// unique key of the level (StudyInstanceUID, SeriesInstanceUID or
+// SOPInstanceUID). Each result lists the upstreams that reported it, and
+// carries their AE titles in RetrieveAETitle (0008,0054).
+//
+// Finder.CFindQuery is a netdicom.CFindQueryCallback, so one AE title can
+// front several archives:
+//
+//	f, err := federation.New(federation.Params{
+//		AETitle: "GATEWAY",
+//		Upstreams: []federation.Upstream{
+//			{AETitle: "PACS1", HostPort: "pacs1:104"},
+//			{AETitle: "PACS2", HostPort: "pacs2:104", Timeout: 5 * time.Second},
+//		},
+//	})
+//	if err != nil {
+//		...
+//	}
+//	sp, err := netdicom.NewServiceProvider(netdicom.ServiceProviderParams{
+//		AETitle:    "GATEWAY",
+//		CFindQuery: f.CFindQuery,
+//	}, ":11112")
+//
+// If some upstreams fail, the results of the others are still returned, and
+// the C-FIND ends with status StatusPartialResults.
+package federation
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	dicom "github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomtag"
+	"github.com/grailbio/go-netdicom"
+	"github.com/grailbio/go-netdicom/dimse"
+	"github.com/grailbio/go-netdicom/sopclass"
+)
+
+// DefaultTimeout is the default of Params.Timeout.
+const DefaultTimeout = 30 * time.Second
+
+// StatusPartialResults is the warning status of a C-FIND answered by
+// Finder.CFindQuery when some, but not all, upstreams failed. The error
+// comment lists the failures. The C-FIND service defines no such warning;
+// 0xB000 is the generic Bxxx warning, which the SCU reports as
+// dimse.StatusCode.IsWarning.
+const StatusPartialResults dimse.StatusCode = 0xb000
+
+// Upstream is an AE that queries are sent to.
+type Upstream struct {
+	// Name identifies the upstream in Result.Sources and errors. If empty,
+	// AETitle is used.
+	Name string
+	// AETitle is the called AE title. Required.
+	AETitle string
+	// HostPort is the address of the AE. Required.
+	HostPort string
+	// CallingAETitle, if nonempty, replaces Params.AETitle as the calling
+	// AE title.
+	CallingAETitle string
+	// TLSConfig, if non-nil, enables TLS on the association.
+	TLSConfig *tls.Config
+	// Timeout, if > 0, replaces Params.Timeout for this upstream.
+	Timeout time.Duration
+}
+
+// Params defines parameters for New.
+type Params struct {
+	// AETitle is the calling AE title of the associations. Required.
+	AETitle string
+
+	// Upstreams lists the AEs to query. Results are merged in this order:
+	// when several upstreams report a match, the elements reported by the
+	// first one win. Required.
+	Upstreams []Upstream
+
+	// Timeout bounds the time spent on each upstream, including
+	// establishing the association. An upstream that doesn't answer in
+	// time counts as failed. If <= 0, DefaultTimeout is used.
+	Timeout time.Duration
+
+	// User, if non-nil, customizes the upstream associations, whose AE
+	// titles, TLSConfig and SOPClasses are then set by the Finder. The Logger
+	// it sets also receives the warnings of the Finder.
+	User func(params *netdicom.ServiceUserParams)
+}
+
+// Result is a match, merged across upstreams.
+type Result struct {
+	// Elements are the elements of the match. RetrieveAETitle lists the
+	// AE titles of Sources.
+	Elements []*dicom.Element
+	// Sources lists the names of the upstreams that reported the match, in
+	// the order of Params.Upstreams.
+	Sources []string
+}
+
+// UpstreamError is the failure of one upstream.
+type UpstreamError struct {
+	Upstream string
+	Err      error
+}
+
+func (e *UpstreamError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Upstream, e.Err)
+}
+
+// Error is returned by Find when some upstreams failed.
+type Error struct {
+	// Failures lists the upstreams that failed, in the order of
+	// Params.Upstreams.
+	Failures []*UpstreamError
+	// Partial is true if other upstreams succeeded, so the results are
+	// usable, but may be incomplete.
+	Partial bool
+}
+
+func (e *Error) Error() string {
+	msgs := make([]string, len(e.Failures))
+	for i, f := range e.Failures {
+		msgs[i] = f.Error()
+	}
+	return "federation.Find: " + strings.Join(msgs, "; ")
+}
+
+// Finder runs queries across the upstreams. It is thread safe.
+type Finder struct {
+	params Params
+	// logger is the Logger set by Params.User, or netdicom.DefaultLogger.
+	logger netdicom.Logger
+}
+
+// New validates the params and creates a Finder.
+func New(params Params) (*Finder, error) {
+	if params.AETitle == "" {
+		return nil, fmt.Errorf("federation.New: AETitle must be set")
+	}
+	if len(params.Upstreams) == 0 {
+		return nil, fmt.Errorf("federation.New: Upstreams must be set")
+	}
+	names := map[string]bool{}
+	params.Upstreams = append([]Upstream(nil), params.Upstreams...)
+	for i := range params.Upstreams {
+		u := &params.Upstreams[i]
+		if u.AETitle == "" || u.HostPort == "" {
+			return nil, fmt.Errorf("federation.New: upstream %d: AETitle and HostPort must be set", i)
+		}
+		if u.Name == "" {
+			u.Name = u.AETitle
+		}
+		if names[u.Name] {
+			return nil, fmt.Errorf("federation.New: duplicate upstream %q", u.Name)
+		}
+		names[u.Name] = true
+	}
+	if params.Timeout <= 0 {
+		params.Timeout = DefaultTimeout
+	}
+	var user netdicom.ServiceUserParams
+	if params.User != nil {
+		params.User(&user)
+	}
+	logger := user.Logger
+	if logger == nil {
+		logger = netdicom.DefaultLogger()
+	}
+	return &Finder{params: params, logger: logger}, nil
+}
+
+// Find sends the query to the upstreams, and returns the merged results.
+//
+// If some upstreams fail, the error is an *Error with Partial set, and the
+// results of the other upstreams are returned. The matches a failed
+// upstream reported before failing are dropped. If all upstreams fail, the
+// error is an *Error without Partial.
+func (f *Finder) Find(ctx context.Context, query netdicom.QRQuery) ([]Result, error) {
+	key, hasKey := uniqueKey(query.Level)
+	if hasKey {
+		query.Keys = withReturnKey(query.Keys, key)
+	}
+	type response struct {
+		matches [][]*dicom.Element
+		err     error
+	}
+	responses := make([]response, len(f.params.Upstreams))
+	var wg sync.WaitGroup
+	for i := range f.params.Upstreams {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			responses[i].matches, responses[i].err = f.findOne(ctx, &f.params.Upstreams[i], query)
+		}(i)
+	}
+	wg.Wait()
+
+	m := merger{key: key, hasKey: hasKey, index: map[string]*merged{}}
+	errs := &Error{}
+	for i, r := range responses {
+		u := &f.params.Upstreams[i]
+		if r.err != nil {
+			f.logger.Warn("federation: C-FIND failed", "upstream", u.Name, netdicom.LogKeyError, r.err)
+			errs.Failures = append(errs.Failures, &UpstreamError{Upstream: u.Name, Err: r.err})
+		}
+		for _, elems := range r.matches {
+			m.add(u, elems)
+		}
+	}
+	results := m.results()
+	if len(errs.Failures) > 0 {
+		errs.Partial = len(errs.Failures) < len(f.params.Upstreams)
+		return results, errs
+	}
+	return results, nil
+}
+
+// findOne runs the query on one upstream.
+func (f *Finder) findOne(ctx context.Context, u *Upstream, query netdicom.QRQuery) ([][]*dicom.Element, error) {
+	timeout := f.params.Timeout
+	if u.Timeout > 0 {
+		timeout = u.Timeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var params netdicom.ServiceUserParams
+	if f.params.User != nil {
+		f.params.User(&params)
+	}
+	params.CalledAETitle = u.AETitle
+	params.CallingAETitle = u.CallingAETitle
+	if params.CallingAETitle == "" {
+		params.CallingAETitle = f.params.AETitle
+	}
+	params.TLSConfig = u.TLSConfig
+	params.SOPClasses = sopclass.QRFindClasses
+	su, err := netdicom.NewServiceUser(params)
+	if err != nil {
+		return nil, err
+	}
+	// Cancelling ctx doesn't abort ServiceUser.CFindQuery, so the query
+	// runs in the background, and the association is released on
+	// timeout.
+	type response struct {
+		matches [][]*dicom.Element
+		err     error
+	}
+	done := make(chan response, 1)
+	go func() {
+		var r response
+		su.ConnectContext(ctx, u.HostPort)
+		for result := range su.CFindQuery(ctx, query) {
+			if result.Err != nil {
+				r.err = result.Err
+			} else if len(result.Elements) > 0 {
+				r.matches = append(r.matches, result.Elements)
+			}
+		}
+		done <- r
+	}()
+	defer su.Release()
+	select {
+	case r := <-done:
+		if r.err != nil {
+			return nil, r.err
+		}
+		return r.matches, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// CFindQuery is a netdicom.CFindQueryCallback that answers with the results
+// of Find. If some upstreams failed, the final status is
+// StatusPartialResults. If all failed, it is dimse.CFindUnableToProcess.
+func (f *Finder) CFindQuery(conn netdicom.ConnectionState, transferSyntaxUID, sopClassUID string,
+	query netdicom.QRQuery, ch chan netdicom.CFindResult) {
+	defer close(ch)
+	results, err := f.Find(context.Background(), query)
+	for _, r := range results {
+		ch <- netdicom.CFindResult{Elements: r.Elements}
+	}
+	if e, ok := err.(*Error); ok {
+		status := dimse.Status{Status: dimse.CFindUnableToProcess, ErrorComment: e.Error()}
+		if e.Partial {
+			status.Status = StatusPartialResults
+		}
+		ch <- netdicom.CFindResult{Err: &netdicom.StatusError{Status: status}}
+	}
+}
+
+// uniqueKey returns the tag that identifies a match at "level". Patient IDs
+// aren't unique across archives, so patient-level matches aren't merged.
+func uniqueKey(level netdicom.QRLevel) (dicomtag.Tag, bool) {
+	switch level {
+	case netdicom.QRLevelStudy:
+		return dicomtag.StudyInstanceUID, true
+	case netdicom.QRLevelSeries:
+		return dicomtag.SeriesInstanceUID, true
+	case netdicom.QRLevelImage:
+		return dicomtag.SOPInstanceUID, true
+	}
+	return dicomtag.Tag{}, false
+}
+
+// withReturnKey adds an empty "tag" to the keys if it is missing, so that
+// the upstreams return it.
+func withReturnKey(keys []*dicom.Element, tag dicomtag.Tag) []*dicom.Element {
+	if _, err := dicom.FindElementByTag(keys, tag); err == nil {
+		return keys
+	}
+	return append(append([]*dicom.Element(nil), keys...), dicom.MustNewElement(tag, ""))
+}
+
+// merged is a result being built.
+type merged struct {
+	elems    []*dicom.Element
+	sources  []string
+	aeTitles []string
+}
+
+// merger de-duplicates the matches by key, keeping the order of first
+// appearance.
+type merger struct {
+	key    dicomtag.Tag
+	hasKey bool
+	index  map[string]*merged
+	list   []*merged
+}
+
+func (m *merger) add(u *Upstream, elems []*dicom.Element) {
+	var id string
+	if m.hasKey {
+		if elem, err := dicom.FindElementByTag(elems, m.key); err == nil {
+			id, _ = elem.GetString()
+		}
+	}
+	r := m.index[id]
+	if id == "" || r == nil {
+		r = &merged{}
+		for _, elem := range elems {
+			if elem.Tag != dicomtag.RetrieveAETitle {
+				r.elems = append(r.elems, elem)
+			}
+		}
+		if id != "" {
+			m.index[id] = r
+		}
+		m.list = append(m.list, r)
+	} else {
+		// Fill in the elements that the earlier upstreams lacked.
+		for _, elem := range elems {
+			if elem.Tag == dicomtag.RetrieveAETitle {
+				continue
+			}
+			if _, err := dicom.FindElementByTag(r.elems, elem.Tag); err != nil {
+				r.elems = append(r.elems, elem)
+			}
+		}
+	}
+	if len(r.sources) == 0 || r.sources[len(r.sources)-1] != u.Name {
+		r.sources = append(r.sources, u.Name)
+		r.aeTitles = append(r.aeTitles, u.AETitle)
+	}
+}
+
+func (m *merger) results() []Result {
+	results := make([]Result, len(m.list))
+	for i, r := range m.list {
+		values := make([]interface{}, len(r.aeTitles))
+		for j, aeTitle := range r.aeTitles {
+			values[j] = aeTitle
+		}
+		results[i] = Result{
+			Elements: append(r.elems, dicom.MustNewElement(dicomtag.RetrieveAETitle, values...)),
+			Sources:  r.sources,
+		}
+	}
+	return results
+}
@@ -0,0 +1,227 @@
+package federation_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	dicom "github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomtag"
+	"github.com/grailbio/go-netdicom"
+	"github.com/grailbio/go-netdicom/dimse"
+	"github.com/grailbio/go-netdicom/federation"
+	"github.com/grailbio/go-netdicom/netdicomtest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const srFile = "../testdata/reportsi.dcm"
+
+// newPACS starts a PACS that holds one instance in each of the studies.
+func newPACS(t *testing.T, aeTitle string, studyUIDs ...string) (*netdicomtest.PACS, string) {
+	ds := netdicomtest.ReadDataSet(t, srFile)
+	var datasets []*dicom.DataSet
+	for _, studyUID := range studyUIDs {
+		datasets = append(datasets, netdicomtest.WithUIDs(ds, studyUID, studyUID+".1", studyUID+".1.1"))
+	}
+	return netdicomtest.StartPACS(t, netdicomtest.Params{AETitle: aeTitle}, datasets...)
+}
+
+// freeAddr returns a loopback host:port that nothing listens on.
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	l.Close()
+	return addr
+}
+
+var studyQuery = netdicom.QRQuery{
+	Model: netdicom.QRModelStudyRoot,
+	Level: netdicom.QRLevelStudy,
+	Keys:  []*dicom.Element{dicom.MustNewElement(dicomtag.PatientID, "")},
+}
+
+func getString(t *testing.T, elems []*dicom.Element, tag dicomtag.Tag) string {
+	elem, err := dicom.FindElementByTag(elems, tag)
+	require.NoError(t, err)
+	return elem.MustGetString()
+}
+
+func retrieveAETitles(t *testing.T, elems []*dicom.Element) []string {
+	elem, err := dicom.FindElementByTag(elems, dicomtag.RetrieveAETitle)
+	require.NoError(t, err)
+	strs, err := elem.GetStrings()
+	require.NoError(t, err)
+	return strs
+}
+
+func TestFind(t *testing.T) {
+	_, addr1 := newPACS(t, "PACS1", "1.2.3", "1.2.4")
+	_, addr2 := newPACS(t, "PACS2", "1.2.4", "1.2.5")
+	f, err := federation.New(federation.Params{
+		AETitle: "GATEWAY",
+		Upstreams: []federation.Upstream{
+			{AETitle: "PACS1", HostPort: addr1},
+			{Name: "second", AETitle: "PACS2", HostPort: addr2},
+			{AETitle: "PACS3", HostPort: freeAddr(t)},
+		},
+	})
+	require.NoError(t, err)
+
+	results, err := f.Find(context.Background(), studyQuery)
+	var fedErr *federation.Error
+	require.True(t, errors.As(err, &fedErr), "error: %v", err)
+	assert.True(t, fedErr.Partial)
+	require.Equal(t, 1, len(fedErr.Failures))
+	assert.Equal(t, "PACS3", fedErr.Failures[0].Upstream)
+
+	// The study key is added to the query, and the matches are merged by
+	// it.
+	require.Equal(t, 3, len(results))
+	for i, want := range []struct {
+		studyUID string
+		sources  []string
+		aeTitles []string
+	}{
+		{"1.2.3", []string{"PACS1"}, []string{"PACS1"}},
+		{"1.2.4", []string{"PACS1", "second"}, []string{"PACS1", "PACS2"}},
+		{"1.2.5", []string{"second"}, []string{"PACS2"}},
+	} {
+		assert.Equal(t, want.studyUID, getString(t, results[i].Elements, dicomtag.StudyInstanceUID))
+		assert.Equal(t, want.sources, results[i].Sources)
+		assert.Equal(t, want.aeTitles, retrieveAETitles(t, results[i].Elements))
+	}
+
+	// Patient-level matches aren't merged. The fake PACS reports a match
+	// per instance.
+	results, err = f.Find(context.Background(), netdicom.QRQuery{
+		Model: netdicom.QRModelPatientRoot,
+		Level: netdicom.QRLevelPatient,
+		Keys:  []*dicom.Element{dicom.MustNewElement(dicomtag.PatientID, "")},
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 4, len(results))
+}
+
+func TestFindTimeout(t *testing.T) {
+	pacs1, addr1 := newPACS(t, "PACS1", "1.2.3")
+	pacs2, addr2 := newPACS(t, "PACS2", "1.2.4")
+	pacs2.SetScript(netdicomtest.Script{Delay: 2 * time.Second})
+	f, err := federation.New(federation.Params{
+		AETitle: "GATEWAY",
+		Upstreams: []federation.Upstream{
+			{AETitle: "PACS1", HostPort: addr1},
+			{AETitle: "PACS2", HostPort: addr2, Timeout: 100 * time.Millisecond},
+		},
+	})
+	require.NoError(t, err)
+
+	start := time.Now()
+	results, err := f.Find(context.Background(), studyQuery)
+	assert.True(t, time.Since(start) < time.Second)
+	var fedErr *federation.Error
+	require.True(t, errors.As(err, &fedErr), "error: %v", err)
+	require.Equal(t, 1, len(fedErr.Failures))
+	assert.Equal(t, "PACS2", fedErr.Failures[0].Upstream)
+	require.Equal(t, 1, len(results))
+	assert.Equal(t, "1.2.3", getString(t, results[0].Elements, dicomtag.StudyInstanceUID))
+
+	// All upstreams fail.
+	pacs1.Close()
+	_, err = f.Find(context.Background(), studyQuery)
+	require.True(t, errors.As(err, &fedErr), "error: %v", err)
+	assert.False(t, fedErr.Partial)
+	assert.Equal(t, 2, len(fedErr.Failures))
+}
+
+// recordingLogger is a netdicom.Logger that records the Warn messages.
+type recordingLogger struct {
+	mu    sync.Mutex
+	warns []string
+}
+
+func (l *recordingLogger) Debug(msg string, args ...interface{}) {}
+func (l *recordingLogger) Info(msg string, args ...interface{})  {}
+func (l *recordingLogger) Error(msg string, args ...interface{}) {}
+
+func (l *recordingLogger) Warn(msg string, args ...interface{}) {
+	l.mu.Lock()
+	l.warns = append(l.warns, msg)
+	l.mu.Unlock()
+}
+
+func TestCFindQuery(t *testing.T) {
+	_, addr1 := newPACS(t, "PACS1", "1.2.3")
+	_, addr2 := newPACS(t, "PACS2", "1.2.3", "1.2.4")
+	logger := &recordingLogger{}
+	f, err := federation.New(federation.Params{
+		AETitle: "GATEWAY",
+		Upstreams: []federation.Upstream{
+			{AETitle: "PACS1", HostPort: addr1},
+			{AETitle: "PACS2", HostPort: addr2},
+			{AETitle: "PACS3", HostPort: freeAddr(t)},
+		},
+		User: func(params *netdicom.ServiceUserParams) { params.Logger = logger },
+	})
+	require.NoError(t, err)
+	sp, err := netdicom.NewServiceProvider(netdicom.ServiceProviderParams{
+		AETitle:    "GATEWAY",
+		CFindQuery: f.CFindQuery,
+	}, "127.0.0.1:0")
+	require.NoError(t, err)
+	defer sp.Close()
+	go sp.Run()
+
+	su, err := netdicom.NewServiceUser(netdicom.ServiceUserParams{
+		CalledAETitle:  "GATEWAY",
+		CallingAETitle: "VIEWER",
+		SOPClasses:     []string{"1.2.840.10008.5.1.4.1.2.2.1"}, // Study Root Find
+	})
+	require.NoError(t, err)
+	su.Connect(sp.ListenAddr().String())
+	defer su.Release()
+
+	var studyUIDs []string
+	var errs []error
+	for result := range su.CFindQuery(context.Background(), studyQuery) {
+		if result.Err != nil {
+			errs = append(errs, result.Err)
+		} else if len(result.Elements) > 0 {
+			studyUIDs = append(studyUIDs, getString(t, result.Elements, dicomtag.StudyInstanceUID))
+			if studyUIDs[len(studyUIDs)-1] == "1.2.3" {
+				assert.Equal(t, []string{"PACS1", "PACS2"}, retrieveAETitles(t, result.Elements))
+			}
+		}
+	}
+	assert.Equal(t, []string{"1.2.3", "1.2.4"}, studyUIDs)
+	// The failure of PACS3 is reported as a warning.
+	require.Equal(t, 1, len(errs))
+	assert.Contains(t, errs[0].Error(), "PACS3")
+	var statusErr *netdicom.StatusError
+	require.True(t, errors.As(errs[0], &statusErr))
+	assert.Equal(t, federation.StatusPartialResults, statusErr.Status.Status)
+	assert.True(t, statusErr.Status.Status.IsWarning())
+	assert.NotEqual(t, dimse.CFindUnableToProcess, statusErr.Status.Status)
+	logger.mu.Lock()
+	assert.Equal(t, []string{"federation: C-FIND failed"}, logger.warns)
+	logger.mu.Unlock()
+}
+
+func TestNewErrors(t *testing.T) {
+	for _, params := range []federation.Params{
+		{Upstreams: []federation.Upstream{{AETitle: "PACS1", HostPort: "localhost:104"}}},
+		{AETitle: "GATEWAY"},
+		{AETitle: "GATEWAY", Upstreams: []federation.Upstream{{AETitle: "PACS1"}}},
+		{AETitle: "GATEWAY", Upstreams: []federation.Upstream{
+			{AETitle: "PACS1", HostPort: "localhost:104"},
+			{AETitle: "PACS1", HostPort: "localhost:105"},
+		}},
+	} {
+		_, err := federation.New(params)
+		assert.Error(t, err, "params: %+v", params)
+	}
+}
@@ -0,0 +1,212 @@
+package netdicom
+
+// This file implements the interceptors that wrap the DIMSE handlers of a
+// ServiceProvider.
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"runtime/debug"
+
+	"github.com/grailbio/go-netdicom/dimse"
+)
+
+// ProviderRequest is a DIMSE request received by a ServiceProvider, as seen by
+// the interceptors.
+type ProviderRequest struct {
+	// Conn describes the association.
+	Conn ConnectionState
+	// Command is the request, e.g., *dimse.CFindRq. An interceptor may
+	// replace it with a request of the same type.
+	Command dimse.Message
+	// SOPClassUID and TransferSyntaxUID are those of the presentation
+	// context the request arrived on.
+	SOPClassUID       string
+	TransferSyntaxUID string
+	// Data is the payload, serialized in TransferSyntaxUID. An interceptor
+	// may replace it, e.g., to coerce tags. It is nil for a request without
+	// payload, and for a C-STORE whose dataset is streamed to the callback
+	// (see ServiceProviderParams.CStoreStream).
+	Data []byte
+}
+
+// ProviderHandler handles a request, sending its responses.
+type ProviderHandler func(ctx context.Context, req *ProviderRequest) error
+
+// ProviderInterceptor runs around the handling of each request received by a
+// ServiceProvider, like a gRPC interceptor. It usually calls next to run the
+// rest of the chain. To short-circuit the request, it returns an error
+// without calling next. The provider then responds with the status of the
+// error if it is a *StatusError, or 0xC000 (unable to process) otherwise. If
+// it returns nil without calling next, the provider responds with
+// dimse.Success.
+//
+// An error returned after next ran is logged, but it can't change the
+// response if the handler has already sent the final one.
+//
+// Example, rejecting the AEs not on a list:
+//
+//	func(ctx context.Context, req *ProviderRequest, next ProviderHandler) error {
+//		if !allowed[req.Conn.CallingAETitle] {
+//			return &StatusError{Status: dimse.Status{Status: dimse.StatusNotAuthorized}}
+//		}
+//		return next(ctx, req)
+//	}
+type ProviderInterceptor func(ctx context.Context, req *ProviderRequest, next ProviderHandler) error
+
+// PanicError is the error reported by RecoveryInterceptor when a handler or a
+// callback panics.
+type PanicError struct {
+	// Value is the value passed to panic.
+	Value interface{}
+	// Stack is the stack trace of the goroutine that panicked.
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("dicom.PanicError: %v", e.Value)
+}
+
+// RecoveryInterceptor recovers from a panic in the handler or in the
+// callbacks it runs, including the C-FIND, C-MOVE and C-GET callbacks that
+// run in their own goroutines. It returns a *PanicError, so the request is
+// answered with status 0xC000. It should be the first interceptor, so that
+// it covers the others.
+func RecoveryInterceptor(ctx context.Context, req *ProviderRequest, next ProviderHandler) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			if p, ok := r.(*PanicError); ok {
+				err = p
+				return
+			}
+			err = &PanicError{Value: r, Stack: debug.Stack()}
+		}
+	}()
+	return next(ctx, req)
+}
+
+// withInterceptors wraps "handler" with params.Interceptors, the first one
+// outermost.
+func withInterceptors(conn net.Conn, interceptors []ProviderInterceptor,
+	handler func(req *ProviderRequest, cs *serviceCommandState)) serviceCallback {
+	return func(msg dimse.Message, data []byte, cs *serviceCommandState) {
+		req := &ProviderRequest{
+			Conn:              getConnState(conn, cs.cm),
+			Command:           msg,
+			SOPClassUID:       cs.context.abstractSyntaxUID,
+			TransferSyntaxUID: cs.context.transferSyntaxUID,
+			Data:              data,
+		}
+		if len(interceptors) == 0 {
+			handler(req, cs)
+			return
+		}
+		handled := false
+		next := func(ctx context.Context, req *ProviderRequest) error {
+			handled = true
+			handler(req, cs)
+			return nil
+		}
+		for i := len(interceptors) - 1; i >= 0; i-- {
+			interceptor, inner := interceptors[i], next
+			next = func(ctx context.Context, req *ProviderRequest) error {
+				return interceptor(ctx, req, inner)
+			}
+		}
+		err := next(cs.traceContext(), req)
+		if err != nil {
+			if p, ok := err.(*PanicError); ok {
+				cs.logger.error("Handler panicked", LogKeyCommand, commandName(msg), LogKeyError, err, "stack", string(p.Stack))
+			} else {
+				cs.logger.warn("Interceptor failed the request", LogKeyCommand, commandName(msg), LogKeyError, err)
+			}
+		}
+		if cs.finalResponseSent() {
+			return
+		}
+		if cs.dataStream != nil {
+			// The C-STORE dataset must be received before the response.
+			cs.dataStream.release()
+			cs.dataStream.wait()
+		}
+		status := dimse.Success
+		if err != nil {
+			status = errorStatus(err)
+		} else if handled {
+			cs.logger.error("Handler returned without a final response", LogKeyCommand, commandName(msg))
+			status = dimse.Status{Status: dimse.CFindUnableToProcess}
+		}
+		cs.sendMessage(finalResponse(msg, status), nil)
+	}
+}
+
+// finalResponse returns the final response with "status" to request "msg".
+func finalResponse(msg dimse.Message, status dimse.Status) dimse.Message {
+	switch c := msg.(type) {
+	case *dimse.CStoreRq:
+		return &dimse.CStoreRsp{
+			AffectedSOPClassUID:       c.AffectedSOPClassUID,
+			MessageIDBeingRespondedTo: c.MessageID,
+			CommandDataSetType:        dimse.CommandDataSetTypeNull,
+			AffectedSOPInstanceUID:    c.AffectedSOPInstanceUID,
+			Status:                    status,
+		}
+	case *dimse.CFindRq:
+		return &dimse.CFindRsp{
+			AffectedSOPClassUID:       c.AffectedSOPClassUID,
+			MessageIDBeingRespondedTo: c.MessageID,
+			CommandDataSetType:        dimse.CommandDataSetTypeNull,
+			Status:                    status,
+		}
+	case *dimse.CMoveRq:
+		return &dimse.CMoveRsp{
+			AffectedSOPClassUID:       c.AffectedSOPClassUID,
+			MessageIDBeingRespondedTo: c.MessageID,
+			CommandDataSetType:        dimse.CommandDataSetTypeNull,
+			Status:                    status,
+		}
+	case *dimse.CGetRq:
+		return &dimse.CGetRsp{
+			AffectedSOPClassUID:       c.AffectedSOPClassUID,
+			MessageIDBeingRespondedTo: c.MessageID,
+			CommandDataSetType:        dimse.CommandDataSetTypeNull,
+			Status:                    status,
+		}
+	case *dimse.CEchoRq:
+		return &dimse.CEchoRsp{
+			MessageIDBeingRespondedTo: c.MessageID,
+			CommandDataSetType:        dimse.CommandDataSetTypeNull,
+			Status:                    status,
+		}
+	}
+	panic(fmt.Sprintf("dicom.finalResponse: unexpected request %v", msg))
+}
+
+// recoverCFindCallback, deferred in the goroutine that runs a C-FIND
+// callback, reports a panic through "ch" as a *PanicError. The handler
+// re-raises it, so that RecoveryInterceptor can catch it.
+func recoverCFindCallback(ch chan CFindResult) {
+	if r := recover(); r != nil {
+		defer func() { recover() }() // The callback may have closed ch.
+		ch <- CFindResult{Err: &PanicError{Value: r, Stack: debug.Stack()}}
+		close(ch)
+	}
+}
+
+// recoverCMoveCallback is recoverCFindCallback for C-MOVE and C-GET.
+func recoverCMoveCallback(ch chan CMoveResult) {
+	if r := recover(); r != nil {
+		defer func() { recover() }() // The callback may have closed ch.
+		ch <- CMoveResult{Err: &PanicError{Value: r, Stack: debug.Stack()}}
+		close(ch)
+	}
+}
+
+// repanic re-raises the panic of a callback reported by
+// recover{CFind,CMove}Callback.
+func repanic(err error) {
+	if p, ok := err.(*PanicError); ok {
+		panic(p)
+	}
+}
@@ -0,0 +1,173 @@
+package netdicom
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomtag"
+	"github.com/grailbio/go-dicom/dicomuid"
+	"github.com/grailbio/go-netdicom/dimse"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startInterceptorTest starts a provider with the callbacks and interceptors
+// in "params", and connects a user with the given calling AE title.
+func startInterceptorTest(t *testing.T, params ServiceProviderParams, callingAETitle string) *ServiceUser {
+	p, err := NewServiceProvider(params, ":0")
+	require.NoError(t, err)
+	go p.Run()
+	su, err := NewServiceUser(ServiceUserParams{
+		CallingAETitle: callingAETitle,
+		SOPClasses:     []string{dicomuid.VerificationSOPClass, ctImageStorage, dicomuid.StudyRootQRFind},
+	})
+	require.NoError(t, err)
+	su.Connect(p.ListenAddr().String())
+	return su
+}
+
+func statusOf(t *testing.T, err error) dimse.StatusCode {
+	var statusErr *StatusError
+	require.True(t, errors.As(err, &statusErr), "error: %v", err)
+	return statusErr.Status.Status
+}
+
+func TestInterceptorChain(t *testing.T) {
+	var mu sync.Mutex
+	var calls []string
+	record := func(name string) ProviderInterceptor {
+		return func(ctx context.Context, req *ProviderRequest, next ProviderHandler) error {
+			mu.Lock()
+			calls = append(calls, name+":"+commandName(req.Command))
+			mu.Unlock()
+			return next(ctx, req)
+		}
+	}
+	authorize := func(ctx context.Context, req *ProviderRequest, next ProviderHandler) error {
+		if req.Conn.CallingAETitle != "GOOD" {
+			return &StatusError{Status: dimse.Status{Status: dimse.StatusNotAuthorized}}
+		}
+		return next(ctx, req)
+	}
+	var stored []string
+	params := ServiceProviderParams{
+		CEcho: func(ConnectionState) dimse.Status { return dimse.Success },
+		CStore: func(conn ConnectionState, transferSyntaxUID, sopClassUID, sopInstanceUID string, data []byte) dimse.Status {
+			mu.Lock()
+			stored = append(stored, sopInstanceUID)
+			mu.Unlock()
+			return dimse.Success
+		},
+		Interceptors: []ProviderInterceptor{record("a"), authorize, record("b")},
+	}
+
+	su := startInterceptorTest(t, params, "GOOD")
+	defer su.Release()
+	require.NoError(t, su.CEcho())
+	require.NoError(t, su.CStore(newCMoveDataSet(ctImageStorage, "1.2.3.1")))
+	assert.Equal(t, []string{"a:C-ECHO-RQ", "b:C-ECHO-RQ", "a:C-STORE-RQ", "b:C-STORE-RQ"}, calls)
+	assert.Equal(t, []string{"1.2.3.1"}, stored)
+
+	calls = nil
+	bad := startInterceptorTest(t, params, "BAD")
+	defer bad.Release()
+	err := bad.CStore(newCMoveDataSet(ctImageStorage, "1.2.3.2"))
+	assert.Equal(t, dimse.StatusNotAuthorized, statusOf(t, err))
+	assert.Equal(t, []string{"a:C-STORE-RQ"}, calls)
+	assert.Equal(t, []string{"1.2.3.1"}, stored)
+}
+
+func TestInterceptorRewritesPayload(t *testing.T) {
+	var patientIDs []string
+	params := ServiceProviderParams{
+		CFind: func(conn ConnectionState, transferSyntaxUID, sopClassUID string, filters []*dicom.Element, ch chan CFindResult) {
+			for _, elem := range filters {
+				if elem.Tag == dicomtag.PatientID {
+					patientIDs = append(patientIDs, elem.MustGetString())
+				}
+			}
+			close(ch)
+		},
+		Interceptors: []ProviderInterceptor{
+			func(ctx context.Context, req *ProviderRequest, next ProviderHandler) error {
+				elems, err := readElementsInBytes(req.Data, req.TransferSyntaxUID)
+				if err != nil {
+					return err
+				}
+				for i, elem := range elems {
+					if elem.Tag == dicomtag.PatientID {
+						elems[i] = dicom.MustNewElement(dicomtag.PatientID, "SITE-"+elem.MustGetString())
+					}
+				}
+				if req.Data, err = writeElementsToBytes(elems, req.TransferSyntaxUID, 0); err != nil {
+					return err
+				}
+				return next(ctx, req)
+			},
+		},
+	}
+	su := startInterceptorTest(t, params, "GOOD")
+	defer su.Release()
+	for result := range su.CFind(QRLevelStudy, []*dicom.Element{dicom.MustNewElement(dicomtag.PatientID, "P1")}) {
+		require.NoError(t, result.Err)
+	}
+	assert.Equal(t, []string{"SITE-P1"}, patientIDs)
+}
+
+func TestRecoveryInterceptor(t *testing.T) {
+	var mu sync.Mutex
+	var panics []*PanicError
+	params := ServiceProviderParams{
+		CStore: func(conn ConnectionState, transferSyntaxUID, sopClassUID, sopInstanceUID string, data []byte) dimse.Status {
+			if sopInstanceUID == "1.2.3.1" {
+				panic("cstore")
+			}
+			return dimse.Success
+		},
+		CFind: func(conn ConnectionState, transferSyntaxUID, sopClassUID string, filters []*dicom.Element, ch chan CFindResult) {
+			ch <- CFindResult{Elements: []*dicom.Element{dicom.MustNewElement(dicomtag.StudyInstanceUID, "1.2.3")}}
+			panic("cfind")
+		},
+		Interceptors: []ProviderInterceptor{
+			func(ctx context.Context, req *ProviderRequest, next ProviderHandler) error {
+				err := next(ctx, req)
+				if p, ok := err.(*PanicError); ok {
+					mu.Lock()
+					panics = append(panics, p)
+					mu.Unlock()
+				}
+				return err
+			},
+			RecoveryInterceptor,
+		},
+	}
+	su := startInterceptorTest(t, params, "GOOD")
+	defer su.Release()
+
+	err := su.CStore(newCMoveDataSet(ctImageStorage, "1.2.3.1"))
+	assert.Equal(t, dimse.CStoreCannotUnderstand, statusOf(t, err))
+
+	// A panic in the callback goroutine is reported after the matches sent
+	// so far.
+	var matches int
+	var errs []error
+	for result := range su.CFind(QRLevelStudy, []*dicom.Element{dicom.MustNewElement(dicomtag.StudyInstanceUID, "")}) {
+		if result.Err != nil {
+			errs = append(errs, result.Err)
+		} else if len(result.Elements) > 0 {
+			matches++
+		}
+	}
+	assert.Equal(t, 1, matches)
+	assert.Equal(t, 1, len(errs))
+
+	// The association survives.
+	require.NoError(t, su.CStore(newCMoveDataSet(ctImageStorage, "1.2.3.2")))
+	require.Equal(t, 2, len(panics))
+	assert.Equal(t, "cstore", panics[0].Value)
+	assert.Equal(t, "cfind", panics[1].Value)
+	assert.Contains(t, string(panics[1].Stack), "TestRecoveryInterceptor")
+}
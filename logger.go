@@ -0,0 +1,176 @@
+package netdicom
+
+// This file defines the logging interface used by ServiceUser and
+// ServiceProvider.
+
+import (
+	"fmt"
+	"strings"
+
+	dicom "github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomlog"
+	"github.com/grailbio/go-netdicom/dimse"
+)
+
+// Logger receives structured log entries. The args are alternating key/value
+// pairs, following the convention of log/slog; a *slog.Logger can be passed
+// as-is.
+type Logger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+// DebugEnabler is an optional interface of a Logger. If DebugEnabled returns
+// false, the Debug entries that are costly to build, such as those of every
+// statemachine step, are skipped. Loggers that don't implement it receive all
+// the Debug entries.
+type DebugEnabler interface {
+	DebugEnabled() bool
+}
+
+// Keys of the attributes attached to log entries.
+const (
+	LogKeyAssociation = "assoc"       // Unique ID of the association, e.g., "user-34".
+	LogKeyCallingAE   = "calling_ae"  // AE title of the association requestor.
+	LogKeyCalledAE    = "called_ae"   // AE title of the association acceptor.
+	LogKeyRemoteAddr  = "remote_addr" // Network address of the peer.
+	LogKeyState       = "state"       // Statemachine state, e.g., "sta06".
+	LogKeyEvent       = "event"       // Statemachine event, e.g., "evt09".
+	LogKeyMessageID   = "message_id"  // DIMSE message ID.
+	LogKeyCommand     = "command"     // DIMSE command, e.g., "C-STORE-RQ".
+	LogKeyError       = "err"
+)
+
+// dicomlogLogger is the default Logger. It forwards entries to
+// dicomlog.Vprintf.  Error and Warn are logged at level 0, Info at level 1,
+// and Debug at level 2.
+//
+// Routine events that used to be logged at level 0 are now Info entries,
+// hence need level 1: accepted and finished connections, C-ECHO requests,
+// and the datasets sent by C-GET and C-MOVE.
+type dicomlogLogger struct{}
+
+func (dicomlogLogger) DebugEnabled() bool { return dicomlog.Level() >= 2 }
+
+func (dicomlogLogger) Debug(msg string, args ...interface{}) {
+	dicomlog.Vprintf(2, "%s", formatLogEntry(msg, args))
+}
+
+func (dicomlogLogger) Info(msg string, args ...interface{}) {
+	dicomlog.Vprintf(1, "%s", formatLogEntry(msg, args))
+}
+
+func (dicomlogLogger) Warn(msg string, args ...interface{}) {
+	dicomlog.Vprintf(0, "%s", formatLogEntry(msg, args))
+}
+
+func (dicomlogLogger) Error(msg string, args ...interface{}) {
+	dicomlog.Vprintf(0, "%s", formatLogEntry(msg, args))
+}
+
+// DefaultLogger returns the Logger used when none is configured. It forwards
+// entries to dicomlog, as described in dicomlogLogger.
+func DefaultLogger() Logger { return dicomlogLogger{} }
+
+// formatLogEntry produces "msg key1=value1 key2=value2 ...".
+func formatLogEntry(msg string, args []interface{}) string {
+	var b strings.Builder
+	b.WriteString(msg)
+	for i := 0; i < len(args); i += 2 {
+		if i+1 >= len(args) {
+			fmt.Fprintf(&b, " !BADKEY=%v", args[i])
+			break
+		}
+		fmt.Fprintf(&b, " %v=%v", args[i], args[i+1])
+	}
+	return b.String()
+}
+
+// logger is a Logger bound to a list of attributes that are added to every
+// entry. It is immutable; with() creates a new logger.
+type logger struct {
+	out       Logger
+	redaction *RedactionPolicy
+	attrs     []interface{}
+}
+
+// newLogger creates a logger that writes to "out". If out==nil, entries are
+// sent to dicomlog. DICOM elements are rendered through "redaction", which
+// may be nil.
+func newLogger(out Logger, redaction *RedactionPolicy, attrs ...interface{}) *logger {
+	if out == nil {
+		out = dicomlogLogger{}
+	}
+	return &logger{out: out, redaction: redaction, attrs: attrs}
+}
+
+// with returns a logger that adds "attrs" to every entry, in addition to the
+// ones in l.
+func (l *logger) with(attrs ...interface{}) *logger {
+	newAttrs := make([]interface{}, 0, len(l.attrs)+len(attrs))
+	newAttrs = append(newAttrs, l.attrs...)
+	newAttrs = append(newAttrs, attrs...)
+	return &logger{out: l.out, redaction: l.redaction, attrs: newAttrs}
+}
+
+func (l *logger) args(args []interface{}) []interface{} {
+	if len(l.attrs) == 0 {
+		return args
+	}
+	all := make([]interface{}, 0, len(l.attrs)+len(args))
+	all = append(all, l.attrs...)
+	return append(all, args...)
+}
+
+// debugEnabled reports whether Debug entries are wanted. See DebugEnabler.
+func (l *logger) debugEnabled() bool {
+	if e, ok := l.out.(DebugEnabler); ok {
+		return e.DebugEnabled()
+	}
+	return true
+}
+
+func (l *logger) debug(msg string, args ...interface{}) { l.out.Debug(msg, l.args(args)...) }
+func (l *logger) info(msg string, args ...interface{})  { l.out.Info(msg, l.args(args)...) }
+func (l *logger) warn(msg string, args ...interface{})  { l.out.Warn(msg, l.args(args)...) }
+func (l *logger) error(msg string, args ...interface{}) { l.out.Error(msg, l.args(args)...) }
+
+// elementString renders "elem" per the redaction policy.
+func (l *logger) elementString(elem *dicom.Element) string {
+	return l.redaction.ElementString(elem)
+}
+
+// elementsString renders "elems" per the redaction policy.
+func (l *logger) elementsString(elems []*dicom.Element) string {
+	return l.redaction.ElementsString(elems)
+}
+
+// commandName returns a short human-readable name of a DIMSE message, e.g.,
+// "C-STORE-RQ".
+func commandName(msg dimse.Message) string {
+	switch msg.(type) {
+	case *dimse.CStoreRq:
+		return "C-STORE-RQ"
+	case *dimse.CStoreRsp:
+		return "C-STORE-RSP"
+	case *dimse.CFindRq:
+		return "C-FIND-RQ"
+	case *dimse.CFindRsp:
+		return "C-FIND-RSP"
+	case *dimse.CGetRq:
+		return "C-GET-RQ"
+	case *dimse.CGetRsp:
+		return "C-GET-RSP"
+	case *dimse.CMoveRq:
+		return "C-MOVE-RQ"
+	case *dimse.CMoveRsp:
+		return "C-MOVE-RSP"
+	case *dimse.CEchoRq:
+		return "C-ECHO-RQ"
+	case *dimse.CEchoRsp:
+		return "C-ECHO-RSP"
+	}
+	return fmt.Sprintf("command-0x%x", msg.CommandField())
+}
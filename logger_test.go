@@ -0,0 +1,140 @@
+package netdicom
+
+import (
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/grailbio/go-netdicom/dimse"
+	"github.com/grailbio/go-netdicom/sopclass"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type logEntry struct {
+	level string
+	msg   string
+	attrs map[string]interface{}
+}
+
+// recordingLogger is a Logger that keeps the entries in memory.
+type recordingLogger struct {
+	debug bool
+
+	mu      sync.Mutex
+	entries []logEntry
+}
+
+func (l *recordingLogger) add(level, msg string, args []interface{}) {
+	e := logEntry{level: level, msg: msg, attrs: map[string]interface{}{}}
+	for i := 0; i+1 < len(args); i += 2 {
+		e.attrs[args[i].(string)] = args[i+1]
+	}
+	l.mu.Lock()
+	l.entries = append(l.entries, e)
+	l.mu.Unlock()
+}
+
+func (l *recordingLogger) Debug(msg string, args ...interface{}) { l.add("debug", msg, args) }
+func (l *recordingLogger) Info(msg string, args ...interface{})  { l.add("info", msg, args) }
+func (l *recordingLogger) Warn(msg string, args ...interface{})  { l.add("warn", msg, args) }
+func (l *recordingLogger) Error(msg string, args ...interface{}) { l.add("error", msg, args) }
+func (l *recordingLogger) DebugEnabled() bool                    { return l.debug }
+
+// find returns the entries with the message, or all of them if msg=="".
+func (l *recordingLogger) find(msg string) []logEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var entries []logEntry
+	for _, e := range l.entries {
+		if msg == "" || e.msg == msg {
+			entries = append(entries, e)
+		}
+	}
+	return entries
+}
+
+// runEchoWithLoggers runs a C-ECHO between a user and a provider that log to
+// the given loggers.
+func runEchoWithLoggers(t *testing.T, userLog, providerLog Logger) {
+	serverConn, clientConn := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		RunProviderForConn(serverConn, ServiceProviderParams{
+			AETitle: "PROVIDER",
+			Logger:  providerLog,
+			CEcho:   func(ConnectionState) dimse.Status { return dimse.Success },
+		})
+		close(done)
+	}()
+	su, err := NewServiceUser(ServiceUserParams{
+		CalledAETitle:  "PROVIDER",
+		CallingAETitle: "USER",
+		SOPClasses:     sopclass.VerificationClasses,
+		Logger:         userLog,
+	})
+	require.NoError(t, err)
+	su.SetConn(clientConn)
+	require.NoError(t, su.CEcho())
+	su.Release()
+	<-done
+}
+
+func TestLogger(t *testing.T) {
+	userLog := &recordingLogger{debug: true}
+	providerLog := &recordingLogger{debug: true}
+	runEchoWithLoggers(t, userLog, providerLog)
+
+	// Every entry identifies the association.
+	for _, l := range []*recordingLogger{userLog, providerLog} {
+		entries := l.find("")
+		require.NotEmpty(t, entries)
+		for _, e := range entries {
+			assert.NotEmpty(t, e.attrs[LogKeyAssociation], "entry: %+v", e)
+		}
+	}
+
+	// The statemachine steps carry the state and the event.
+	steps := providerLog.find("Received event")
+	require.NotEmpty(t, steps)
+	assert.Equal(t, "debug", steps[0].level)
+	assert.Equal(t, "sta02", steps[0].attrs[LogKeyState])
+	assert.Equal(t, "evt06", steps[0].attrs[LogKeyEvent])
+
+	// Once the association is established, entries carry the AE titles,
+	// and the DIMSE messages their IDs.
+	var found bool
+	for _, e := range providerLog.find("Received DIMSE message") {
+		if e.attrs[LogKeyCommand] == "C-ECHO-RQ" {
+			found = true
+			assert.NotNil(t, e.attrs[LogKeyMessageID])
+			assert.Equal(t, "USER", e.attrs[LogKeyCallingAE])
+			assert.Equal(t, "PROVIDER", e.attrs[LogKeyCalledAE])
+		}
+	}
+	assert.True(t, found)
+	echo := providerLog.find("Received C-ECHO request")
+	require.Equal(t, 1, len(echo))
+	assert.Equal(t, "info", echo[0].level)
+	assert.NotNil(t, echo[0].attrs[LogKeyMessageID])
+}
+
+func TestLoggerDebugDisabled(t *testing.T) {
+	userLog := &recordingLogger{}
+	providerLog := &recordingLogger{}
+	runEchoWithLoggers(t, userLog, providerLog)
+	for _, l := range []*recordingLogger{userLog, providerLog} {
+		// The per-message entries, whose details are costly to format,
+		// are skipped too.
+		for _, msg := range []string{"Received event", "Next state", "Send DIMSE message", "Received DIMSE message",
+			"Sending DIMSE message", "Sent PDU", "Read PDU"} {
+			assert.Empty(t, l.find(msg), msg)
+		}
+	}
+	assert.Equal(t, 1, len(providerLog.find("Received C-ECHO request")))
+}
+
+func TestFormatLogEntry(t *testing.T) {
+	assert.Equal(t, "msg a=1 b=x", formatLogEntry("msg", []interface{}{"a", 1, "b", "x"}))
+	assert.Equal(t, "msg a=1 !BADKEY=b", formatLogEntry("msg", []interface{}{"a", 1, "b"}))
+}
@@ -0,0 +1,117 @@
+package netdicom
+
+// This file defines the interface for collecting metrics from ServiceUser and
+// ServiceProvider.
+
+import (
+	"strings"
+	"time"
+
+	"github.com/grailbio/go-netdicom/dimse"
+	"github.com/grailbio/go-netdicom/pdu"
+)
+
+// AssociationEvent describes how an association started or ended.
+type AssociationEvent int
+
+const (
+	// AssociationOpened is reported when A-ASSOCIATE-AC is sent (provider)
+	// or received (user).
+	AssociationOpened AssociationEvent = iota
+	// AssociationRejected is reported when A-ASSOCIATE-RJ is sent or
+	// received.
+	AssociationRejected
+	// AssociationAborted is reported when the association is aborted by
+	// either peer, or the connection is lost before release.
+	AssociationAborted
+	// AssociationReleased is reported when the association is released
+	// normally.
+	AssociationReleased
+)
+
+func (e AssociationEvent) String() string {
+	switch e {
+	case AssociationOpened:
+		return "opened"
+	case AssociationRejected:
+		return "rejected"
+	case AssociationAborted:
+		return "aborted"
+	case AssociationReleased:
+		return "released"
+	}
+	return "unknown"
+}
+
+// PDUDirection is the direction of a PDU, relative to the local AE.
+type PDUDirection int
+
+const (
+	// PDUSent is a PDU sent to the peer.
+	PDUSent PDUDirection = iota
+	// PDUReceived is a PDU received from the peer.
+	PDUReceived
+)
+
+func (d PDUDirection) String() string {
+	if d == PDUSent {
+		return "sent"
+	}
+	return "received"
+}
+
+// MetricsObserver receives counters and timings from ServiceUser and
+// ServiceProvider. The methods are called synchronously from the goroutines
+// that run the associations, so they must be cheap and thread safe.
+//
+// Package github.com/grailbio/go-netdicom/metrics provides an implementation
+// that exports the values in the Prometheus format.
+type MetricsObserver interface {
+	// ObserveAssociation is called with AssociationOpened when an
+	// association is established, then with one of the other events when it
+	// ends. A rejected association reports only AssociationRejected.
+	ObserveAssociation(event AssociationEvent)
+
+	// ObservePDU is called for every PDU sent or received. "bytes" includes
+	// the 6-byte PDU header.
+	ObservePDU(dir PDUDirection, pduType pdu.Type, bytes int)
+
+	// ObserveDIMSEInFlight is called with delta=1 when a DIMSE operation
+	// (e.g., "C-FIND") starts, and with delta=-1 when it ends, with or
+	// without a final response.
+	ObserveDIMSEInFlight(op string, delta int)
+
+	// ObserveDIMSE is called when the final (non-pending) response of an
+	// operation is sent or received. "elapsed" is the time since the
+	// request.
+	ObserveDIMSE(op string, status dimse.StatusCode, elapsed time.Duration)
+
+	// ObserveSubOperations is called with the sub-operation counts in the
+	// final response of a C-MOVE or C-GET.
+	ObserveSubOperations(op string, completed, failed, warning int)
+}
+
+// nopMetricsObserver is used when the application doesn't set a
+// MetricsObserver.
+type nopMetricsObserver struct{}
+
+func (nopMetricsObserver) ObserveAssociation(AssociationEvent)                  {}
+func (nopMetricsObserver) ObservePDU(PDUDirection, pdu.Type, int)               {}
+func (nopMetricsObserver) ObserveDIMSEInFlight(string, int)                     {}
+func (nopMetricsObserver) ObserveDIMSE(string, dimse.StatusCode, time.Duration) {}
+func (nopMetricsObserver) ObserveSubOperations(string, int, int, int)           {}
+
+func metricsObserverOrDefault(m MetricsObserver) MetricsObserver {
+	if m == nil {
+		return nopMetricsObserver{}
+	}
+	return m
+}
+
+// operationName returns the name of the DIMSE operation "msg" belongs to,
+// e.g., "C-STORE" for both C-STORE-RQ and C-STORE-RSP.
+func operationName(msg dimse.Message) string {
+	name := commandName(msg)
+	name = strings.TrimSuffix(name, "-RQ")
+	return strings.TrimSuffix(name, "-RSP")
+}
@@ -0,0 +1,237 @@
+// Package metrics provides a netdicom.MetricsObserver that keeps counters in
+// memory and exports them in the Prometheus text exposition format.
+//
+// Example:
+//
+//	m := metrics.NewObserver("dicom")
+//	http.Handle("/metrics", m)
+//	params := netdicom.ServiceProviderParams{
+//	  ...
+//	  Metrics: m,
+//	}
+//
+// The exported metrics are (assuming namespace "dicom"):
+//
+//	dicom_associations_total{event}                 opened, rejected, aborted, released.
+//	dicom_pdus_total{direction,type}                PDUs sent and received.
+//	dicom_pdu_bytes_total{direction,type}           Bytes sent and received, including PDU headers.
+//	dicom_dimse_operations_total{op,status}         Completed operations; status is a hex code, e.g., "A700".
+//	dicom_dimse_operation_duration_seconds{op}      Histogram of operation latencies.
+//	dicom_dimse_operations_in_flight{op}            Operations currently running.
+//	dicom_dimse_suboperations_total{op,result}      C-MOVE and C-GET sub-operations; completed, failed, warning.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grailbio/go-netdicom"
+	"github.com/grailbio/go-netdicom/dimse"
+	"github.com/grailbio/go-netdicom/pdu"
+)
+
+// DefaultDurationBuckets are the upper bounds, in seconds, of the operation
+// latency histogram.
+var DefaultDurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// Observer implements netdicom.MetricsObserver and http.Handler. It is thread
+// safe.
+type Observer struct {
+	namespace string
+	buckets   []float64
+
+	mu           sync.Mutex
+	associations *vec
+	pdus         *vec
+	pduBytes     *vec
+	operations   *vec
+	inFlight     *vec
+	subOps       *vec
+	durations    map[string]*histogram // keyed by op.
+}
+
+var _ netdicom.MetricsObserver = (*Observer)(nil)
+
+// NewObserver creates a new Observer. "namespace" is prefixed to the metric
+// names, e.g., "dicom" produces "dicom_associations_total". It may be empty.
+func NewObserver(namespace string) *Observer {
+	if namespace != "" {
+		namespace += "_"
+	}
+	return &Observer{
+		namespace:    namespace,
+		buckets:      DefaultDurationBuckets,
+		associations: newVec("associations_total", "counter", "Number of associations, by how they started or ended.", "event"),
+		pdus:         newVec("pdus_total", "counter", "Number of PDUs sent and received.", "direction", "type"),
+		pduBytes:     newVec("pdu_bytes_total", "counter", "Number of bytes sent and received, including PDU headers.", "direction", "type"),
+		operations:   newVec("dimse_operations_total", "counter", "Number of completed DIMSE operations, by final status.", "op", "status"),
+		inFlight:     newVec("dimse_operations_in_flight", "gauge", "Number of DIMSE operations running.", "op"),
+		subOps:       newVec("dimse_suboperations_total", "counter", "Number of C-MOVE and C-GET sub-operations.", "op", "result"),
+		durations:    map[string]*histogram{},
+	}
+}
+
+// ObserveAssociation implements netdicom.MetricsObserver.
+func (o *Observer) ObserveAssociation(event netdicom.AssociationEvent) {
+	o.mu.Lock()
+	o.associations.add(1, event.String())
+	o.mu.Unlock()
+}
+
+// ObservePDU implements netdicom.MetricsObserver.
+func (o *Observer) ObservePDU(dir netdicom.PDUDirection, pduType pdu.Type, bytes int) {
+	typeName := pduTypeName(pduType)
+	o.mu.Lock()
+	o.pdus.add(1, dir.String(), typeName)
+	o.pduBytes.add(float64(bytes), dir.String(), typeName)
+	o.mu.Unlock()
+}
+
+// ObserveDIMSEInFlight implements netdicom.MetricsObserver.
+func (o *Observer) ObserveDIMSEInFlight(op string, delta int) {
+	o.mu.Lock()
+	o.inFlight.add(float64(delta), op)
+	o.mu.Unlock()
+}
+
+// ObserveDIMSE implements netdicom.MetricsObserver.
+func (o *Observer) ObserveDIMSE(op string, status dimse.StatusCode, elapsed time.Duration) {
+	o.mu.Lock()
+	o.operations.add(1, op, fmt.Sprintf("%04X", uint16(status)))
+	h, ok := o.durations[op]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(o.buckets))}
+		o.durations[op] = h
+	}
+	h.observe(o.buckets, elapsed.Seconds())
+	o.mu.Unlock()
+}
+
+// ObserveSubOperations implements netdicom.MetricsObserver.
+func (o *Observer) ObserveSubOperations(op string, completed, failed, warning int) {
+	o.mu.Lock()
+	o.subOps.add(float64(completed), op, "completed")
+	o.subOps.add(float64(failed), op, "failed")
+	o.subOps.add(float64(warning), op, "warning")
+	o.mu.Unlock()
+}
+
+// ServeHTTP writes the metrics in the Prometheus text format.
+func (o *Observer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if err := o.Write(w); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// Write writes the metrics in the Prometheus text format.
+func (o *Observer) Write(out io.Writer) error {
+	w := bufio.NewWriter(out)
+	o.mu.Lock()
+	for _, v := range []*vec{o.associations, o.pdus, o.pduBytes, o.operations, o.inFlight, o.subOps} {
+		v.write(w, o.namespace)
+	}
+	o.writeDurations(w)
+	o.mu.Unlock()
+	return w.Flush()
+}
+
+// REQUIRES: o.mu is locked.
+func (o *Observer) writeDurations(w io.Writer) {
+	name := o.namespace + "dimse_operation_duration_seconds"
+	fmt.Fprintf(w, "# HELP %s Latency of DIMSE operations.\n", name)
+	fmt.Fprintf(w, "# TYPE %s histogram\n", name)
+	var ops []string
+	for op := range o.durations {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+	for _, op := range ops {
+		h := o.durations[op]
+		var cum uint64
+		for i, bound := range o.buckets {
+			cum += h.counts[i]
+			fmt.Fprintf(w, "%s_bucket{op=%q,le=\"%g\"} %d\n", name, op, bound, cum)
+		}
+		fmt.Fprintf(w, "%s_bucket{op=%q,le=\"+Inf\"} %d\n", name, op, h.count)
+		fmt.Fprintf(w, "%s_sum{op=%q} %g\n", name, op, h.sum)
+		fmt.Fprintf(w, "%s_count{op=%q} %d\n", name, op, h.count)
+	}
+}
+
+// vec is a set of counters or gauges that share a name and the label names.
+type vec struct {
+	name, kind, help string
+	labels           []string
+	values           map[string]float64 // keyed by label values joined by "\x00".
+}
+
+func newVec(name, kind, help string, labels ...string) *vec {
+	return &vec{name: name, kind: kind, help: help, labels: labels, values: map[string]float64{}}
+}
+
+func (v *vec) add(delta float64, labelValues ...string) {
+	v.values[strings.Join(labelValues, "\x00")] += delta
+}
+
+func (v *vec) write(w io.Writer, namespace string) {
+	name := namespace + v.name
+	fmt.Fprintf(w, "# HELP %s %s\n", name, v.help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, v.kind)
+	var keys []string
+	for k := range v.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		labelValues := strings.Split(k, "\x00")
+		pairs := make([]string, len(v.labels))
+		for i, l := range v.labels {
+			pairs[i] = fmt.Sprintf("%s=%q", l, labelValues[i])
+		}
+		fmt.Fprintf(w, "%s{%s} %g\n", name, strings.Join(pairs, ","), v.values[k])
+	}
+}
+
+type histogram struct {
+	counts []uint64 // counts[i] is the number of samples in (buckets[i-1], buckets[i]].
+	count  uint64
+	sum    float64
+}
+
+func (h *histogram) observe(buckets []float64, v float64) {
+	h.count++
+	h.sum += v
+	for i, bound := range buckets {
+		if v <= bound {
+			h.counts[i]++
+			return
+		}
+	}
+}
+
+func pduTypeName(t pdu.Type) string {
+	switch t {
+	case pdu.TypeAAssociateRq:
+		return "A-ASSOCIATE-RQ"
+	case pdu.TypeAAssociateAc:
+		return "A-ASSOCIATE-AC"
+	case pdu.TypeAAssociateRj:
+		return "A-ASSOCIATE-RJ"
+	case pdu.TypePDataTf:
+		return "P-DATA-TF"
+	case pdu.TypeAReleaseRq:
+		return "A-RELEASE-RQ"
+	case pdu.TypeAReleaseRp:
+		return "A-RELEASE-RP"
+	case pdu.TypeAAbort:
+		return "A-ABORT"
+	}
+	return fmt.Sprintf("0x%02x", byte(t))
+}
@@ -0,0 +1,100 @@
+package metrics_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	dicom "github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomtag"
+	"github.com/grailbio/go-netdicom"
+	"github.com/grailbio/go-netdicom/dimse"
+	"github.com/grailbio/go-netdicom/metrics"
+	"github.com/grailbio/go-netdicom/netdicomtest"
+	"github.com/grailbio/go-netdicom/pdu"
+	"github.com/grailbio/go-netdicom/sopclass"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestObserver(t *testing.T) {
+	m := metrics.NewObserver("dicom")
+	m.ObserveAssociation(netdicom.AssociationOpened)
+	m.ObserveAssociation(netdicom.AssociationReleased)
+	m.ObservePDU(netdicom.PDUSent, pdu.TypePDataTf, 100)
+	m.ObservePDU(netdicom.PDUSent, pdu.TypePDataTf, 50)
+	m.ObserveDIMSEInFlight("C-MOVE", 1)
+	m.ObserveDIMSEInFlight("C-MOVE", -1)
+	m.ObserveDIMSE("C-MOVE", dimse.StatusCode(0xa700), 30*time.Millisecond)
+	m.ObserveSubOperations("C-MOVE", 3, 1, 0)
+
+	var buf bytes.Buffer
+	require.NoError(t, m.Write(&buf))
+	out := buf.String()
+	assert.Contains(t, out, `dicom_associations_total{event="opened"} 1`)
+	assert.Contains(t, out, `dicom_associations_total{event="released"} 1`)
+	assert.Contains(t, out, `dicom_pdus_total{direction="sent",type="P-DATA-TF"} 2`)
+	assert.Contains(t, out, `dicom_pdu_bytes_total{direction="sent",type="P-DATA-TF"} 150`)
+	assert.Contains(t, out, `dicom_dimse_operations_total{op="C-MOVE",status="A700"} 1`)
+	assert.Contains(t, out, `dicom_dimse_operations_in_flight{op="C-MOVE"} 0`)
+	assert.Contains(t, out, `dicom_dimse_suboperations_total{op="C-MOVE",result="completed"} 3`)
+	assert.Contains(t, out, `dicom_dimse_suboperations_total{op="C-MOVE",result="failed"} 1`)
+	assert.Contains(t, out, `dicom_dimse_operation_duration_seconds_bucket{op="C-MOVE",le="0.025"} 0`)
+	assert.Contains(t, out, `dicom_dimse_operation_duration_seconds_bucket{op="C-MOVE",le="0.05"} 1`)
+	assert.Contains(t, out, `dicom_dimse_operation_duration_seconds_count{op="C-MOVE"} 1`)
+}
+
+// metricsText returns the exported metrics.
+func metricsText(t *testing.T, m *metrics.Observer) string {
+	var buf bytes.Buffer
+	require.NoError(t, m.Write(&buf))
+	return buf.String()
+}
+
+// TestAssociation runs operations between a user and a fake PACS that report
+// to observers, and checks the counters of both sides.
+func TestAssociation(t *testing.T) {
+	userMetrics := metrics.NewObserver("dicom")
+	pacsMetrics := metrics.NewObserver("dicom")
+	pacs := netdicomtest.NewPACS(netdicomtest.Params{
+		AETitle:  "PACS",
+		Provider: func(params *netdicom.ServiceProviderParams) { params.Metrics = pacsMetrics },
+	})
+	require.NoError(t, pacs.AddFile("../testdata/reportsi.dcm"))
+	su := pacs.NewUser(t, netdicom.ServiceUserParams{
+		SOPClasses: append(append([]string{}, sopclass.QRFindClasses...), sopclass.StorageClasses...),
+		Metrics:    userMetrics,
+	})
+	require.NoError(t, su.CStore(netdicomtest.ReadDataSet(t, "../testdata/IM-0001-0003.dcm")))
+	var n int
+	for result := range su.CFind(netdicom.QRLevelStudy, []*dicom.Element{dicom.MustNewElement(dicomtag.PatientName, "*")}) {
+		require.NoError(t, result.Err)
+		if len(result.Elements) > 0 {
+			n++
+		}
+	}
+	require.Equal(t, 1, n)
+	su.Release()
+
+	for _, m := range []*metrics.Observer{userMetrics, pacsMetrics} {
+		// The associations end asynchronously.
+		deadline := time.Now().Add(5 * time.Second)
+		for !strings.Contains(metricsText(t, m), `dicom_associations_total{event="released"} 1`) {
+			require.True(t, time.Now().Before(deadline), metricsText(t, m))
+			time.Sleep(time.Millisecond)
+		}
+		out := metricsText(t, m)
+		assert.Contains(t, out, `dicom_associations_total{event="opened"} 1`)
+		assert.Contains(t, out, `dicom_pdus_total{direction="sent",type="P-DATA-TF"}`)
+		assert.Contains(t, out, `dicom_pdus_total{direction="received",type="P-DATA-TF"}`)
+		assert.Contains(t, out, `dicom_dimse_operations_total{op="C-STORE",status="0000"} 1`)
+		assert.Contains(t, out, `dicom_dimse_operations_total{op="C-FIND",status="0000"} 1`)
+		assert.Contains(t, out, `dicom_dimse_operations_in_flight{op="C-STORE"} 0`)
+		assert.Contains(t, out, `dicom_dimse_operations_in_flight{op="C-FIND"} 0`)
+		assert.Contains(t, out, `dicom_dimse_operation_duration_seconds_count{op="C-STORE"} 1`)
+		assert.Contains(t, out, `dicom_dimse_operation_duration_seconds_count{op="C-FIND"} 1`)
+	}
+	assert.Contains(t, metricsText(t, userMetrics), `dicom_pdus_total{direction="sent",type="A-ASSOCIATE-RQ"} 1`)
+	assert.Contains(t, metricsText(t, pacsMetrics), `dicom_pdus_total{direction="received",type="A-ASSOCIATE-RQ"} 1`)
+}
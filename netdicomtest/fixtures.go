@@ -0,0 +1,169 @@
+package netdicomtest
+
+// This file holds the fixtures shared by tests: starting a PACS, connecting a
+// ServiceUser to a provider, recording the transfer syntaxes proposed to a
+// provider, and rewriting datasets.
+
+import (
+	"bytes"
+	"net"
+	"sort"
+	"sync"
+	"testing"
+
+	dicom "github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomtag"
+	"github.com/grailbio/go-netdicom"
+	"github.com/grailbio/go-netdicom/pdu"
+)
+
+// StartPACS creates a PACS seeded with the datasets, and starts it with
+// Listen. It returns the PACS and its host:port. The PACS is closed when the
+// test ends.
+func StartPACS(t testing.TB, params Params, datasets ...*dicom.DataSet) (*PACS, string) {
+	t.Helper()
+	p := NewPACS(params)
+	for _, ds := range datasets {
+		if err := p.AddDataSet(ds); err != nil {
+			t.Fatal(err)
+		}
+	}
+	addr, err := p.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.Close() })
+	return p, addr
+}
+
+// NewUser creates a ServiceUser, and connects it over net.Pipe to a provider
+// that runs with "provider", e.g., the ProviderParams of a pacs.Server. The
+// caller must Release the user.
+func NewUser(t testing.TB, user netdicom.ServiceUserParams, provider netdicom.ServiceProviderParams) *netdicom.ServiceUser {
+	t.Helper()
+	su, err := netdicom.NewServiceUser(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConn, clientConn := net.Pipe()
+	go netdicom.RunProviderForConn(serverConn, provider)
+	su.SetConn(clientConn)
+	return su
+}
+
+// NewUser creates a ServiceUser, and connects it to the PACS with Pipe. If
+// empty, user.CalledAETitle is set to the AE title of the PACS. The caller
+// must Release the user.
+func (p *PACS) NewUser(t testing.TB, user netdicom.ServiceUserParams) *netdicom.ServiceUser {
+	t.Helper()
+	if user.CalledAETitle == "" {
+		user.CalledAETitle = p.params.AETitle
+	}
+	su, err := netdicom.NewServiceUser(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	su.SetConn(p.Pipe())
+	return su
+}
+
+// ProposalTap is a netdicom.WireTap that records the transfer syntaxes
+// proposed in each A-ASSOCIATE-RQ received by a provider. Set
+// ServiceProviderParams.WireTap to its Factory method.
+type ProposalTap struct {
+	mu        sync.Mutex
+	proposals [][]string
+}
+
+// Factory is a netdicom.WireTapFactory that returns the tap.
+func (tap *ProposalTap) Factory(info netdicom.WireTapInfo) (netdicom.WireTap, error) {
+	return tap, nil
+}
+
+// TapPDU implements netdicom.WireTap.
+func (tap *ProposalTap) TapPDU(dir netdicom.PDUDirection, data []byte) {
+	if dir != netdicom.PDUReceived || pdu.Type(data[0]) != pdu.TypeAAssociateRq {
+		return
+	}
+	v, err := pdu.ReadPDU(bytes.NewReader(data), netdicom.DefaultMaxPDUSize)
+	if err != nil {
+		panic(err)
+	}
+	var transferSyntaxes []string
+	for _, item := range v.(*pdu.AAssociate).Items {
+		if pc, ok := item.(*pdu.PresentationContextItem); ok {
+			for _, sub := range pc.Items {
+				if ts, ok := sub.(*pdu.TransferSyntaxSubItem); ok {
+					transferSyntaxes = append(transferSyntaxes, ts.Name)
+				}
+			}
+		}
+	}
+	tap.mu.Lock()
+	tap.proposals = append(tap.proposals, transferSyntaxes)
+	tap.mu.Unlock()
+}
+
+// Close implements netdicom.WireTap.
+func (tap *ProposalTap) Close() error { return nil }
+
+// Proposals returns the transfer syntaxes proposed so far, per association,
+// in the order of the presentation contexts.
+func (tap *ProposalTap) Proposals() [][]string {
+	tap.mu.Lock()
+	defer tap.mu.Unlock()
+	return append([][]string(nil), tap.proposals...)
+}
+
+// ReadDataSet reads a DICOM file, and fails the test on error.
+func ReadDataSet(t testing.TB, path string) *dicom.DataSet {
+	t.Helper()
+	ds, err := dicom.ReadDataSetFromFile(path, dicom.ReadOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ds
+}
+
+// WithElements returns a copy of the dataset in which the elements replace
+// those of the same tags, or are added. "ds" isn't modified.
+func WithElements(ds *dicom.DataSet, elems ...*dicom.Element) *dicom.DataSet {
+	result := &dicom.DataSet{Elements: append([]*dicom.Element(nil), ds.Elements...)}
+	for _, elem := range elems {
+		found := false
+		for i, old := range result.Elements {
+			if old.Tag == elem.Tag {
+				result.Elements[i] = elem
+				found = true
+				break
+			}
+		}
+		if !found {
+			result.Elements = append(result.Elements, elem)
+		}
+	}
+	sort.SliceStable(result.Elements, func(i, j int) bool {
+		return result.Elements[i].Tag.Compare(result.Elements[j].Tag) < 0
+	})
+	return result
+}
+
+// WithUIDs returns a copy of the dataset with new study, series and SOP
+// instance UIDs, e.g., to seed a PACS with several instances made from one
+// file. The SOP instance UID also replaces MediaStorageSOPInstanceUID. An
+// empty UID is left unchanged. "ds" isn't modified.
+func WithUIDs(ds *dicom.DataSet, studyUID, seriesUID, instanceUID string) *dicom.DataSet {
+	var elems []*dicom.Element
+	if studyUID != "" {
+		elems = append(elems, dicom.MustNewElement(dicomtag.StudyInstanceUID, studyUID))
+	}
+	if seriesUID != "" {
+		elems = append(elems, dicom.MustNewElement(dicomtag.SeriesInstanceUID, seriesUID))
+	}
+	if instanceUID != "" {
+		elems = append(elems,
+			dicom.MustNewElement(dicomtag.MediaStorageSOPInstanceUID, instanceUID),
+			dicom.MustNewElement(dicomtag.SOPInstanceUID, instanceUID))
+	}
+	return WithElements(ds, elems...)
+}
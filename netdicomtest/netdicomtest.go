@@ -0,0 +1,387 @@
+// Package netdicomtest provides an in-memory fake PACS for testing code that
+// uses go-netdicom.
+//
+// The fake is seeded with DICOM files or datasets. It answers C-ECHO, C-FIND,
+// C-GET and C-MOVE from the seeded datasets, and records every C-STORE it
+// receives. A Script injects failures: rejecting associations, returning a
+// given status at the Nth operation, dropping the connection before an
+// operation or in the middle of a C-GET or C-MOVE, and delaying responses.
+//
+// StartPACS, NewUser, ProposalTap, WithUIDs and WithElements are fixtures for
+// tests that need a PACS, a ServiceUser connected to a provider, the transfer
+// syntaxes proposed to a provider, or variants of a test file.
+//
+// Example:
+//
+//	pacs := netdicomtest.NewPACS(netdicomtest.Params{AETitle: "PACS"})
+//	if err := pacs.AddFile("testdata/reportsi.dcm"); err != nil {
+//		...
+//	}
+//	su, err := netdicom.NewServiceUser(netdicom.ServiceUserParams{
+//		CalledAETitle:  "PACS",
+//		CallingAETitle: "SCU",
+//		SOPClasses:     sopclass.QRFindClasses})
+//	su.SetConn(pacs.Pipe())
+//	defer su.Release()
+//	for result := range su.CFind(netdicom.QRLevelStudy, filter) {
+//		...
+//	}
+package netdicomtest
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	dicom "github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomtag"
+	"github.com/grailbio/go-netdicom"
+	"github.com/grailbio/go-netdicom/dimse"
+	"github.com/grailbio/go-netdicom/pdu"
+	"github.com/grailbio/go-netdicom/qrmatch"
+)
+
+// Params configures a PACS.
+type Params struct {
+	// AETitle is the AE title of the PACS. If empty, "NETDICOMTEST" is used.
+	AETitle string
+
+	// RemoteAEs maps the AE titles of C-MOVE destinations to their
+	// host:ports. C-MOVE sub-operations always open a new TCP connection, so
+	// the destination must listen on a real port, e.g., another PACS started
+	// with Listen.
+	RemoteAEs map[string]string
+
+	// Provider, if non-nil, customizes the provider, whose AETitle, RemoteAEs
+	// and DIMSE callbacks are then set by the PACS.
+	Provider func(params *netdicom.ServiceProviderParams)
+}
+
+// Script lists the failures injected by a PACS. The zero value injects no
+// failures.
+//
+// Operations are numbered from 1 in the order the PACS receives them, across
+// all associations. C-ECHO, C-FIND, C-GET, C-MOVE and C-STORE requests count
+// as operations; the C-STORE sub-operations sent by the PACS don't.
+type Script struct {
+	// RejectAssociation makes the PACS reject every association with
+	// A-ASSOCIATE-RJ.
+	RejectAssociation bool
+
+	// FailOp, if > 0, makes the FailOp'th operation respond with FailStatus
+	// instead of running the operation. For C-FIND, C-GET and C-MOVE, the
+	// status is sent in the final response.
+	FailOp     int
+	FailStatus dimse.Status
+
+	// AbortOp, if > 0, makes the PACS close the connection without
+	// responding to the AbortOp'th operation, after it receives the
+	// request and its dataset.
+	AbortOp int
+
+	// AbortSubOps, if > 0, makes the PACS close the connection in the middle
+	// of each C-GET and C-MOVE, once it has started AbortSubOps C-STORE
+	// sub-operations, without sending the final response. The last
+	// sub-operation started may or may not complete.
+	AbortSubOps int
+
+	// Delay is slept before handling each operation.
+	Delay time.Duration
+}
+
+// Stored is a C-STORE request received by the PACS.
+type Stored struct {
+	TransferSyntaxUID string
+	SOPClassUID       string
+	SOPInstanceUID    string
+	// Data is the dataset, without the metadata (group 2) elements, encoded
+	// in TransferSyntaxUID.
+	Data []byte
+}
+
+// PACS is an in-memory fake PACS. It is safe for concurrent use.
+type PACS struct {
+	params Params
+
+	mu       sync.Mutex
+	script   Script
+	datasets []*dicom.DataSet
+	stored   []Stored
+	numOps   int
+	conns    map[net.Conn]bool
+	listener net.Listener
+}
+
+// NewPACS creates an empty PACS.
+func NewPACS(params Params) *PACS {
+	if params.AETitle == "" {
+		params.AETitle = "NETDICOMTEST"
+	}
+	return &PACS{params: params, conns: map[net.Conn]bool{}}
+}
+
+// AddFile reads the DICOM file and adds it to the PACS. The file must contain
+// the metadata elements, in particular MediaStorageSOPClassUID and
+// MediaStorageSOPInstanceUID, since C-GET and C-MOVE need them.
+func (p *PACS) AddFile(path string) error {
+	ds, err := dicom.ReadDataSetFromFile(path, dicom.ReadOptions{})
+	if err != nil {
+		return err
+	}
+	return p.AddDataSet(ds)
+}
+
+// AddDataSet adds the dataset to the PACS. See AddFile for the requirements.
+func (p *PACS) AddDataSet(ds *dicom.DataSet) error {
+	for _, tag := range []dicomtag.Tag{dicomtag.MediaStorageSOPClassUID, dicomtag.MediaStorageSOPInstanceUID} {
+		if _, err := ds.FindElementByTag(tag); err != nil {
+			return fmt.Errorf("netdicomtest.AddDataSet: %v: %v", dicomtag.DebugString(tag), err)
+		}
+	}
+	p.mu.Lock()
+	p.datasets = append(p.datasets, ds)
+	p.mu.Unlock()
+	return nil
+}
+
+// SetScript replaces the failure script. It also resets the operation count,
+// so Script.FailOp and Script.AbortOp count from the next operation.
+func (p *PACS) SetScript(script Script) {
+	p.mu.Lock()
+	p.script = script
+	p.numOps = 0
+	p.mu.Unlock()
+}
+
+// Stored returns the C-STORE requests received so far, in order.
+func (p *PACS) Stored() []Stored {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]Stored(nil), p.stored...)
+}
+
+// NumOps returns the number of operations received since the last SetScript.
+func (p *PACS) NumOps() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.numOps
+}
+
+// Pipe starts serving an association over net.Pipe, and returns the client
+// end. Pass it to netdicom.ServiceUser.SetConn.
+func (p *PACS) Pipe() net.Conn {
+	server, client := net.Pipe()
+	go p.ServeConn(server)
+	return client
+}
+
+// Listen starts serving on a loopback TCP port, and returns its host:port.
+// Call Close to stop.
+func (p *PACS) Listen() (string, error) {
+	return p.ListenAddr("127.0.0.1:0")
+}
+
+// ListenAddr is Listen on the given host:port. After Close, the PACS may
+// listen again, e.g., on the same port to simulate an AE that restarts.
+func (p *PACS) ListenAddr(hostPort string) (string, error) {
+	listener, err := net.Listen("tcp", hostPort)
+	if err != nil {
+		return "", err
+	}
+	p.mu.Lock()
+	p.listener = listener
+	p.mu.Unlock()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go p.ServeConn(conn)
+		}
+	}()
+	return listener.Addr().String(), nil
+}
+
+// Close stops the listener started by Listen, and closes all the open
+// connections.
+func (p *PACS) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var err error
+	if p.listener != nil {
+		err = p.listener.Close()
+		p.listener = nil
+	}
+	for conn := range p.conns {
+		conn.Close()
+	}
+	return err
+}
+
+// ServeConn runs one association over "conn". It blocks until the
+// association ends, and closes conn.
+func (p *PACS) ServeConn(conn net.Conn) {
+	p.mu.Lock()
+	p.conns[conn] = true
+	reject := p.script.RejectAssociation
+	p.mu.Unlock()
+	defer func() {
+		conn.Close()
+		p.mu.Lock()
+		delete(p.conns, conn)
+		p.mu.Unlock()
+	}()
+	if reject {
+		rejectAssociation(conn)
+		return
+	}
+	netdicom.RunProviderForConn(conn, p.providerParams(conn))
+}
+
+// rejectAssociation reads the A-ASSOCIATE-RQ and responds with
+// A-ASSOCIATE-RJ.
+func rejectAssociation(conn net.Conn) {
+	if _, err := pdu.ReadPDU(conn, netdicom.DefaultMaxPDUSize); err != nil {
+		return
+	}
+	data, err := pdu.EncodePDU(&pdu.AAssociateRj{
+		Result: pdu.ResultRejectedPermanent,
+		Source: pdu.SourceULServiceUser,
+		Reason: pdu.RejectReasonNone,
+	})
+	if err != nil {
+		panic(err)
+	}
+	conn.Write(data)
+}
+
+// opAction is what startOp decides to do with an operation.
+type opAction int
+
+const (
+	opRun opAction = iota
+	opFail
+	opAbort
+)
+
+// startOp counts a new operation and applies the script to it.
+func (p *PACS) startOp(conn net.Conn) (opAction, dimse.Status) {
+	p.mu.Lock()
+	p.numOps++
+	n := p.numOps
+	script := p.script
+	p.mu.Unlock()
+	if script.Delay > 0 {
+		time.Sleep(script.Delay)
+	}
+	switch n {
+	case script.AbortOp:
+		conn.Close()
+		return opAbort, dimse.Status{}
+	case script.FailOp:
+		return opFail, script.FailStatus
+	}
+	return opRun, dimse.Success
+}
+
+func (p *PACS) providerParams(conn net.Conn) netdicom.ServiceProviderParams {
+	var params netdicom.ServiceProviderParams
+	if p.params.Provider != nil {
+		p.params.Provider(&params)
+	}
+	params.AETitle = p.params.AETitle
+	params.RemoteAEs = p.params.RemoteAEs
+	params.CEcho = func(connState netdicom.ConnectionState) dimse.Status {
+		_, status := p.startOp(conn)
+		return status
+	}
+	params.CStore = func(connState netdicom.ConnectionState, transferSyntaxUID string,
+		sopClassUID string,
+		sopInstanceUID string,
+		data []byte) dimse.Status {
+		action, status := p.startOp(conn)
+		if action != opRun {
+			return status
+		}
+		p.mu.Lock()
+		p.stored = append(p.stored, Stored{
+			TransferSyntaxUID: transferSyntaxUID,
+			SOPClassUID:       sopClassUID,
+			SOPInstanceUID:    sopInstanceUID,
+			Data:              data,
+		})
+		p.mu.Unlock()
+		return dimse.Success
+	}
+	params.CFind = func(connState netdicom.ConnectionState, transferSyntaxUID string, sopClassUID string,
+		filters []*dicom.Element, ch chan netdicom.CFindResult) {
+		defer close(ch)
+		if action, status := p.startOp(conn); action != opRun {
+			ch <- netdicom.CFindResult{Err: &netdicom.StatusError{Status: status}}
+			return
+		}
+		matches, err := p.findMatches(filters)
+		if err != nil {
+			ch <- netdicom.CFindResult{Err: err}
+			return
+		}
+		for _, m := range matches {
+			ch <- netdicom.CFindResult{Elements: m.elems}
+		}
+	}
+	cmove := func(connState netdicom.ConnectionState, transferSyntaxUID string, sopClassUID string,
+		filters []*dicom.Element, ch chan netdicom.CMoveResult) {
+		defer close(ch)
+		if action, status := p.startOp(conn); action != opRun {
+			ch <- netdicom.CMoveResult{Err: &netdicom.StatusError{Status: status}}
+			return
+		}
+		matches, err := p.findMatches(filters)
+		if err != nil {
+			ch <- netdicom.CMoveResult{Err: err}
+			return
+		}
+		p.mu.Lock()
+		abortSubOps := p.script.AbortSubOps
+		p.mu.Unlock()
+		for i, m := range matches {
+			ch <- netdicom.CMoveResult{
+				Remaining: len(matches) - i - 1,
+				Path:      fmt.Sprintf("dataset%d", m.index),
+				DataSet:   m.ds,
+			}
+			if i+1 == abortSubOps {
+				conn.Close()
+				return
+			}
+		}
+	}
+	params.CGet = cmove
+	params.CMove = cmove
+	return params
+}
+
+type match struct {
+	index int // Index in PACS.datasets.
+	ds    *dicom.DataSet
+	elems []*dicom.Element // The identifier of the C-FIND response.
+}
+
+// findMatches returns the datasets that match all the filters.
+func (p *PACS) findMatches(filters []*dicom.Element) ([]match, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var matches []match
+	for i, ds := range p.datasets {
+		ok, err := qrmatch.Match(ds, filters)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			matches = append(matches, match{index: i, ds: ds, elems: qrmatch.Response(ds, filters)})
+		}
+	}
+	return matches, nil
+}
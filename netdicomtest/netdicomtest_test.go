@@ -0,0 +1,346 @@
+package netdicomtest_test
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	dicom "github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomio"
+	"github.com/grailbio/go-dicom/dicomtag"
+	"github.com/grailbio/go-dicom/dicomuid"
+	"github.com/grailbio/go-netdicom"
+	"github.com/grailbio/go-netdicom/dimse"
+	"github.com/grailbio/go-netdicom/netdicomtest"
+	"github.com/grailbio/go-netdicom/pdu"
+	"github.com/grailbio/go-netdicom/sopclass"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newPACS(t *testing.T) *netdicomtest.PACS {
+	pacs := netdicomtest.NewPACS(netdicomtest.Params{AETitle: "PACS"})
+	require.NoError(t, pacs.AddFile("../testdata/reportsi.dcm"))
+	return pacs
+}
+
+func TestEcho(t *testing.T) {
+	pacs := newPACS(t)
+	su := pacs.NewUser(t, netdicom.ServiceUserParams{SOPClasses: sopclass.VerificationClasses})
+	defer su.Release()
+	require.NoError(t, su.CEcho())
+	assert.Equal(t, 1, pacs.NumOps())
+}
+
+func TestStore(t *testing.T) {
+	pacs := newPACS(t)
+	ds, err := dicom.ReadDataSetFromFile("../testdata/IM-0001-0003.dcm", dicom.ReadOptions{})
+	require.NoError(t, err)
+	su := pacs.NewUser(t, netdicom.ServiceUserParams{SOPClasses: sopclass.StorageClasses})
+	defer su.Release()
+	require.NoError(t, su.CStore(ds))
+	stored := pacs.Stored()
+	require.Len(t, stored, 1)
+	elem, err := ds.FindElementByTag(dicomtag.MediaStorageSOPInstanceUID)
+	require.NoError(t, err)
+	assert.Equal(t, elem.MustGetString(), stored[0].SOPInstanceUID)
+}
+
+func TestFind(t *testing.T) {
+	pacs := newPACS(t)
+	su := pacs.NewUser(t, netdicom.ServiceUserParams{SOPClasses: sopclass.QRFindClasses})
+	defer su.Release()
+	filter := []*dicom.Element{
+		dicom.MustNewElement(dicomtag.PatientName, "*"),
+	}
+	var n int
+	for result := range su.CFind(netdicom.QRLevelStudy, filter) {
+		require.NoError(t, result.Err)
+		if len(result.Elements) > 0 {
+			n++
+		}
+	}
+	assert.Equal(t, 1, n)
+}
+
+// newRetrievePACS returns a PACS with "n" instances of one study.
+func newRetrievePACS(t *testing.T, params netdicomtest.Params, n int) *netdicomtest.PACS {
+	ds := netdicomtest.ReadDataSet(t, "../testdata/reportsi.dcm")
+	params.AETitle = "PACS"
+	pacs := netdicomtest.NewPACS(params)
+	for i := 0; i < n; i++ {
+		require.NoError(t, pacs.AddDataSet(netdicomtest.WithUIDs(ds, "1.2.3", "", fmt.Sprintf("1.2.3.4.%d", i))))
+	}
+	return pacs
+}
+
+var retrieveQuery = netdicom.QRQuery{
+	Model: netdicom.QRModelStudyRoot,
+	Level: netdicom.QRLevelStudy,
+	Keys:  []*dicom.Element{dicom.MustNewElement(dicomtag.StudyInstanceUID, "1.2.3")},
+}
+
+// cget runs a C-GET of retrieveQuery, and returns the SOP instance UIDs
+// received.
+func cget(t *testing.T, pacs *netdicomtest.PACS) ([]string, error) {
+	su := pacs.NewUser(t, netdicom.ServiceUserParams{SOPClasses: sopclass.QRGetClasses})
+	defer su.Release()
+	var uids []string
+	err := su.CGetDataSets(context.Background(), retrieveQuery, nil, func(ds *dicom.DataSet) dimse.Status {
+		elem, err := ds.FindElementByTag(dicomtag.SOPInstanceUID)
+		if assert.NoError(t, err) {
+			uids = append(uids, elem.MustGetString())
+		}
+		return dimse.Success
+	})
+	return uids, err
+}
+
+func TestGet(t *testing.T) {
+	pacs := newRetrievePACS(t, netdicomtest.Params{}, 3)
+	uids, err := cget(t, pacs)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1.2.3.4.0", "1.2.3.4.1", "1.2.3.4.2"}, uids)
+	assert.Equal(t, 1, pacs.NumOps())
+}
+
+func TestGetAbortSubOps(t *testing.T) {
+	pacs := newRetrievePACS(t, netdicomtest.Params{}, 3)
+	pacs.SetScript(netdicomtest.Script{AbortSubOps: 1})
+	uids, err := cget(t, pacs)
+	assert.Error(t, err)
+	assert.True(t, len(uids) <= 1, "received %v", uids)
+}
+
+// cmove sends a C-MOVE request for retrieveQuery over "conn", and returns the
+// final response. ServiceUser doesn't implement C-MOVE, so the PDUs are built
+// by hand. It returns an error if the connection closes before the final
+// response.
+func cmove(t *testing.T, conn net.Conn, moveDestination string) (*dimse.CMoveRsp, error) {
+	defer conn.Close()
+	sopClassUID := sopclass.QRMoveClasses[1] // Study Root.
+	const contextID = 1
+	writePDU := func(v pdu.PDU) {
+		data, err := pdu.EncodePDU(v)
+		require.NoError(t, err)
+		_, err = conn.Write(data)
+		require.NoError(t, err)
+	}
+	writePDU(&pdu.AAssociate{
+		Type:            pdu.TypeAAssociateRq,
+		ProtocolVersion: pdu.CurrentProtocolVersion,
+		CalledAETitle:   "PACS",
+		CallingAETitle:  "MOVESCU",
+		Items: []pdu.SubItem{
+			&pdu.ApplicationContextItem{Name: pdu.DICOMApplicationContextItemName},
+			&pdu.PresentationContextItem{
+				Type:      pdu.ItemTypePresentationContextRequest,
+				ContextID: contextID,
+				Items: []pdu.SubItem{
+					&pdu.AbstractSyntaxSubItem{Name: sopClassUID},
+					&pdu.TransferSyntaxSubItem{Name: dicomuid.ImplicitVRLittleEndian},
+				},
+			},
+			&pdu.UserInformationItem{
+				Items: []pdu.SubItem{&pdu.UserInformationMaximumLengthItem{MaximumLengthReceived: uint32(netdicom.DefaultMaxPDUSize)}},
+			},
+		},
+	})
+	v, err := pdu.ReadPDU(conn, netdicom.DefaultMaxPDUSize)
+	require.NoError(t, err)
+	ac, ok := v.(*pdu.AAssociate)
+	require.True(t, ok && ac.Type == pdu.TypeAAssociateAc, "response: %v", v)
+
+	e := dicomio.NewBytesEncoder(nil, dicomio.UnknownVR)
+	dimse.EncodeMessage(e, &dimse.CMoveRq{
+		AffectedSOPClassUID: sopClassUID,
+		MessageID:           1,
+		MoveDestination:     moveDestination,
+		CommandDataSetType:  dimse.CommandDataSetTypeNonNull,
+	})
+	require.NoError(t, e.Error())
+	command := e.Bytes()
+	e = dicomio.NewBytesEncoderWithTransferSyntax(dicomuid.ImplicitVRLittleEndian)
+	dicom.WriteElement(e, dicom.MustNewElement(dicomtag.QueryRetrieveLevel, "STUDY"))
+	for _, elem := range retrieveQuery.Keys {
+		dicom.WriteElement(e, elem)
+	}
+	require.NoError(t, e.Error())
+	writePDU(&pdu.PDataTf{Items: []pdu.PresentationDataValueItem{
+		{ContextID: contextID, Command: true, Last: true, Value: command},
+		{ContextID: contextID, Command: false, Last: true, Value: e.Bytes()},
+	}})
+
+	for {
+		var assembler dimse.CommandAssembler
+		var msg dimse.Message
+		for msg == nil {
+			v, err := pdu.ReadPDU(conn, netdicom.DefaultMaxPDUSize)
+			if err != nil {
+				return nil, err
+			}
+			data, ok := v.(*pdu.PDataTf)
+			if !ok {
+				return nil, fmt.Errorf("unexpected PDU %v", v)
+			}
+			_, msg, _, err = assembler.AddDataPDU(data)
+			require.NoError(t, err)
+		}
+		rsp, ok := msg.(*dimse.CMoveRsp)
+		require.True(t, ok, "response: %v", msg)
+		if rsp.Status.Status != dimse.StatusPending {
+			writePDU(&pdu.AReleaseRq{})
+			return rsp, nil
+		}
+	}
+}
+
+// startMove starts a destination PACS, and returns it with a PACS that has
+// "n" instances and can move them to "DEST".
+func startMove(t *testing.T, n int) (source, dest *netdicomtest.PACS) {
+	dest, destAddr := netdicomtest.StartPACS(t, netdicomtest.Params{AETitle: "DEST"})
+	source = newRetrievePACS(t, netdicomtest.Params{RemoteAEs: map[string]string{"DEST": destAddr}}, n)
+	t.Cleanup(func() { source.Close() })
+	return source, dest
+}
+
+func storedUIDs(pacs *netdicomtest.PACS) []string {
+	var uids []string
+	for _, s := range pacs.Stored() {
+		uids = append(uids, s.SOPInstanceUID)
+	}
+	return uids
+}
+
+func TestMove(t *testing.T) {
+	source, dest := startMove(t, 2)
+	rsp, err := cmove(t, source.Pipe(), "DEST")
+	require.NoError(t, err)
+	assert.Equal(t, dimse.StatusSuccess, rsp.Status.Status)
+	assert.Equal(t, uint16(2), rsp.NumberOfCompletedSuboperations)
+	assert.Equal(t, []string{"1.2.3.4.0", "1.2.3.4.1"}, storedUIDs(dest))
+
+	rsp, err = cmove(t, source.Pipe(), "NOSUCHAE")
+	require.NoError(t, err)
+	assert.Equal(t, dimse.CMoveMoveDestinationUnknown, rsp.Status.Status)
+}
+
+func TestMoveFailOp(t *testing.T) {
+	source, dest := startMove(t, 2)
+	source.SetScript(netdicomtest.Script{FailOp: 1, FailStatus: dimse.Status{Status: dimse.CMoveOutOfResourcesUnableToCalculateNumberOfMatches}})
+	rsp, err := cmove(t, source.Pipe(), "DEST")
+	require.NoError(t, err)
+	assert.Equal(t, dimse.CMoveOutOfResourcesUnableToCalculateNumberOfMatches, rsp.Status.Status)
+	assert.Empty(t, dest.Stored())
+}
+
+func TestMoveAbortSubOps(t *testing.T) {
+	source, dest := startMove(t, 3)
+	source.SetScript(netdicomtest.Script{AbortSubOps: 1})
+	_, err := cmove(t, source.Pipe(), "DEST")
+	assert.Error(t, err)
+	assert.True(t, len(dest.Stored()) <= 1, "stored %v", storedUIDs(dest))
+}
+
+func TestRejectAssociation(t *testing.T) {
+	pacs := newPACS(t)
+	pacs.SetScript(netdicomtest.Script{RejectAssociation: true})
+	su := pacs.NewUser(t, netdicom.ServiceUserParams{SOPClasses: sopclass.VerificationClasses})
+	defer su.Release()
+	assert.Error(t, su.CEcho())
+	assert.Equal(t, 0, pacs.NumOps())
+}
+
+func TestFailOp(t *testing.T) {
+	pacs := newPACS(t)
+	pacs.SetScript(netdicomtest.Script{
+		FailOp:     2,
+		FailStatus: dimse.Status{Status: dimse.StatusNotAuthorized, ErrorComment: "Foohah"},
+	})
+	su := pacs.NewUser(t, netdicom.ServiceUserParams{SOPClasses: sopclass.VerificationClasses})
+	defer su.Release()
+	require.NoError(t, su.CEcho())
+	err := su.CEcho()
+	require.Error(t, err)
+	assert.True(t, strings.Contains(err.Error(), "Foohah"), err)
+	require.NoError(t, su.CEcho())
+}
+
+func TestFailFind(t *testing.T) {
+	pacs := newPACS(t)
+	pacs.SetScript(netdicomtest.Script{
+		FailOp:     1,
+		FailStatus: dimse.Status{Status: dimse.CFindUnableToProcess, ErrorComment: "Foohah"},
+	})
+	su := pacs.NewUser(t, netdicom.ServiceUserParams{SOPClasses: sopclass.QRFindClasses})
+	defer su.Release()
+	var errs []error
+	for result := range su.CFind(netdicom.QRLevelStudy, []*dicom.Element{dicom.MustNewElement(dicomtag.PatientName, "*")}) {
+		if result.Err != nil {
+			errs = append(errs, result.Err)
+		}
+	}
+	require.Len(t, errs, 1)
+	assert.True(t, strings.Contains(errs[0].Error(), "Foohah"), errs[0])
+}
+
+func TestAbortOp(t *testing.T) {
+	pacs := newPACS(t)
+	pacs.SetScript(netdicomtest.Script{AbortOp: 1})
+	su := pacs.NewUser(t, netdicom.ServiceUserParams{SOPClasses: sopclass.VerificationClasses})
+	defer su.Release()
+	assert.Error(t, su.CEcho())
+}
+
+func TestDelay(t *testing.T) {
+	pacs := newPACS(t)
+	pacs.SetScript(netdicomtest.Script{Delay: 50 * time.Millisecond})
+	su := pacs.NewUser(t, netdicom.ServiceUserParams{SOPClasses: sopclass.VerificationClasses})
+	defer su.Release()
+	start := time.Now()
+	require.NoError(t, su.CEcho())
+	assert.True(t, time.Since(start) >= 50*time.Millisecond)
+}
+
+func TestListen(t *testing.T) {
+	pacs := newPACS(t)
+	addr, err := pacs.Listen()
+	require.NoError(t, err)
+	defer pacs.Close()
+	su, err := netdicom.NewServiceUser(netdicom.ServiceUserParams{
+		CalledAETitle: "PACS",
+		SOPClasses:    sopclass.VerificationClasses})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(addr)
+	require.NoError(t, su.CEcho())
+}
+
+func TestWithUIDs(t *testing.T) {
+	ds := netdicomtest.ReadDataSet(t, "../testdata/reportsi.dcm")
+	modified := netdicomtest.WithUIDs(ds, "1.2.3", "", "1.2.3.4.5")
+	for tag, want := range map[dicomtag.Tag]string{
+		dicomtag.StudyInstanceUID:           "1.2.3",
+		dicomtag.SeriesInstanceUID:          "1.2.276.0.7230010.3.1.3.1787205428.166.1117461927.11",
+		dicomtag.SOPInstanceUID:             "1.2.3.4.5",
+		dicomtag.MediaStorageSOPInstanceUID: "1.2.3.4.5",
+	} {
+		elem, err := modified.FindElementByTag(tag)
+		require.NoError(t, err)
+		assert.Equal(t, want, elem.MustGetString(), dicomtag.DebugString(tag))
+	}
+	// The original is left alone.
+	elem, err := ds.FindElementByTag(dicomtag.StudyInstanceUID)
+	require.NoError(t, err)
+	assert.NotEqual(t, "1.2.3", elem.MustGetString())
+
+	// New elements are added in tag order.
+	modified = netdicomtest.WithElements(ds, dicom.MustNewElement(dicomtag.AcquisitionDateTime, "20200101"))
+	assert.Equal(t, len(ds.Elements)+1, len(modified.Elements))
+	for i := 1; i < len(modified.Elements); i++ {
+		assert.True(t, modified.Elements[i-1].Tag.Compare(modified.Elements[i].Tag) < 0)
+	}
+}
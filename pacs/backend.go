@@ -0,0 +1,149 @@
+package pacs
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	dicom "github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomtag"
+	"github.com/grailbio/go-netdicom"
+	"github.com/grailbio/go-netdicom/qrmatch"
+)
+
+// ErrNotFound is returned by Backend.Get when the instance doesn't exist.
+var ErrNotFound = errors.New("pacs: instance not found")
+
+// Object is a SOP instance received by C-STORE.
+type Object struct {
+	// Conn is the state of the association the object arrived on.
+	Conn              netdicom.ConnectionState
+	TransferSyntaxUID string
+	SOPClassUID       string
+	SOPInstanceUID    string
+	// Data is the dataset, without the metadata (group 2) elements, encoded
+	// in TransferSyntaxUID.
+	Data []byte
+}
+
+// Match is an instance found by Backend.Query.
+type Match struct {
+	SOPInstanceUID string
+	// Elements is the identifier of the C-FIND response. See
+	// qrmatch.Response.
+	Elements []*dicom.Element
+}
+
+// Backend stores the SOP instances of a Server. Implementations must be safe
+// for concurrent use.
+type Backend interface {
+	// Put stores the object. It replaces the instance with the same
+	// SOPInstanceUID, if any.
+	Put(obj Object) error
+
+	// Get returns the instance, including the metadata elements and
+	// PixelData. It returns ErrNotFound if the instance doesn't exist.
+	Get(sopInstanceUID string) (*dicom.DataSet, error)
+
+	// List returns the SOPInstanceUIDs of all the instances.
+	List() ([]string, error)
+
+	// Query returns the instances that match all the filters of a C-FIND,
+	// C-GET or C-MOVE request, following the rules implemented by package
+	// qrmatch.
+	Query(filters []*dicom.Element) ([]Match, error)
+}
+
+// sopInstanceUID returns the SOPInstanceUID of the dataset, taken from the
+// metadata if present.
+func sopInstanceUID(ds *dicom.DataSet) (string, error) {
+	for _, tag := range []dicomtag.Tag{dicomtag.MediaStorageSOPInstanceUID, dicomtag.SOPInstanceUID} {
+		if elem, err := ds.FindElementByTag(tag); err == nil {
+			return elem.GetString()
+		}
+	}
+	return "", fmt.Errorf("pacs: SOPInstanceUID not found")
+}
+
+// MemoryBackend is a Backend that keeps the instances in memory. It is meant
+// for tests and small, short-lived archives.
+type MemoryBackend struct {
+	mu        sync.Mutex
+	datasets  map[string]*dicom.DataSet
+	instances []string // SOPInstanceUIDs, in the order first stored.
+}
+
+// NewMemoryBackend creates an empty MemoryBackend.
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{datasets: map[string]*dicom.DataSet{}}
+}
+
+// Put implements Backend.
+func (b *MemoryBackend) Put(obj Object) error {
+	ds, err := netdicom.ParseCStoreData(obj.Conn, obj.TransferSyntaxUID, obj.SOPClassUID, obj.SOPInstanceUID, obj.Data)
+	if err != nil {
+		return err
+	}
+	b.add(obj.SOPInstanceUID, ds)
+	return nil
+}
+
+// AddDataSet stores the dataset. It must contain the metadata elements, in
+// particular MediaStorageSOPClassUID and MediaStorageSOPInstanceUID, since
+// C-GET and C-MOVE need them.
+func (b *MemoryBackend) AddDataSet(ds *dicom.DataSet) error {
+	if _, err := ds.FindElementByTag(dicomtag.MediaStorageSOPClassUID); err != nil {
+		return fmt.Errorf("pacs.AddDataSet: %v", err)
+	}
+	uid, err := sopInstanceUID(ds)
+	if err != nil {
+		return fmt.Errorf("pacs.AddDataSet: %v", err)
+	}
+	b.add(uid, ds)
+	return nil
+}
+
+func (b *MemoryBackend) add(uid string, ds *dicom.DataSet) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.datasets[uid]; !ok {
+		b.instances = append(b.instances, uid)
+	}
+	b.datasets[uid] = ds
+}
+
+// Get implements Backend.
+func (b *MemoryBackend) Get(sopInstanceUID string) (*dicom.DataSet, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	ds, ok := b.datasets[sopInstanceUID]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return ds, nil
+}
+
+// List implements Backend.
+func (b *MemoryBackend) List() ([]string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]string(nil), b.instances...), nil
+}
+
+// Query implements Backend.
+func (b *MemoryBackend) Query(filters []*dicom.Element) ([]Match, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var matches []Match
+	for _, uid := range b.instances {
+		ds := b.datasets[uid]
+		ok, err := qrmatch.Match(ds, filters)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			matches = append(matches, Match{SOPInstanceUID: uid, Elements: qrmatch.Response(ds, filters)})
+		}
+	}
+	return matches, nil
+}
@@ -0,0 +1,165 @@
+package pacs
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	dicom "github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-netdicom"
+	"github.com/grailbio/go-netdicom/qrmatch"
+)
+
+// FileBackendParams configures a FileBackend.
+type FileBackendParams struct {
+	// Dir is scanned recursively for DICOM files when the backend is
+	// created. Files that aren't DICOM are skipped.
+	Dir string
+
+	// StoreDir is the directory where Put writes new files, named
+	// <SOPInstanceUID>.dcm. It is created if missing, and scanned too. If
+	// empty, Dir is used.
+	StoreDir string
+}
+
+// FileBackend is a Backend that stores each instance as a DICOM Part 10 file.
+// The attributes of the instances, except PixelData, are kept in memory for
+// queries.
+type FileBackend struct {
+	storeDir string
+
+	mu        sync.Mutex
+	files     map[string]*fileEntry // Keyed by SOPInstanceUID.
+	instances []string              // SOPInstanceUIDs, in the order first seen.
+}
+
+type fileEntry struct {
+	path  string
+	attrs *dicom.DataSet // Without PixelData.
+}
+
+// validUID matches the UIDs that are safe to use as file names.
+var validUID = regexp.MustCompile(`^[0-9]+(\.[0-9]+)*$`)
+
+// NewFileBackend creates a FileBackend and indexes the existing files.
+func NewFileBackend(params FileBackendParams) (*FileBackend, error) {
+	if params.Dir == "" {
+		return nil, fmt.Errorf("pacs.NewFileBackend: Dir must be set")
+	}
+	if params.StoreDir == "" {
+		params.StoreDir = params.Dir
+	}
+	if err := os.MkdirAll(params.StoreDir, 0755); err != nil {
+		return nil, fmt.Errorf("pacs.NewFileBackend: %v", err)
+	}
+	b := &FileBackend{storeDir: params.StoreDir, files: map[string]*fileEntry{}}
+	dirs := []string{params.Dir}
+	if rel, err := filepath.Rel(params.Dir, params.StoreDir); err != nil || strings.HasPrefix(rel, "..") {
+		dirs = append(dirs, params.StoreDir)
+	}
+	for _, dir := range dirs {
+		if err := b.scan(dir); err != nil {
+			return nil, fmt.Errorf("pacs.NewFileBackend: %v", err)
+		}
+	}
+	return b, nil
+}
+
+// scan indexes the DICOM files in or under "dir", in lexical order.
+func (b *FileBackend) scan(dir string) error {
+	var paths []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		// Skip the temp files left by an interrupted Put, and DICOMDIRs,
+		// which don't describe an instance.
+		if info.Mode().IsRegular() && !strings.HasPrefix(info.Name(), ".") && info.Name() != "DICOMDIR" {
+			paths = append(paths, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		attrs, err := dicom.ReadDataSetFromFile(path, dicom.ReadOptions{DropPixelData: true})
+		if err != nil {
+			continue
+		}
+		uid, err := sopInstanceUID(attrs)
+		if err != nil {
+			continue
+		}
+		b.add(uid, &fileEntry{path: path, attrs: attrs})
+	}
+	return nil
+}
+
+func (b *FileBackend) add(uid string, e *fileEntry) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.files[uid]; !ok {
+		b.instances = append(b.instances, uid)
+	}
+	b.files[uid] = e
+}
+
+// Put implements Backend. The file is written atomically; see
+// netdicom.WriteCStoreFile.
+func (b *FileBackend) Put(obj Object) error {
+	if !validUID.MatchString(obj.SOPInstanceUID) {
+		return fmt.Errorf("pacs.FileBackend: invalid SOPInstanceUID '%s'", obj.SOPInstanceUID)
+	}
+	path := filepath.Join(b.storeDir, obj.SOPInstanceUID+".dcm")
+	if err := netdicom.WriteCStoreFile(path, obj.Conn, obj.TransferSyntaxUID, obj.SOPClassUID, obj.SOPInstanceUID, obj.Data); err != nil {
+		return err
+	}
+	attrs, err := dicom.ReadDataSetFromFile(path, dicom.ReadOptions{DropPixelData: true})
+	if err != nil {
+		return fmt.Errorf("pacs.FileBackend: %s: %v", path, err)
+	}
+	b.add(obj.SOPInstanceUID, &fileEntry{path: path, attrs: attrs})
+	return nil
+}
+
+// Get implements Backend.
+func (b *FileBackend) Get(sopInstanceUID string) (*dicom.DataSet, error) {
+	b.mu.Lock()
+	e, ok := b.files[sopInstanceUID]
+	b.mu.Unlock()
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return dicom.ReadDataSetFromFile(e.path, dicom.ReadOptions{})
+}
+
+// List implements Backend.
+func (b *FileBackend) List() ([]string, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]string(nil), b.instances...), nil
+}
+
+// Query implements Backend.
+func (b *FileBackend) Query(filters []*dicom.Element) ([]Match, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var matches []Match
+	for _, uid := range b.instances {
+		attrs := b.files[uid].attrs
+		ok, err := qrmatch.Match(attrs, filters)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			matches = append(matches, Match{SOPInstanceUID: uid, Elements: qrmatch.Response(attrs, filters)})
+		}
+	}
+	return matches, nil
+}
@@ -0,0 +1,151 @@
+// Package pacs implements a small DICOM archive (PACS) on top of a pluggable
+// storage backend.
+//
+// A Server implements all the netdicom.ServiceProviderParams callbacks: it
+// stores the instances received by C-STORE in a Backend, answers C-FIND from
+// Backend.Query, and sends the matching instances for C-GET and C-MOVE. The
+// package ships two backends: FileBackend, which stores Part 10 files in a
+// directory, and MemoryBackend.
+//
+// Example:
+//
+//	backend, err := pacs.NewFileBackend(pacs.FileBackendParams{Dir: "/var/lib/dicom"})
+//	if err != nil {
+//		...
+//	}
+//	server, err := pacs.NewServer(pacs.Params{AETitle: "ARCHIVE", Backend: backend})
+//	if err != nil {
+//		...
+//	}
+//	sp, err := netdicom.NewServiceProvider(server.ProviderParams(), ":11112")
+//	if err != nil {
+//		...
+//	}
+//	sp.Run()
+package pacs
+
+import (
+	"fmt"
+	"strings"
+
+	dicom "github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-netdicom"
+	"github.com/grailbio/go-netdicom/dimse"
+)
+
+// Params configures a Server.
+type Params struct {
+	// AETitle is the AE title of the server. Required.
+	AETitle string
+
+	// Backend stores the instances. Required.
+	Backend Backend
+
+	// RemoteAEs maps the AE titles of C-MOVE destinations to their
+	// host:ports.
+	RemoteAEs map[string]string
+
+	// Provider, if non-nil, customizes the provider, whose AETitle,
+	// RemoteAEs and DIMSE callbacks are then set by the server.
+	Provider func(params *netdicom.ServiceProviderParams)
+}
+
+// Server serves a Backend over DICOM. It is safe for concurrent use.
+type Server struct {
+	params Params
+}
+
+// NewServer creates a Server.
+func NewServer(params Params) (*Server, error) {
+	if params.AETitle == "" {
+		return nil, fmt.Errorf("pacs.NewServer: AETitle must be set")
+	}
+	if params.Backend == nil {
+		return nil, fmt.Errorf("pacs.NewServer: Backend must be set")
+	}
+	return &Server{params: params}, nil
+}
+
+// ProviderParams returns the params to pass to netdicom.NewServiceProvider or
+// netdicom.RunProviderForConn.
+func (s *Server) ProviderParams() netdicom.ServiceProviderParams {
+	var params netdicom.ServiceProviderParams
+	if s.params.Provider != nil {
+		s.params.Provider(&params)
+	}
+	params.AETitle = s.params.AETitle
+	params.RemoteAEs = s.params.RemoteAEs
+	params.CEcho = func(connState netdicom.ConnectionState) dimse.Status {
+		return dimse.Success
+	}
+	params.CStore = s.onCStore
+	params.CFind = s.onCFind
+	params.CGet = s.onCMoveOrCGet
+	params.CMove = s.onCMoveOrCGet
+	return params
+}
+
+func (s *Server) onCStore(connState netdicom.ConnectionState, transferSyntaxUID string,
+	sopClassUID string,
+	sopInstanceUID string,
+	data []byte) dimse.Status {
+	err := s.params.Backend.Put(Object{
+		Conn:              connState,
+		TransferSyntaxUID: transferSyntaxUID,
+		SOPClassUID:       sopClassUID,
+		SOPInstanceUID:    sopInstanceUID,
+		Data:              data,
+	})
+	if err != nil {
+		return dimse.Status{Status: dimse.CStoreOutOfResources, ErrorComment: err.Error()}
+	}
+	return dimse.Success
+}
+
+func (s *Server) onCFind(connState netdicom.ConnectionState, transferSyntaxUID string, sopClassUID string,
+	filters []*dicom.Element, ch chan netdicom.CFindResult) {
+	defer close(ch)
+	matches, err := s.params.Backend.Query(filters)
+	if err != nil {
+		ch <- netdicom.CFindResult{Err: err}
+		return
+	}
+	// At the PATIENT, STUDY and SERIES levels, many instances yield the same
+	// response. Send each once.
+	seen := map[string]bool{}
+	for _, m := range matches {
+		key := responseKey(m.Elements)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		ch <- netdicom.CFindResult{Elements: m.Elements}
+	}
+}
+
+// responseKey returns a string that identifies the values of the elements.
+func responseKey(elems []*dicom.Element) string {
+	var b strings.Builder
+	for _, elem := range elems {
+		fmt.Fprintf(&b, "%v=%v;", elem.Tag, elem.Value)
+	}
+	return b.String()
+}
+
+func (s *Server) onCMoveOrCGet(connState netdicom.ConnectionState, transferSyntaxUID string, sopClassUID string,
+	filters []*dicom.Element, ch chan netdicom.CMoveResult) {
+	defer close(ch)
+	matches, err := s.params.Backend.Query(filters)
+	if err != nil {
+		ch <- netdicom.CMoveResult{Err: err}
+		return
+	}
+	for i, m := range matches {
+		resp := netdicom.CMoveResult{
+			Remaining: len(matches) - i - 1,
+			Path:      m.SOPInstanceUID,
+		}
+		resp.DataSet, resp.Err = s.params.Backend.Get(m.SOPInstanceUID)
+		ch <- resp
+	}
+}
@@ -0,0 +1,152 @@
+package pacs_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	dicom "github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomtag"
+	"github.com/grailbio/go-netdicom"
+	"github.com/grailbio/go-netdicom/dimse"
+	"github.com/grailbio/go-netdicom/netdicomtest"
+	"github.com/grailbio/go-netdicom/pacs"
+	"github.com/grailbio/go-netdicom/sopclass"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newServiceUser(t *testing.T, server *pacs.Server, sopClasses []string) *netdicom.ServiceUser {
+	return netdicomtest.NewUser(t, netdicom.ServiceUserParams{
+		CalledAETitle:  "PACS",
+		CallingAETitle: "SCU",
+		SOPClasses:     sopClasses}, server.ProviderParams())
+}
+
+func newServer(t *testing.T, backend pacs.Backend) *pacs.Server {
+	server, err := pacs.NewServer(pacs.Params{AETitle: "PACS", Backend: backend})
+	require.NoError(t, err)
+	return server
+}
+
+func store(t *testing.T, server *pacs.Server, path string) string {
+	ds, err := dicom.ReadDataSetFromFile(path, dicom.ReadOptions{})
+	require.NoError(t, err)
+	su := newServiceUser(t, server, sopclass.StorageClasses)
+	defer su.Release()
+	require.NoError(t, su.CStore(ds))
+	elem, err := ds.FindElementByTag(dicomtag.MediaStorageSOPInstanceUID)
+	require.NoError(t, err)
+	return elem.MustGetString()
+}
+
+func find(t *testing.T, server *pacs.Server, filter []*dicom.Element) [][]*dicom.Element {
+	su := newServiceUser(t, server, sopclass.QRFindClasses)
+	defer su.Release()
+	var results [][]*dicom.Element
+	for result := range su.CFind(netdicom.QRLevelStudy, filter) {
+		require.NoError(t, result.Err)
+		if len(result.Elements) > 0 {
+			results = append(results, result.Elements)
+		}
+	}
+	return results
+}
+
+func get(t *testing.T, server *pacs.Server, filter []*dicom.Element) []string {
+	su := newServiceUser(t, server, sopclass.QRGetClasses)
+	defer su.Release()
+	var uids []string
+	err := su.CGet(netdicom.QRLevelStudy, filter,
+		func(transferSyntaxUID, sopClassUID, sopInstanceUID string, data []byte) dimse.Status {
+			uids = append(uids, sopInstanceUID)
+			return dimse.Success
+		})
+	require.NoError(t, err)
+	return uids
+}
+
+func TestMemoryBackend(t *testing.T) {
+	backend := pacs.NewMemoryBackend()
+	server := newServer(t, backend)
+	uid0 := store(t, server, "../testdata/reportsi.dcm")
+	uid1 := store(t, server, "../testdata/IM-0001-0003.dcm")
+	// Storing the same instance again replaces it.
+	store(t, server, "../testdata/reportsi.dcm")
+
+	uids, err := backend.List()
+	require.NoError(t, err)
+	assert.Equal(t, []string{uid0, uid1}, uids)
+
+	ds, err := backend.Get(uid0)
+	require.NoError(t, err)
+	elem, err := ds.FindElementByTag(dicomtag.SourceApplicationEntityTitle)
+	require.NoError(t, err)
+	assert.Equal(t, "SCU", elem.MustGetString())
+	_, err = backend.Get("1.2.3")
+	assert.Equal(t, pacs.ErrNotFound, err)
+
+	all := []*dicom.Element{dicom.MustNewElement(dicomtag.SOPInstanceUID, "")}
+	assert.Len(t, find(t, server, all), 2)
+	assert.Equal(t, []string{uid0, uid1}, get(t, server, all))
+	one := []*dicom.Element{dicom.MustNewElement(dicomtag.SOPInstanceUID, uid1)}
+	assert.Equal(t, []string{uid1}, get(t, server, one))
+}
+
+func TestFindDedup(t *testing.T) {
+	backend := pacs.NewMemoryBackend()
+	server := newServer(t, backend)
+	store(t, server, "../testdata/reportsi.dcm")
+	ds, err := dicom.ReadDataSetFromFile("../testdata/reportsi.dcm", dicom.ReadOptions{})
+	require.NoError(t, err)
+	// Add a second instance in the same study.
+	for _, tag := range []dicomtag.Tag{dicomtag.MediaStorageSOPInstanceUID, dicomtag.SOPInstanceUID} {
+		elem, err := ds.FindElementByTag(tag)
+		require.NoError(t, err)
+		elem.Value = []interface{}{"1.2.3.4"}
+	}
+	require.NoError(t, backend.AddDataSet(ds))
+
+	study := []*dicom.Element{dicom.MustNewElement(dicomtag.StudyInstanceUID, "")}
+	assert.Len(t, find(t, server, study), 1)
+	instance := []*dicom.Element{dicom.MustNewElement(dicomtag.SOPInstanceUID, "")}
+	assert.Len(t, find(t, server, instance), 2)
+}
+
+func TestFileBackend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pacs")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "existing"), 0755))
+	data, err := ioutil.ReadFile("../testdata/reportsi.dcm")
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "existing", "report"), data, 0644))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "README"), []byte("not dicom"), 0644))
+
+	params := pacs.FileBackendParams{Dir: dir, StoreDir: filepath.Join(dir, "incoming")}
+	backend, err := pacs.NewFileBackend(params)
+	require.NoError(t, err)
+	uids, err := backend.List()
+	require.NoError(t, err)
+	require.Len(t, uids, 1)
+
+	server := newServer(t, backend)
+	uid := store(t, server, "../testdata/IM-0001-0003.dcm")
+	_, err = os.Stat(filepath.Join(dir, "incoming", uid+".dcm"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{uids[0], uid}, get(t, server, []*dicom.Element{dicom.MustNewElement(dicomtag.SOPInstanceUID, "")}))
+
+	// The stored file is found after a restart, with its PixelData.
+	backend, err = pacs.NewFileBackend(params)
+	require.NoError(t, err)
+	uids, err = backend.List()
+	require.NoError(t, err)
+	assert.Len(t, uids, 2)
+	ds, err := backend.Get(uid)
+	require.NoError(t, err)
+	_, err = ds.FindElementByTag(dicomtag.PixelData)
+	assert.NoError(t, err)
+
+	assert.Error(t, backend.Put(pacs.Object{SOPInstanceUID: "../x"}))
+}
@@ -0,0 +1,128 @@
+package netdicom
+
+// This file implements helpers for C-STORE handlers that save or parse the
+// received datasets.
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomio"
+	"github.com/grailbio/go-dicom/dicomtag"
+)
+
+// CStoreFileMeta returns the file meta information (group 2) elements for a
+// dataset received by a CStoreCallback. The args are those passed to the
+// callback. The result includes the file meta information version, the
+// implementation class UID and version name of this library, and, if known,
+// the AE title of the peer as SourceApplicationEntityTitle.
+func CStoreFileMeta(conn ConnectionState, transferSyntaxUID, sopClassUID, sopInstanceUID string) []*dicom.Element {
+	elems := []*dicom.Element{
+		dicom.MustNewElement(dicomtag.FileMetaInformationVersion, []byte{0, 1}),
+		dicom.MustNewElement(dicomtag.MediaStorageSOPClassUID, sopClassUID),
+		dicom.MustNewElement(dicomtag.MediaStorageSOPInstanceUID, sopInstanceUID),
+		dicom.MustNewElement(dicomtag.TransferSyntaxUID, transferSyntaxUID),
+		dicom.MustNewElement(dicomtag.ImplementationClassUID, dicom.GoDICOMImplementationClassUID),
+		dicom.MustNewElement(dicomtag.ImplementationVersionName, dicom.GoDICOMImplementationVersionName),
+	}
+	if conn.CallingAETitle != "" {
+		elems = append(elems, dicom.MustNewElement(dicomtag.SourceApplicationEntityTitle, conn.CallingAETitle))
+	}
+	return elems
+}
+
+// WriteCStoreFile writes a dataset received by a CStoreCallback to "path" as a
+// DICOM Part 10 file. The args other than "path" are those passed to the
+// callback. The file meta information is generated by CStoreFileMeta.
+//
+// The file is written atomically: the contents go to a temp file in the same
+// directory, which is synced to disk and then renamed to "path". On error,
+// "path" is left untouched.
+//
+// Example:
+//
+//	CStore: func(conn netdicom.ConnectionState, transferSyntaxUID, sopClassUID,
+//	  sopInstanceUID string, data []byte) dimse.Status {
+//	  path := filepath.Join(dir, sopInstanceUID+".dcm")
+//	  if err := netdicom.WriteCStoreFile(path, conn, transferSyntaxUID, sopClassUID, sopInstanceUID, data); err != nil {
+//	    return dimse.Status{Status: dimse.CStoreOutOfResources, ErrorComment: err.Error()}
+//	  }
+//	  return dimse.Success
+//	}
+func WriteCStoreFile(path string, conn ConnectionState,
+	transferSyntaxUID, sopClassUID, sopInstanceUID string, data []byte) error {
+	dir := filepath.Dir(path)
+	tmp, err := ioutil.TempFile(dir, "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("dicom.WriteCStoreFile(%s): %v", path, err)
+	}
+	tmpPath := tmp.Name()
+	err = writeCStoreFile(tmp, conn, transferSyntaxUID, sopClassUID, sopInstanceUID, data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("dicom.WriteCStoreFile(%s): %v", path, err)
+	}
+	// Persist the rename. Not all filesystems support syncing a directory,
+	// and the file itself is already durable, so errors are ignored.
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// writeCStoreFile writes the Part 10 file header and "data" to "out", then
+// syncs it.
+func writeCStoreFile(out *os.File, conn ConnectionState,
+	transferSyntaxUID, sopClassUID, sopInstanceUID string, data []byte) error {
+	if err := out.Chmod(0644); err != nil {
+		return err
+	}
+	w := bufio.NewWriter(out)
+	e := dicomio.NewEncoder(w, binary.LittleEndian, dicomio.ExplicitVR)
+	dicom.WriteFileHeader(e, CStoreFileMeta(conn, transferSyntaxUID, sopClassUID, sopInstanceUID))
+	e.WriteBytes(data)
+	if err := e.Error(); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return out.Sync()
+}
+
+// ParseCStoreData parses a dataset received by a CStoreCallback. The args are
+// those passed to the callback. The result starts with the file meta
+// information generated by CStoreFileMeta, so it looks as if the dataset was
+// read from a Part 10 file. A deflated dataset is inflated.
+func ParseCStoreData(conn ConnectionState,
+	transferSyntaxUID, sopClassUID, sopInstanceUID string, data []byte) (*dicom.DataSet, error) {
+	body, err := readElementsInBytes(data, transferSyntaxUID)
+	if err != nil {
+		return nil, fmt.Errorf("dicom.ParseCStoreData(%s): %v", sopInstanceUID, err)
+	}
+	meta := CStoreFileMeta(conn, transferSyntaxUID, sopClassUID, sopInstanceUID)
+	e := dicomio.NewBytesEncoder(binary.LittleEndian, dicomio.ExplicitVR)
+	for _, elem := range meta {
+		dicom.WriteElement(e, elem)
+	}
+	if err := e.Error(); err != nil {
+		return nil, fmt.Errorf("dicom.ParseCStoreData(%s): %v", sopInstanceUID, err)
+	}
+	elems := make([]*dicom.Element, 0, 1+len(meta)+len(body))
+	elems = append(elems, dicom.MustNewElement(dicomtag.FileMetaInformationGroupLength, uint32(len(e.Bytes()))))
+	elems = append(elems, meta...)
+	elems = append(elems, body...)
+	return &dicom.DataSet{Elements: elems}, nil
+}
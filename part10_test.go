@@ -0,0 +1,83 @@
+package netdicom
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomtag"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// readCStoreArgs returns the args that a CStoreCallback would receive for the
+// given file.
+func readCStoreArgs(t *testing.T, path string) (ds *dicom.DataSet, transferSyntaxUID, sopClassUID, sopInstanceUID string, data []byte) {
+	ds = mustReadDICOMFile(path)
+	get := func(tag dicomtag.Tag) string {
+		elem, err := ds.FindElementByTag(tag)
+		require.NoError(t, err)
+		return elem.MustGetString()
+	}
+	transferSyntaxUID = get(dicomtag.TransferSyntaxUID)
+	sopClassUID = get(dicomtag.MediaStorageSOPClassUID)
+	sopInstanceUID = get(dicomtag.MediaStorageSOPInstanceUID)
+	data, err := encodeCStoreBody(ds.Elements, transferSyntaxUID, 0)
+	require.NoError(t, err)
+	return
+}
+
+func checkCStoreFileMeta(t *testing.T, ds *dicom.DataSet, transferSyntaxUID, sopClassUID, sopInstanceUID string) {
+	for tag, value := range map[dicomtag.Tag]string{
+		dicomtag.TransferSyntaxUID:            transferSyntaxUID,
+		dicomtag.MediaStorageSOPClassUID:      sopClassUID,
+		dicomtag.MediaStorageSOPInstanceUID:   sopInstanceUID,
+		dicomtag.ImplementationClassUID:       dicom.GoDICOMImplementationClassUID,
+		dicomtag.ImplementationVersionName:    dicom.GoDICOMImplementationVersionName,
+		dicomtag.SourceApplicationEntityTitle: "MODALITY",
+	} {
+		elem, err := ds.FindElementByTag(tag)
+		require.NoError(t, err, dicomtag.DebugString(tag))
+		assert.Equal(t, value, elem.MustGetString(), dicomtag.DebugString(tag))
+	}
+	_, err := ds.FindElementByTag(dicomtag.FileMetaInformationVersion)
+	assert.NoError(t, err)
+}
+
+func TestWriteCStoreFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "part10")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	conn := ConnectionState{CallingAETitle: "MODALITY", CalledAETitle: "PACS"}
+
+	for _, name := range []string{"IM-0001-0003.dcm", "reportsi.dcm"} {
+		in, ts, class, instance, data := readCStoreArgs(t, filepath.Join("testdata", name))
+		path := filepath.Join(dir, name)
+		require.NoError(t, WriteCStoreFile(path, conn, ts, class, instance, data))
+		out := mustReadDICOMFile(path)
+		checkCStoreFileMeta(t, out, ts, class, instance)
+		checkFileBodiesEqual(t, in, out)
+	}
+	// No temp files are left behind.
+	files, err := ioutil.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, files, 2)
+
+	err = WriteCStoreFile(filepath.Join(dir, "nonexistent", "x.dcm"), conn, "", "", "", nil)
+	assert.Error(t, err)
+}
+
+func TestParseCStoreData(t *testing.T) {
+	conn := ConnectionState{CallingAETitle: "MODALITY", CalledAETitle: "PACS"}
+	in, ts, class, instance, data := readCStoreArgs(t, "testdata/reportsi.dcm")
+	out, err := ParseCStoreData(conn, ts, class, instance, data)
+	require.NoError(t, err)
+	checkCStoreFileMeta(t, out, ts, class, instance)
+	assert.Equal(t, dicomtag.FileMetaInformationGroupLength, out.Elements[0].Tag)
+	checkFileBodiesEqual(t, in, out)
+
+	_, err = ParseCStoreData(conn, ts, class, instance, []byte{1, 2, 3})
+	assert.Error(t, err)
+}
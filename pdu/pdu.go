@@ -387,7 +387,9 @@ func (v *PresentationContextItem) Write(e *dicomio.Encoder) {
 	itemBytes := itemEncoder.Bytes()
 	encodeSubItemHeader(e, v.Type, uint16(4+len(itemBytes)))
 	e.WriteByte(v.ContextID)
-	e.WriteZeros(3)
+	e.WriteZeros(1)
+	e.WriteByte(byte(v.Result))
+	e.WriteZeros(1)
 	e.WriteBytes(itemBytes)
 }
 
@@ -462,17 +464,44 @@ func EncodePDU(pdu PDU) ([]byte, error) {
 		panic(fmt.Sprintf("Unknown PDU %v", pdu))
 	}
 	e := dicomio.NewBytesEncoder(binary.BigEndian, dicomio.UnknownVR)
+	// Reserve the header bytes, and fill them after encoding the payload,
+	// so that the payload needn't be copied.
+	e.WriteZeros(6)
 	pdu.WritePayload(e)
 	if err := e.Error(); err != nil {
 		return nil, err
 	}
-	payload := e.Bytes()
-	// Reserve the header bytes. It will be filled in Finish.
-	var header [6]byte // First 6 bytes of buf.
-	header[0] = byte(pduType)
-	header[1] = 0 // Reserved.
-	binary.BigEndian.PutUint32(header[2:6], uint32(len(payload)))
-	return append(header[:], payload...), nil
+	data := e.Bytes()
+	data[0] = byte(pduType)
+	data[1] = 0 // Reserved.
+	binary.BigEndian.PutUint32(data[2:6], uint32(len(data)-6))
+	return data, nil
+}
+
+// PDataTfHeaderSize is the size of the header of a P-DATA-TF PDU that holds
+// one presentation data value item: the PDU header (6 bytes) followed by the
+// item header (6 bytes).
+const PDataTfHeaderSize = 12
+
+// PutPDataTfHeader writes into buf[:PDataTfHeaderSize] the header of a
+// P-DATA-TF PDU that holds one presentation data value item of valueLen bytes.
+// The header followed by the value encodes the same bytes as EncodePDU of the
+// equivalent PDataTf, so the caller can write the value from its own buffer
+// without copying it.
+func PutPDataTfHeader(buf []byte, contextID byte, command, last bool, valueLen int) {
+	var flags byte
+	if command {
+		flags |= 1
+	}
+	if last {
+		flags |= 2
+	}
+	buf[0] = byte(TypePDataTf)
+	buf[1] = 0 // Reserved.
+	binary.BigEndian.PutUint32(buf[2:6], uint32(PDataTfHeaderSize-6+valueLen))
+	binary.BigEndian.PutUint32(buf[6:10], uint32(2+valueLen))
+	buf[10] = contextID
+	buf[11] = flags
 }
 
 // EncodePDU reads a "pdu" from a stream. maxPDUSize defines the maximum
@@ -0,0 +1,256 @@
+package netdicom
+
+// This file implements the write path for P-DATA-TF PDUs. The PDU headers are
+// written into small pooled buffers placed in front of the caller's data
+// chunks. On a TCP connection, consecutive PDUs are written with one
+// net.Buffers (writev) call, so sending a dataset doesn't copy it. Other
+// connections, e.g., *tls.Conn, get the PDUs through a buffer, so that each
+// header is sent along with the data that follows it.
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/grailbio/go-dicom/dicomuid"
+	"github.com/grailbio/go-netdicom/pdu"
+)
+
+// maxPDUBatch is the max number of PDUs written in one writev call.
+const maxPDUBatch = 64
+
+// pduBatch holds the buffers for writing one batch of PDUs.
+type pduBatch struct {
+	headers [maxPDUBatch * pdu.PDataTfHeaderSize]byte
+	iovecs  net.Buffers
+}
+
+var pduBatchPool = sync.Pool{
+	New: func() interface{} {
+		return &pduBatch{iovecs: make(net.Buffers, 0, 2*maxPDUBatch)}
+	},
+}
+
+// chunkPool holds buffers used by streamDataPDUs. Their sizes depend on the
+// peer's max PDU size, so a buffer that is too small is dropped.
+var chunkPool sync.Pool
+
+func getChunkBuffer(size int) *[]byte {
+	if b, ok := chunkPool.Get().(*[]byte); ok && cap(*b) >= size {
+		*b = (*b)[:size]
+		return b
+	}
+	b := make([]byte, size)
+	return &b
+}
+
+// maxDataChunkSize is the max size of the value in a presentation data value
+// item that the peer accepts.
+func maxDataChunkSize(sm *stateMachine) int {
+	// two byte header overhead.
+	//
+	// TODO(saito) move the magic number elsewhere.
+	return sm.contextManager.peerMaxPDUSize - 8
+}
+
+// dataPDU is one P-DATA-TF PDU, split into its header and value. See
+// pdu.PutPDataTfHeader.
+type dataPDU struct {
+	contextID byte
+	command   bool
+	last      bool
+	value     []byte
+}
+
+// sendDataPDUs splits "data" into P-DATA-TF PDUs that fit the peer's max PDU
+// size, and writes them. "data" isn't copied, and it must not be empty.
+func sendDataPDUs(sm *stateMachine, abstractSyntaxName string, command bool, data []byte) error {
+	doassert(len(data) > 0)
+	context, err := sm.contextManager.lookupByAbstractSyntaxUID(abstractSyntaxName)
+	if err != nil {
+		// TODO(saito) Don't crash here.
+		panic(fmt.Sprintf("dicom.stateMachine(%s): Illegal syntax name %s: %s", sm.label, dicomuid.UIDString(abstractSyntaxName), err))
+	}
+	maxChunkSize := maxDataChunkSize(sm)
+	var batch [maxPDUBatch]dataPDU
+	for len(data) > 0 {
+		n := 0
+		for n < maxPDUBatch && len(data) > 0 {
+			chunkSize := len(data)
+			if chunkSize > maxChunkSize {
+				chunkSize = maxChunkSize
+			}
+			batch[n] = dataPDU{
+				contextID: context.contextID,
+				command:   command,
+				last:      chunkSize == len(data),
+				value:     data[:chunkSize],
+			}
+			data = data[chunkSize:]
+			n++
+		}
+		if err := writeDataPDUs(sm, batch[:n]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// streamDataPDUs is similar to sendDataPDUs, but it reads the data payload
+// from "r" one PDU at a time, so the payload need not fit in memory. "r" must
+// yield at least one byte. It returns the number of bytes sent, and the error
+// in reading "r", if any. It stops silently if a write fails, since
+// writeDataPDUs reports that as evt17.
+func streamDataPDUs(sm *stateMachine, abstractSyntaxName string, r io.Reader) (int64, error) {
+	context, err := sm.contextManager.lookupByAbstractSyntaxUID(abstractSyntaxName)
+	if err != nil {
+		return 0, err
+	}
+	in := getBufferedReader(r)
+	defer putBufferedReader(in)
+	buf := getChunkBuffer(maxDataChunkSize(sm))
+	defer chunkPool.Put(buf)
+	chunk := *buf
+	var total int64
+	for {
+		n, err := io.ReadFull(in, chunk)
+		last := false
+		switch err {
+		case nil:
+			// Look ahead to find whether this is the last chunk.
+			if _, err := in.Peek(1); err == io.EOF {
+				last = true
+			} else if err != nil {
+				return total, err
+			}
+		case io.ErrUnexpectedEOF:
+			last = true
+		case io.EOF:
+			return total, fmt.Errorf("dicom.stateMachine(%s): empty DIMSE data", sm.label)
+		default:
+			return total, err
+		}
+		if err := writeDataPDUs(sm, []dataPDU{{
+			contextID: context.contextID,
+			command:   false,
+			last:      last,
+			value:     chunk[:n],
+		}}); err != nil {
+			return total, nil
+		}
+		total += int64(n)
+		if last {
+			return total, nil
+		}
+	}
+}
+
+// writeDataPDUs writes the PDUs in one writev call. On error, it closes the
+// connection and reports evt17, like sendPDU.
+func writeDataPDUs(sm *stateMachine, pdus []dataPDU) error {
+	doassert(sm.conn != nil)
+	if sm.faults != nil {
+		// The fault injector inspects each encoded PDU.
+		for _, p := range pdus {
+			if err := sendPDU(sm, &pdu.PDataTf{Items: []pdu.PresentationDataValueItem{
+				pdu.PresentationDataValueItem{
+					ContextID: p.contextID,
+					Command:   p.command,
+					Last:      p.last,
+					Value:     p.value,
+				}}}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	doassert(len(pdus) <= maxPDUBatch)
+	batch := pduBatchPool.Get().(*pduBatch)
+	defer pduBatchPool.Put(batch)
+	bufs := batch.iovecs[:0]
+	total := 0
+	for i, p := range pdus {
+		header := batch.headers[i*pdu.PDataTfHeaderSize : (i+1)*pdu.PDataTfHeaderSize]
+		pdu.PutPDataTfHeader(header, p.contextID, p.command, p.last, len(p.value))
+		bufs = append(bufs, header, p.value)
+		total += len(header) + len(p.value)
+	}
+	err := writeBuffers(sm.conn, bufs)
+	// Don't retain the caller's data in the pool. WriteTo advances its
+	// receiver, and may reslice the elements it writes partially, but bufs
+	// and batch.iovecs share the same array.
+	used := batch.iovecs[:2*len(pdus)]
+	for i := range used {
+		used[i] = nil
+	}
+	if err != nil {
+		sm.logger.error("Failed to write PDUs; closing connection", "bytes", total, LogKeyError, err)
+		sm.conn.Close()
+		sm.errorCh <- stateEvent{event: evt17, err: err}
+		return err
+	}
+	for i, p := range pdus {
+		sm.metrics.ObservePDU(PDUSent, pdu.TypePDataTf, pdu.PDataTfHeaderSize+len(p.value))
+		if sm.tap != nil {
+			header := batch.headers[i*pdu.PDataTfHeaderSize : (i+1)*pdu.PDataTfHeaderSize]
+			sm.tap.TapPDU(PDUSent, append(append([]byte(nil), header...), p.value...))
+		}
+	}
+	sm.logger.debug("Sent P-DATA-TF PDUs", "pdus", len(pdus), "bytes", total)
+	return nil
+}
+
+// writeBuffers writes "bufs" to "conn". net.Buffers.WriteTo issues one writev
+// call on a *net.TCPConn or *net.UnixConn, but a Write per buffer on other
+// connections, which for *tls.Conn would mean a TLS record per PDU header. So
+// on those, the buffers are coalesced with a bufio.Writer.
+func writeBuffers(conn net.Conn, bufs net.Buffers) error {
+	switch conn.(type) {
+	case *net.TCPConn, *net.UnixConn:
+		total := 0
+		for _, b := range bufs {
+			total += len(b)
+		}
+		n, err := bufs.WriteTo(conn)
+		if err == nil && n != int64(total) {
+			err = io.ErrShortWrite
+		}
+		return err
+	}
+	out := bufferedWriterPool.Get().(*bufio.Writer)
+	out.Reset(conn)
+	defer func() {
+		out.Reset(nil)
+		bufferedWriterPool.Put(out)
+	}()
+	for _, b := range bufs {
+		if _, err := out.Write(b); err != nil {
+			return err
+		}
+	}
+	return out.Flush()
+}
+
+// bufferedWriterPool holds the bufio.Writers used by writeBuffers. A value
+// larger than the buffer is written directly, once the buffer is filled.
+var bufferedWriterPool = sync.Pool{
+	New: func() interface{} { return bufio.NewWriterSize(nil, 64<<10) },
+}
+
+// bufferedReaderPool holds the bufio.Readers used by streamDataPDUs.
+var bufferedReaderPool = sync.Pool{
+	New: func() interface{} { return bufio.NewReader(nil) },
+}
+
+func getBufferedReader(r io.Reader) *bufio.Reader {
+	in := bufferedReaderPool.Get().(*bufio.Reader)
+	in.Reset(r)
+	return in
+}
+
+func putBufferedReader(in *bufio.Reader) {
+	in.Reset(nil)
+	bufferedReaderPool.Put(in)
+}
@@ -0,0 +1,242 @@
+package netdicom
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"runtime"
+	"testing"
+
+	"github.com/grailbio/go-dicom/dicomuid"
+	"github.com/grailbio/go-netdicom/pdu"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writerConn is a net.Conn that only supports Write.
+type writerConn struct {
+	net.Conn
+	w io.Writer
+}
+
+func (c writerConn) Write(data []byte) (int, error) { return c.w.Write(data) }
+func (c writerConn) Close() error                   { return nil }
+
+// countingWriter counts the Write calls made on it.
+type countingWriter struct {
+	bytes.Buffer
+	writes int
+}
+
+func (w *countingWriter) Write(data []byte) (int, error) {
+	w.writes++
+	return w.Buffer.Write(data)
+}
+
+// newLoopbackConns returns the two ends of a TCP connection on 127.0.0.1.
+func newLoopbackConns(t testing.TB) (net.Conn, net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			close(accepted)
+			return
+		}
+		accepted <- conn
+	}()
+	client, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	server, ok := <-accepted
+	require.True(t, ok)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+func newTestStateMachine(conn net.Conn, peerMaxPDUSize int) *stateMachine {
+	sm := &stateMachine{
+		label:          "test",
+		contextManager: newContextManager("test", newLogger(nil, nil)),
+		conn:           conn,
+		errorCh:        make(chan stateEvent, 128),
+		metrics:        nopMetricsObserver{},
+		logger:         newLogger(nil, nil),
+	}
+	sm.contextManager.peerMaxPDUSize = peerMaxPDUSize
+	e := &contextManagerEntry{
+		contextID:         3,
+		abstractSyntaxUID: dicomuid.VerificationSOPClass,
+		transferSyntaxUID: dicomuid.ImplicitVRLittleEndian,
+		result:            pdu.PresentationContextAccepted,
+	}
+	sm.contextManager.contextIDToAbstractSyntaxNameMap[e.contextID] = e
+	sm.contextManager.abstractSyntaxNameToContextIDMap[e.abstractSyntaxUID] = e
+	return sm
+}
+
+// encodeDataPDUs produces the P-DATA-TF PDUs for "data" using pdu.EncodePDU.
+func encodeDataPDUs(t testing.TB, data []byte, maxChunkSize int, command bool) []byte {
+	var out []byte
+	for len(data) > 0 {
+		n := len(data)
+		if n > maxChunkSize {
+			n = maxChunkSize
+		}
+		encoded, err := pdu.EncodePDU(&pdu.PDataTf{Items: []pdu.PresentationDataValueItem{
+			pdu.PresentationDataValueItem{ContextID: 3, Command: command, Last: n == len(data), Value: data[:n]},
+		}})
+		require.NoError(t, err)
+		out = append(out, encoded...)
+		data = data[n:]
+	}
+	return out
+}
+
+func testPayload(n int) []byte {
+	data := make([]byte, n)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	return data
+}
+
+func TestSendDataPDUs(t *testing.T) {
+	for _, n := range []int{1, 100, 108, 109, 1000, 100 * maxPDUBatch} {
+		data := testPayload(n)
+		var buf bytes.Buffer
+		sm := newTestStateMachine(writerConn{w: &buf}, 108)
+		require.NoError(t, sendDataPDUs(sm, dicomuid.VerificationSOPClass, true, data))
+		assert.Equal(t, encodeDataPDUs(t, data, 100, true), buf.Bytes(), "size %d", n)
+
+		buf.Reset()
+		total, err := streamDataPDUs(sm, dicomuid.VerificationSOPClass, bytes.NewReader(data))
+		require.NoError(t, err)
+		assert.Equal(t, int64(n), total)
+		assert.Equal(t, encodeDataPDUs(t, data, 100, false), buf.Bytes(), "size %d", n)
+	}
+}
+
+// TestSendDataPDUsCoalesced checks that, on a connection other than TCP, the
+// PDUs of a batch reach the connection in one Write rather than one per
+// header and value.
+func TestSendDataPDUsCoalesced(t *testing.T) {
+	data := testPayload(1000)
+	w := &countingWriter{}
+	sm := newTestStateMachine(writerConn{w: w}, 108)
+	require.NoError(t, sendDataPDUs(sm, dicomuid.VerificationSOPClass, false, data))
+	assert.Equal(t, encodeDataPDUs(t, data, 100, false), w.Bytes())
+	assert.Equal(t, 1, w.writes)
+}
+
+func TestSendDataPDUsTCP(t *testing.T) {
+	data := testPayload(100 * maxPDUBatch)
+	client, server := newLoopbackConns(t)
+	sm := newTestStateMachine(client, 108)
+	received := make(chan []byte, 1)
+	go func() {
+		b, _ := ioutil.ReadAll(server)
+		received <- b
+	}()
+	require.NoError(t, sendDataPDUs(sm, dicomuid.VerificationSOPClass, false, data))
+	_, err := streamDataPDUs(sm, dicomuid.VerificationSOPClass, bytes.NewReader(data))
+	require.NoError(t, err)
+	client.Close()
+	expected := encodeDataPDUs(t, data, 100, false)
+	assert.Equal(t, append(expected, expected...), <-received)
+}
+
+const benchmarkPayloadSize = 64 << 20
+
+// benchmarkPeerMaxPDUSize is the max PDU size the benchmarks' peer accepts.
+// About 16KB is the default of common peers, e.g., pynetdicom (16382) and
+// DCMTK (16384), so it is typical of the PDUs actually sent.
+const benchmarkPeerMaxPDUSize = 16384
+
+// newBenchmarkConn returns a TCP connection on 127.0.0.1 whose peer discards
+// what it receives.
+func newBenchmarkConn(b *testing.B) net.Conn {
+	client, server := newLoopbackConns(b)
+	go io.Copy(ioutil.Discard, server)
+	return client
+}
+
+// reportBytesPerGB reports the bytes allocated per GB sent.
+func reportBytesPerGB(b *testing.B, start runtime.MemStats) {
+	var end runtime.MemStats
+	runtime.ReadMemStats(&end)
+	sent := float64(b.N) * benchmarkPayloadSize
+	b.ReportMetric(float64(end.TotalAlloc-start.TotalAlloc)*(1<<30)/sent, "allocB/GB")
+}
+
+// BenchmarkSendDataPDUs measures the write path used by the state machine.
+func BenchmarkSendDataPDUs(b *testing.B) {
+	data := testPayload(benchmarkPayloadSize)
+	sm := newTestStateMachine(newBenchmarkConn(b), benchmarkPeerMaxPDUSize)
+	b.SetBytes(benchmarkPayloadSize)
+	var start runtime.MemStats
+	runtime.ReadMemStats(&start)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := sendDataPDUs(sm, dicomuid.VerificationSOPClass, false, data); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	reportBytesPerGB(b, start)
+}
+
+// BenchmarkStreamDataPDUs measures the write path used by CStoreFile and
+// CStoreReader.
+func BenchmarkStreamDataPDUs(b *testing.B) {
+	data := testPayload(benchmarkPayloadSize)
+	sm := newTestStateMachine(newBenchmarkConn(b), benchmarkPeerMaxPDUSize)
+	b.SetBytes(benchmarkPayloadSize)
+	var start runtime.MemStats
+	runtime.ReadMemStats(&start)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := streamDataPDUs(sm, dicomuid.VerificationSOPClass, bytes.NewReader(data)); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	reportBytesPerGB(b, start)
+}
+
+// BenchmarkEncodePDUs measures encoding each PDU with pdu.EncodePDU and
+// writing it separately, for comparison.
+func BenchmarkEncodePDUs(b *testing.B) {
+	data := testPayload(benchmarkPayloadSize)
+	conn := newBenchmarkConn(b)
+	maxChunkSize := benchmarkPeerMaxPDUSize - 8
+	b.SetBytes(benchmarkPayloadSize)
+	var start runtime.MemStats
+	runtime.ReadMemStats(&start)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for rest := data; len(rest) > 0; {
+			n := len(rest)
+			if n > maxChunkSize {
+				n = maxChunkSize
+			}
+			encoded, err := pdu.EncodePDU(&pdu.PDataTf{Items: []pdu.PresentationDataValueItem{
+				pdu.PresentationDataValueItem{ContextID: 3, Last: n == len(rest), Value: rest[:n]},
+			}})
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := conn.Write(encoded); err != nil {
+				b.Fatal(err)
+			}
+			rest = rest[n:]
+		}
+	}
+	b.StopTimer()
+	reportBytesPerGB(b, start)
+}
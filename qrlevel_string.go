@@ -4,9 +4,9 @@ package netdicom
 
 import "fmt"
 
-const _QRLevel_name = "QRLevelPatientQRLevelStudyQRLevelSeries"
+const _QRLevel_name = "QRLevelPatientQRLevelStudyQRLevelSeriesQRLevelImage"
 
-var _QRLevel_index = [...]uint8{0, 14, 26, 39}
+var _QRLevel_index = [...]uint8{0, 14, 26, 39, 51}
 
 func (i QRLevel) String() string {
 	if i < 0 || i >= QRLevel(len(_QRLevel_index)-1) {
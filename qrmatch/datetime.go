@@ -0,0 +1,175 @@
+package qrmatch
+
+// This file implements range matching of DA, TM and DT values. PS3.4
+// C.2.2.2.5.
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/grailbio/go-dicom/dicomtag"
+)
+
+// dateTimePairs maps the DA attributes that have a TM counterpart to the
+// counterpart. Keys of both attributes are matched as one datetime range.
+// PS3.4 C.2.2.2.5.1.
+var dateTimePairs = map[dicomtag.Tag]dicomtag.Tag{
+	dicomtag.StudyDate:            dicomtag.StudyTime,
+	dicomtag.SeriesDate:           dicomtag.SeriesTime,
+	dicomtag.AcquisitionDate:      dicomtag.AcquisitionTime,
+	dicomtag.ContentDate:          dicomtag.ContentTime,
+	dicomtag.InstanceCreationDate: dicomtag.InstanceCreationTime,
+	dicomtag.PatientBirthDate:     dicomtag.PatientBirthTime,
+}
+
+// timeRange is a closed range of normalized values; see normalizeTime and
+// friends. An empty bound is open.
+type timeRange struct {
+	lower, upper string
+}
+
+func (r timeRange) contains(v string) bool {
+	return (r.lower == "" || v >= r.lower) && (r.upper == "" || v <= r.upper)
+}
+
+// parseRange parses a key value of VR DA, TM or DT. The value is either a
+// single value, "<lower>-<upper>", "<lower>-" or "-<upper>". A single value
+// matches the whole period it denotes, e.g., "10" matches 10:00 to 10:59:59.
+func parseRange(vr, value string) (timeRange, error) {
+	lower, upper := value, value
+	if i := rangeSeparator(vr, value); i >= 0 {
+		lower, upper = value[:i], value[i+1:]
+		if lower == "" && upper == "" {
+			return timeRange{}, fmt.Errorf("qrmatch: invalid %s range '%s'", vr, value)
+		}
+	}
+	var r timeRange
+	var err error
+	if lower != "" {
+		if r.lower, err = normalize(vr, lower, false); err != nil {
+			return r, err
+		}
+	}
+	if upper != "" {
+		if r.upper, err = normalize(vr, upper, true); err != nil {
+			return r, err
+		}
+	}
+	return r, nil
+}
+
+// rangeSeparator returns the index of the '-' that separates the bounds of a
+// range, or -1. In DT values, '-' also starts a negative UTC offset, "-HHMM".
+// An offset follows a value that has at least the hour.
+func rangeSeparator(vr, value string) int {
+	if vr != "DT" {
+		return strings.IndexByte(value, '-')
+	}
+	for i := 0; i < len(value); i++ {
+		if value[i] != '-' {
+			continue
+		}
+		isOffset := i >= 10 && i+5 <= len(value) && isDigits(value[i+1:i+5]) &&
+			(i+5 == len(value) || value[i+5] == '-')
+		if !isOffset {
+			return i
+		}
+	}
+	return -1
+}
+
+// normalize converts a DA, TM or DT value into a string that sorts in time
+// order. Missing trailing components are filled with their smallest values,
+// or with their largest values if "upper" is set.
+func normalize(vr, value string, upper bool) (string, error) {
+	value = strings.TrimSpace(value)
+	switch vr {
+	case "DA":
+		return normalizeDate(value)
+	case "TM":
+		return normalizeTime(value, upper)
+	case "DT":
+		return normalizeDateTime(value, upper)
+	}
+	return "", fmt.Errorf("qrmatch: VR %s doesn't support range matching", vr)
+}
+
+// normalizeDate returns "YYYYMMDD". It also accepts the ACR-NEMA
+// "YYYY.MM.DD" format.
+func normalizeDate(value string) (string, error) {
+	value = strings.Replace(value, ".", "", -1)
+	if len(value) != 8 || !isDigits(value) {
+		return "", fmt.Errorf("qrmatch: invalid DA '%s'", value)
+	}
+	return value, nil
+}
+
+const (
+	minTime = "000000.000000"
+	maxTime = "235959.999999"
+)
+
+// normalizeTime returns "HHMMSS.FFFFFF". It also accepts the ACR-NEMA
+// "HH:MM:SS.FFFFFF" format.
+func normalizeTime(value string, upper bool) (string, error) {
+	value = strings.Replace(value, ":", "", -1)
+	digits := value
+	if i := strings.IndexByte(value, '.'); i >= 0 {
+		digits = value[:i] + value[i+1:]
+		if i != 6 || len(value) > len(minTime) {
+			return "", fmt.Errorf("qrmatch: invalid TM '%s'", value)
+		}
+	} else if len(value) > 6 || len(value)%2 != 0 {
+		return "", fmt.Errorf("qrmatch: invalid TM '%s'", value)
+	}
+	if len(digits) == 0 || !isDigits(digits) {
+		return "", fmt.Errorf("qrmatch: invalid TM '%s'", value)
+	}
+	if len(value) == 6 {
+		value += "."
+	}
+	if upper {
+		return value + maxTime[len(value):], nil
+	}
+	return value + minTime[len(value):], nil
+}
+
+// normalizeDateTime returns "YYYYMMDDHHMMSS.FFFFFF". The UTC offset, if any,
+// is ignored.
+func normalizeDateTime(value string, upper bool) (string, error) {
+	if i := strings.IndexAny(value, "+-"); i >= 0 {
+		value = value[:i]
+	}
+	date := value
+	if len(date) > 8 {
+		date = value[:8]
+	}
+	if len(date) < 4 || len(date)%2 != 0 || !isDigits(date) {
+		return "", fmt.Errorf("qrmatch: invalid DT '%s'", value)
+	}
+	if upper {
+		date += "1231"[len(date)-4:]
+	} else {
+		date += "0101"[len(date)-4:]
+	}
+	if len(value) <= 8 {
+		if upper {
+			return date + maxTime, nil
+		}
+		return date + minTime, nil
+	}
+	t, err := normalizeTime(value[8:], upper)
+	if err != nil {
+		return "", fmt.Errorf("qrmatch: invalid DT '%s'", value)
+	}
+	return date + t, nil
+}
+
+func isDigits(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] < '0' || s[i] > '9' {
+			return false
+		}
+	}
+	return true
+}
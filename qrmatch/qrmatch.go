@@ -0,0 +1,371 @@
+// Package qrmatch implements the attribute matching rules of C-FIND, C-GET and
+// C-MOVE, PS3.4 C.2.2.2, and builds the identifiers of C-FIND responses. It
+// lets SCPs built on go-netdicom answer the same query the same way.
+//
+// The supported rules are single value matching, list of UID matching,
+// universal matching, wildcard ('*' and '?') matching, range matching of DA,
+// TM and DT values, including combined DA/TM matching, and sequence
+// matching. PN values are matched case-insensitively.
+//
+// Example:
+//
+//	CFind: func(conn netdicom.ConnectionState, transferSyntaxUID, sopClassUID string,
+//		keys []*dicom.Element, ch chan netdicom.CFindResult) {
+//		defer close(ch)
+//		for _, ds := range datasets {
+//			ok, err := qrmatch.Match(ds, keys)
+//			if err != nil {
+//				ch <- netdicom.CFindResult{Err: err}
+//				return
+//			}
+//			if ok {
+//				ch <- netdicom.CFindResult{Elements: qrmatch.Response(ds, keys)}
+//			}
+//		}
+//	}
+package qrmatch
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	dicom "github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomtag"
+)
+
+// Match reports whether "ds" matches all the keys of a C-FIND, C-GET or C-MOVE
+// identifier. The QueryRetrieveLevel and SpecificCharacterSet keys are not
+// matched. It returns an error if a key is malformed, e.g., an invalid date
+// range.
+func Match(ds *dicom.DataSet, keys []*dicom.Element) (bool, error) {
+	return matchElements(ds.Elements, keys)
+}
+
+func matchElements(elems, keys []*dicom.Element) (bool, error) {
+	// DA and TM keys that are matched together.
+	combined := map[dicomtag.Tag]bool{}
+	for _, key := range keys {
+		timeTag, ok := dateTimePairs[key.Tag]
+		if !ok {
+			continue
+		}
+		timeKey, err := dicom.FindElementByTag(keys, timeTag)
+		if err != nil || !isRangeKey(key) || !isRangeKey(timeKey) {
+			continue
+		}
+		ok, err = matchDateTime(elems, key, timeKey)
+		if err != nil || !ok {
+			return false, err
+		}
+		combined[key.Tag] = true
+		combined[timeTag] = true
+	}
+	for _, key := range keys {
+		if key.Tag == dicomtag.QueryRetrieveLevel || key.Tag == dicomtag.SpecificCharacterSet || combined[key.Tag] {
+			continue
+		}
+		elem, err := dicom.FindElementByTag(elems, key.Tag)
+		if err != nil {
+			elem = nil
+		}
+		ok, err := MatchElement(elem, key)
+		if err != nil || !ok {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// MatchElement reports whether the attribute "elem" matches "key". "elem" is
+// nil if the dataset lacks the attribute. A missing or empty attribute matches
+// only a universal key, i.e., one that is empty or "*".
+func MatchElement(elem, key *dicom.Element) (bool, error) {
+	if key.VR == "SQ" {
+		return matchSequence(elem, key)
+	}
+	keyValues := stringValues(key)
+	if len(keyValues) == 0 {
+		return true, nil
+	}
+	if len(keyValues) == 1 && keyValues[0] == "*" && SupportsWildcard(key.VR) {
+		return true, nil
+	}
+	if elem == nil {
+		return false, nil
+	}
+	values := stringValues(elem)
+	for _, keyValue := range keyValues {
+		for _, value := range values {
+			ok, err := matchValue(key.VR, keyValue, value)
+			if err != nil {
+				return false, fmt.Errorf("qrmatch: key %v: %v", dicomtag.DebugString(key.Tag), err)
+			}
+			if ok {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// matchValue matches one value of an attribute against one value of a key.
+func matchValue(vr, keyValue, value string) (bool, error) {
+	switch {
+	case vr == "DA" || vr == "TM" || vr == "DT":
+		r, err := parseRange(vr, keyValue)
+		if err != nil {
+			return false, err
+		}
+		v, err := normalize(vr, value, false)
+		if err != nil {
+			// Malformed values in the dataset match nothing.
+			return false, nil
+		}
+		return r.contains(v), nil
+	case vr == "PN":
+		keyValue, value = strings.ToLower(keyValue), strings.ToLower(value)
+		return matchWildcard(keyValue, value), nil
+	case SupportsWildcard(vr):
+		return matchWildcard(keyValue, value), nil
+	}
+	return keyValue == value, nil
+}
+
+// matchDateTime matches a DA key and its TM counterpart as one datetime range.
+// PS3.4 C.2.2.2.5.1.
+func matchDateTime(elems []*dicom.Element, dateKey, timeKey *dicom.Element) (bool, error) {
+	dr, err := parseRange("DA", stringValues(dateKey)[0])
+	if err != nil {
+		return false, fmt.Errorf("qrmatch: key %v: %v", dicomtag.DebugString(dateKey.Tag), err)
+	}
+	tr, err := parseRange("TM", stringValues(timeKey)[0])
+	if err != nil {
+		return false, fmt.Errorf("qrmatch: key %v: %v", dicomtag.DebugString(timeKey.Tag), err)
+	}
+	var r timeRange
+	if dr.lower != "" {
+		r.lower = dr.lower + minTime
+		if tr.lower != "" {
+			r.lower = dr.lower + tr.lower
+		}
+	}
+	if dr.upper != "" {
+		r.upper = dr.upper + maxTime
+		if tr.upper != "" {
+			r.upper = dr.upper + tr.upper
+		}
+	}
+	date := firstValue(elems, dateKey.Tag)
+	if date == "" {
+		return false, nil
+	}
+	d, err := normalize("DA", date, false)
+	if err != nil {
+		return false, nil
+	}
+	t := minTime
+	if value := firstValue(elems, timeKey.Tag); value != "" {
+		if t, err = normalize("TM", value, false); err != nil {
+			return false, nil
+		}
+	}
+	return r.contains(d + t), nil
+}
+
+// matchSequence implements sequence matching. PS3.4 C.2.2.2.6. A key with no
+// items, or with an empty item, is universal. Otherwise, the attribute matches
+// if one of its items matches all the keys in the first item of the key.
+func matchSequence(elem, key *dicom.Element) (bool, error) {
+	subKeys := sequenceKeys(key)
+	if len(subKeys) == 0 {
+		return true, nil
+	}
+	if elem == nil {
+		return false, nil
+	}
+	for _, item := range elem.Value {
+		ok, err := matchElements(itemElements(item), subKeys)
+		if err != nil || ok {
+			return ok, err
+		}
+	}
+	return false, nil
+}
+
+// isRangeKey reports whether the key uses range matching.
+func isRangeKey(key *dicom.Element) bool {
+	values := stringValues(key)
+	return len(values) == 1 && strings.Contains(values[0], "-")
+}
+
+// SupportsWildcard reports whether wildcard matching applies to the VR.
+// PS3.4 C.2.2.2.4.
+func SupportsWildcard(vr string) bool {
+	switch vr {
+	case "AE", "CS", "LO", "LT", "PN", "SH", "ST", "UC", "UR", "UT":
+		return true
+	}
+	return false
+}
+
+// matchWildcard matches "value" against "pattern", where '*' matches any
+// sequence of characters, including an empty one, and '?' matches one
+// character.
+func matchWildcard(pattern, value string) bool {
+	p, v := []rune(pattern), []rune(value)
+	pi, vi := 0, 0
+	star, starVi := -1, 0
+	for vi < len(v) {
+		switch {
+		case pi < len(p) && p[pi] == '*':
+			star, starVi = pi, vi
+			pi++
+		case pi < len(p) && (p[pi] == '?' || p[pi] == v[vi]):
+			pi++
+			vi++
+		case star >= 0:
+			// Let the last '*' absorb one more character.
+			starVi++
+			pi, vi = star+1, starVi
+		default:
+			return false
+		}
+	}
+	for pi < len(p) && p[pi] == '*' {
+		pi++
+	}
+	return pi == len(p)
+}
+
+// stringValues returns the nonempty values of the element as strings, with
+// the padding removed.
+func stringValues(elem *dicom.Element) []string {
+	var values []string
+	for _, v := range elem.Value {
+		s := strings.TrimRight(strings.TrimSpace(fmt.Sprint(v)), "\x00")
+		if s != "" {
+			values = append(values, s)
+		}
+	}
+	return values
+}
+
+// firstValue returns the first value of the attribute in "elems", or "".
+func firstValue(elems []*dicom.Element, tag dicomtag.Tag) string {
+	elem, err := dicom.FindElementByTag(elems, tag)
+	if err != nil {
+		return ""
+	}
+	values := stringValues(elem)
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+// itemElements returns the elements in an item of a sequence.
+func itemElements(item interface{}) []*dicom.Element {
+	var elems []*dicom.Element
+	if itemElem, ok := item.(*dicom.Element); ok {
+		for _, v := range itemElem.Value {
+			if elem, ok := v.(*dicom.Element); ok {
+				elems = append(elems, elem)
+			}
+		}
+	}
+	return elems
+}
+
+// sequenceKeys returns the keys in the first item of a sequence key.
+func sequenceKeys(key *dicom.Element) []*dicom.Element {
+	if len(key.Value) == 0 {
+		return nil
+	}
+	return itemElements(key.Value[0])
+}
+
+// levelUniqueKeys maps the values of QueryRetrieveLevel to the unique keys of
+// the levels. PS3.4 C.6.
+var levelUniqueKeys = map[string]dicomtag.Tag{
+	"PATIENT": dicomtag.PatientID,
+	"STUDY":   dicomtag.StudyInstanceUID,
+	"SERIES":  dicomtag.SeriesInstanceUID,
+	"IMAGE":   dicomtag.SOPInstanceUID,
+}
+
+// Response returns the identifier of the C-FIND response for "ds", which
+// should match "keys". The identifier contains the attributes of "ds" named by
+// the keys, the unique key of the query level, QueryRetrieveLevel, and the
+// SpecificCharacterSet of "ds", if any. An attribute missing in "ds" is
+// returned empty. For a sequence key that isn't universal, only the matching
+// items are returned, each with the attributes named by the item of the key.
+// The result is sorted by tag.
+func Response(ds *dicom.DataSet, keys []*dicom.Element) []*dicom.Element {
+	elems := responseElements(ds.Elements, keys)
+	if charset, err := ds.FindElementByTag(dicomtag.SpecificCharacterSet); err == nil {
+		if _, err := dicom.FindElementByTag(elems, charset.Tag); err != nil {
+			elems = append(elems, charset)
+		}
+	}
+	if level, err := dicom.FindElementByTag(keys, dicomtag.QueryRetrieveLevel); err == nil {
+		values := stringValues(level)
+		if len(values) > 0 {
+			if tag, ok := levelUniqueKeys[values[0]]; ok {
+				if _, err := dicom.FindElementByTag(elems, tag); err != nil {
+					elems = append(elems, responseElement(ds.Elements, dicom.MustNewElement(tag)))
+				}
+			}
+		}
+	}
+	sort.SliceStable(elems, func(i, j int) bool {
+		return tagLess(elems[i].Tag, elems[j].Tag)
+	})
+	return elems
+}
+
+func responseElements(elems, keys []*dicom.Element) []*dicom.Element {
+	var resp []*dicom.Element
+	for _, key := range keys {
+		if key.Tag == dicomtag.QueryRetrieveLevel {
+			resp = append(resp, key)
+			continue
+		}
+		resp = append(resp, responseElement(elems, key))
+	}
+	return resp
+}
+
+func responseElement(elems []*dicom.Element, key *dicom.Element) *dicom.Element {
+	elem, err := dicom.FindElementByTag(elems, key.Tag)
+	if err != nil {
+		return &dicom.Element{Tag: key.Tag, VR: key.VR}
+	}
+	if key.VR != "SQ" {
+		return elem
+	}
+	subKeys := sequenceKeys(key)
+	if len(subKeys) == 0 {
+		return elem
+	}
+	seq := &dicom.Element{Tag: elem.Tag, VR: elem.VR, UndefinedLength: elem.UndefinedLength}
+	for _, item := range elem.Value {
+		itemElems := itemElements(item)
+		if ok, err := matchElements(itemElems, subKeys); err != nil || !ok {
+			continue
+		}
+		respItem := &dicom.Element{Tag: dicomtag.Item, UndefinedLength: true}
+		for _, e := range responseElements(itemElems, subKeys) {
+			respItem.Value = append(respItem.Value, e)
+		}
+		seq.Value = append(seq.Value, respItem)
+	}
+	return seq
+}
+
+func tagLess(t0, t1 dicomtag.Tag) bool {
+	if t0.Group != t1.Group {
+		return t0.Group < t1.Group
+	}
+	return t0.Element < t1.Element
+}
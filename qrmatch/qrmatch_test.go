@@ -0,0 +1,192 @@
+package qrmatch
+
+import (
+	"testing"
+
+	dicom "github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomtag"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newItem(elems ...*dicom.Element) *dicom.Element {
+	item := &dicom.Element{Tag: dicomtag.Item}
+	for _, elem := range elems {
+		item.Value = append(item.Value, elem)
+	}
+	return item
+}
+
+func newDataSet() *dicom.DataSet {
+	return &dicom.DataSet{Elements: []*dicom.Element{
+		dicom.MustNewElement(dicomtag.SpecificCharacterSet, "ISO_IR 100"),
+		dicom.MustNewElement(dicomtag.StudyDate, "20170105"),
+		dicom.MustNewElement(dicomtag.StudyTime, "134512.5"),
+		dicom.MustNewElement(dicomtag.Modality, "CT"),
+		dicom.MustNewElement(dicomtag.PatientName, "Doe^John "),
+		dicom.MustNewElement(dicomtag.PatientID, "P1"),
+		dicom.MustNewElement(dicomtag.StudyInstanceUID, "1.2.3"),
+		dicom.MustNewElement(dicomtag.SeriesInstanceUID, "1.2.3.4"),
+		dicom.MustNewElement(dicomtag.SOPInstanceUID, "1.2.3.4.5\x00"),
+		dicom.MustNewElement(dicomtag.ScheduledProcedureStepSequence,
+			newItem(dicom.MustNewElement(dicomtag.Modality, "MR"),
+				dicom.MustNewElement(dicomtag.ScheduledProcedureStepStartDate, "20170101")),
+			newItem(dicom.MustNewElement(dicomtag.Modality, "CT"),
+				dicom.MustNewElement(dicomtag.ScheduledProcedureStepStartDate, "20170102"))),
+	}}
+}
+
+func TestMatch(t *testing.T) {
+	ds := newDataSet()
+	for _, test := range []struct {
+		keys  []*dicom.Element
+		match bool
+	}{
+		// Universal matching.
+		{[]*dicom.Element{dicom.MustNewElement(dicomtag.PatientName)}, true},
+		{[]*dicom.Element{dicom.MustNewElement(dicomtag.PatientName, "")}, true},
+		{[]*dicom.Element{dicom.MustNewElement(dicomtag.PatientBirthDate, "")}, true},
+		{[]*dicom.Element{dicom.MustNewElement(dicomtag.PatientName, "*")}, true},
+		// Single value matching.
+		{[]*dicom.Element{dicom.MustNewElement(dicomtag.Modality, "CT")}, true},
+		{[]*dicom.Element{dicom.MustNewElement(dicomtag.Modality, "ct")}, false},
+		{[]*dicom.Element{dicom.MustNewElement(dicomtag.PatientBirthDate, "19700101")}, false},
+		{[]*dicom.Element{dicom.MustNewElement(dicomtag.QueryRetrieveLevel, "IMAGE")}, true},
+		// PN is case-insensitive.
+		{[]*dicom.Element{dicom.MustNewElement(dicomtag.PatientName, "DOE^JOHN")}, true},
+		{[]*dicom.Element{dicom.MustNewElement(dicomtag.PatientName, "doe*")}, true},
+		{[]*dicom.Element{dicom.MustNewElement(dicomtag.PatientName, "Doe")}, false},
+		// Wildcards.
+		{[]*dicom.Element{dicom.MustNewElement(dicomtag.PatientID, "P?")}, true},
+		{[]*dicom.Element{dicom.MustNewElement(dicomtag.PatientID, "P??")}, false},
+		{[]*dicom.Element{dicom.MustNewElement(dicomtag.PatientID, "*1")}, true},
+		{[]*dicom.Element{dicom.MustNewElement(dicomtag.PatientID, "*2")}, false},
+		// List of UID matching.
+		{[]*dicom.Element{dicom.MustNewElement(dicomtag.SOPInstanceUID, "1.2", "1.2.3.4.5")}, true},
+		{[]*dicom.Element{dicom.MustNewElement(dicomtag.SOPInstanceUID, "1.2", "1.2.3")}, false},
+		{[]*dicom.Element{dicom.MustNewElement(dicomtag.SOPInstanceUID, "1.2.3.4.*")}, false},
+		// Range matching.
+		{[]*dicom.Element{dicom.MustNewElement(dicomtag.StudyDate, "20170101-20170131")}, true},
+		{[]*dicom.Element{dicom.MustNewElement(dicomtag.StudyDate, "20170106-")}, false},
+		{[]*dicom.Element{dicom.MustNewElement(dicomtag.StudyDate, "-20170105")}, true},
+		{[]*dicom.Element{dicom.MustNewElement(dicomtag.StudyDate, "2017.01.05")}, true},
+		{[]*dicom.Element{dicom.MustNewElement(dicomtag.StudyTime, "13")}, true},
+		{[]*dicom.Element{dicom.MustNewElement(dicomtag.StudyTime, "1346-")}, false},
+		{[]*dicom.Element{dicom.MustNewElement(dicomtag.StudyTime, "-1345")}, true},
+		// Combined DA/TM matching: 2017-01-04 14:00 to 2017-01-05 13:00
+		// excludes 2017-01-05 13:45, while matching the date and the time
+		// separately would not.
+		{[]*dicom.Element{
+			dicom.MustNewElement(dicomtag.StudyDate, "20170104-20170105"),
+			dicom.MustNewElement(dicomtag.StudyTime, "1400-1300"),
+		}, false},
+		{[]*dicom.Element{
+			dicom.MustNewElement(dicomtag.StudyDate, "20170104-20170105"),
+			dicom.MustNewElement(dicomtag.StudyTime, "1400-1400"),
+		}, true},
+		{[]*dicom.Element{
+			dicom.MustNewElement(dicomtag.StudyDate, "20170105"),
+			dicom.MustNewElement(dicomtag.StudyTime, "1300-1400"),
+		}, true},
+		// Sequence matching.
+		{[]*dicom.Element{dicom.MustNewElement(dicomtag.ScheduledProcedureStepSequence)}, true},
+		{[]*dicom.Element{dicom.MustNewElement(dicomtag.ScheduledProcedureStepSequence, newItem())}, true},
+		{[]*dicom.Element{dicom.MustNewElement(dicomtag.ScheduledProcedureStepSequence,
+			newItem(dicom.MustNewElement(dicomtag.Modality, "CT"),
+				dicom.MustNewElement(dicomtag.ScheduledProcedureStepStartDate, "20170102")))}, true},
+		{[]*dicom.Element{dicom.MustNewElement(dicomtag.ScheduledProcedureStepSequence,
+			newItem(dicom.MustNewElement(dicomtag.Modality, "CT"),
+				dicom.MustNewElement(dicomtag.ScheduledProcedureStepStartDate, "20170101")))}, false},
+		// All keys must match.
+		{[]*dicom.Element{
+			dicom.MustNewElement(dicomtag.Modality, "CT"),
+			dicom.MustNewElement(dicomtag.PatientID, "P2"),
+		}, false},
+	} {
+		ok, err := Match(ds, test.keys)
+		require.NoError(t, err)
+		assert.Equal(t, test.match, ok, "keys %v", test.keys)
+	}
+
+	for _, key := range []*dicom.Element{
+		dicom.MustNewElement(dicomtag.StudyDate, "2017"),
+		dicom.MustNewElement(dicomtag.StudyDate, "-"),
+		dicom.MustNewElement(dicomtag.StudyTime, "1x"),
+	} {
+		_, err := Match(ds, []*dicom.Element{key})
+		assert.Error(t, err, "key %v", key)
+	}
+}
+
+func TestParseRange(t *testing.T) {
+	for _, test := range []struct {
+		vr, value    string
+		lower, upper string
+	}{
+		{"DA", "20170101", "20170101", "20170101"},
+		{"TM", "10", "100000.000000", "105959.999999"},
+		{"TM", "10:15-", "101500.000000", ""},
+		{"TM", "-101530.25", "", "101530.259999"},
+		{"DT", "2017", "20170101000000.000000", "20171231235959.999999"},
+		{"DT", "201701-20170102", "20170101000000.000000", "20170102235959.999999"},
+		{"DT", "20170101120000-0500", "20170101120000.000000", "20170101120000.999999"},
+		{"DT", "20170101120000-0500-", "20170101120000.000000", ""},
+	} {
+		r, err := parseRange(test.vr, test.value)
+		require.NoError(t, err, test.value)
+		assert.Equal(t, timeRange{test.lower, test.upper}, r, test.value)
+	}
+}
+
+func TestMatchWildcard(t *testing.T) {
+	assert.True(t, matchWildcard("", ""))
+	assert.True(t, matchWildcard("*", ""))
+	assert.True(t, matchWildcard("a*b*c", "aXbYbZc"))
+	assert.True(t, matchWildcard("a?c", "abc"))
+	assert.False(t, matchWildcard("a?c", "ac"))
+	assert.False(t, matchWildcard("a*b", "ac"))
+	assert.True(t, matchWildcard("*é", "café"))
+}
+
+func TestResponse(t *testing.T) {
+	ds := newDataSet()
+	keys := []*dicom.Element{
+		dicom.MustNewElement(dicomtag.QueryRetrieveLevel, "SERIES"),
+		dicom.MustNewElement(dicomtag.PatientName, "doe*"),
+		dicom.MustNewElement(dicomtag.StudyInstanceUID, "1.2.3"),
+		dicom.MustNewElement(dicomtag.PatientBirthDate),
+		dicom.MustNewElement(dicomtag.ScheduledProcedureStepSequence,
+			newItem(dicom.MustNewElement(dicomtag.Modality, "MR"))),
+	}
+	ok, err := Match(ds, keys)
+	require.NoError(t, err)
+	require.True(t, ok)
+	resp := Response(ds, keys)
+	var tags []dicomtag.Tag
+	for _, elem := range resp {
+		tags = append(tags, elem.Tag)
+	}
+	assert.Equal(t, []dicomtag.Tag{
+		dicomtag.SpecificCharacterSet,
+		dicomtag.QueryRetrieveLevel,
+		dicomtag.PatientName,
+		dicomtag.PatientBirthDate,
+		dicomtag.StudyInstanceUID,
+		dicomtag.SeriesInstanceUID,
+		dicomtag.ScheduledProcedureStepSequence,
+	}, tags)
+
+	elem, err := dicom.FindElementByTag(resp, dicomtag.PatientName)
+	require.NoError(t, err)
+	assert.Equal(t, "Doe^John ", elem.MustGetString())
+	elem, err = dicom.FindElementByTag(resp, dicomtag.PatientBirthDate)
+	require.NoError(t, err)
+	assert.Empty(t, elem.Value)
+	// Only the matching item, with only the requested attributes.
+	elem, err = dicom.FindElementByTag(resp, dicomtag.ScheduledProcedureStepSequence)
+	require.NoError(t, err)
+	require.Len(t, elem.Value, 1)
+	items := itemElements(elem.Value[0])
+	require.Len(t, items, 1)
+	assert.Equal(t, "MR", items[0].MustGetString())
+}
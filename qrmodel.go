@@ -0,0 +1,218 @@
+package netdicom
+
+// This file implements the Query/Retrieve information models of C-FIND, C-GET
+// and C-MOVE. P3.4, C.6.
+
+//go:generate stringer -type QRModel
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomtag"
+	"github.com/grailbio/go-dicom/dicomuid"
+)
+
+// QRModel is the Query/Retrieve information model of a C-FIND, C-GET or
+// C-MOVE request. It determines the SOP class of the request, and the levels
+// it may use.
+type QRModel int
+
+const (
+	// QRModelPatientRoot is the Patient Root model. It supports all the
+	// levels.  P3.4, C.6.1
+	QRModelPatientRoot QRModel = iota
+
+	// QRModelStudyRoot is the Study Root model. It supports all the levels
+	// but QRLevelPatient.  P3.4, C.6.2
+	QRModelStudyRoot
+
+	// QRModelPatientStudyOnly is the Patient/Study Only model, retired in
+	// 2006. It supports QRLevelPatient and QRLevelStudy.
+	QRModelPatientStudyOnly
+)
+
+// SOP classes of the Patient/Study Only model. go-dicom doesn't define them,
+// since the model is retired.
+const (
+	patientStudyOnlyQRFind = "1.2.840.10008.5.1.4.1.2.3.1"
+	patientStudyOnlyQRMove = "1.2.840.10008.5.1.4.1.2.3.2"
+	patientStudyOnlyQRGet  = "1.2.840.10008.5.1.4.1.2.3.3"
+)
+
+// QRQuery is a C-FIND, C-GET or C-MOVE request in terms of the
+// Query/Retrieve information model.
+type QRQuery struct {
+	Model QRModel
+	Level QRLevel
+	// Keys are the matching and return keys. QueryRetrieveLevel is derived
+	// from Level, so it need not be in Keys.
+	Keys []*dicom.Element
+}
+
+// Identifier returns the keys of the query, plus the QueryRetrieveLevel
+// element, if Keys lack it.
+func (q QRQuery) Identifier() []*dicom.Element {
+	elems := make([]*dicom.Element, 0, len(q.Keys)+1)
+	elems = append(elems, q.Keys...)
+	if _, err := dicom.FindElementByTag(q.Keys, dicomtag.QueryRetrieveLevel); err != nil {
+		elems = append(elems, dicom.MustNewElement(dicomtag.QueryRetrieveLevel, qrLevelString(q.Level)))
+	}
+	return elems
+}
+
+// qrLevelStrings lists the values of QueryRetrieveLevel, indexed by QRLevel.
+var qrLevelStrings = []string{"PATIENT", "STUDY", "SERIES", "IMAGE"}
+
+// qrLevelUniqueKeys lists the unique keys of the levels, indexed by QRLevel.
+// P3.4, C.6.1.1.
+var qrLevelUniqueKeys = []dicomtag.Tag{
+	dicomtag.PatientID,
+	dicomtag.StudyInstanceUID,
+	dicomtag.SeriesInstanceUID,
+	dicomtag.SOPInstanceUID,
+}
+
+func qrLevelString(level QRLevel) string {
+	if level < 0 || int(level) >= len(qrLevelStrings) {
+		return ""
+	}
+	return qrLevelStrings[level]
+}
+
+func parseQRLevel(s string) (QRLevel, error) {
+	s = strings.TrimSpace(s)
+	for i, v := range qrLevelStrings {
+		if v == s {
+			return QRLevel(i), nil
+		}
+	}
+	return 0, fmt.Errorf("dicom.QRQuery: unknown QueryRetrieveLevel '%s'", s)
+}
+
+// qrModelLevels returns the levels supported by the model, from the top.
+func qrModelLevels(model QRModel) []QRLevel {
+	switch model {
+	case QRModelPatientRoot:
+		return []QRLevel{QRLevelPatient, QRLevelStudy, QRLevelSeries, QRLevelImage}
+	case QRModelStudyRoot:
+		return []QRLevel{QRLevelStudy, QRLevelSeries, QRLevelImage}
+	case QRModelPatientStudyOnly:
+		return []QRLevel{QRLevelPatient, QRLevelStudy}
+	}
+	return nil
+}
+
+// qrSOPClassUID returns the SOP class of the operation in the model.
+func qrSOPClassUID(model QRModel, opType qrOpType) (string, error) {
+	var uids [3]string // Indexed by qrOpType.
+	switch model {
+	case QRModelPatientRoot:
+		uids = [3]string{dicomuid.PatientRootQRFind, dicomuid.PatientRootQRGet, dicomuid.PatientRootQRMove}
+	case QRModelStudyRoot:
+		uids = [3]string{dicomuid.StudyRootQRFind, dicomuid.StudyRootQRGet, dicomuid.StudyRootQRMove}
+	case QRModelPatientStudyOnly:
+		uids = [3]string{patientStudyOnlyQRFind, patientStudyOnlyQRGet, patientStudyOnlyQRMove}
+	default:
+		return "", fmt.Errorf("dicom.QRQuery: invalid model %v", model)
+	}
+	return uids[opType], nil
+}
+
+// qrModelForSOPClass returns the model of the SOP class.
+func qrModelForSOPClass(sopClassUID string) (QRModel, error) {
+	for _, model := range []QRModel{QRModelPatientRoot, QRModelStudyRoot, QRModelPatientStudyOnly} {
+		for _, opType := range []qrOpType{qrOpCFind, qrOpCGet, qrOpCMove} {
+			if uid, _ := qrSOPClassUID(model, opType); uid == sopClassUID {
+				return model, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("dicom.QRQuery: SOP class %s isn't a Query/Retrieve class", sopClassUID)
+}
+
+// validateQRQuery checks that the level is in the model, and that the keys
+// contain the unique keys of the levels above, each with a single value.
+// P3.4, C.4.1.2.1. For C-GET and C-MOVE, the unique key of the level itself
+// must have a value too, possibly a list. P3.4, C.4.2.2.1.
+func validateQRQuery(opType qrOpType, q QRQuery) error {
+	levels := qrModelLevels(q.Model)
+	if levels == nil {
+		return fmt.Errorf("dicom.QRQuery: invalid model %v", q.Model)
+	}
+	var above []QRLevel
+	found := false
+	for _, level := range levels {
+		if level == q.Level {
+			found = true
+			break
+		}
+		above = append(above, level)
+	}
+	if !found {
+		return fmt.Errorf("dicom.QRQuery: level %v isn't supported by %v", q.Level, q.Model)
+	}
+	if elem, err := dicom.FindElementByTag(q.Keys, dicomtag.QueryRetrieveLevel); err == nil {
+		s, err := elem.GetString()
+		if err != nil || strings.TrimSpace(s) != qrLevelString(q.Level) {
+			return fmt.Errorf("dicom.QRQuery: QueryRetrieveLevel element doesn't match level %v", q.Level)
+		}
+	}
+	for _, level := range above {
+		tag := qrLevelUniqueKeys[level]
+		values := uniqueKeyValues(q.Keys, tag)
+		if len(values) != 1 || strings.ContainsAny(values[0], "*?") {
+			return fmt.Errorf("dicom.QRQuery: level %v requires a single value of %v", q.Level, dicomtag.DebugString(tag))
+		}
+	}
+	if opType != qrOpCFind {
+		tag := qrLevelUniqueKeys[q.Level]
+		if len(uniqueKeyValues(q.Keys, tag)) == 0 {
+			return fmt.Errorf("dicom.QRQuery: retrieving at level %v requires %v", q.Level, dicomtag.DebugString(tag))
+		}
+	}
+	return nil
+}
+
+// uniqueKeyValues returns the nonempty values of the key.
+func uniqueKeyValues(keys []*dicom.Element, tag dicomtag.Tag) []string {
+	elem, err := dicom.FindElementByTag(keys, tag)
+	if err != nil {
+		return nil
+	}
+	var values []string
+	for _, v := range elem.Value {
+		if s, ok := v.(string); ok && strings.TrimSpace(s) != "" {
+			values = append(values, strings.TrimSpace(s))
+		}
+	}
+	return values
+}
+
+// decodeQRQuery builds the query of a request received by the provider, and
+// validates it. The QueryRetrieveLevel element is removed from the keys.
+func decodeQRQuery(opType qrOpType, sopClassUID string, elems []*dicom.Element) (QRQuery, error) {
+	model, err := qrModelForSOPClass(sopClassUID)
+	if err != nil {
+		return QRQuery{}, err
+	}
+	q := QRQuery{Model: model}
+	levelElem, err := dicom.FindElementByTag(elems, dicomtag.QueryRetrieveLevel)
+	if err != nil {
+		return q, fmt.Errorf("dicom.QRQuery: QueryRetrieveLevel not found")
+	}
+	s, err := levelElem.GetString()
+	if err != nil {
+		return q, fmt.Errorf("dicom.QRQuery: QueryRetrieveLevel: %v", err)
+	}
+	if q.Level, err = parseQRLevel(s); err != nil {
+		return q, err
+	}
+	for _, elem := range elems {
+		if elem.Tag != dicomtag.QueryRetrieveLevel {
+			q.Keys = append(q.Keys, elem)
+		}
+	}
+	return q, validateQRQuery(opType, q)
+}
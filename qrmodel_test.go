@@ -0,0 +1,141 @@
+package netdicom
+
+import (
+	"context"
+	"testing"
+
+	"github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomtag"
+	"github.com/grailbio/go-dicom/dicomuid"
+	"github.com/grailbio/go-netdicom/sopclass"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidateQRQuery(t *testing.T) {
+	patient := dicom.MustNewElement(dicomtag.PatientID, "P1")
+	study := dicom.MustNewElement(dicomtag.StudyInstanceUID, "1.2.3")
+	series := dicom.MustNewElement(dicomtag.SeriesInstanceUID, "1.2.3.4")
+	instance := dicom.MustNewElement(dicomtag.SOPInstanceUID, "1.2.3.4.5", "1.2.3.4.6")
+	for _, test := range []struct {
+		opType qrOpType
+		query  QRQuery
+		ok     bool
+	}{
+		{qrOpCFind, QRQuery{Model: QRModelPatientRoot, Level: QRLevelPatient}, true},
+		{qrOpCFind, QRQuery{Model: QRModelStudyRoot, Level: QRLevelStudy}, true},
+		{qrOpCFind, QRQuery{Model: QRModelStudyRoot, Level: QRLevelPatient}, false},
+		{qrOpCFind, QRQuery{Model: QRModelPatientStudyOnly, Level: QRLevelSeries}, false},
+		{qrOpCFind, QRQuery{Model: QRModelPatientRoot, Level: QRLevelStudy}, false},
+		{qrOpCFind, QRQuery{Model: QRModelPatientRoot, Level: QRLevelStudy,
+			Keys: []*dicom.Element{patient}}, true},
+		{qrOpCFind, QRQuery{Model: QRModelPatientRoot, Level: QRLevelStudy,
+			Keys: []*dicom.Element{dicom.MustNewElement(dicomtag.PatientID, "P*")}}, false},
+		{qrOpCFind, QRQuery{Model: QRModelStudyRoot, Level: QRLevelImage,
+			Keys: []*dicom.Element{study, series}}, true},
+		{qrOpCFind, QRQuery{Model: QRModelStudyRoot, Level: QRLevelImage,
+			Keys: []*dicom.Element{study}}, false},
+		{qrOpCFind, QRQuery{Model: QRModelStudyRoot, Level: QRLevelImage,
+			Keys: []*dicom.Element{study, dicom.MustNewElement(dicomtag.SeriesInstanceUID, "1.2", "1.3")}}, false},
+		{qrOpCFind, QRQuery{Model: QRModelStudyRoot, Level: QRLevelStudy,
+			Keys: []*dicom.Element{dicom.MustNewElement(dicomtag.QueryRetrieveLevel, "SERIES")}}, false},
+		{qrOpCGet, QRQuery{Model: QRModelStudyRoot, Level: QRLevelImage,
+			Keys: []*dicom.Element{study, series}}, false},
+		{qrOpCGet, QRQuery{Model: QRModelStudyRoot, Level: QRLevelImage,
+			Keys: []*dicom.Element{study, series, instance}}, true},
+		{qrOpCMove, QRQuery{Model: QRModelPatientStudyOnly, Level: QRLevelPatient,
+			Keys: []*dicom.Element{patient}}, true},
+	} {
+		err := validateQRQuery(test.opType, test.query)
+		assert.Equal(t, test.ok, err == nil, "query %+v: %v", test.query, err)
+	}
+}
+
+func TestQRSOPClassUID(t *testing.T) {
+	uid, err := qrSOPClassUID(QRModelStudyRoot, qrOpCMove)
+	require.NoError(t, err)
+	assert.Equal(t, dicomuid.StudyRootQRMove, uid)
+	uid, err = qrSOPClassUID(QRModelPatientStudyOnly, qrOpCGet)
+	require.NoError(t, err)
+	assert.Equal(t, patientStudyOnlyQRGet, uid)
+
+	model, err := qrModelForSOPClass(dicomuid.PatientRootQRGet)
+	require.NoError(t, err)
+	assert.Equal(t, QRModelPatientRoot, model)
+	_, err = qrModelForSOPClass(dicomuid.VerificationSOPClass)
+	assert.Error(t, err)
+}
+
+func TestDecodeQRQuery(t *testing.T) {
+	elems := []*dicom.Element{
+		dicom.MustNewElement(dicomtag.QueryRetrieveLevel, "IMAGE"),
+		dicom.MustNewElement(dicomtag.StudyInstanceUID, "1.2.3"),
+		dicom.MustNewElement(dicomtag.SeriesInstanceUID, "1.2.3.4"),
+	}
+	q, err := decodeQRQuery(qrOpCFind, dicomuid.StudyRootQRFind, elems)
+	require.NoError(t, err)
+	assert.Equal(t, QRModelStudyRoot, q.Model)
+	assert.Equal(t, QRLevelImage, q.Level)
+	assert.Equal(t, elems[1:], q.Keys)
+	assert.Equal(t, 3, len(q.Identifier()))
+
+	_, err = decodeQRQuery(qrOpCFind, dicomuid.PatientRootQRFind, elems)
+	assert.Error(t, err, "PatientID is missing")
+	_, err = decodeQRQuery(qrOpCFind, dicomuid.StudyRootQRFind, elems[1:])
+	assert.Error(t, err, "QueryRetrieveLevel is missing")
+}
+
+func TestCFindQueryImageLevel(t *testing.T) {
+	var received QRQuery
+	p, err := NewServiceProvider(ServiceProviderParams{
+		CFindQuery: func(conn ConnectionState, transferSyntaxUID, sopClassUID string, query QRQuery, ch chan CFindResult) {
+			received = query
+			ch <- CFindResult{Elements: []*dicom.Element{dicom.MustNewElement(dicomtag.SOPInstanceUID, "1.2.3.4.5")}}
+			close(ch)
+		},
+	}, ":0")
+	require.NoError(t, err)
+	go p.Run()
+
+	su, err := NewServiceUser(ServiceUserParams{SOPClasses: sopclass.QRFindClasses})
+	require.NoError(t, err)
+	su.Connect(p.ListenAddr().String())
+	defer su.Release()
+
+	// The provider rejects a query that lacks the unique keys of the
+	// higher levels. CFindQuery would catch it, so use CFind.
+	var errs []error
+	for result := range su.CFind(QRLevelImage, []*dicom.Element{dicom.MustNewElement(dicomtag.StudyInstanceUID, "1.2.3")}) {
+		if result.Err != nil {
+			errs = append(errs, result.Err)
+		}
+	}
+	assert.Equal(t, 1, len(errs))
+	assert.Nil(t, received.Keys, "the callback must not run")
+
+	query := QRQuery{
+		Model: QRModelStudyRoot,
+		Level: QRLevelImage,
+		Keys: []*dicom.Element{
+			dicom.MustNewElement(dicomtag.StudyInstanceUID, "1.2.3"),
+			dicom.MustNewElement(dicomtag.SeriesInstanceUID, "1.2.3.4"),
+			dicom.MustNewElement(dicomtag.SOPInstanceUID, ""),
+		},
+	}
+	var uids []string
+	for result := range su.CFindQuery(context.Background(), query) {
+		require.NoError(t, result.Err)
+		for _, elem := range result.Elements {
+			uids = append(uids, elem.MustGetString())
+		}
+	}
+	assert.Equal(t, []string{"1.2.3.4.5"}, uids)
+	assert.Equal(t, QRModelStudyRoot, received.Model)
+	assert.Equal(t, QRLevelImage, received.Level)
+	assert.Equal(t, 3, len(received.Keys))
+
+	query.Level = QRLevelPatient
+	for result := range su.CFindQuery(context.Background(), query) {
+		assert.Error(t, result.Err)
+	}
+}
@@ -0,0 +1,408 @@
+// Package query builds the identifiers of C-FIND, C-GET and C-MOVE requests
+// from typed values, and parses C-FIND responses into typed records.
+//
+// A Builder encodes each key the way PS3.4 C.2.2.2 expects: date and time
+// ranges with open ends, wildcards only in the VRs that allow them,
+// multi-valued UID lists, and zero-length return keys. It fills in
+// QueryRetrieveLevel and the return keys parsed by the record type of the
+// level.
+//
+// Example:
+//
+//	q, err := query.New(netdicom.QRLevelStudy).
+//		PatientName("DOE^J*").
+//		DateRange(dicomtag.StudyDate, time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), time.Time{}).
+//		Return(dicomtag.ReferringPhysicianName).
+//		Build()
+//	if err != nil {
+//		...
+//	}
+//	for result := range su.CFindQuery(ctx, q) {
+//		if result.Err != nil {
+//			...
+//		}
+//		if len(result.Elements) == 0 {
+//			continue
+//		}
+//		study, err := query.ParseStudy(result.Elements)
+//		...
+//	}
+package query
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	dicom "github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomtag"
+	"github.com/grailbio/go-netdicom"
+	"github.com/grailbio/go-netdicom/qrmatch"
+)
+
+// Formats of the DA, TM and DT values written by Builder.
+const (
+	dateFormat     = "20060102"
+	timeFormat     = "150405"
+	dateTimeFormat = "20060102150405"
+)
+
+// Builder builds a netdicom.QRQuery. Its methods record the first error,
+// which Build returns, so that calls can be chained. Setting a key again
+// replaces it.
+type Builder struct {
+	model netdicom.QRModel
+	level netdicom.QRLevel
+	keys  map[dicomtag.Tag]*dicom.Element
+	err   error
+}
+
+// New starts a query at the level. The model is Patient Root for
+// QRLevelPatient, and Study Root otherwise, as with ServiceUser.CFind. Call
+// Model to change it.
+func New(level netdicom.QRLevel) *Builder {
+	b := &Builder{model: netdicom.QRModelStudyRoot, level: level, keys: map[dicomtag.Tag]*dicom.Element{}}
+	if level == netdicom.QRLevelPatient {
+		b.model = netdicom.QRModelPatientRoot
+	}
+	return b
+}
+
+// Model sets the Query/Retrieve information model.
+func (b *Builder) Model(model netdicom.QRModel) *Builder {
+	b.model = model
+	return b
+}
+
+func (b *Builder) setErr(format string, args ...interface{}) *Builder {
+	if b.err == nil {
+		b.err = fmt.Errorf("query.Builder: "+format, args...)
+	}
+	return b
+}
+
+// vr returns the VR of the tag, or "" after recording an error.
+func (b *Builder) vr(tag dicomtag.Tag) string {
+	info, err := dicomtag.Find(tag)
+	if err != nil {
+		b.setErr("%v", err)
+		return ""
+	}
+	return info.VR
+}
+
+func (b *Builder) set(tag dicomtag.Tag, values ...interface{}) *Builder {
+	elem, err := dicom.NewElement(tag, values...)
+	if err != nil {
+		return b.setErr("%v", err)
+	}
+	b.keys[tag] = elem
+	return b
+}
+
+// Equal adds a key for single value matching. The value can't contain the
+// wildcards '*' and '?' if the VR of the tag allows them, since they can't be
+// escaped; use Wildcard instead. Nor can it contain '\', the value
+// delimiter. An empty value is a return key; use Return instead.
+func (b *Builder) Equal(tag dicomtag.Tag, value string) *Builder {
+	vr := b.vr(tag)
+	switch {
+	case vr == "":
+		return b
+	case vr == "SQ":
+		return b.setErr("%v: can't match a sequence by value", dicomtag.DebugString(tag))
+	case value == "":
+		return b.setErr("%v: empty value; use Return", dicomtag.DebugString(tag))
+	case strings.Contains(value, "\\"):
+		return b.setErr("%v: value %q contains the value delimiter '\\'", dicomtag.DebugString(tag), value)
+	case qrmatch.SupportsWildcard(vr) && strings.ContainsAny(value, "*?"):
+		return b.setErr("%v: value %q contains wildcards; use Wildcard", dicomtag.DebugString(tag), value)
+	case (vr == "DA" || vr == "TM" || vr == "DT") && strings.Contains(value, "-"):
+		return b.setErr("%v: value %q is a range; use DateRange, TimeRange or DateTimeRange", dicomtag.DebugString(tag), value)
+	case vr == "UI":
+		return b.UIDs(tag, value)
+	}
+	return b.set(tag, value)
+}
+
+// Wildcard adds a key for wildcard matching, where '*' matches any sequence of
+// characters and '?' any one character. The VR of the tag must be one that
+// allows wildcards, e.g., PN, LO, SH or CS.
+func (b *Builder) Wildcard(tag dicomtag.Tag, pattern string) *Builder {
+	vr := b.vr(tag)
+	if vr == "" {
+		return b
+	}
+	if !qrmatch.SupportsWildcard(vr) {
+		return b.setErr("%v: VR %s doesn't allow wildcards", dicomtag.DebugString(tag), vr)
+	}
+	if pattern == "" {
+		return b.setErr("%v: empty pattern; use Return", dicomtag.DebugString(tag))
+	}
+	return b.set(tag, pattern)
+}
+
+// UIDs adds a key for list of UID matching. PS3.4 C.2.2.2.2.
+func (b *Builder) UIDs(tag dicomtag.Tag, uids ...string) *Builder {
+	vr := b.vr(tag)
+	if vr == "" {
+		return b
+	}
+	if vr != "UI" {
+		return b.setErr("%v: VR %s isn't UI", dicomtag.DebugString(tag), vr)
+	}
+	if len(uids) == 0 {
+		return b.setErr("%v: no UIDs", dicomtag.DebugString(tag))
+	}
+	values := make([]interface{}, len(uids))
+	for i, uid := range uids {
+		if !validUID(uid) {
+			return b.setErr("%v: invalid UID %q", dicomtag.DebugString(tag), uid)
+		}
+		values[i] = uid
+	}
+	return b.set(tag, values...)
+}
+
+// validUID checks that "uid" is made of dot-separated numbers, at most 64
+// characters long. PS3.5 9.1.
+func validUID(uid string) bool {
+	if uid == "" || len(uid) > 64 {
+		return false
+	}
+	for _, c := range strings.Split(uid, ".") {
+		if c == "" || strings.Trim(c, "0123456789") != "" || (len(c) > 1 && c[0] == '0') {
+			return false
+		}
+	}
+	return true
+}
+
+// DateRange adds a DA key for range matching. A zero "from" or "to" leaves
+// that end open. If both are on the same day, the key matches that day only.
+// Only the dates of "from" and "to", in their own locations, are used.
+func (b *Builder) DateRange(tag dicomtag.Tag, from, to time.Time) *Builder {
+	return b.timeRange(tag, "DA", dateFormat, from, to)
+}
+
+// TimeRange adds a TM key for range matching. A zero "from" or "to" leaves
+// that end open. Only the clock times of "from" and "to", in their own
+// locations, are used, to the second.
+func (b *Builder) TimeRange(tag dicomtag.Tag, from, to time.Time) *Builder {
+	return b.timeRange(tag, "TM", timeFormat, from, to)
+}
+
+// DateTimeRange adds a DT key for range matching. A zero "from" or "to" leaves
+// that end open. The times are encoded in their own locations, to the second,
+// without offset.
+func (b *Builder) DateTimeRange(tag dicomtag.Tag, from, to time.Time) *Builder {
+	return b.timeRange(tag, "DT", dateTimeFormat, from, to)
+}
+
+func (b *Builder) timeRange(tag dicomtag.Tag, wantVR, format string, from, to time.Time) *Builder {
+	vr := b.vr(tag)
+	if vr == "" {
+		return b
+	}
+	if vr != wantVR {
+		return b.setErr("%v: VR %s isn't %s", dicomtag.DebugString(tag), vr, wantVR)
+	}
+	if from.IsZero() && to.IsZero() {
+		return b.setErr("%v: both ends of the range are open; use Return", dicomtag.DebugString(tag))
+	}
+	var lower, upper string
+	if !from.IsZero() {
+		lower = from.Format(format)
+	}
+	if !to.IsZero() {
+		upper = to.Format(format)
+	}
+	if lower != "" && upper != "" && lower > upper {
+		return b.setErr("%v: empty range %s-%s", dicomtag.DebugString(tag), lower, upper)
+	}
+	if lower == upper {
+		return b.set(tag, lower)
+	}
+	return b.set(tag, lower+"-"+upper)
+}
+
+// Return adds return keys, i.e., keys with no value, which match everything
+// and ask the provider to return the attribute. A tag that already has a
+// matching key is left alone.
+func (b *Builder) Return(tags ...dicomtag.Tag) *Builder {
+	for _, tag := range tags {
+		if _, ok := b.keys[tag]; !ok && b.vr(tag) != "" {
+			b.set(tag)
+		}
+	}
+	return b
+}
+
+// PatientID adds a key for the patient ID.
+func (b *Builder) PatientID(id string) *Builder {
+	return b.Equal(dicomtag.PatientID, id)
+}
+
+// PatientName adds a key for the patient name. The pattern may contain
+// wildcards, e.g., "DOE^J*".
+func (b *Builder) PatientName(pattern string) *Builder {
+	return b.Wildcard(dicomtag.PatientName, pattern)
+}
+
+// StudyInstanceUIDs adds a key for the study instance UIDs.
+func (b *Builder) StudyInstanceUIDs(uids ...string) *Builder {
+	return b.UIDs(dicomtag.StudyInstanceUID, uids...)
+}
+
+// SeriesInstanceUIDs adds a key for the series instance UIDs.
+func (b *Builder) SeriesInstanceUIDs(uids ...string) *Builder {
+	return b.UIDs(dicomtag.SeriesInstanceUID, uids...)
+}
+
+// SOPInstanceUIDs adds a key for the SOP instance UIDs.
+func (b *Builder) SOPInstanceUIDs(uids ...string) *Builder {
+	return b.UIDs(dicomtag.SOPInstanceUID, uids...)
+}
+
+// BuildRetrieve returns the identifier of a C-GET or C-MOVE. Unlike Build,
+// it adds no return keys: the keys are QueryRetrieveLevel and the unique keys
+// set on the Builder, sorted by tag. Any other key is an error, since a
+// retrieve matches on unique keys only. PS3.4 C.4.2.2.1. ServiceUser.CGetQuery
+// and CMoveQuery check that the unique keys of the levels above have a
+// single value.
+func (b *Builder) BuildRetrieve() (netdicom.QRQuery, error) {
+	if b.err != nil {
+		return netdicom.QRQuery{}, b.err
+	}
+	levelString := levelStrings[b.level]
+	if levelString == "" {
+		return netdicom.QRQuery{}, fmt.Errorf("query.Builder: invalid level %v", b.level)
+	}
+	uniqueKeys := map[dicomtag.Tag]bool{}
+	for _, level := range modelLevels[b.model] {
+		uniqueKeys[levelUniqueKeys[level]] = true
+		if level == b.level {
+			break
+		}
+	}
+	if !uniqueKeys[levelUniqueKeys[b.level]] {
+		return netdicom.QRQuery{}, fmt.Errorf("query.Builder: level %v isn't in model %v", b.level, b.model)
+	}
+	q := netdicom.QRQuery{Model: b.model, Level: b.level}
+	q.Keys = append(q.Keys, dicom.MustNewElement(dicomtag.QueryRetrieveLevel, levelString))
+	for tag, elem := range b.keys {
+		if !uniqueKeys[tag] {
+			return netdicom.QRQuery{}, fmt.Errorf("query.Builder: %v isn't a unique key at level %v; a retrieve can't use it", dicomtag.DebugString(tag), b.level)
+		}
+		if len(elem.Value) == 0 {
+			return netdicom.QRQuery{}, fmt.Errorf("query.Builder: %v is a return key; a retrieve can't use it", dicomtag.DebugString(tag))
+		}
+		q.Keys = append(q.Keys, elem)
+	}
+	sort.Slice(q.Keys, func(i, j int) bool { return q.Keys[i].Tag.Compare(q.Keys[j].Tag) < 0 })
+	return q, nil
+}
+
+// Build returns the query. Its keys are sorted by tag, and include
+// QueryRetrieveLevel and the return keys of DefaultReturnKeys, unless they
+// are set already.
+func (b *Builder) Build() (netdicom.QRQuery, error) {
+	if b.err != nil {
+		return netdicom.QRQuery{}, b.err
+	}
+	levelString := levelStrings[b.level]
+	if levelString == "" {
+		return netdicom.QRQuery{}, fmt.Errorf("query.Builder: invalid level %v", b.level)
+	}
+	keys := make(map[dicomtag.Tag]*dicom.Element, len(b.keys))
+	for tag, elem := range b.keys {
+		keys[tag] = elem
+	}
+	keys[dicomtag.QueryRetrieveLevel] = dicom.MustNewElement(dicomtag.QueryRetrieveLevel, levelString)
+	for _, tag := range DefaultReturnKeys(b.model, b.level) {
+		if _, ok := keys[tag]; !ok {
+			keys[tag] = dicom.MustNewElement(tag)
+		}
+	}
+	q := netdicom.QRQuery{Model: b.model, Level: b.level}
+	for _, elem := range keys {
+		q.Keys = append(q.Keys, elem)
+	}
+	sort.Slice(q.Keys, func(i, j int) bool { return q.Keys[i].Tag.Compare(q.Keys[j].Tag) < 0 })
+	return q, nil
+}
+
+var levelStrings = map[netdicom.QRLevel]string{
+	netdicom.QRLevelPatient: "PATIENT",
+	netdicom.QRLevelStudy:   "STUDY",
+	netdicom.QRLevelSeries:  "SERIES",
+	netdicom.QRLevelImage:   "IMAGE",
+}
+
+// levelUniqueKeys lists the unique key of each level. PS3.4 C.6.1.1.
+var levelUniqueKeys = map[netdicom.QRLevel]dicomtag.Tag{
+	netdicom.QRLevelPatient: dicomtag.PatientID,
+	netdicom.QRLevelStudy:   dicomtag.StudyInstanceUID,
+	netdicom.QRLevelSeries:  dicomtag.SeriesInstanceUID,
+	netdicom.QRLevelImage:   dicomtag.SOPInstanceUID,
+}
+
+// modelLevels lists the levels of each model, from the top.
+var modelLevels = map[netdicom.QRModel][]netdicom.QRLevel{
+	netdicom.QRModelPatientRoot:      {netdicom.QRLevelPatient, netdicom.QRLevelStudy, netdicom.QRLevelSeries, netdicom.QRLevelImage},
+	netdicom.QRModelStudyRoot:        {netdicom.QRLevelStudy, netdicom.QRLevelSeries, netdicom.QRLevelImage},
+	netdicom.QRModelPatientStudyOnly: {netdicom.QRLevelPatient, netdicom.QRLevelStudy},
+}
+
+// DefaultReturnKeys lists the return keys that Build adds at the level: the
+// attributes parsed by ParsePatient, ParseStudy, ParseSeries or
+// ParseInstance. The unique keys of the levels above are left out, since a
+// hierarchical query must set them.
+func DefaultReturnKeys(model netdicom.QRModel, level netdicom.QRLevel) []dicomtag.Tag {
+	switch level {
+	case netdicom.QRLevelPatient:
+		return []dicomtag.Tag{
+			dicomtag.PatientName,
+			dicomtag.PatientID,
+			dicomtag.PatientBirthDate,
+			dicomtag.PatientSex,
+			dicomtag.NumberOfPatientRelatedStudies,
+		}
+	case netdicom.QRLevelStudy:
+		tags := []dicomtag.Tag{
+			dicomtag.StudyDate,
+			dicomtag.StudyTime,
+			dicomtag.AccessionNumber,
+			dicomtag.StudyID,
+			dicomtag.StudyInstanceUID,
+			dicomtag.StudyDescription,
+			dicomtag.ModalitiesInStudy,
+			dicomtag.NumberOfStudyRelatedSeries,
+			dicomtag.NumberOfStudyRelatedInstances,
+		}
+		if model == netdicom.QRModelStudyRoot {
+			// In the Study Root model, the patient attributes
+			// belong to the study level.
+			tags = append(tags, dicomtag.PatientName, dicomtag.PatientID)
+		}
+		return tags
+	case netdicom.QRLevelSeries:
+		return []dicomtag.Tag{
+			dicomtag.SeriesDate,
+			dicomtag.SeriesTime,
+			dicomtag.Modality,
+			dicomtag.SeriesDescription,
+			dicomtag.SeriesInstanceUID,
+			dicomtag.SeriesNumber,
+			dicomtag.NumberOfSeriesRelatedInstances,
+		}
+	case netdicom.QRLevelImage:
+		return []dicomtag.Tag{
+			dicomtag.SOPClassUID,
+			dicomtag.SOPInstanceUID,
+			dicomtag.InstanceNumber,
+		}
+	}
+	return nil
+}
@@ -0,0 +1,268 @@
+package query_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	dicom "github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomtag"
+	"github.com/grailbio/go-netdicom"
+	"github.com/grailbio/go-netdicom/dimse"
+	"github.com/grailbio/go-netdicom/netdicomtest"
+	"github.com/grailbio/go-netdicom/query"
+	"github.com/grailbio/go-netdicom/sopclass"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func date(year int, month time.Month, day int) time.Time {
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+}
+
+// keyValues returns the keys of the query as tag -> values.
+func keyValues(t *testing.T, q netdicom.QRQuery) map[dicomtag.Tag][]string {
+	m := map[dicomtag.Tag][]string{}
+	for _, elem := range q.Keys {
+		values, err := elem.GetStrings()
+		require.NoError(t, err)
+		m[elem.Tag] = values
+	}
+	return m
+}
+
+func TestBuild(t *testing.T) {
+	q, err := query.New(netdicom.QRLevelStudy).
+		PatientName("DOE^J*").
+		DateRange(dicomtag.StudyDate, date(2020, 1, 1), time.Time{}).
+		TimeRange(dicomtag.StudyTime, time.Time{}, time.Date(0, 1, 1, 12, 30, 0, 0, time.UTC)).
+		StudyInstanceUIDs("1.2.3", "1.2.4").
+		Return(dicomtag.ReferringPhysicianName, dicomtag.PatientName).
+		Build()
+	require.NoError(t, err)
+	assert.Equal(t, netdicom.QRModelStudyRoot, q.Model)
+	assert.Equal(t, netdicom.QRLevelStudy, q.Level)
+	for i := 1; i < len(q.Keys); i++ {
+		assert.True(t, q.Keys[i-1].Tag.Compare(q.Keys[i].Tag) < 0, "keys: %v", q.Keys)
+	}
+	keys := keyValues(t, q)
+	assert.Equal(t, []string{"STUDY"}, keys[dicomtag.QueryRetrieveLevel])
+	assert.Equal(t, []string{"DOE^J*"}, keys[dicomtag.PatientName])
+	assert.Equal(t, []string{"20200101-"}, keys[dicomtag.StudyDate])
+	assert.Equal(t, []string{"-123000"}, keys[dicomtag.StudyTime])
+	assert.Equal(t, []string{"1.2.3", "1.2.4"}, keys[dicomtag.StudyInstanceUID])
+	for _, tag := range append(query.DefaultReturnKeys(q.Model, q.Level), dicomtag.ReferringPhysicianName) {
+		_, ok := keys[tag]
+		assert.True(t, ok, "missing return key %v", dicomtag.DebugString(tag))
+	}
+	assert.Empty(t, keys[dicomtag.AccessionNumber])
+	assert.Empty(t, keys[dicomtag.ReferringPhysicianName])
+
+	// A range that ends on the day it starts is a single date.
+	q, err = query.New(netdicom.QRLevelSeries).
+		StudyInstanceUIDs("1.2.3").
+		DateRange(dicomtag.SeriesDate, date(2020, 3, 15), time.Date(2020, 3, 15, 23, 0, 0, 0, time.UTC)).
+		Equal(dicomtag.Modality, "CT").
+		Build()
+	require.NoError(t, err)
+	keys = keyValues(t, q)
+	assert.Equal(t, []string{"SERIES"}, keys[dicomtag.QueryRetrieveLevel])
+	assert.Equal(t, []string{"20200315"}, keys[dicomtag.SeriesDate])
+	assert.Equal(t, []string{"CT"}, keys[dicomtag.Modality])
+	assert.Equal(t, []string{"1.2.3"}, keys[dicomtag.StudyInstanceUID])
+	_, ok := keys[dicomtag.PatientName]
+	assert.False(t, ok)
+
+	q, err = query.New(netdicom.QRLevelImage).
+		DateTimeRange(dicomtag.AcquisitionDateTime, date(2020, 1, 1), time.Date(2020, 1, 2, 8, 0, 0, 0, time.UTC)).
+		Build()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"20200101000000-20200102080000"}, keyValues(t, q)[dicomtag.AcquisitionDateTime])
+}
+
+func TestDefaultReturnKeys(t *testing.T) {
+	// The patient attributes are returned at study level only in the Study
+	// Root model.
+	q, err := query.New(netdicom.QRLevelStudy).Model(netdicom.QRModelPatientRoot).PatientID("P1").Build()
+	require.NoError(t, err)
+	keys := keyValues(t, q)
+	assert.Equal(t, []string{"P1"}, keys[dicomtag.PatientID])
+	_, ok := keys[dicomtag.PatientName]
+	assert.False(t, ok)
+
+	q, err = query.New(netdicom.QRLevelPatient).Build()
+	require.NoError(t, err)
+	assert.Equal(t, netdicom.QRModelPatientRoot, q.Model)
+	keys = keyValues(t, q)
+	assert.Equal(t, []string{"PATIENT"}, keys[dicomtag.QueryRetrieveLevel])
+	_, ok = keys[dicomtag.PatientBirthDate]
+	assert.True(t, ok)
+}
+
+func TestBuildErrors(t *testing.T) {
+	for name, b := range map[string]*query.Builder{
+		"wildcard in UI":      query.New(netdicom.QRLevelStudy).Wildcard(dicomtag.StudyInstanceUID, "1.2.*"),
+		"wildcard via Equal":  query.New(netdicom.QRLevelStudy).Equal(dicomtag.PatientName, "DOE*"),
+		"range via Equal":     query.New(netdicom.QRLevelStudy).Equal(dicomtag.StudyDate, "20200101-"),
+		"backslash in Equal":  query.New(netdicom.QRLevelStudy).Equal(dicomtag.PatientID, `P1\P2`),
+		"empty value":         query.New(netdicom.QRLevelStudy).Equal(dicomtag.PatientID, ""),
+		"empty range":         query.New(netdicom.QRLevelStudy).DateRange(dicomtag.StudyDate, date(2020, 2, 1), date(2020, 1, 1)),
+		"open range":          query.New(netdicom.QRLevelStudy).DateRange(dicomtag.StudyDate, time.Time{}, time.Time{}),
+		"wrong VR for range":  query.New(netdicom.QRLevelStudy).DateRange(dicomtag.StudyTime, date(2020, 1, 1), time.Time{}),
+		"invalid UID":         query.New(netdicom.QRLevelStudy).StudyInstanceUIDs("1.02.3"),
+		"no UIDs":             query.New(netdicom.QRLevelStudy).StudyInstanceUIDs(),
+		"UIDs of a non-UI VR": query.New(netdicom.QRLevelStudy).UIDs(dicomtag.PatientID, "1.2.3"),
+		"invalid level":       query.New(netdicom.QRLevel(42)),
+	} {
+		_, err := b.Build()
+		assert.Error(t, err, name)
+	}
+}
+
+func TestParse(t *testing.T) {
+	elems := []*dicom.Element{
+		dicom.MustNewElement(dicomtag.StudyDate, "2020.03.15"),
+		dicom.MustNewElement(dicomtag.StudyTime, "10:15:30.25"),
+		dicom.MustNewElement(dicomtag.AccessionNumber, "A1 "),
+		dicom.MustNewElement(dicomtag.ModalitiesInStudy, "CT", "SR"),
+		dicom.MustNewElement(dicomtag.PatientName, "DOE^JOHN"),
+		dicom.MustNewElement(dicomtag.StudyInstanceUID, "1.2.3\x00"),
+		dicom.MustNewElement(dicomtag.NumberOfStudyRelatedInstances, " +12 "),
+		dicom.MustNewElement(dicomtag.RetrieveAETitle, "PACS1", "PACS2"),
+		dicom.MustNewElement(dicomtag.StudyDescription),
+	}
+	study, err := query.ParseStudy(elems)
+	require.NoError(t, err)
+	assert.Equal(t, query.Study{
+		StudyInstanceUID:         "1.2.3",
+		Date:                     time.Date(2020, 3, 15, 10, 15, 30, 250000000, time.UTC),
+		AccessionNumber:          "A1",
+		ModalitiesInStudy:        []string{"CT", "SR"},
+		PatientName:              "DOE^JOHN",
+		NumberOfRelatedInstances: 12,
+		RetrieveAETitles:         []string{"PACS1", "PACS2"},
+		Elements:                 elems,
+	}, study)
+
+	series, err := query.ParseSeries([]*dicom.Element{
+		dicom.MustNewElement(dicomtag.SeriesDate, "20200315"),
+		dicom.MustNewElement(dicomtag.SeriesTime, "1015"),
+		dicom.MustNewElement(dicomtag.SeriesNumber, "3"),
+	})
+	require.NoError(t, err)
+	assert.Equal(t, time.Date(2020, 3, 15, 10, 15, 0, 0, time.UTC), series.Date)
+	assert.Equal(t, 3, series.SeriesNumber)
+
+	patient, err := query.ParsePatient([]*dicom.Element{dicom.MustNewElement(dicomtag.PatientBirthDate, "19700101")})
+	require.NoError(t, err)
+	assert.Equal(t, date(1970, 1, 1), patient.BirthDate)
+
+	for _, elem := range []*dicom.Element{
+		dicom.MustNewElement(dicomtag.SeriesDate, "2020-03-15"),
+		dicom.MustNewElement(dicomtag.SeriesTime, "25"),
+		dicom.MustNewElement(dicomtag.SeriesTime, "10153"),
+		dicom.MustNewElement(dicomtag.SeriesNumber, "three"),
+	} {
+		elems := []*dicom.Element{elem}
+		if elem.Tag == dicomtag.SeriesTime {
+			elems = append(elems, dicom.MustNewElement(dicomtag.SeriesDate, "20200315"))
+		}
+		_, err := query.ParseSeries(elems)
+		assert.Error(t, err, "element: %v", elem)
+	}
+}
+
+// TestCFind runs a built query against a PACS, and parses the matches.
+func TestCFind(t *testing.T) {
+	ds := netdicomtest.WithElements(netdicomtest.ReadDataSet(t, "../testdata/reportsi.dcm"),
+		dicom.MustNewElement(dicomtag.StudyDate, "20200315"),
+		dicom.MustNewElement(dicomtag.StudyTime, "101500"))
+	pacs := netdicomtest.NewPACS(netdicomtest.Params{AETitle: "PACS"})
+	require.NoError(t, pacs.AddDataSet(ds))
+	su := pacs.NewUser(t, netdicom.ServiceUserParams{SOPClasses: sopclass.QRFindClasses})
+	defer su.Release()
+
+	find := func(from, to time.Time) []query.Study {
+		q, err := query.New(netdicom.QRLevelStudy).
+			PatientName("Last*").
+			DateRange(dicomtag.StudyDate, from, to).
+			Build()
+		require.NoError(t, err)
+		var studies []query.Study
+		for result := range su.CFindQuery(context.Background(), q) {
+			require.NoError(t, result.Err)
+			if len(result.Elements) == 0 {
+				continue
+			}
+			study, err := query.ParseStudy(result.Elements)
+			require.NoError(t, err)
+			studies = append(studies, study)
+		}
+		return studies
+	}
+	studies := find(date(2020, 1, 1), time.Time{})
+	require.Equal(t, 1, len(studies))
+	assert.Equal(t, "1.2.276.0.7230010.3.1.2.1787205428.166.1117461927.5", studies[0].StudyInstanceUID)
+	assert.Equal(t, "Last Name^First Name", studies[0].PatientName)
+	assert.Equal(t, time.Date(2020, 3, 15, 10, 15, 0, 0, time.UTC), studies[0].Date)
+
+	assert.Empty(t, find(time.Time{}, date(2019, 12, 31)))
+}
+
+func TestBuildRetrieve(t *testing.T) {
+	q, err := query.New(netdicom.QRLevelSeries).
+		StudyInstanceUIDs("1.2.3").
+		SeriesInstanceUIDs("1.2.3.1", "1.2.3.2").
+		BuildRetrieve()
+	require.NoError(t, err)
+	assert.Equal(t, map[dicomtag.Tag][]string{
+		dicomtag.QueryRetrieveLevel: {"SERIES"},
+		dicomtag.StudyInstanceUID:   {"1.2.3"},
+		dicomtag.SeriesInstanceUID:  {"1.2.3.1", "1.2.3.2"},
+	}, keyValues(t, q))
+
+	q, err = query.New(netdicom.QRLevelStudy).Model(netdicom.QRModelPatientRoot).
+		PatientID("P1").
+		StudyInstanceUIDs("1.2.3").
+		BuildRetrieve()
+	require.NoError(t, err)
+	assert.Equal(t, map[dicomtag.Tag][]string{
+		dicomtag.QueryRetrieveLevel: {"STUDY"},
+		dicomtag.PatientID:          {"P1"},
+		dicomtag.StudyInstanceUID:   {"1.2.3"},
+	}, keyValues(t, q))
+}
+
+func TestBuildRetrieveErrors(t *testing.T) {
+	for name, b := range map[string]*query.Builder{
+		"non-unique key":        query.New(netdicom.QRLevelStudy).StudyInstanceUIDs("1.2.3").PatientName("DOE*"),
+		"return key":            query.New(netdicom.QRLevelStudy).StudyInstanceUIDs("1.2.3").Return(dicomtag.StudyDate),
+		"empty unique key":      query.New(netdicom.QRLevelStudy).Return(dicomtag.StudyInstanceUID),
+		"key below the level":   query.New(netdicom.QRLevelStudy).StudyInstanceUIDs("1.2.3").SeriesInstanceUIDs("1.2.3.1"),
+		"patient in Study Root": query.New(netdicom.QRLevelStudy).PatientID("P1").StudyInstanceUIDs("1.2.3"),
+		"level not in model":    query.New(netdicom.QRLevelPatient).Model(netdicom.QRModelStudyRoot).PatientID("P1"),
+		"invalid level":         query.New(netdicom.QRLevel(42)),
+	} {
+		_, err := b.BuildRetrieve()
+		assert.Error(t, err, name)
+	}
+}
+
+func TestCGet(t *testing.T) {
+	pacs := netdicomtest.NewPACS(netdicomtest.Params{AETitle: "PACS"})
+	require.NoError(t, pacs.AddDataSet(netdicomtest.ReadDataSet(t, "../testdata/reportsi.dcm")))
+	su := pacs.NewUser(t, netdicom.ServiceUserParams{SOPClasses: sopclass.QRGetClasses})
+	defer su.Release()
+
+	q, err := query.New(netdicom.QRLevelStudy).
+		StudyInstanceUIDs("1.2.276.0.7230010.3.1.2.1787205428.166.1117461927.5").
+		BuildRetrieve()
+	require.NoError(t, err)
+	var uids []string
+	err = su.CGetQuery(context.Background(), q, func(transferSyntaxUID, sopClassUID, sopInstanceUID string, data []byte) dimse.Status {
+		uids = append(uids, sopInstanceUID)
+		return dimse.Success
+	})
+	require.NoError(t, err)
+	assert.Equal(t, 1, len(uids))
+}
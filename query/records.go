@@ -0,0 +1,257 @@
+package query
+
+// This file parses C-FIND responses into typed records.
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	dicom "github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomtag"
+)
+
+// Patient is a patient-level C-FIND match.
+type Patient struct {
+	PatientID   string
+	PatientName string
+	// BirthDate is zero if unknown.
+	BirthDate              time.Time
+	Sex                    string
+	NumberOfRelatedStudies int
+	// Elements are all the elements of the match.
+	Elements []*dicom.Element
+}
+
+// Study is a study-level C-FIND match.
+type Study struct {
+	StudyInstanceUID string
+	// Date combines StudyDate and StudyTime. It is zero if StudyDate is
+	// unknown.
+	Date                     time.Time
+	AccessionNumber          string
+	StudyID                  string
+	Description              string
+	ModalitiesInStudy        []string
+	PatientID                string
+	PatientName              string
+	NumberOfRelatedSeries    int
+	NumberOfRelatedInstances int
+	// RetrieveAETitles lists the AEs that the study can be retrieved from,
+	// if the provider says so.
+	RetrieveAETitles []string
+	Elements         []*dicom.Element
+}
+
+// Series is a series-level C-FIND match.
+type Series struct {
+	StudyInstanceUID  string
+	SeriesInstanceUID string
+	// Date combines SeriesDate and SeriesTime. It is zero if SeriesDate is
+	// unknown.
+	Date                     time.Time
+	Modality                 string
+	Description              string
+	SeriesNumber             int
+	NumberOfRelatedInstances int
+	RetrieveAETitles         []string
+	Elements                 []*dicom.Element
+}
+
+// Instance is an image-level C-FIND match.
+type Instance struct {
+	StudyInstanceUID  string
+	SeriesInstanceUID string
+	SOPInstanceUID    string
+	SOPClassUID       string
+	InstanceNumber    int
+	RetrieveAETitles  []string
+	Elements          []*dicom.Element
+}
+
+// ParsePatient parses a patient-level match. Missing attributes are left
+// zero. It returns an error if an attribute is malformed.
+func ParsePatient(elems []*dicom.Element) (Patient, error) {
+	p := parser{elems: elems}
+	r := Patient{
+		PatientID:              p.str(dicomtag.PatientID),
+		PatientName:            p.str(dicomtag.PatientName),
+		BirthDate:              p.dateTime(dicomtag.PatientBirthDate, dicomtag.Tag{}),
+		Sex:                    p.str(dicomtag.PatientSex),
+		NumberOfRelatedStudies: p.int(dicomtag.NumberOfPatientRelatedStudies),
+		Elements:               elems,
+	}
+	return r, p.err
+}
+
+// ParseStudy parses a study-level match. Missing attributes are left zero. It
+// returns an error if an attribute is malformed.
+func ParseStudy(elems []*dicom.Element) (Study, error) {
+	p := parser{elems: elems}
+	r := Study{
+		StudyInstanceUID:         p.str(dicomtag.StudyInstanceUID),
+		Date:                     p.dateTime(dicomtag.StudyDate, dicomtag.StudyTime),
+		AccessionNumber:          p.str(dicomtag.AccessionNumber),
+		StudyID:                  p.str(dicomtag.StudyID),
+		Description:              p.str(dicomtag.StudyDescription),
+		ModalitiesInStudy:        p.strs(dicomtag.ModalitiesInStudy),
+		PatientID:                p.str(dicomtag.PatientID),
+		PatientName:              p.str(dicomtag.PatientName),
+		NumberOfRelatedSeries:    p.int(dicomtag.NumberOfStudyRelatedSeries),
+		NumberOfRelatedInstances: p.int(dicomtag.NumberOfStudyRelatedInstances),
+		RetrieveAETitles:         p.strs(dicomtag.RetrieveAETitle),
+		Elements:                 elems,
+	}
+	return r, p.err
+}
+
+// ParseSeries parses a series-level match. Missing attributes are left zero.
+// It returns an error if an attribute is malformed.
+func ParseSeries(elems []*dicom.Element) (Series, error) {
+	p := parser{elems: elems}
+	r := Series{
+		StudyInstanceUID:         p.str(dicomtag.StudyInstanceUID),
+		SeriesInstanceUID:        p.str(dicomtag.SeriesInstanceUID),
+		Date:                     p.dateTime(dicomtag.SeriesDate, dicomtag.SeriesTime),
+		Modality:                 p.str(dicomtag.Modality),
+		Description:              p.str(dicomtag.SeriesDescription),
+		SeriesNumber:             p.int(dicomtag.SeriesNumber),
+		NumberOfRelatedInstances: p.int(dicomtag.NumberOfSeriesRelatedInstances),
+		RetrieveAETitles:         p.strs(dicomtag.RetrieveAETitle),
+		Elements:                 elems,
+	}
+	return r, p.err
+}
+
+// ParseInstance parses an image-level match. Missing attributes are left
+// zero. It returns an error if an attribute is malformed.
+func ParseInstance(elems []*dicom.Element) (Instance, error) {
+	p := parser{elems: elems}
+	r := Instance{
+		StudyInstanceUID:  p.str(dicomtag.StudyInstanceUID),
+		SeriesInstanceUID: p.str(dicomtag.SeriesInstanceUID),
+		SOPInstanceUID:    p.str(dicomtag.SOPInstanceUID),
+		SOPClassUID:       p.str(dicomtag.SOPClassUID),
+		InstanceNumber:    p.int(dicomtag.InstanceNumber),
+		RetrieveAETitles:  p.strs(dicomtag.RetrieveAETitle),
+		Elements:          elems,
+	}
+	return r, p.err
+}
+
+// parser extracts typed values from the elements of a match. It records the
+// first error.
+type parser struct {
+	elems []*dicom.Element
+	err   error
+}
+
+func (p *parser) setErr(tag dicomtag.Tag, err error) {
+	if p.err == nil {
+		p.err = fmt.Errorf("query: %v: %v", dicomtag.DebugString(tag), err)
+	}
+}
+
+// strs returns the values of the tag, with the padding removed.
+func (p *parser) strs(tag dicomtag.Tag) []string {
+	elem, err := dicom.FindElementByTag(p.elems, tag)
+	if err != nil || len(elem.Value) == 0 {
+		return nil
+	}
+	values, err := elem.GetStrings()
+	if err != nil {
+		p.setErr(tag, err)
+		return nil
+	}
+	var result []string
+	for _, v := range values {
+		if v = strings.TrimRight(v, "\x00 "); v != "" {
+			result = append(result, strings.TrimLeft(v, " "))
+		}
+	}
+	return result
+}
+
+// str returns the first value of the tag, or "".
+func (p *parser) str(tag dicomtag.Tag) string {
+	if values := p.strs(tag); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// int parses an IS value. It returns 0 if the tag is missing.
+func (p *parser) int(tag dicomtag.Tag) int {
+	s := p.str(tag)
+	if s == "" {
+		return 0
+	}
+	n, err := strconv.Atoi(strings.TrimPrefix(s, "+"))
+	if err != nil {
+		p.setErr(tag, err)
+	}
+	return n
+}
+
+// dateTime parses a DA value and, if timeTag is set, a TM value. DICOM dates
+// and times carry no time zone; the result is in UTC. It returns the zero
+// time if the date is missing.
+func (p *parser) dateTime(dateTag, timeTag dicomtag.Tag) time.Time {
+	date := p.str(dateTag)
+	if date == "" {
+		return time.Time{}
+	}
+	// ACR-NEMA dates, "YYYY.MM.DD", are still seen in the wild.
+	d, err := time.Parse(dateFormat, strings.Replace(date, ".", "", -1))
+	if err != nil {
+		p.setErr(dateTag, err)
+		return time.Time{}
+	}
+	if timeTag == (dicomtag.Tag{}) {
+		return d
+	}
+	tm := p.str(timeTag)
+	if tm == "" {
+		return d
+	}
+	clock, err := parseTime(tm)
+	if err != nil {
+		p.setErr(timeTag, err)
+		return d
+	}
+	return d.Add(clock)
+}
+
+// parseTime parses a TM value, "HH[MM[SS[.F{1,6}]]]", into the time since
+// midnight. The ACR-NEMA form "HH:MM:SS" is accepted too.
+func parseTime(s string) (time.Duration, error) {
+	s = strings.Replace(s, ":", "", -1)
+	frac := ""
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		s, frac = s[:i], s[i+1:]
+	}
+	if len(s) != 2 && len(s) != 4 && len(s) != 6 || len(frac) > 6 {
+		return 0, fmt.Errorf("invalid time %q", s)
+	}
+	var d time.Duration
+	units := []struct {
+		unit time.Duration
+		max  int
+	}{{time.Hour, 23}, {time.Minute, 59}, {time.Second, 60}}
+	for i := 0; i < len(s); i += 2 {
+		n, err := strconv.Atoi(s[i : i+2])
+		if err != nil || n < 0 || n > units[i/2].max {
+			return 0, fmt.Errorf("invalid time %q", s)
+		}
+		d += time.Duration(n) * units[i/2].unit
+	}
+	if frac != "" {
+		n, err := strconv.Atoi(frac + strings.Repeat("0", 6-len(frac)))
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid time fraction %q", frac)
+		}
+		d += time.Duration(n) * time.Microsecond
+	}
+	return d, nil
+}
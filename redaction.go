@@ -0,0 +1,92 @@
+package netdicom
+
+// This file defines RedactionPolicy, which keeps dataset contents (e.g.,
+// patient names) out of log entries.
+
+import (
+	"fmt"
+	"strings"
+
+	dicom "github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomtag"
+)
+
+// RedactionPolicy controls how DICOM elements are rendered in log
+// entries. When a policy is set, an element is logged as its tag and VR only;
+// its values are replaced by "<redacted>" unless the tag is in AllowedTags.
+// Sequences are traversed, so allowed tags nested in an item are still shown.
+//
+// A nil *RedactionPolicy logs elements verbatim.
+type RedactionPolicy struct {
+	// AllowedTags lists the tags whose values are safe to log.
+	AllowedTags []dicomtag.Tag
+}
+
+// DefaultRedactionAllowedTags are the tags whose values carry no PHI: the
+// query/retrieve level, the transfer syntax, and the UIDs that identify
+// studies, series, instances, and SOP classes.
+var DefaultRedactionAllowedTags = []dicomtag.Tag{
+	dicomtag.QueryRetrieveLevel,
+	dicomtag.SpecificCharacterSet,
+	dicomtag.TransferSyntaxUID,
+	dicomtag.MediaStorageSOPClassUID,
+	dicomtag.MediaStorageSOPInstanceUID,
+	dicomtag.SOPClassUID,
+	dicomtag.SOPInstanceUID,
+	dicomtag.StudyInstanceUID,
+	dicomtag.SeriesInstanceUID,
+}
+
+// NewDefaultRedactionPolicy creates a policy that allows
+// DefaultRedactionAllowedTags.
+func NewDefaultRedactionPolicy() *RedactionPolicy {
+	tags := make([]dicomtag.Tag, len(DefaultRedactionAllowedTags))
+	copy(tags, DefaultRedactionAllowedTags)
+	return &RedactionPolicy{AllowedTags: tags}
+}
+
+func (p *RedactionPolicy) allowed(tag dicomtag.Tag) bool {
+	for _, t := range p.AllowedTags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// ElementString renders "elem" for logging.
+func (p *RedactionPolicy) ElementString(elem *dicom.Element) string {
+	if p == nil || elem == nil || p.allowed(elem.Tag) {
+		return fmt.Sprint(elem)
+	}
+	if elem.VR == "SQ" || elem.Tag == dicomtag.Item {
+		// Sequence or item: the values are *dicom.Elements.
+		children := make([]string, 0, len(elem.Value))
+		for _, v := range elem.Value {
+			if child, ok := v.(*dicom.Element); ok {
+				children = append(children, p.ElementString(child))
+			} else {
+				children = append(children, "<redacted>")
+			}
+		}
+		return fmt.Sprintf("%s %s [%s]", dicomtag.DebugString(elem.Tag), elem.VR, strings.Join(children, ", "))
+	}
+	return fmt.Sprintf("%s %s <redacted>", dicomtag.DebugString(elem.Tag), elem.VR)
+}
+
+// ElementsString renders a list of elements for logging.
+func (p *RedactionPolicy) ElementsString(elems []*dicom.Element) string {
+	s := make([]string, len(elems))
+	for i, elem := range elems {
+		s[i] = p.ElementString(elem)
+	}
+	return "[" + strings.Join(s, ", ") + "]"
+}
+
+// DataSetString renders "ds" for logging.
+func (p *RedactionPolicy) DataSetString(ds *dicom.DataSet) string {
+	if ds == nil {
+		return "<nil>"
+	}
+	return p.ElementsString(ds.Elements)
+}
@@ -0,0 +1,47 @@
+package netdicom
+
+import (
+	"strings"
+	"testing"
+
+	dicom "github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomtag"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedactionPolicy(t *testing.T) {
+	elems := []*dicom.Element{
+		dicom.MustNewElement(dicomtag.QueryRetrieveLevel, "STUDY"),
+		dicom.MustNewElement(dicomtag.PatientName, "Doe^John"),
+		dicom.MustNewElement(dicomtag.StudyInstanceUID, "1.2.3.4"),
+		dicom.MustNewElement(dicomtag.PatientID, "MRN12345"),
+	}
+
+	// A nil policy logs everything.
+	var nilPolicy *RedactionPolicy
+	s := nilPolicy.ElementsString(elems)
+	assert.Contains(t, s, "Doe^John")
+	assert.Contains(t, s, "MRN12345")
+
+	s = NewDefaultRedactionPolicy().ElementsString(elems)
+	assert.Contains(t, s, "STUDY")
+	assert.Contains(t, s, "1.2.3.4")
+	assert.NotContains(t, s, "Doe^John")
+	assert.NotContains(t, s, "MRN12345")
+	assert.Equal(t, 2, strings.Count(s, "<redacted>"), s)
+
+	s = (&RedactionPolicy{AllowedTags: []dicomtag.Tag{dicomtag.PatientID}}).ElementsString(elems)
+	assert.Contains(t, s, "MRN12345")
+	assert.NotContains(t, s, "Doe^John")
+	assert.NotContains(t, s, "1.2.3.4")
+}
+
+func TestRedactionPolicySequence(t *testing.T) {
+	item := dicom.MustNewElement(dicomtag.Item,
+		dicom.MustNewElement(dicomtag.PatientName, "Doe^John"),
+		dicom.MustNewElement(dicomtag.SOPInstanceUID, "1.2.3.4.5"))
+	seq := dicom.MustNewElement(dicomtag.ScheduledProcedureStepSequence, item)
+	s := NewDefaultRedactionPolicy().ElementString(seq)
+	assert.Contains(t, s, "1.2.3.4.5")
+	assert.NotContains(t, s, "Doe^John")
+}
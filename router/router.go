@@ -0,0 +1,555 @@
+// Package router implements a DICOM store-and-forward router.
+//
+// A Router accepts associations as a netdicom.ServiceProvider, and forwards
+// the instances it receives by C-STORE to upstream AEs through
+// netdicom.ServiceUser. Rules pick the destinations of each instance by
+// calling or called AE title, SOP class, modality or any other tag. The
+// dataset is forwarded as received, unless the destination doesn't accept
+// its transfer syntax. Then an uncompressed dataset is re-encoded, and a
+// compressed one fails to forward.
+//
+// By default the router answers a C-STORE as soon as the instance is queued,
+// and forwards it in the background. An instance that then fails to forward
+// is not retried: the failure is only logged and reported to
+// Params.OnForward, and the sender is never told. With Params.Synchronous,
+// the router answers after the destinations have, passing their status back
+// to the sender, which can retry.
+//
+// Example:
+//
+//	r, err := router.New(router.Params{
+//		AETitle: "ROUTER",
+//		Destinations: map[string]router.Destination{
+//			"archive": {AETitle: "ARCHIVE", HostPort: "archive:11112"},
+//			"ai":      {AETitle: "AI", HostPort: "ai:104"},
+//		},
+//		Rules: []router.Rule{
+//			{Modalities: []string{"CT"}, Destinations: []string{"archive", "ai"}, Stop: true},
+//			{Destinations: []string{"archive"}},
+//		},
+//	})
+//	if err != nil {
+//		...
+//	}
+//	defer r.Close()
+//	sp, err := netdicom.NewServiceProvider(r.ProviderParams(), ":11112")
+//	if err != nil {
+//		...
+//	}
+//	sp.Run()
+package router
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"sync"
+
+	dicom "github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomtag"
+	"github.com/grailbio/go-dicom/dicomuid"
+	"github.com/grailbio/go-netdicom"
+	"github.com/grailbio/go-netdicom/dimse"
+)
+
+// Destination is an upstream AE.
+type Destination struct {
+	// AETitle is the called AE title. Required.
+	AETitle string
+	// HostPort is the address of the AE. Required.
+	HostPort string
+	// CallingAETitle, if nonempty, replaces Params.AETitle as the calling
+	// AE title.
+	CallingAETitle string
+	// TLSConfig, if non-nil, enables TLS on the associations.
+	TLSConfig *tls.Config
+}
+
+// Rule selects the destinations of the instances it matches. A rule matches
+// an instance if every condition set in it holds. A rule without conditions
+// matches every instance.
+type Rule struct {
+	// CallingAETitles, if nonempty, lists the AE titles of the senders.
+	CallingAETitles []string
+	// CalledAETitles, if nonempty, lists the AE titles that the senders
+	// call the router by.
+	CalledAETitles []string
+	// SOPClasses, if nonempty, lists the SOP class UIDs.
+	SOPClasses []string
+	// Modalities, if nonempty, lists the values of the Modality element.
+	Modalities []string
+	// Tags, if nonempty, lists the accepted values of elements. The
+	// instance must have every element, with one of the listed values.
+	Tags map[dicomtag.Tag][]string
+	// Match, if non-nil, is called after the other conditions hold.
+	Match func(in *Instance) bool
+
+	// Destinations lists the names of the destinations, keys of
+	// Params.Destinations.
+	Destinations []string
+	// Stop, if true, skips the rules after this one when it matches.
+	Stop bool
+}
+
+// Params configures a Router.
+type Params struct {
+	// AETitle is the AE title of the router. Required.
+	AETitle string
+
+	// Destinations maps names to upstream AEs.
+	Destinations map[string]Destination
+
+	// Rules are evaluated in order for each instance. The instance is sent
+	// to the destinations of all the matching rules, up to the first
+	// matching one with Stop set. An instance that no rule routes anywhere
+	// is refused with status 0xC000.
+	Rules []Rule
+
+	// Synchronous, if true, makes the router forward an instance before
+	// answering the C-STORE. The response carries the status of the
+	// destination, or if there are several, that of the first one that
+	// fails. If false, the instance is answered with success once it is
+	// queued, and the outcome is reported only to OnForward. A failed
+	// instance is then dropped; to keep it, e.g., queue it for another
+	// attempt from OnForward.
+	Synchronous bool
+
+	// QueueSize is the max number of instances waiting to be forwarded to
+	// a destination, when Synchronous is false. An instance that finds a
+	// queue full is refused with dimse.CStoreOutOfResources. If <= 0, 1000
+	// is used.
+	QueueSize int
+
+	// MaxAssociations is the max number of associations to a destination
+	// that the router keeps open. If <= 0, 4 is used.
+	MaxAssociations int
+
+	// EchoDestination, if nonempty, names the destination that C-ECHO
+	// requests are forwarded to. The sender then gets success only if the
+	// destination answers the C-ECHO. If empty, the router answers C-ECHO
+	// itself.
+	EchoDestination string
+
+	// OnForward, if non-nil, is called after each attempt to forward an
+	// instance to a destination.
+	OnForward func(r ForwardResult)
+
+	// Logger receives the log entries of the router. It is also the Logger
+	// of the provider and of the associations to the destinations, unless
+	// Provider or User set another one. If nil, netdicom.DefaultLogger is
+	// used.
+	Logger netdicom.Logger
+
+	// Provider, if non-nil, customizes the provider, whose AETitle, CEcho and
+	// CStore are then set by the router.
+	Provider func(params *netdicom.ServiceProviderParams)
+
+	// User, if non-nil, customizes the destination associations, whose AE
+	// titles, TLSConfig, SOPClasses and TransferSyntaxes are then set by the
+	// router.
+	User func(params *netdicom.ServiceUserParams)
+}
+
+// ForwardResult is the outcome of forwarding an instance to a destination.
+type ForwardResult struct {
+	Destination    string
+	SOPClassUID    string
+	SOPInstanceUID string
+	// Err is nil on success. If the destination answered with a failure
+	// or warning status, it is a *netdicom.StatusError.
+	Err error
+}
+
+// Instance is an instance received by the router.
+type Instance struct {
+	Conn              netdicom.ConnectionState
+	TransferSyntaxUID string
+	SOPClassUID       string
+	SOPInstanceUID    string
+	// Data is the dataset, without the metadata (group 2) elements, encoded
+	// in TransferSyntaxUID.
+	Data []byte
+
+	ds    *dicom.DataSet
+	dsErr error
+}
+
+// DataSet parses the instance. The result is cached.
+func (in *Instance) DataSet() (*dicom.DataSet, error) {
+	if in.ds == nil && in.dsErr == nil {
+		in.ds, in.dsErr = netdicom.ParseCStoreData(in.Conn, in.TransferSyntaxUID, in.SOPClassUID, in.SOPInstanceUID, in.Data)
+	}
+	return in.ds, in.dsErr
+}
+
+// Router forwards the instances it receives. It is safe for concurrent use.
+type Router struct {
+	params Params
+	dests  map[string]*destination
+
+	mu     sync.Mutex
+	closed bool
+	wg     sync.WaitGroup // Running workers.
+}
+
+// New creates a Router. When Synchronous is false, it starts the goroutines
+// that forward the queued instances. Call Close to stop them.
+func New(params Params) (*Router, error) {
+	if params.AETitle == "" {
+		return nil, fmt.Errorf("router.New: AETitle must be set")
+	}
+	if params.QueueSize <= 0 {
+		params.QueueSize = 1000
+	}
+	if params.MaxAssociations <= 0 {
+		params.MaxAssociations = 4
+	}
+	if params.Logger == nil {
+		params.Logger = netdicom.DefaultLogger()
+	}
+	r := &Router{params: params, dests: map[string]*destination{}}
+	for name, dest := range params.Destinations {
+		if dest.AETitle == "" || dest.HostPort == "" {
+			return nil, fmt.Errorf("router.New: destination %q: AETitle and HostPort must be set", name)
+		}
+		r.dests[name] = &destination{
+			name:   name,
+			dest:   dest,
+			router: r,
+			sem:    make(chan struct{}, params.MaxAssociations),
+		}
+	}
+	for i, rule := range params.Rules {
+		if len(rule.Destinations) == 0 {
+			return nil, fmt.Errorf("router.New: rule %d has no destinations", i)
+		}
+		for _, name := range rule.Destinations {
+			if r.dests[name] == nil {
+				return nil, fmt.Errorf("router.New: rule %d: unknown destination %q", i, name)
+			}
+		}
+	}
+	if params.EchoDestination != "" && r.dests[params.EchoDestination] == nil {
+		return nil, fmt.Errorf("router.New: unknown EchoDestination %q", params.EchoDestination)
+	}
+	if !params.Synchronous {
+		for _, d := range r.dests {
+			d.queue = make(chan *Instance, params.QueueSize)
+			for i := 0; i < params.MaxAssociations; i++ {
+				r.wg.Add(1)
+				go d.runWorker()
+			}
+		}
+	}
+	return r, nil
+}
+
+// Close stops accepting instances, waits until the queued ones are
+// forwarded, and releases the associations to the destinations.
+func (r *Router) Close() {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return
+	}
+	r.closed = true
+	for _, d := range r.dests {
+		if d.queue != nil {
+			close(d.queue)
+		}
+	}
+	r.mu.Unlock()
+	r.wg.Wait()
+	for _, d := range r.dests {
+		d.close()
+	}
+}
+
+// ProviderParams returns the params to pass to netdicom.NewServiceProvider or
+// netdicom.RunProviderForConn.
+func (r *Router) ProviderParams() netdicom.ServiceProviderParams {
+	params := netdicom.ServiceProviderParams{Logger: r.params.Logger}
+	if r.params.Provider != nil {
+		r.params.Provider(&params)
+	}
+	params.AETitle = r.params.AETitle
+	params.CEcho = r.onCEcho
+	params.CStore = r.onCStore
+	return params
+}
+
+// Route returns the names of the destinations of "in", per Params.Rules.
+func (r *Router) Route(in *Instance) []string {
+	var names []string
+	for _, rule := range r.params.Rules {
+		if !rule.matches(in) {
+			continue
+		}
+		for _, name := range rule.Destinations {
+			names = appendIfMissing(names, name)
+		}
+		if rule.Stop {
+			break
+		}
+	}
+	if in.dsErr != nil {
+		r.params.Logger.Warn("router: failed to parse instance; its tag rules don't match",
+			"sop_instance", in.SOPInstanceUID, netdicom.LogKeyError, in.dsErr)
+	}
+	return names
+}
+
+func (r *Router) onCEcho(conn netdicom.ConnectionState) dimse.Status {
+	if r.params.EchoDestination == "" {
+		return dimse.Success
+	}
+	d := r.dests[r.params.EchoDestination]
+	su, err := netdicom.NewServiceUser(d.userParams([]string{dicomuid.VerificationSOPClass}, nil))
+	if err != nil {
+		return dimse.Status{Status: dimse.StatusUnrecognizedOperation, ErrorComment: err.Error()}
+	}
+	defer su.Release()
+	su.Connect(d.dest.HostPort)
+	if err := su.CEcho(); err != nil {
+		r.params.Logger.Warn("router: C-ECHO failed", "destination", d.name, netdicom.LogKeyError, err)
+		return dimse.Status{Status: dimse.StatusUnrecognizedOperation, ErrorComment: d.name + ": " + err.Error()}
+	}
+	return dimse.Success
+}
+
+func (r *Router) onCStore(conn netdicom.ConnectionState, transferSyntaxUID, sopClassUID, sopInstanceUID string, data []byte) dimse.Status {
+	in := &Instance{
+		Conn:              conn,
+		TransferSyntaxUID: transferSyntaxUID,
+		SOPClassUID:       sopClassUID,
+		SOPInstanceUID:    sopInstanceUID,
+		Data:              data,
+	}
+	names := r.Route(in)
+	if len(names) == 0 {
+		return dimse.Status{Status: dimse.CStoreCannotUnderstand, ErrorComment: "No route for the instance"}
+	}
+	if r.params.Synchronous {
+		return r.forwardSync(in, names)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return dimse.Status{Status: dimse.CStoreOutOfResources, ErrorComment: "Router is closed"}
+	}
+	for _, name := range names {
+		select {
+		case r.dests[name].queue <- in:
+		default:
+			// The instance may have been queued for the other
+			// destinations. Since the sender will retry, they may
+			// receive it twice.
+			return dimse.Status{Status: dimse.CStoreOutOfResources, ErrorComment: "Queue for " + name + " is full"}
+		}
+	}
+	return dimse.Success
+}
+
+// forwardSync forwards "in" to the destinations in parallel, and returns the
+// status for the sender.
+func (r *Router) forwardSync(in *Instance, names []string) dimse.Status {
+	errs := make([]error, len(names))
+	var wg sync.WaitGroup
+	for i, name := range names {
+		wg.Add(1)
+		go func(i int, d *destination) {
+			defer wg.Done()
+			errs[i] = d.forward(in)
+		}(i, r.dests[name])
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+		var statusErr *netdicom.StatusError
+		if errors.As(err, &statusErr) {
+			return statusErr.Status
+		}
+		return dimse.Status{Status: dimse.CStoreOutOfResources, ErrorComment: names[i] + ": " + err.Error()}
+	}
+	return dimse.Success
+}
+
+func (rule *Rule) matches(in *Instance) bool {
+	if len(rule.CallingAETitles) > 0 && !contains(rule.CallingAETitles, in.Conn.CallingAETitle) {
+		return false
+	}
+	if len(rule.CalledAETitles) > 0 && !contains(rule.CalledAETitles, in.Conn.CalledAETitle) {
+		return false
+	}
+	if len(rule.SOPClasses) > 0 && !contains(rule.SOPClasses, in.SOPClassUID) {
+		return false
+	}
+	if len(rule.Modalities) > 0 && !tagMatches(in, dicomtag.Modality, rule.Modalities) {
+		return false
+	}
+	for tag, values := range rule.Tags {
+		if !tagMatches(in, tag, values) {
+			return false
+		}
+	}
+	return rule.Match == nil || rule.Match(in)
+}
+
+// tagMatches reports whether the element "tag" of "in" has one of "values".
+// A dataset that fails to parse matches no values; the error is logged once,
+// by Router.Route.
+func tagMatches(in *Instance, tag dicomtag.Tag, values []string) bool {
+	ds, err := in.DataSet()
+	if err != nil {
+		return false
+	}
+	elem, err := ds.FindElementByTag(tag)
+	if err != nil {
+		return false
+	}
+	for _, v := range elem.Value {
+		if s, ok := v.(string); ok && contains(values, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// destination holds the associations to an upstream AE.
+type destination struct {
+	name   string
+	dest   Destination
+	router *Router
+	queue  chan *Instance // nil if Synchronous.
+
+	sem  chan struct{} // Bounds the # of associations.
+	mu   sync.Mutex
+	idle []*upstream
+}
+
+func (d *destination) runWorker() {
+	defer d.router.wg.Done()
+	for in := range d.queue {
+		if err := d.forward(in); err != nil {
+			d.router.params.Logger.Error("router: failed to forward instance; dropping it",
+				"destination", d.name, "sop_instance", in.SOPInstanceUID, netdicom.LogKeyError, err)
+		}
+	}
+}
+
+// forward sends "in" to the destination, and reports the result to
+// Params.OnForward.
+func (d *destination) forward(in *Instance) error {
+	d.sem <- struct{}{}
+	d.mu.Lock()
+	var u *upstream
+	if n := len(d.idle); n > 0 {
+		u, d.idle = d.idle[n-1], d.idle[:n-1]
+	} else {
+		u = &upstream{d: d}
+	}
+	d.mu.Unlock()
+	err := u.store(in)
+	d.mu.Lock()
+	d.idle = append(d.idle, u)
+	d.mu.Unlock()
+	<-d.sem
+	if d.router.params.OnForward != nil {
+		d.router.params.OnForward(ForwardResult{
+			Destination:    d.name,
+			SOPClassUID:    in.SOPClassUID,
+			SOPInstanceUID: in.SOPInstanceUID,
+			Err:            err,
+		})
+	}
+	return err
+}
+
+func (d *destination) close() {
+	d.mu.Lock()
+	idle := d.idle
+	d.idle = nil
+	d.mu.Unlock()
+	for _, u := range idle {
+		u.close()
+	}
+}
+
+func (d *destination) userParams(sopClasses, transferSyntaxes []string) netdicom.ServiceUserParams {
+	params := netdicom.ServiceUserParams{Logger: d.router.params.Logger}
+	if d.router.params.User != nil {
+		d.router.params.User(&params)
+	}
+	params.CalledAETitle = d.dest.AETitle
+	params.CallingAETitle = d.dest.CallingAETitle
+	if params.CallingAETitle == "" {
+		params.CallingAETitle = d.router.params.AETitle
+	}
+	params.TLSConfig = d.dest.TLSConfig
+	params.SOPClasses = sopClasses
+	params.TransferSyntaxes = transferSyntaxes
+	return params
+}
+
+// upstream is an association to a destination. It proposes the SOP classes
+// forwarded on it so far, and the transfer syntax of the last instance. It
+// is reopened when an instance needs another SOP class or transfer syntax.
+// Used by one goroutine at a time.
+type upstream struct {
+	d                 *destination
+	su                *netdicom.ServiceUser // nil if not connected.
+	sopClasses        []string
+	transferSyntaxUID string
+}
+
+func (u *upstream) store(in *Instance) error {
+	if u.su == nil || !contains(u.sopClasses, in.SOPClassUID) || u.transferSyntaxUID != in.TransferSyntaxUID {
+		u.close()
+		u.sopClasses = appendIfMissing(u.sopClasses, in.SOPClassUID)
+		u.transferSyntaxUID = in.TransferSyntaxUID
+		// The instance is re-encoded if another syntax is picked, so
+		// a compressed one is offered only in its own.
+		transferSyntaxes := netdicom.StoreTransferSyntaxes(in.TransferSyntaxUID)
+		su, err := netdicom.NewServiceUser(u.d.userParams(u.sopClasses, transferSyntaxes))
+		if err != nil {
+			return err
+		}
+		su.Connect(u.d.dest.HostPort)
+		u.su = su
+	}
+	meta := netdicom.CStoreFileMeta(in.Conn, in.TransferSyntaxUID, in.SOPClassUID, in.SOPInstanceUID)
+	err := u.su.CStoreReader(meta, bytes.NewReader(in.Data))
+	var statusErr *netdicom.StatusError
+	if err != nil && !errors.As(err, &statusErr) {
+		// The association may be broken. Reconnect on the next
+		// instance.
+		u.close()
+	}
+	return err
+}
+
+func (u *upstream) close() {
+	if u.su != nil {
+		u.su.Release()
+		u.su = nil
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+func appendIfMissing(list []string, s string) []string {
+	if contains(list, s) {
+		return list
+	}
+	return append(list, s)
+}
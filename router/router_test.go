@@ -0,0 +1,251 @@
+package router_test
+
+import (
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/grailbio/go-dicom/dicomtag"
+	"github.com/grailbio/go-dicom/dicomuid"
+	"github.com/grailbio/go-netdicom"
+	"github.com/grailbio/go-netdicom/dimse"
+	"github.com/grailbio/go-netdicom/netdicomtest"
+	"github.com/grailbio/go-netdicom/router"
+	"github.com/grailbio/go-netdicom/sopclass"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	srFile = "../testdata/reportsi.dcm"
+	ctFile = "../testdata/IM-0001-0003.dcm"
+)
+
+func newServiceUser(t *testing.T, r *router.Router, sopClasses, transferSyntaxes []string) *netdicom.ServiceUser {
+	return netdicomtest.NewUser(t, netdicom.ServiceUserParams{
+		CalledAETitle:    "ROUTER",
+		CallingAETitle:   "MODALITY",
+		SOPClasses:       sopClasses,
+		TransferSyntaxes: transferSyntaxes}, r.ProviderParams())
+}
+
+// store sends the file to the router, on an association that proposes only
+// the transfer syntax of the file.
+func store(t *testing.T, r *router.Router, path string) error {
+	ds := netdicomtest.ReadDataSet(t, path)
+	elem, err := ds.FindElementByTag(dicomtag.TransferSyntaxUID)
+	require.NoError(t, err)
+	su := newServiceUser(t, r, sopclass.StorageClasses, []string{elem.MustGetString()})
+	defer su.Release()
+	return su.CStore(ds)
+}
+
+func sopClassUIDs(stored []netdicomtest.Stored) []string {
+	var uids []string
+	for _, s := range stored {
+		uids = append(uids, s.SOPClassUID)
+	}
+	return uids
+}
+
+func TestForwardAsync(t *testing.T) {
+	archive, archiveAddr := netdicomtest.StartPACS(t, netdicomtest.Params{AETitle: "ARCHIVE"})
+	viewer, viewerAddr := netdicomtest.StartPACS(t, netdicomtest.Params{AETitle: "VIEWER"})
+
+	var mu sync.Mutex
+	var results []router.ForwardResult
+	r, err := router.New(router.Params{
+		AETitle: "ROUTER",
+		Destinations: map[string]router.Destination{
+			"archive": {AETitle: "ARCHIVE", HostPort: archiveAddr},
+			"viewer":  {AETitle: "VIEWER", HostPort: viewerAddr},
+		},
+		Rules: []router.Rule{
+			{Modalities: []string{"CT"}, Destinations: []string{"archive", "viewer"}, Stop: true},
+			{CallingAETitles: []string{"MODALITY"}, Destinations: []string{"archive"}},
+		},
+		OnForward: func(result router.ForwardResult) {
+			mu.Lock()
+			results = append(results, result)
+			mu.Unlock()
+		},
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, store(t, r, ctFile))
+	require.NoError(t, store(t, r, srFile))
+	r.Close()
+
+	ct, sr := "1.2.840.10008.5.1.4.1.1.2", "1.2.840.10008.5.1.4.1.1.88.11"
+	assert.ElementsMatch(t, []string{ct, sr}, sopClassUIDs(archive.Stored()))
+	require.Equal(t, []string{ct}, sopClassUIDs(viewer.Stored()))
+	for _, s := range archive.Stored() {
+		if s.SOPClassUID == ct {
+			assert.Equal(t, s, viewer.Stored()[0])
+		}
+	}
+	assert.Equal(t, 3, len(results))
+	for _, result := range results {
+		assert.NoError(t, result.Err)
+	}
+
+	// Rules on any tag. No rule matches, so the instance is refused.
+	r, err = router.New(router.Params{
+		AETitle:      "ROUTER",
+		Destinations: map[string]router.Destination{"archive": {AETitle: "ARCHIVE", HostPort: archiveAddr}},
+		Rules: []router.Rule{
+			{Tags: map[dicomtag.Tag][]string{dicomtag.PatientID: {"NO-SUCH-PATIENT"}}, Destinations: []string{"archive"}},
+		},
+	})
+	require.NoError(t, err)
+	defer r.Close()
+	err = store(t, r, srFile)
+	var statusErr *netdicom.StatusError
+	require.True(t, errors.As(err, &statusErr), "error: %v", err)
+	assert.Equal(t, dimse.CStoreCannotUnderstand, statusErr.Status.Status)
+}
+
+func TestForwardSync(t *testing.T) {
+	archive, archiveAddr := netdicomtest.StartPACS(t, netdicomtest.Params{AETitle: "ARCHIVE"})
+	r, err := router.New(router.Params{
+		AETitle:      "ROUTER",
+		Destinations: map[string]router.Destination{"archive": {AETitle: "ARCHIVE", HostPort: archiveAddr}},
+		Rules:        []router.Rule{{Destinations: []string{"archive"}}},
+		Synchronous:  true,
+	})
+	require.NoError(t, err)
+	defer r.Close()
+
+	// The status of the destination is passed back.
+	archive.SetScript(netdicomtest.Script{
+		FailOp:     1,
+		FailStatus: dimse.Status{Status: dimse.CStoreOutOfResources, ErrorComment: "disk full"},
+	})
+	err = store(t, r, srFile)
+	var statusErr *netdicom.StatusError
+	require.True(t, errors.As(err, &statusErr), "error: %v", err)
+	assert.Equal(t, dimse.CStoreOutOfResources, statusErr.Status.Status)
+	assert.Equal(t, "disk full", statusErr.Status.ErrorComment)
+	assert.Equal(t, 0, len(archive.Stored()))
+
+	require.NoError(t, store(t, r, srFile))
+	assert.Equal(t, 1, len(archive.Stored()))
+
+	// The destination drops the connection. The router reconnects for the
+	// next instance.
+	archive.SetScript(netdicomtest.Script{AbortOp: 1})
+	assert.Error(t, store(t, r, srFile))
+	require.NoError(t, store(t, r, ctFile))
+	assert.Equal(t, 2, len(archive.Stored()))
+}
+
+func TestEchoPassThrough(t *testing.T) {
+	archive, archiveAddr := netdicomtest.StartPACS(t, netdicomtest.Params{AETitle: "ARCHIVE"})
+	r, err := router.New(router.Params{
+		AETitle:         "ROUTER",
+		Destinations:    map[string]router.Destination{"archive": {AETitle: "ARCHIVE", HostPort: archiveAddr}},
+		EchoDestination: "archive",
+	})
+	require.NoError(t, err)
+	defer r.Close()
+	su := newServiceUser(t, r, sopclass.VerificationClasses, nil)
+	defer su.Release()
+	require.NoError(t, su.CEcho())
+	assert.Equal(t, 1, archive.NumOps())
+
+	archive.Close()
+	assert.Error(t, su.CEcho())
+}
+
+func TestNewErrors(t *testing.T) {
+	dests := map[string]router.Destination{"archive": {AETitle: "ARCHIVE", HostPort: "localhost:104"}}
+	for _, params := range []router.Params{
+		{Destinations: dests},
+		{AETitle: "ROUTER", Destinations: map[string]router.Destination{"archive": {AETitle: "ARCHIVE"}}},
+		{AETitle: "ROUTER", Destinations: dests, Rules: []router.Rule{{Destinations: []string{"viewer"}}}},
+		{AETitle: "ROUTER", Destinations: dests, Rules: []router.Rule{{Modalities: []string{"CT"}}}},
+		{AETitle: "ROUTER", Destinations: dests, EchoDestination: "viewer"},
+	} {
+		_, err := router.New(params)
+		assert.Error(t, err, "params: %+v", params)
+	}
+}
+
+// TestForwardCompressed forwards to a destination that prefers Implicit VR
+// Little Endian. The uncompressed instance may be re-encoded into it, but the
+// compressed one is offered without it.
+func TestForwardCompressed(t *testing.T) {
+	tap := &netdicomtest.ProposalTap{}
+	archive, archiveAddr := netdicomtest.StartPACS(t, netdicomtest.Params{
+		AETitle: "ARCHIVE",
+		Provider: func(params *netdicom.ServiceProviderParams) {
+			params.TransferSyntaxes = []string{dicomuid.ImplicitVRLittleEndian}
+			params.WireTap = tap.Factory
+		},
+	})
+	r, err := router.New(router.Params{
+		AETitle:      "ROUTER",
+		Destinations: map[string]router.Destination{"archive": {AETitle: "ARCHIVE", HostPort: archiveAddr}},
+		Rules:        []router.Rule{{Destinations: []string{"archive"}}},
+		Synchronous:  true,
+	})
+	require.NoError(t, err)
+	defer r.Close()
+
+	// The modality stores the instance in its own syntax, JPEG 2000.
+	const jpeg2000 = "1.2.840.10008.1.2.4.91"
+	require.NoError(t, store(t, r, ctFile))
+	require.NoError(t, store(t, r, srFile))
+
+	stored := archive.Stored()
+	require.Len(t, stored, 2)
+	assert.Equal(t, jpeg2000, stored[0].TransferSyntaxUID)
+	assert.Equal(t, dicomuid.ImplicitVRLittleEndian, stored[1].TransferSyntaxUID)
+
+	proposals := tap.Proposals()
+	require.Len(t, proposals, 2)
+	assert.Equal(t, []string{jpeg2000}, proposals[0])
+	assert.Contains(t, proposals[1], dicomuid.ImplicitVRLittleEndian)
+}
+
+// recordingLogger records the messages of the Warn and Error entries.
+type recordingLogger struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (l *recordingLogger) Debug(msg string, args ...interface{}) {}
+func (l *recordingLogger) Info(msg string, args ...interface{})  {}
+func (l *recordingLogger) Warn(msg string, args ...interface{})  { l.record(msg) }
+func (l *recordingLogger) Error(msg string, args ...interface{}) { l.record(msg) }
+
+func (l *recordingLogger) record(msg string) {
+	l.mu.Lock()
+	l.messages = append(l.messages, msg)
+	l.mu.Unlock()
+}
+
+func TestForwardAsyncFailure(t *testing.T) {
+	archive, archiveAddr := netdicomtest.StartPACS(t, netdicomtest.Params{AETitle: "ARCHIVE"})
+	archive.SetScript(netdicomtest.Script{AbortOp: 1})
+	logger := &recordingLogger{}
+	var results []router.ForwardResult
+	r, err := router.New(router.Params{
+		AETitle:      "ROUTER",
+		Destinations: map[string]router.Destination{"archive": {AETitle: "ARCHIVE", HostPort: archiveAddr}},
+		Rules:        []router.Rule{{Destinations: []string{"archive"}}},
+		OnForward:    func(result router.ForwardResult) { results = append(results, result) },
+		Logger:       logger,
+	})
+	require.NoError(t, err)
+
+	// The sender is told of success, but the instance is dropped.
+	require.NoError(t, store(t, r, srFile))
+	r.Close()
+	assert.Equal(t, 0, len(archive.Stored()))
+	require.Len(t, results, 1)
+	assert.Error(t, results[0].Err)
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	assert.Contains(t, logger.messages, "router: failed to forward instance; dropping it")
+}
@@ -0,0 +1,182 @@
+package sendqueue
+
+// This file implements the write-ahead journal of the queue.
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+const (
+	journalName = "journal"
+	dataDirName = "data"
+)
+
+// record is a line of the journal. A "put" record stores the full state of an
+// item, replacing the previous one; a "del" record removes it.
+type record struct {
+	Op   string `json:"op"`
+	Item *Item  `json:"item,omitempty"`
+	ID   uint64 `json:"id,omitempty"`
+}
+
+// journal is an append-only file of records, one JSON object per line. Each
+// append is synced before it returns. The journal is rewritten as a snapshot
+// of the live items when it grows to several times their number.
+type journal struct {
+	dir     string
+	f       *os.File
+	records int // Number of records in f.
+}
+
+// openJournal replays the journal in "dir", compacts it, and returns the live
+// items. A truncated or corrupt last line, left by a crash during an append,
+// is ignored.
+func openJournal(dir string) (*journal, map[uint64]*Item, error) {
+	items := map[uint64]*Item{}
+	path := filepath.Join(dir, journalName)
+	f, err := os.Open(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+	if err == nil {
+		err = replayJournal(f, items)
+		f.Close()
+		if err != nil {
+			return nil, nil, fmt.Errorf("sendqueue.openJournal(%s): %v", path, err)
+		}
+	}
+	j := &journal{dir: dir}
+	if err := j.compact(items); err != nil {
+		return nil, nil, err
+	}
+	return j, items, nil
+}
+
+func replayJournal(in io.Reader, items map[uint64]*Item) error {
+	r := bufio.NewReader(in)
+	for line := 1; ; line++ {
+		data, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			// A partial last line is an interrupted append.
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var rec record
+		if err := json.Unmarshal(data, &rec); err != nil {
+			if _, peekErr := r.Peek(1); peekErr == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("line %d: %v", line, err)
+		}
+		switch {
+		case rec.Op == "put" && rec.Item != nil:
+			items[rec.Item.ID] = rec.Item
+		case rec.Op == "del":
+			delete(items, rec.ID)
+		default:
+			return fmt.Errorf("line %d: invalid record %q", line, data)
+		}
+	}
+}
+
+func (j *journal) put(item *Item) error {
+	return j.append(record{Op: "put", Item: item})
+}
+
+func (j *journal) del(id uint64) error {
+	return j.append(record{Op: "del", ID: id})
+}
+
+func (j *journal) append(rec record) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if _, err := j.f.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	j.records++
+	return j.f.Sync()
+}
+
+// needsCompaction checks if the journal has grown large compared to the
+// number of live items.
+func (j *journal) needsCompaction(liveItems int) bool {
+	return j.records > 2*liveItems+1000
+}
+
+// compact atomically replaces the journal with one "put" record per item.
+func (j *journal) compact(items map[uint64]*Item) error {
+	ids := make([]uint64, 0, len(items))
+	for id := range items {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, k int) bool { return ids[i] < ids[k] })
+
+	path := filepath.Join(j.dir, journalName)
+	tmpPath := path + ".tmp"
+	err := func() error {
+		f, err := os.Create(tmpPath)
+		if err != nil {
+			return err
+		}
+		w := bufio.NewWriter(f)
+		for _, id := range ids {
+			data, err := json.Marshal(record{Op: "put", Item: items[id]})
+			if err != nil {
+				f.Close()
+				return err
+			}
+			w.Write(append(data, '\n'))
+		}
+		err = w.Flush()
+		if err == nil {
+			err = f.Sync()
+		}
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err == nil {
+			err = os.Rename(tmpPath, path)
+		}
+		return err
+	}()
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("sendqueue.compact(%s): %v", path, err)
+	}
+	syncDir(j.dir)
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("sendqueue.compact(%s): %v", path, err)
+	}
+	if j.f != nil {
+		j.f.Close()
+	}
+	j.f = f
+	j.records = len(ids)
+	return nil
+}
+
+func (j *journal) close() error {
+	return j.f.Close()
+}
+
+// syncDir persists the renames in "dir". Not all filesystems support syncing
+// a directory, and the files themselves are already durable, so errors are
+// ignored.
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
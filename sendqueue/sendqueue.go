@@ -0,0 +1,728 @@
+// Package sendqueue implements a durable queue of DICOM instances to send by
+// C-STORE.
+//
+// Enqueue stores the instance under Params.Dir, and records it in a
+// write-ahead journal, before it returns. The queue survives process
+// restarts: Open replays the journal and resumes sending. Each destination
+// has its own worker, which retries with exponential backoff while the
+// destination is unreachable or out of resources. Instances of a study are
+// sent in the order they were enqueued. An instance that fails
+// Params.MaxAttempts times, or that the destination refuses outright, is
+// moved to the dead-letter state, where it stays until Retry or Purge is
+// called.
+//
+// Example:
+//
+//	q, err := sendqueue.Open(sendqueue.Params{
+//		Dir:     "/var/spool/dicom",
+//		AETitle: "GATEWAY",
+//		Destinations: map[string]sendqueue.Destination{
+//			"archive": {AETitle: "ARCHIVE", HostPort: "archive:11112"},
+//		},
+//	})
+//	if err != nil {
+//		...
+//	}
+//	defer q.Close()
+//	if _, err := q.Enqueue("archive", ds); err != nil {
+//		...
+//	}
+package sendqueue
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	dicom "github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomtag"
+	"github.com/grailbio/go-netdicom"
+	"github.com/grailbio/go-netdicom/dimse"
+)
+
+// Defaults of Params.
+const (
+	DefaultMaxAttempts     = 10
+	DefaultRetryBackoff    = time.Second
+	DefaultMaxRetryBackoff = 5 * time.Minute
+)
+
+// Destination is an AE that instances are sent to.
+type Destination struct {
+	// AETitle is the called AE title. Required.
+	AETitle string
+	// HostPort is the address of the AE. Required.
+	HostPort string
+	// CallingAETitle, if nonempty, replaces Params.AETitle as the calling
+	// AE title.
+	CallingAETitle string
+	// TLSConfig, if non-nil, enables TLS on the associations.
+	TLSConfig *tls.Config
+}
+
+// Params defines parameters for Open.
+type Params struct {
+	// Dir is the directory that holds the journal and the queued
+	// instances. It is created if needed. Only one Queue may use a
+	// directory at a time. Required.
+	Dir string
+
+	// AETitle is the calling AE title of the associations. Required.
+	AETitle string
+
+	// Destinations maps the names passed to Enqueue to the AEs. Items
+	// whose destination was removed since they were enqueued stay in the
+	// queue, unsent, until they are purged.
+	Destinations map[string]Destination
+
+	// MaxAttempts is the max number of times an instance is sent before it
+	// is moved to the dead-letter state. An instance is sent again if the
+	// destination responds with an out-of-resources status (A7xx). Any
+	// other failure status, a SOP class or transfer syntax that the
+	// destination rejects, or a data file that can't be read, moves it to
+	// the dead-letter state at once. Failures to connect, or an association
+	// that breaks, count against the destination, not the instance: they
+	// delay all its instances, but don't move any of them to the
+	// dead-letter state. See netdicom.IsAssociationError. If <= 0,
+	// DefaultMaxAttempts is used.
+	MaxAttempts int
+
+	// RetryBackoff is the delay before the first retry. The delay doubles
+	// on each subsequent failure, up to MaxRetryBackoff. If <= 0,
+	// DefaultRetryBackoff and DefaultMaxRetryBackoff are used.
+	RetryBackoff    time.Duration
+	MaxRetryBackoff time.Duration
+
+	// OnSend, if non-nil, is called after each attempt to send an item,
+	// with the state of the item after the attempt. err is nil on success.
+	// If the destination answered with a failure or warning status, it is
+	// a *netdicom.StatusError. Calls are serialized.
+	OnSend func(item Item, err error)
+
+	// User, if non-nil, customizes the destination associations, whose AE
+	// titles, TLSConfig, SOPClasses and TransferSyntaxes are then set by the
+	// queue.
+	User func(params *netdicom.ServiceUserParams)
+
+	// Logger receives the log entries of the queue. It is also the Logger of
+	// the associations, unless User sets another one. If nil,
+	// netdicom.DefaultLogger is used.
+	Logger netdicom.Logger
+}
+
+// State is the state of an Item.
+type State int
+
+const (
+	// StatePending is the state of an item waiting to be sent.
+	StatePending State = iota
+	// StateDead is the state of an item that won't be sent again, unless
+	// Retry is called.
+	StateDead
+)
+
+func (s State) String() string {
+	switch s {
+	case StatePending:
+		return "pending"
+	case StateDead:
+		return "dead"
+	}
+	return fmt.Sprintf("State(%d)", int(s))
+}
+
+// Item is an instance in the queue.
+type Item struct {
+	// ID identifies the item. IDs increase in the order of Enqueue calls.
+	ID          uint64 `json:"id"`
+	Destination string `json:"destination"`
+
+	TransferSyntaxUID string `json:"transfer_syntax_uid"`
+	SOPClassUID       string `json:"sop_class_uid"`
+	SOPInstanceUID    string `json:"sop_instance_uid"`
+	// StudyInstanceUID is empty if the dataset has none. Such items are
+	// ordered among themselves as if they belonged to one study.
+	StudyInstanceUID string `json:"study_instance_uid,omitempty"`
+
+	State State `json:"state"`
+	// Attempts is the number of failed attempts that count against the
+	// item, as opposed to the destination. See Params.MaxAttempts.
+	Attempts int `json:"attempts,omitempty"`
+	// LastError describes the last failure.
+	LastError string `json:"last_error,omitempty"`
+	// Enqueued is the time of the Enqueue call.
+	Enqueued time.Time `json:"enqueued"`
+	// NextAttempt is the earliest time the item is sent again, after a
+	// failure.
+	NextAttempt time.Time `json:"next_attempt,omitempty"`
+}
+
+// Queue is a durable queue of instances to send. Its methods are thread
+// safe.
+type Queue struct {
+	params  Params
+	dataDir string
+	closeCh chan struct{}
+	wg      sync.WaitGroup
+
+	// sendMu serializes the calls to params.OnSend.
+	sendMu sync.Mutex
+
+	mu      sync.Mutex
+	closed  bool
+	journal *journal
+	nextID  uint64
+	items   map[uint64]*Item
+	dests   map[string]*destination
+}
+
+// destination is the state of the worker of a destination.
+type destination struct {
+	name string
+	dest Destination
+	wake chan struct{}
+
+	// Guarded by Queue.mu.
+	items    []*Item // The items of the destination, in ID order.
+	sending  *Item   // The item being sent, if any.
+	failures int     // Consecutive failures to reach the destination.
+	retryAt  time.Time
+}
+
+// Open opens the queue in params.Dir, and starts sending the instances
+// queued in a previous run.
+func Open(params Params) (*Queue, error) {
+	if params.Dir == "" {
+		return nil, fmt.Errorf("sendqueue.Open: Dir must be set")
+	}
+	if params.AETitle == "" {
+		return nil, fmt.Errorf("sendqueue.Open: AETitle must be set")
+	}
+	for name, dest := range params.Destinations {
+		if dest.AETitle == "" || dest.HostPort == "" {
+			return nil, fmt.Errorf("sendqueue.Open: destination %q: AETitle and HostPort must be set", name)
+		}
+	}
+	if params.MaxAttempts <= 0 {
+		params.MaxAttempts = DefaultMaxAttempts
+	}
+	if params.RetryBackoff <= 0 {
+		params.RetryBackoff = DefaultRetryBackoff
+	}
+	if params.MaxRetryBackoff <= 0 {
+		params.MaxRetryBackoff = DefaultMaxRetryBackoff
+	}
+	if params.MaxRetryBackoff < params.RetryBackoff {
+		params.MaxRetryBackoff = params.RetryBackoff
+	}
+	if params.Logger == nil {
+		params.Logger = netdicom.DefaultLogger()
+	}
+	q := &Queue{
+		params:  params,
+		dataDir: filepath.Join(params.Dir, dataDirName),
+		closeCh: make(chan struct{}),
+		dests:   map[string]*destination{},
+	}
+	if err := os.MkdirAll(q.dataDir, 0755); err != nil {
+		return nil, fmt.Errorf("sendqueue.Open: %v", err)
+	}
+	journal, items, err := openJournal(params.Dir)
+	if err != nil {
+		return nil, err
+	}
+	q.journal, q.items = journal, items
+	if err := q.removeOrphans(); err != nil {
+		journal.close()
+		return nil, err
+	}
+
+	ids := make([]uint64, 0, len(items))
+	for id := range items {
+		ids = append(ids, id)
+		if id >= q.nextID {
+			q.nextID = id + 1
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for name, dest := range params.Destinations {
+		q.dests[name] = &destination{name: name, dest: dest, wake: make(chan struct{}, 1)}
+	}
+	for _, id := range ids {
+		if d := q.dests[items[id].Destination]; d != nil {
+			d.items = append(d.items, items[id])
+		}
+	}
+	for _, d := range q.dests {
+		q.wg.Add(1)
+		go q.runWorker(d)
+	}
+	return q, nil
+}
+
+// removeOrphans reconciles the data directory with the journal. It drops the
+// items whose data file is missing, and removes the data files of no item,
+// e.g., those of an Enqueue interrupted by a crash.
+func (q *Queue) removeOrphans() error {
+	files, err := ioutil.ReadDir(q.dataDir)
+	if err != nil {
+		return fmt.Errorf("sendqueue.Open: %v", err)
+	}
+	found := map[uint64]bool{}
+	for _, fi := range files {
+		var id uint64
+		if n, err := fmt.Sscanf(fi.Name(), "%016x.dcm", &id); err == nil && n == 1 &&
+			fi.Name() == dataFileName(id) && q.items[id] != nil {
+			found[id] = true
+			continue
+		}
+		q.params.Logger.Warn("sendqueue: removing orphan file", "file", fi.Name())
+		os.Remove(filepath.Join(q.dataDir, fi.Name()))
+	}
+	for id := range q.items {
+		if !found[id] {
+			q.params.Logger.Warn("sendqueue: dropping item; data file missing", "item", id)
+			delete(q.items, id)
+		}
+	}
+	return q.journal.compact(q.items)
+}
+
+func dataFileName(id uint64) string {
+	return fmt.Sprintf("%016x.dcm", id)
+}
+
+func (q *Queue) dataPath(id uint64) string {
+	return filepath.Join(q.dataDir, dataFileName(id))
+}
+
+// Enqueue adds "ds" to the queue of destination "dest". The dataset must
+// contain the metadata elements, as read from a DICOM file. When Enqueue
+// returns, the instance is durably stored; it is sent in the background.
+func (q *Queue) Enqueue(dest string, ds *dicom.DataSet) (Item, error) {
+	var err error
+	item := &Item{Destination: dest, State: StatePending, Enqueued: time.Now()}
+	if item.TransferSyntaxUID, err = findString(ds, dicomtag.TransferSyntaxUID); err != nil {
+		return Item{}, fmt.Errorf("sendqueue.Enqueue: %v", err)
+	}
+	if item.SOPClassUID, err = findString(ds, dicomtag.MediaStorageSOPClassUID); err != nil {
+		return Item{}, fmt.Errorf("sendqueue.Enqueue: %v", err)
+	}
+	if item.SOPInstanceUID, err = findString(ds, dicomtag.MediaStorageSOPInstanceUID); err != nil {
+		return Item{}, fmt.Errorf("sendqueue.Enqueue: %v", err)
+	}
+	item.StudyInstanceUID, _ = findString(ds, dicomtag.StudyInstanceUID)
+
+	q.mu.Lock()
+	d := q.dests[dest]
+	if q.closed {
+		err = fmt.Errorf("sendqueue.Enqueue: queue is closed")
+	} else if d == nil {
+		err = fmt.Errorf("sendqueue.Enqueue: unknown destination %q", dest)
+	}
+	item.ID = q.nextID
+	q.nextID++
+	q.mu.Unlock()
+	if err != nil {
+		return Item{}, err
+	}
+
+	path := q.dataPath(item.ID)
+	if err := writeDataSet(path, ds); err != nil {
+		return Item{}, fmt.Errorf("sendqueue.Enqueue: %v", err)
+	}
+	q.mu.Lock()
+	if q.closed {
+		err = fmt.Errorf("sendqueue.Enqueue: queue is closed")
+	} else {
+		err = q.journal.put(item)
+	}
+	if err != nil {
+		q.mu.Unlock()
+		os.Remove(path)
+		return Item{}, fmt.Errorf("sendqueue.Enqueue: %v", err)
+	}
+	q.items[item.ID] = item
+	// Concurrent Enqueue calls may get here out of ID order.
+	i := sort.Search(len(d.items), func(i int) bool { return d.items[i].ID > item.ID })
+	d.items = append(d.items, nil)
+	copy(d.items[i+1:], d.items[i:])
+	d.items[i] = item
+	result := *item
+	q.maybeCompactLocked()
+	q.mu.Unlock()
+	d.notify()
+	return result, nil
+}
+
+func findString(ds *dicom.DataSet, tag dicomtag.Tag) (string, error) {
+	elem, err := ds.FindElementByTag(tag)
+	if err != nil {
+		return "", err
+	}
+	return elem.GetString()
+}
+
+// writeDataSet atomically writes "ds" as a DICOM file.
+func writeDataSet(path string, ds *dicom.DataSet) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	err = dicom.WriteDataSet(tmp, ds)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, path)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	syncDir(filepath.Dir(path))
+	return nil
+}
+
+// List returns the items in the queue, in ID order.
+func (q *Queue) List() []Item {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	items := make([]Item, 0, len(q.items))
+	for _, item := range q.items {
+		items = append(items, *item)
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].ID < items[j].ID })
+	return items
+}
+
+// Retry makes the item pending again, and resets its attempts. It also
+// cancels the backoff of its destination, so the item is sent right away.
+func (q *Queue) Retry(id uint64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	item := q.items[id]
+	if item == nil {
+		return fmt.Errorf("sendqueue.Retry: item %d not found", id)
+	}
+	updated := *item
+	updated.State = StatePending
+	updated.Attempts = 0
+	updated.NextAttempt = time.Time{}
+	if err := q.journal.put(&updated); err != nil {
+		return fmt.Errorf("sendqueue.Retry: %v", err)
+	}
+	*item = updated
+	if d := q.dests[item.Destination]; d != nil {
+		d.failures, d.retryAt = 0, time.Time{}
+		d.notify()
+	}
+	return nil
+}
+
+// Purge removes the item from the queue, and deletes its data. It fails if
+// the item is being sent.
+func (q *Queue) Purge(id uint64) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	item := q.items[id]
+	if item == nil {
+		return fmt.Errorf("sendqueue.Purge: item %d not found", id)
+	}
+	d := q.dests[item.Destination]
+	if d != nil && d.sending == item {
+		return fmt.Errorf("sendqueue.Purge: item %d is being sent", id)
+	}
+	if err := q.removeLocked(item); err != nil {
+		return fmt.Errorf("sendqueue.Purge: %v", err)
+	}
+	if d != nil {
+		// Later items of the study may be unblocked.
+		d.notify()
+	}
+	return nil
+}
+
+// Close stops the workers, waiting for the attempts in progress. The items
+// still queued are sent when the queue is opened again.
+func (q *Queue) Close() error {
+	q.mu.Lock()
+	if q.closed {
+		q.mu.Unlock()
+		return nil
+	}
+	q.closed = true
+	close(q.closeCh)
+	q.mu.Unlock()
+	q.wg.Wait()
+	return q.journal.close()
+}
+
+// removeLocked deletes the item from the journal and the data directory.
+//
+// REQUIRES: q.mu is locked.
+func (q *Queue) removeLocked(item *Item) error {
+	if err := q.journal.del(item.ID); err != nil {
+		return err
+	}
+	delete(q.items, item.ID)
+	if d := q.dests[item.Destination]; d != nil {
+		for i, it := range d.items {
+			if it == item {
+				d.items = append(d.items[:i], d.items[i+1:]...)
+				break
+			}
+		}
+	}
+	os.Remove(q.dataPath(item.ID))
+	q.maybeCompactLocked()
+	return nil
+}
+
+// REQUIRES: q.mu is locked.
+func (q *Queue) maybeCompactLocked() {
+	if !q.journal.needsCompaction(len(q.items)) {
+		return
+	}
+	if err := q.journal.compact(q.items); err != nil {
+		q.params.Logger.Error("sendqueue: failed to compact journal", netdicom.LogKeyError, err)
+	}
+}
+
+func (d *destination) notify() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// nextLocked returns the next item to send to "d", or nil if none can be sent
+// before time "wakeAt". wakeAt is zero if no item is waiting for a backoff.
+// An item is held back while an earlier item of its study is pending.
+//
+// REQUIRES: q.mu is locked.
+func (q *Queue) nextLocked(d *destination, now time.Time) (item *Item, wakeAt time.Time) {
+	if now.Before(d.retryAt) {
+		return nil, d.retryAt
+	}
+	blocked := map[string]bool{}
+	for _, it := range d.items {
+		if it.State != StatePending || blocked[it.StudyInstanceUID] {
+			continue
+		}
+		blocked[it.StudyInstanceUID] = true
+		if now.Before(it.NextAttempt) {
+			if wakeAt.IsZero() || it.NextAttempt.Before(wakeAt) {
+				wakeAt = it.NextAttempt
+			}
+			continue
+		}
+		return it, time.Time{}
+	}
+	return nil, wakeAt
+}
+
+func (q *Queue) runWorker(d *destination) {
+	defer q.wg.Done()
+	u := &upstream{q: q, d: d}
+	defer u.close()
+	for {
+		q.mu.Lock()
+		if q.closed {
+			q.mu.Unlock()
+			return
+		}
+		item, wakeAt := q.nextLocked(d, time.Now())
+		var snapshot Item
+		if item != nil {
+			d.sending = item
+			snapshot = *item
+		}
+		q.mu.Unlock()
+
+		if item == nil {
+			var timer *time.Timer
+			var timerCh <-chan time.Time
+			if !wakeAt.IsZero() {
+				timer = time.NewTimer(time.Until(wakeAt))
+				timerCh = timer.C
+			}
+			select {
+			case <-d.wake:
+			case <-timerCh:
+			case <-q.closeCh:
+			}
+			if timer != nil {
+				timer.Stop()
+			}
+			continue
+		}
+		err := u.store(&snapshot, q.dataPath(snapshot.ID))
+		q.finish(d, item, err)
+	}
+}
+
+// finish records the outcome of sending "item".
+func (q *Queue) finish(d *destination, item *Item, err error) {
+	q.mu.Lock()
+	d.sending = nil
+	now := time.Now()
+	updated := *item
+	var statusErr *netdicom.StatusError
+	switch {
+	case err == nil || (errors.As(err, &statusErr) && statusErr.Status.Status.IsWarning()):
+		d.failures, d.retryAt = 0, time.Time{}
+		if removeErr := q.removeLocked(item); removeErr != nil {
+			q.params.Logger.Error("sendqueue: failed to remove item", "item", item.ID, netdicom.LogKeyError, removeErr)
+		}
+	case netdicom.IsAssociationError(err):
+		// No response: the destination is unreachable, or the
+		// association broke.
+		d.failures++
+		d.retryAt = now.Add(q.backoff(d.failures))
+		updated.LastError = err.Error()
+		q.params.Logger.Warn("sendqueue: destination failed; retrying",
+			"destination", d.name, "backoff", d.retryAt.Sub(now), netdicom.LogKeyError, err)
+	case statusErr != nil && statusErr.Status.Status&0xff00 == dimse.CStoreOutOfResources:
+		d.failures, d.retryAt = 0, time.Time{}
+		updated.Attempts++
+		updated.LastError = err.Error()
+		if updated.Attempts >= q.params.MaxAttempts {
+			updated.State = StateDead
+		} else {
+			updated.NextAttempt = now.Add(q.backoff(updated.Attempts))
+		}
+	default:
+		// Refused by the destination, or the data file is gone or
+		// unreadable. The destination answered, or wasn't asked, so
+		// it isn't held back.
+		if !os.IsNotExist(err) {
+			d.failures, d.retryAt = 0, time.Time{}
+			updated.Attempts++
+		}
+		updated.LastError = err.Error()
+		updated.State = StateDead
+	}
+	if q.items[item.ID] == item && updated != *item {
+		if putErr := q.journal.put(&updated); putErr != nil {
+			q.params.Logger.Error("sendqueue: failed to update item", "item", item.ID, netdicom.LogKeyError, putErr)
+		}
+		*item = updated
+		if item.State == StateDead {
+			q.params.Logger.Warn("sendqueue: item moved to dead letters", "destination", d.name,
+				"item", item.ID, "sop_instance", item.SOPInstanceUID, netdicom.LogKeyError, err)
+		}
+	}
+	q.mu.Unlock()
+
+	if q.params.OnSend != nil {
+		q.sendMu.Lock()
+		q.params.OnSend(updated, err)
+		q.sendMu.Unlock()
+	}
+}
+
+// backoff returns the delay after the n'th consecutive failure, n >= 1.
+func (q *Queue) backoff(n int) time.Duration {
+	delay := q.params.RetryBackoff
+	for i := 1; i < n && delay < q.params.MaxRetryBackoff; i++ {
+		delay *= 2
+	}
+	if delay > q.params.MaxRetryBackoff {
+		delay = q.params.MaxRetryBackoff
+	}
+	return delay
+}
+
+// upstream is the association of a worker. It proposes the SOP classes sent
+// on it so far, and the transfer syntax of the last item. It is reopened
+// when an item needs another SOP class or transfer syntax.
+type upstream struct {
+	q                 *Queue
+	d                 *destination
+	su                *netdicom.ServiceUser // nil if not connected.
+	sopClasses        []string
+	transferSyntaxUID string
+}
+
+func (u *upstream) store(item *Item, path string) error {
+	if _, err := os.Stat(path); err != nil {
+		return err
+	}
+	if u.su == nil || !contains(u.sopClasses, item.SOPClassUID) || u.transferSyntaxUID != item.TransferSyntaxUID {
+		u.close()
+		if !contains(u.sopClasses, item.SOPClassUID) {
+			u.sopClasses = append(u.sopClasses, item.SOPClassUID)
+		}
+		u.transferSyntaxUID = item.TransferSyntaxUID
+		// The instance is re-encoded if another syntax is picked, so
+		// a compressed one is offered only in its own.
+		transferSyntaxes := netdicom.StoreTransferSyntaxes(item.TransferSyntaxUID)
+		su, err := netdicom.NewServiceUser(u.userParams(transferSyntaxes))
+		if err != nil {
+			return err
+		}
+		su.Connect(u.d.dest.HostPort)
+		u.su = su
+	}
+	err := u.su.CStoreFile(path)
+	var statusErr *netdicom.StatusError
+	if err != nil && !errors.As(err, &statusErr) {
+		// The association may be broken. Reconnect on the next item.
+		u.close()
+	}
+	return err
+}
+
+func (u *upstream) userParams(transferSyntaxes []string) netdicom.ServiceUserParams {
+	params := netdicom.ServiceUserParams{Logger: u.q.params.Logger}
+	if u.q.params.User != nil {
+		u.q.params.User(&params)
+	}
+	params.CalledAETitle = u.d.dest.AETitle
+	params.CallingAETitle = u.d.dest.CallingAETitle
+	if params.CallingAETitle == "" {
+		params.CallingAETitle = u.q.params.AETitle
+	}
+	params.TLSConfig = u.d.dest.TLSConfig
+	params.SOPClasses = u.sopClasses
+	params.TransferSyntaxes = transferSyntaxes
+	return params
+}
+
+func (u *upstream) close() {
+	if u.su != nil {
+		u.su.Release()
+		u.su = nil
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// String returns a one-line description of the item, for logging.
+func (item Item) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d %s %s %s", item.ID, item.Destination, item.SOPInstanceUID, item.State)
+	if item.LastError != "" {
+		fmt.Fprintf(&b, " (%d attempts: %s)", item.Attempts, item.LastError)
+	}
+	return b.String()
+}
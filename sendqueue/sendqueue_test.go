@@ -0,0 +1,330 @@
+package sendqueue_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	dicom "github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomtag"
+	"github.com/grailbio/go-dicom/dicomuid"
+	"github.com/grailbio/go-netdicom"
+	"github.com/grailbio/go-netdicom/dimse"
+	"github.com/grailbio/go-netdicom/netdicomtest"
+	"github.com/grailbio/go-netdicom/sendqueue"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	srFile     = "../testdata/reportsi.dcm"
+	ctFile     = "../testdata/IM-0001-0003.dcm" // JPEG 2000.
+	srSOPClass = "1.2.840.10008.5.1.4.1.1.88.11"
+	ctSOPClass = "1.2.840.10008.5.1.4.1.1.2"
+)
+
+// newDataSet reads srFile, and gives it the study and instance UIDs.
+func newDataSet(t *testing.T, studyUID, instanceUID string) *dicom.DataSet {
+	return netdicomtest.WithUIDs(netdicomtest.ReadDataSet(t, srFile), studyUID, "", instanceUID)
+}
+
+// freeAddr returns a loopback host:port that nothing listens on.
+func freeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := l.Addr().String()
+	l.Close()
+	return addr
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "sendqueue")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func open(t *testing.T, dir, addr string, modify func(*sendqueue.Params)) *sendqueue.Queue {
+	params := sendqueue.Params{
+		Dir:     dir,
+		AETitle: "GATEWAY",
+		Destinations: map[string]sendqueue.Destination{
+			"archive": {AETitle: "ARCHIVE", HostPort: addr},
+		},
+		RetryBackoff:    10 * time.Millisecond,
+		MaxRetryBackoff: 50 * time.Millisecond,
+	}
+	if modify != nil {
+		modify(&params)
+	}
+	q, err := sendqueue.Open(params)
+	require.NoError(t, err)
+	return q
+}
+
+// waitFor polls until cond holds.
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func instanceUIDs(stored []netdicomtest.Stored) []string {
+	var uids []string
+	for _, s := range stored {
+		uids = append(uids, s.SOPInstanceUID)
+	}
+	return uids
+}
+
+// sendCounter counts the calls to Params.OnSend.
+type sendCounter struct {
+	mu sync.Mutex
+	n  int
+}
+
+func (c *sendCounter) onSend(item sendqueue.Item, err error) {
+	c.mu.Lock()
+	c.n++
+	c.mu.Unlock()
+}
+
+func (c *sendCounter) get() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.n
+}
+
+func TestSurvivesRestart(t *testing.T) {
+	dir, addr := tempDir(t), freeAddr(t)
+
+	// The destination is down. The items wait in the queue.
+	sends := &sendCounter{}
+	q := open(t, dir, addr, func(params *sendqueue.Params) { params.OnSend = sends.onSend })
+	for _, uid := range []string{"1.2.3.1", "1.2.3.2", "1.2.3.3"} {
+		_, err := q.Enqueue("archive", newDataSet(t, "1.2.3", uid))
+		require.NoError(t, err)
+	}
+	_, err := q.Enqueue("viewer", newDataSet(t, "1.2.3", "1.2.3.4"))
+	assert.Error(t, err)
+	waitFor(t, func() bool { return sends.get() >= 2 })
+	require.NoError(t, q.Close())
+	_, err = q.Enqueue("archive", newDataSet(t, "1.2.3", "1.2.3.4"))
+	assert.Error(t, err)
+
+	sends = &sendCounter{}
+	q = open(t, dir, addr, func(params *sendqueue.Params) { params.OnSend = sends.onSend })
+	defer q.Close()
+	items := q.List()
+	require.Equal(t, 3, len(items))
+	for i, item := range items {
+		assert.Equal(t, sendqueue.StatePending, item.State)
+		assert.Equal(t, "1.2.3", item.StudyInstanceUID)
+		if i > 0 {
+			assert.True(t, items[i-1].ID < item.ID)
+		}
+	}
+
+	// The destination comes up. The items are sent in order.
+	pacs := netdicomtest.NewPACS(netdicomtest.Params{AETitle: "ARCHIVE"})
+	_, err = pacs.ListenAddr(addr)
+	require.NoError(t, err)
+	defer pacs.Close()
+	waitFor(t, func() bool { return len(q.List()) == 0 })
+	assert.Equal(t, []string{"1.2.3.1", "1.2.3.2", "1.2.3.3"}, instanceUIDs(pacs.Stored()))
+
+	// The destination goes down and comes back.
+	pacs.Close()
+	n := sends.get()
+	_, err = q.Enqueue("archive", newDataSet(t, "1.2.4", "1.2.4.1"))
+	require.NoError(t, err)
+	waitFor(t, func() bool { return sends.get() >= n+2 })
+	items = q.List()
+	require.Equal(t, 1, len(items))
+	assert.Equal(t, sendqueue.StatePending, items[0].State)
+	assert.Equal(t, 0, items[0].Attempts)
+	_, err = pacs.ListenAddr(addr)
+	require.NoError(t, err)
+	waitFor(t, func() bool { return len(q.List()) == 0 })
+	assert.Equal(t, 4, len(pacs.Stored()))
+	files, err := ioutil.ReadDir(dir + "/data")
+	require.NoError(t, err)
+	assert.Equal(t, 0, len(files))
+}
+
+func TestRetryAndDeadLetter(t *testing.T) {
+	pacs, addr := netdicomtest.StartPACS(t, netdicomtest.Params{AETitle: "ARCHIVE"})
+
+	var mu sync.Mutex
+	var sends []error
+	q := open(t, tempDir(t), addr, func(params *sendqueue.Params) {
+		params.OnSend = func(item sendqueue.Item, err error) {
+			mu.Lock()
+			sends = append(sends, err)
+			mu.Unlock()
+		}
+	})
+	defer q.Close()
+
+	// An out-of-resources status is retried.
+	pacs.SetScript(netdicomtest.Script{
+		FailOp:     1,
+		FailStatus: dimse.Status{Status: dimse.CStoreOutOfResources},
+	})
+	_, err := q.Enqueue("archive", newDataSet(t, "1.2.3", "1.2.3.1"))
+	require.NoError(t, err)
+	waitFor(t, func() bool { return len(q.List()) == 0 })
+	mu.Lock()
+	require.Equal(t, 2, len(sends))
+	var statusErr *netdicom.StatusError
+	assert.True(t, errors.As(sends[0], &statusErr), "error: %v", sends[0])
+	assert.NoError(t, sends[1])
+	mu.Unlock()
+
+	// Any other failure status moves the item to the dead letters at once.
+	// The next item of the study isn't held back by it.
+	pacs.SetScript(netdicomtest.Script{
+		FailOp:     1,
+		FailStatus: dimse.Status{Status: dimse.CStoreCannotUnderstand, ErrorComment: "bad"},
+	})
+	dead, err := q.Enqueue("archive", newDataSet(t, "1.2.3", "1.2.3.2"))
+	require.NoError(t, err)
+	_, err = q.Enqueue("archive", newDataSet(t, "1.2.3", "1.2.3.3"))
+	require.NoError(t, err)
+	waitFor(t, func() bool { return len(pacs.Stored()) == 2 })
+	waitFor(t, func() bool { return len(q.List()) == 1 })
+	items := q.List()
+	assert.Equal(t, dead.ID, items[0].ID)
+	assert.Equal(t, sendqueue.StateDead, items[0].State)
+	assert.Equal(t, 1, items[0].Attempts)
+	assert.Contains(t, items[0].LastError, "bad")
+
+	require.NoError(t, q.Retry(dead.ID))
+	waitFor(t, func() bool { return len(q.List()) == 0 })
+	assert.Equal(t, []string{"1.2.3.1", "1.2.3.3", "1.2.3.2"}, instanceUIDs(pacs.Stored()))
+	assert.Error(t, q.Retry(dead.ID))
+}
+
+func TestMaxAttempts(t *testing.T) {
+	var mu sync.Mutex
+	attempts := 0
+	p, err := netdicom.NewServiceProvider(netdicom.ServiceProviderParams{
+		AETitle: "ARCHIVE",
+		CStore: func(conn netdicom.ConnectionState, transferSyntaxUID, sopClassUID, sopInstanceUID string, data []byte) dimse.Status {
+			mu.Lock()
+			attempts++
+			mu.Unlock()
+			return dimse.Status{Status: dimse.CStoreOutOfResources}
+		},
+	}, "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { p.Close() })
+	go p.Run()
+
+	dir := tempDir(t)
+	q := open(t, dir, p.ListenAddr().String(), func(params *sendqueue.Params) { params.MaxAttempts = 3 })
+	item, err := q.Enqueue("archive", newDataSet(t, "1.2.3", "1.2.3.1"))
+	require.NoError(t, err)
+	waitFor(t, func() bool { return q.List()[0].State == sendqueue.StateDead })
+	assert.Equal(t, 3, q.List()[0].Attempts)
+	mu.Lock()
+	assert.Equal(t, 3, attempts)
+	mu.Unlock()
+	require.NoError(t, q.Close())
+
+	// The dead letter is persisted, and can be purged.
+	q = open(t, dir, freeAddr(t), nil)
+	defer q.Close()
+	items := q.List()
+	require.Equal(t, 1, len(items))
+	assert.Equal(t, sendqueue.StateDead, items[0].State)
+	require.NoError(t, q.Purge(item.ID))
+	assert.Equal(t, 0, len(q.List()))
+	assert.Error(t, q.Purge(item.ID))
+}
+
+func TestOpenErrors(t *testing.T) {
+	dir := tempDir(t)
+	for _, params := range []sendqueue.Params{
+		{AETitle: "GATEWAY"},
+		{Dir: dir},
+		{Dir: dir, AETitle: "GATEWAY", Destinations: map[string]sendqueue.Destination{"archive": {AETitle: "ARCHIVE"}}},
+	} {
+		_, err := sendqueue.Open(params)
+		assert.Error(t, err, "params: %+v", params)
+	}
+}
+
+// TestRejectedSOPClass sends to a destination that rejects the SOP class of
+// the first item. The item is moved to the dead letters, without delaying
+// the next one.
+func TestRejectedSOPClass(t *testing.T) {
+	mux := netdicom.NewServiceMux()
+	var mu sync.Mutex
+	var stored []string
+	mux.HandleCStore([]string{srSOPClass}, func(conn netdicom.ConnectionState, transferSyntaxUID, sopClassUID, sopInstanceUID string, data []byte) dimse.Status {
+		mu.Lock()
+		stored = append(stored, sopInstanceUID)
+		mu.Unlock()
+		return dimse.Success
+	})
+	p, err := netdicom.NewServiceProvider(netdicom.ServiceProviderParams{AETitle: "ARCHIVE", Mux: mux}, "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { p.Close() })
+	go p.Run()
+
+	// Failures that counted against the destination would delay the next
+	// item by an hour.
+	q := open(t, tempDir(t), p.ListenAddr().String(), func(params *sendqueue.Params) {
+		params.RetryBackoff = time.Hour
+		params.MaxRetryBackoff = time.Hour
+	})
+	defer q.Close()
+	rejected := netdicomtest.WithElements(newDataSet(t, "1.2.3", "1.2.3.1"),
+		dicom.MustNewElement(dicomtag.MediaStorageSOPClassUID, ctSOPClass),
+		dicom.MustNewElement(dicomtag.SOPClassUID, ctSOPClass))
+	dead, err := q.Enqueue("archive", rejected)
+	require.NoError(t, err)
+	_, err = q.Enqueue("archive", newDataSet(t, "1.2.4", "1.2.4.1"))
+	require.NoError(t, err)
+	waitFor(t, func() bool { return len(q.List()) == 1 })
+	items := q.List()
+	assert.Equal(t, dead.ID, items[0].ID)
+	assert.Equal(t, sendqueue.StateDead, items[0].State)
+	assert.Equal(t, 1, items[0].Attempts)
+	mu.Lock()
+	assert.Equal(t, []string{"1.2.4.1"}, stored)
+	mu.Unlock()
+}
+
+// TestCompressed checks that a compressed item is proposed, and sent, in its
+// own transfer syntax, even if the destination prefers another one.
+func TestCompressed(t *testing.T) {
+	const jpeg2000 = "1.2.840.10008.1.2.4.91"
+	tap := &netdicomtest.ProposalTap{}
+	pacs, addr := netdicomtest.StartPACS(t, netdicomtest.Params{
+		AETitle: "ARCHIVE",
+		Provider: func(params *netdicom.ServiceProviderParams) {
+			params.TransferSyntaxes = []string{dicomuid.ExplicitVRLittleEndian, dicomuid.ImplicitVRLittleEndian}
+			params.WireTap = tap.Factory
+		},
+	})
+	q := open(t, tempDir(t), addr, nil)
+	defer q.Close()
+	_, err := q.Enqueue("archive", netdicomtest.ReadDataSet(t, ctFile))
+	require.NoError(t, err)
+	waitFor(t, func() bool { return len(q.List()) == 0 })
+
+	stored := pacs.Stored()
+	require.Len(t, stored, 1)
+	assert.Equal(t, jpeg2000, stored[0].TransferSyntaxUID)
+	assert.Equal(t, [][]string{{jpeg2000}}, tap.Proposals())
+}
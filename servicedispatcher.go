@@ -1,16 +1,20 @@
 package netdicom
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"sync"
+	"time"
 
-	"github.com/grailbio/go-dicom/dicomlog"
 	"github.com/grailbio/go-netdicom/dimse"
 )
 
 // serviceDispatcher multiplexes statemachine upcall events to DIMSE commands.
 type serviceDispatcher struct {
-	label      string          // for logging.
+	logger     *logger         // Tagged with the association ID.
+	metrics    MetricsObserver // Never nil.
+	tracer     Tracer          // Never nil.
 	downcallCh chan stateEvent // for sending PDUs to the statemachine.
 
 	mu sync.Mutex
@@ -39,19 +43,120 @@ type serviceCommandState struct {
 
 	// upcallCh streams command+data for this messageID.
 	upcallCh chan upcallEvent
+
+	// If non-nil, the request's data payload is streamed through it, instead
+	// of being passed to the callback. Set before the callback runs.
+	dataStream *cstoreSpool
+
+	// Tagged with the message ID.
+	logger *logger
+
+	// For the C-STORE sub-operations of C-MOVE, the C-MOVE request.
+	moveOriginator moveOriginator
+
+	// For metrics. Guarded by disp.mu.
+	opName  string    // Name of the DIMSE operation. "" until the request is seen.
+	opStart time.Time // Time the request was seen.
+	opDone  bool      // True once the final response is seen.
+	// The status of the final response. Valid if opDone.
+	opStatus dimse.Status
+
+	// For tracing. Set by startSpan or setContext. Guarded by disp.mu. Span
+	// is nil if the command isn't traced.
+	ctx  context.Context
+	span Span
+}
+
+// observeMessage updates metrics for a DIMSE message sent or received as part
+// of this command.
+func (cs *serviceCommandState) observeMessage(msg dimse.Message) {
+	disp := cs.disp
+	disp.mu.Lock()
+	defer disp.mu.Unlock()
+	status := msg.GetStatus()
+	if status == nil { // Request
+		if cs.opName == "" {
+			cs.opName = operationName(msg)
+			cs.opStart = time.Now()
+			disp.metrics.ObserveDIMSEInFlight(cs.opName, 1)
+		}
+		return
+	}
+	if cs.opName == "" || cs.opDone || status.Status == dimse.StatusPending {
+		return
+	}
+	cs.opDone = true
+	cs.opStatus = *status
+	if cs.span != nil {
+		cs.span.SetAttribute(TraceAttrStatus, statusString(uint16(status.Status)))
+	}
+	disp.metrics.ObserveDIMSEInFlight(cs.opName, -1)
+	disp.metrics.ObserveDIMSE(cs.opName, status.Status, time.Since(cs.opStart))
+	switch m := msg.(type) {
+	case *dimse.CMoveRsp:
+		disp.metrics.ObserveSubOperations(cs.opName,
+			int(m.NumberOfCompletedSuboperations), int(m.NumberOfFailedSuboperations), int(m.NumberOfWarningSuboperations))
+	case *dimse.CGetRsp:
+		disp.metrics.ObserveSubOperations(cs.opName,
+			int(m.NumberOfCompletedSuboperations), int(m.NumberOfFailedSuboperations), int(m.NumberOfWarningSuboperations))
+	}
+}
+
+// finalStatusError returns a *StatusError if the final response of the
+// command reports a failure, and nil if it reports success, a warning or a
+// cancellation, or if it hasn't been seen.
+func (cs *serviceCommandState) finalStatusError() error {
+	cs.disp.mu.Lock()
+	defer cs.disp.mu.Unlock()
+	if !cs.opDone {
+		return nil
+	}
+	code := cs.opStatus.Status
+	if code == dimse.StatusSuccess || code == dimse.StatusCancel || code.IsWarning() {
+		return nil
+	}
+	return &StatusError{Status: cs.opStatus}
+}
+
+// finalResponseSent reports whether the final response of the command has
+// been sent.
+func (cs *serviceCommandState) finalResponseSent() bool {
+	cs.disp.mu.Lock()
+	defer cs.disp.mu.Unlock()
+	return cs.opDone
 }
 
 // Send a command+data combo to the remote peer. data may be nil.
 func (cs *serviceCommandState) sendMessage(cmd dimse.Message, data []byte) {
+	cs.sendPayload(&stateEventDIMSEPayload{command: cmd, data: data})
+}
+
+// sendMessageStream is similar to sendMessage, but the data payload is read
+// from "data" while it is sent. If reading fails, onError is called from the
+// state machine and the association is aborted.
+func (cs *serviceCommandState) sendMessageStream(cmd dimse.Message, data io.Reader, onError func(err error)) {
+	cs.sendPayload(&stateEventDIMSEPayload{command: cmd, dataReader: data, onDataError: onError})
+}
+
+func (cs *serviceCommandState) sendPayload(payload *stateEventDIMSEPayload) {
+	cmd := payload.command
 	if s := cmd.GetStatus(); s != nil && s.Status != dimse.StatusSuccess && s.Status != dimse.StatusPending {
-		dicomlog.Vprintf(0, "dicom.serviceDispatcher(%s): Sending DIMSE error: %v %v", cs.disp.label, cmd, cs.disp)
-	} else {
-		dicomlog.Vprintf(1, "dicom.serviceDispatcher(%s): Sending DIMSE message: %v %v", cs.disp.label, cmd, cs.disp)
+		cs.logger.warn("Sending DIMSE error", LogKeyCommand, commandName(cmd), "status", s.Status, "detail", cmd.String())
+	} else if cs.logger.debugEnabled() {
+		cs.logger.debug("Sending DIMSE message", LogKeyCommand, commandName(cmd), "detail", cmd.String())
 	}
-	payload := &stateEventDIMSEPayload{
-		abstractSyntaxName: cs.context.abstractSyntaxUID,
-		command:            cmd,
-		data:               data,
+	cs.observeMessage(cmd)
+	payload.abstractSyntaxName = cs.context.abstractSyntaxUID
+	cs.disp.mu.Lock()
+	ctx, span := cs.ctx, cs.span
+	cs.disp.mu.Unlock()
+	if span != nil {
+		_, writeSpan := cs.disp.tracer.Start(ctx, "dicom.WritePDUs")
+		writeSpan.SetAttribute(TraceAttrCommand, commandName(cmd))
+		if payload.dataReader == nil {
+			writeSpan.SetAttribute("dicom.bytes", len(payload.data))
+		}
+		payload.onSent = writeSpan.End
 	}
 	cs.disp.downcallCh <- stateEvent{
 		event:        evt09,
@@ -76,9 +181,10 @@ func (disp *serviceDispatcher) findOrCreateCommand(
 		cm:        cm,
 		context:   context,
 		upcallCh:  make(chan upcallEvent, 128),
+		logger:    disp.logger.with(LogKeyMessageID, msgID),
 	}
 	disp.activeCommands[msgID] = cs
-	dicomlog.Vprintf(1, "dicom.serviceDispatcher(%s): Start command %+v", disp.label, cs)
+	cs.logger.debug("Start command", "context", context.contextID)
 	return cs, false
 }
 
@@ -100,10 +206,11 @@ func (disp *serviceDispatcher) newCommand(
 			cm:        cm,
 			context:   context,
 			upcallCh:  make(chan upcallEvent, 128),
+			logger:    disp.logger.with(LogKeyMessageID, msgID),
 		}
 		disp.activeCommands[msgID] = cs
 		disp.lastMessageID = msgID
-		dicomlog.Vprintf(1, "dicom.serviceDispatcher: Start new command %+v", cs)
+		cs.logger.debug("Start new command", "context", context.contextID)
 		return cs, nil
 	}
 	return nil, fmt.Errorf("Failed to allocate a message ID (too many outstading?)")
@@ -111,11 +218,23 @@ func (disp *serviceDispatcher) newCommand(
 
 func (disp *serviceDispatcher) deleteCommand(cs *serviceCommandState) {
 	disp.mu.Lock()
-	dicomlog.Vprintf(1, "dicom.serviceDispatcher(%s): Finish provider command %v", disp.label, cs.messageID)
+	cs.logger.debug("Finish command")
 	if _, ok := disp.activeCommands[cs.messageID]; !ok {
 		panic(fmt.Sprintf("cs %+v", cs))
 	}
 	delete(disp.activeCommands, cs.messageID)
+	if cs.opName != "" && !cs.opDone {
+		// The operation ended without a final response, e.g., because
+		// the association was aborted.
+		disp.metrics.ObserveDIMSEInFlight(cs.opName, -1)
+	}
+	disp.mu.Unlock()
+}
+
+// setLogger replaces the logger used for new commands.
+func (disp *serviceDispatcher) setLogger(logger *logger) {
+	disp.mu.Lock()
+	disp.logger = logger
 	disp.mu.Unlock()
 }
 
@@ -139,21 +258,23 @@ func (disp *serviceDispatcher) handleEvent(event upcallEvent) {
 	doassert(event.command != nil)
 	context, err := event.cm.lookupByContextID(event.contextID)
 	if err != nil {
-		dicomlog.Vprintf(0, "dicom.serviceDispatcher(%s): Invalid context ID %d: %v", disp.label, event.contextID, err)
+		disp.logger.error("Invalid context ID", "context", event.contextID, LogKeyError, err)
 		disp.downcallCh <- stateEvent{event: evt19, pdu: nil, err: err}
 		return
 	}
 	messageID := event.command.GetMessageID()
 	dc, found := disp.findOrCreateCommand(messageID, event.cm, context)
+	dc.observeMessage(event.command)
 	if found {
-		dicomlog.Vprintf(1, "dicom.serviceDispatcher(%s): Forwarding command to existing command: %+v %+v", disp.label, event.command, dc)
+		dc.logger.debug("Forwarding command to existing command", LogKeyCommand, commandName(event.command))
 		dc.upcallCh <- event
-		dicomlog.Vprintf(1, "dicom.serviceDispatcher(%s): Done forwarding command to existing command: %+v %+v", disp.label, event.command, dc)
+		dc.logger.debug("Done forwarding command to existing command", LogKeyCommand, commandName(event.command))
 		return
 	}
 	disp.mu.Lock()
 	cb := disp.callbacks[event.command.CommandField()]
 	disp.mu.Unlock()
+	dc.dataStream = event.dataStream
 	go func() {
 		cb(event.command, event.data, dc)
 		disp.deleteCommand(dc)
@@ -170,9 +291,11 @@ func (disp *serviceDispatcher) close() {
 	// TODO(saito): prevent new command from launching.
 }
 
-func newServiceDispatcher(label string) *serviceDispatcher {
+func newServiceDispatcher(logger *logger, metrics MetricsObserver, tracer Tracer) *serviceDispatcher {
 	return &serviceDispatcher{
-		label:          label,
+		logger:         logger,
+		metrics:        metrics,
+		tracer:         tracer,
 		downcallCh:     make(chan stateEvent, 128),
 		activeCommands: make(map[dimse.MessageID]*serviceCommandState),
 		callbacks:      make(map[int]serviceCallback),
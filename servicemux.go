@@ -0,0 +1,327 @@
+package netdicom
+
+// This file implements ServiceMux, which routes requests to handlers by SOP
+// class.
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"sort"
+	"sync"
+
+	"github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomuid"
+	"github.com/grailbio/go-netdicom/dimse"
+	"github.com/grailbio/go-netdicom/sopclass"
+)
+
+// ServiceMux routes the requests received by a ServiceProvider to handlers
+// registered per DIMSE command and SOP class. Set it in
+// ServiceProviderParams.Mux.
+//
+// The provider accepts the presentation contexts of the SOP classes that have
+// a handler, and rejects the others. If a C-GET handler is registered, the
+// storage SOP classes are accepted too, since C-GET sends the datasets over
+// the same association. A request for a SOP class without a handler for its
+// command is answered with dimse.StatusSOPClassNotSupported.
+//
+// Each command has two kinds of handlers, e.g., HandleCFind and
+// HandleCFindQuery, like the callbacks of ServiceProviderParams. A SOP class
+// has one handler per command, of either kind.
+//
+// Example:
+//
+//	mux := netdicom.NewServiceMux()
+//	mux.HandleCEcho(onCEcho)
+//	mux.HandleCStore(sopclass.StorageClasses, onCStore)
+//	mux.HandleCFindQuery([]string{dicomuid.StudyRootQRFind}, onStudyRootFind)
+//	mux.HandleCFind([]string{dicomuid.PatientRootQRFind}, onPatientRootFind)
+//	sp, err := netdicom.NewServiceProvider(netdicom.ServiceProviderParams{
+//		AETitle: "SCP",
+//		Mux:     mux,
+//	}, ":11112")
+//
+// Handlers may be registered while the provider runs. They apply to the
+// associations established afterwards. ServiceMux is thread safe.
+type ServiceMux struct {
+	mu     sync.Mutex
+	cecho  CEchoCallback
+	cstore map[string]muxCStoreHandler
+	cfind  map[string]muxCFindHandler
+	cmove  map[string]muxCMoveHandler
+	cget   map[string]muxCMoveHandler
+}
+
+// muxCStoreHandler is the C-STORE handler of a SOP class. One of the fields
+// is set.
+type muxCStoreHandler struct {
+	cb     CStoreCallback
+	stream CStoreStreamCallback
+}
+
+// muxCFindHandler is the C-FIND handler of a SOP class. One of the fields is
+// set.
+type muxCFindHandler struct {
+	cb    CFindCallback
+	query CFindQueryCallback
+}
+
+// muxCMoveHandler is the C-MOVE or C-GET handler of a SOP class. One of the
+// fields is set.
+type muxCMoveHandler struct {
+	cb    CMoveCallback
+	query CMoveQueryCallback
+}
+
+// NewServiceMux creates a ServiceMux without handlers.
+func NewServiceMux() *ServiceMux {
+	return &ServiceMux{
+		cstore: map[string]muxCStoreHandler{},
+		cfind:  map[string]muxCFindHandler{},
+		cmove:  map[string]muxCMoveHandler{},
+		cget:   map[string]muxCMoveHandler{},
+	}
+}
+
+// HandleCEcho registers the C-ECHO handler, for the Verification SOP class.
+func (m *ServiceMux) HandleCEcho(cb CEchoCallback) {
+	m.mu.Lock()
+	m.cecho = cb
+	m.mu.Unlock()
+}
+
+// HandleCStore registers the C-STORE handler for the SOP classes. It replaces
+// the handler registered earlier for any of them.
+func (m *ServiceMux) HandleCStore(sopClassUIDs []string, cb CStoreCallback) {
+	m.handleCStore(sopClassUIDs, muxCStoreHandler{cb: cb})
+}
+
+// HandleCStoreStream is similar to HandleCStore, but the handler receives the
+// dataset as it arrives from the network. See
+// ServiceProviderParams.CStoreStream.
+//
+// Datasets are streamed only on the associations established after a
+// HandleCStoreStream handler is registered. On the others, the provider reads
+// each dataset into memory first.
+func (m *ServiceMux) HandleCStoreStream(sopClassUIDs []string, cb CStoreStreamCallback) {
+	m.handleCStore(sopClassUIDs, muxCStoreHandler{stream: cb})
+}
+
+func (m *ServiceMux) handleCStore(sopClassUIDs []string, h muxCStoreHandler) {
+	m.mu.Lock()
+	for _, uid := range sopClassUIDs {
+		m.cstore[uid] = h
+	}
+	m.mu.Unlock()
+}
+
+// HandleCFind registers the C-FIND handler for the SOP classes, e.g.,
+// sopclass.QRFindClasses. It replaces the handler registered earlier for any
+// of them.
+func (m *ServiceMux) HandleCFind(sopClassUIDs []string, cb CFindCallback) {
+	m.handleCFind(sopClassUIDs, muxCFindHandler{cb: cb})
+}
+
+// HandleCFindQuery is similar to HandleCFind, but the handler receives the
+// request as a QRQuery. See ServiceProviderParams.CFindQuery.
+func (m *ServiceMux) HandleCFindQuery(sopClassUIDs []string, cb CFindQueryCallback) {
+	m.handleCFind(sopClassUIDs, muxCFindHandler{query: cb})
+}
+
+func (m *ServiceMux) handleCFind(sopClassUIDs []string, h muxCFindHandler) {
+	m.mu.Lock()
+	for _, uid := range sopClassUIDs {
+		m.cfind[uid] = h
+	}
+	m.mu.Unlock()
+}
+
+// HandleCMove registers the C-MOVE handler for the SOP classes. It replaces
+// the handler registered earlier for any of them.
+func (m *ServiceMux) HandleCMove(sopClassUIDs []string, cb CMoveCallback) {
+	m.handleCMove(m.cmove, sopClassUIDs, muxCMoveHandler{cb: cb})
+}
+
+// HandleCMoveQuery is similar to HandleCMove, but the handler receives the
+// request as a QRQuery. See ServiceProviderParams.CMoveQuery.
+func (m *ServiceMux) HandleCMoveQuery(sopClassUIDs []string, cb CMoveQueryCallback) {
+	m.handleCMove(m.cmove, sopClassUIDs, muxCMoveHandler{query: cb})
+}
+
+// HandleCGet registers the C-GET handler for the SOP classes. It replaces the
+// handler registered earlier for any of them.
+func (m *ServiceMux) HandleCGet(sopClassUIDs []string, cb CMoveCallback) {
+	m.handleCMove(m.cget, sopClassUIDs, muxCMoveHandler{cb: cb})
+}
+
+// HandleCGetQuery is similar to HandleCGet, but the handler receives the
+// request as a QRQuery. See ServiceProviderParams.CGetQuery.
+func (m *ServiceMux) HandleCGetQuery(sopClassUIDs []string, cb CMoveQueryCallback) {
+	m.handleCMove(m.cget, sopClassUIDs, muxCMoveHandler{query: cb})
+}
+
+func (m *ServiceMux) handleCMove(handlers map[string]muxCMoveHandler, sopClassUIDs []string, h muxCMoveHandler) {
+	m.mu.Lock()
+	for _, uid := range sopClassUIDs {
+		handlers[uid] = h
+	}
+	m.mu.Unlock()
+}
+
+// SOPClasses returns the SOP classes accepted by the provider, sorted.
+func (m *ServiceMux) SOPClasses() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	set := map[string]bool{}
+	if m.cecho != nil {
+		set[dicomuid.VerificationSOPClass] = true
+	}
+	for uid := range m.cstore {
+		set[uid] = true
+	}
+	for uid := range m.cfind {
+		set[uid] = true
+	}
+	for _, handlers := range []map[string]muxCMoveHandler{m.cmove, m.cget} {
+		for uid := range handlers {
+			set[uid] = true
+		}
+	}
+	if len(m.cget) > 0 {
+		for _, uid := range sopclass.StorageClasses {
+			set[uid] = true
+		}
+	}
+	var uids []string
+	for uid := range set {
+		uids = append(uids, uid)
+	}
+	sort.Strings(uids)
+	return uids
+}
+
+// acceptor returns the function that decides whether a presentation context
+// is accepted, for a new association.
+func (m *ServiceMux) acceptor() func(sopClassUID string) bool {
+	set := map[string]bool{}
+	for _, uid := range m.SOPClasses() {
+		set[uid] = true
+	}
+	return func(sopClassUID string) bool { return set[sopClassUID] }
+}
+
+// sopClassNotSupported is the status of a request without a handler.
+func sopClassNotSupported(command, sopClassUID string) dimse.Status {
+	return dimse.Status{
+		Status:       dimse.StatusSOPClassNotSupported,
+		ErrorComment: "No " + command + " handler for SOP class " + sopClassUID,
+	}
+}
+
+// providerParams returns "params" with the callbacks replaced by the ones
+// that dispatch to the handlers of the mux.
+func (m *ServiceMux) providerParams(params ServiceProviderParams) ServiceProviderParams {
+	params.CEcho = func(conn ConnectionState) dimse.Status {
+		m.mu.Lock()
+		cb := m.cecho
+		m.mu.Unlock()
+		if cb == nil {
+			return sopClassNotSupported("C-ECHO", dicomuid.VerificationSOPClass)
+		}
+		return cb(conn)
+	}
+	params.CStore = func(conn ConnectionState, transferSyntaxUID, sopClassUID, sopInstanceUID string, data []byte) dimse.Status {
+		m.mu.Lock()
+		h := m.cstore[sopClassUID]
+		m.mu.Unlock()
+		switch {
+		case h.stream != nil:
+			return h.stream(conn, transferSyntaxUID, sopClassUID, sopInstanceUID, bytes.NewReader(data))
+		case h.cb != nil:
+			return h.cb(conn, transferSyntaxUID, sopClassUID, sopInstanceUID, data)
+		}
+		return sopClassNotSupported("C-STORE", sopClassUID)
+	}
+	params.CStoreStream = nil
+	if m.hasCStoreStream() {
+		params.CStoreStream = func(conn ConnectionState, transferSyntaxUID, sopClassUID, sopInstanceUID string, data io.Reader) dimse.Status {
+			m.mu.Lock()
+			h := m.cstore[sopClassUID]
+			m.mu.Unlock()
+			switch {
+			case h.stream != nil:
+				return h.stream(conn, transferSyntaxUID, sopClassUID, sopInstanceUID, data)
+			case h.cb != nil:
+				payload, err := ioutil.ReadAll(data)
+				if err != nil {
+					return dimse.Status{Status: dimse.CStoreOutOfResources, ErrorComment: err.Error()}
+				}
+				return h.cb(conn, transferSyntaxUID, sopClassUID, sopInstanceUID, payload)
+			}
+			return sopClassNotSupported("C-STORE", sopClassUID)
+		}
+	}
+	params.CFind = func(conn ConnectionState, transferSyntaxUID, sopClassUID string, filters []*dicom.Element, ch chan CFindResult) {
+		m.mu.Lock()
+		h := m.cfind[sopClassUID]
+		m.mu.Unlock()
+		switch {
+		case h.query != nil:
+			query, err := decodeQRQuery(qrOpCFind, sopClassUID, filters)
+			if err != nil {
+				ch <- CFindResult{Err: &StatusError{Status: dimse.Status{
+					Status: dimse.CFindIdentifierDoesNotMatchSOPClass, ErrorComment: err.Error()}}}
+				close(ch)
+				return
+			}
+			h.query(conn, transferSyntaxUID, sopClassUID, query, ch)
+		case h.cb != nil:
+			h.cb(conn, transferSyntaxUID, sopClassUID, filters, ch)
+		default:
+			ch <- CFindResult{Err: &StatusError{Status: sopClassNotSupported("C-FIND", sopClassUID)}}
+			close(ch)
+		}
+	}
+	dispatchMove := func(opType qrOpType, command string, handlers map[string]muxCMoveHandler) CMoveCallback {
+		return func(conn ConnectionState, transferSyntaxUID, sopClassUID string, filters []*dicom.Element, ch chan CMoveResult) {
+			m.mu.Lock()
+			h := handlers[sopClassUID]
+			m.mu.Unlock()
+			switch {
+			case h.query != nil:
+				query, err := decodeQRQuery(opType, sopClassUID, filters)
+				if err != nil {
+					ch <- CMoveResult{Err: &StatusError{Status: dimse.Status{
+						Status: dimse.CMoveDataSetDoesNotMatchSOPClass, ErrorComment: err.Error()}}}
+					close(ch)
+					return
+				}
+				h.query(conn, transferSyntaxUID, sopClassUID, query, ch)
+			case h.cb != nil:
+				h.cb(conn, transferSyntaxUID, sopClassUID, filters, ch)
+			default:
+				ch <- CMoveResult{Err: &StatusError{Status: sopClassNotSupported(command, sopClassUID)}}
+				close(ch)
+			}
+		}
+	}
+	params.CMove = dispatchMove(qrOpCMove, "C-MOVE", m.cmove)
+	params.CGet = dispatchMove(qrOpCGet, "C-GET", m.cget)
+	params.CFindQuery = nil
+	params.CMoveQuery = nil
+	params.CGetQuery = nil
+	return params
+}
+
+// hasCStoreStream checks if a HandleCStoreStream handler is registered.
+func (m *ServiceMux) hasCStoreStream() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, h := range m.cstore {
+		if h.stream != nil {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,181 @@
+package netdicom
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync"
+	"testing"
+
+	"github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-dicom/dicomtag"
+	"github.com/grailbio/go-dicom/dicomuid"
+	"github.com/grailbio/go-netdicom/dimse"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServiceMuxSOPClasses(t *testing.T) {
+	mux := NewServiceMux()
+	assert.Nil(t, mux.SOPClasses())
+	mux.HandleCEcho(func(ConnectionState) dimse.Status { return dimse.Success })
+	mux.HandleCStore([]string{mrImageStorage, ctImageStorage}, nil)
+	assert.Equal(t, []string{dicomuid.VerificationSOPClass, ctImageStorage, mrImageStorage}, mux.SOPClasses())
+
+	accept := mux.acceptor()
+	assert.True(t, accept(ctImageStorage))
+	assert.False(t, accept(dicomuid.StudyRootQRGet))
+
+	// C-GET needs the storage classes for its sub-operations.
+	mux.HandleCGet([]string{dicomuid.StudyRootQRGet}, nil)
+	accept = mux.acceptor()
+	assert.True(t, accept(dicomuid.StudyRootQRGet))
+	assert.True(t, accept("1.2.840.10008.5.1.4.1.1.1")) // CR Image Storage
+	assert.False(t, accept(dicomuid.StudyRootQRFind))
+}
+
+func TestServiceMux(t *testing.T) {
+	mux := NewServiceMux()
+	var stored []string
+	mux.HandleCStore([]string{ctImageStorage}, func(conn ConnectionState, transferSyntaxUID, sopClassUID, sopInstanceUID string, data []byte) dimse.Status {
+		stored = append(stored, sopInstanceUID)
+		return dimse.Success
+	})
+	mux.HandleCFind([]string{dicomuid.StudyRootQRFind}, func(conn ConnectionState, transferSyntaxUID, sopClassUID string, filters []*dicom.Element, ch chan CFindResult) {
+		ch <- CFindResult{Elements: []*dicom.Element{dicom.MustNewElement(dicomtag.StudyInstanceUID, "1.2.3")}}
+		close(ch)
+	})
+	mux.HandleCGet([]string{dicomuid.StudyRootQRGet}, func(conn ConnectionState, transferSyntaxUID, sopClassUID string, filters []*dicom.Element, ch chan CMoveResult) {
+		close(ch)
+	})
+	p, err := NewServiceProvider(ServiceProviderParams{
+		Mux: mux,
+		// Ignored, since Mux is set.
+		CEcho: func(ConnectionState) dimse.Status { return dimse.Success },
+	}, ":0")
+	require.NoError(t, err)
+	go p.Run()
+
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses: []string{
+			dicomuid.VerificationSOPClass,
+			ctImageStorage,
+			mrImageStorage,
+			dicomuid.StudyRootQRFind,
+			dicomuid.PatientRootQRFind,
+			dicomuid.StudyRootQRGet,
+		},
+	})
+	require.NoError(t, err)
+	su.Connect(p.ListenAddr().String())
+	defer su.Release()
+
+	// The contexts of the SOP classes without a handler are rejected.
+	assert.Error(t, su.CEcho())
+	var errs []error
+	for result := range su.CFind(QRLevelPatient, []*dicom.Element{dicom.MustNewElement(dicomtag.PatientID, "P1")}) {
+		if result.Err != nil {
+			errs = append(errs, result.Err)
+		}
+	}
+	assert.Equal(t, 1, len(errs))
+
+	var uids []string
+	for result := range su.CFind(QRLevelStudy, []*dicom.Element{dicom.MustNewElement(dicomtag.StudyInstanceUID, "")}) {
+		require.NoError(t, result.Err)
+		for _, elem := range result.Elements {
+			uids = append(uids, elem.MustGetString())
+		}
+	}
+	assert.Equal(t, []string{"1.2.3"}, uids)
+
+	require.NoError(t, su.CStore(newCMoveDataSet(ctImageStorage, "1.2.3.1")))
+	assert.Equal(t, []string{"1.2.3.1"}, stored)
+
+	// MR Image Storage is accepted for C-GET, but has no C-STORE handler.
+	err = su.CStore(newCMoveDataSet(mrImageStorage, "1.2.3.2"))
+	var statusErr *StatusError
+	require.True(t, errors.As(err, &statusErr), "error: %v", err)
+	assert.Equal(t, dimse.StatusSOPClassNotSupported, statusErr.Status.Status)
+	assert.Equal(t, []string{"1.2.3.1"}, stored)
+}
+
+func TestServiceMuxQueryAndStream(t *testing.T) {
+	mux := NewServiceMux()
+	var mu sync.Mutex
+	stored := map[string]int{} // SOPInstanceUID -> size.
+	mux.HandleCStoreStream([]string{ctImageStorage}, func(conn ConnectionState, transferSyntaxUID, sopClassUID, sopInstanceUID string, data io.Reader) dimse.Status {
+		payload, err := ioutil.ReadAll(data)
+		if err != nil {
+			return dimse.Status{Status: dimse.CStoreOutOfResources}
+		}
+		mu.Lock()
+		stored[sopInstanceUID] = len(payload)
+		mu.Unlock()
+		return dimse.Success
+	})
+	// A plain handler on an association where the datasets are streamed.
+	mux.HandleCStore([]string{mrImageStorage}, func(conn ConnectionState, transferSyntaxUID, sopClassUID, sopInstanceUID string, data []byte) dimse.Status {
+		mu.Lock()
+		stored[sopInstanceUID] = len(data)
+		mu.Unlock()
+		return dimse.Success
+	})
+	var queries []QRQuery
+	mux.HandleCFindQuery([]string{dicomuid.StudyRootQRFind}, func(conn ConnectionState, transferSyntaxUID, sopClassUID string, query QRQuery, ch chan CFindResult) {
+		queries = append(queries, query)
+		ch <- CFindResult{Elements: []*dicom.Element{dicom.MustNewElement(dicomtag.StudyInstanceUID, "1.2.3")}}
+		close(ch)
+	})
+	mux.HandleCGetQuery([]string{dicomuid.StudyRootQRGet}, func(conn ConnectionState, transferSyntaxUID, sopClassUID string, query QRQuery, ch chan CMoveResult) {
+		queries = append(queries, query)
+		ch <- CMoveResult{DataSet: newCMoveDataSet(ctImageStorage, "1.2.3.9")}
+		close(ch)
+	})
+	p, err := NewServiceProvider(ServiceProviderParams{Mux: mux}, "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { p.Close() })
+	go p.Run()
+
+	su, err := NewServiceUser(ServiceUserParams{
+		SOPClasses: []string{ctImageStorage, mrImageStorage, dicomuid.StudyRootQRFind, dicomuid.StudyRootQRGet},
+	})
+	require.NoError(t, err)
+	defer su.Release()
+	su.Connect(p.ListenAddr().String())
+
+	require.NoError(t, su.CStore(newCMoveDataSet(ctImageStorage, "1.2.3.1")))
+	require.NoError(t, su.CStore(newCMoveDataSet(mrImageStorage, "1.2.3.2")))
+	mu.Lock()
+	assert.Len(t, stored, 2)
+	assert.NotZero(t, stored["1.2.3.1"])
+	assert.Equal(t, stored["1.2.3.1"], stored["1.2.3.2"])
+	mu.Unlock()
+
+	keys := []*dicom.Element{dicom.MustNewElement(dicomtag.StudyInstanceUID, "1.2.3")}
+	for result := range su.CFind(QRLevelStudy, keys) {
+		require.NoError(t, result.Err)
+	}
+	var got []string
+	require.NoError(t, su.CGet(QRLevelStudy, keys,
+		func(transferSyntaxUID, sopClassUID, sopInstanceUID string, data []byte) dimse.Status {
+			got = append(got, sopInstanceUID)
+			return dimse.Success
+		}))
+	assert.Equal(t, []string{"1.2.3.9"}, got)
+	require.Len(t, queries, 2)
+	for _, query := range queries {
+		assert.Equal(t, QRModelStudyRoot, query.Model)
+		assert.Equal(t, QRLevelStudy, query.Level)
+	}
+
+	// The QRQuery handlers reject identifiers invalid for the model.
+	err = su.CGet(QRLevelStudy, []*dicom.Element{dicom.MustNewElement(dicomtag.PatientID, "P1")},
+		func(transferSyntaxUID, sopClassUID, sopInstanceUID string, data []byte) dimse.Status {
+			return dimse.Success
+		})
+	var statusErr *StatusError
+	require.True(t, errors.As(err, &statusErr), "error: %v", err)
+	assert.Equal(t, dimse.CMoveDataSetDoesNotMatchSOPClass, statusErr.Status.Status)
+	assert.Len(t, queries, 2)
+}
@@ -3,15 +3,19 @@
 package netdicom
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
+	"sync"
 
 	dicom "github.com/grailbio/go-dicom"
 	"github.com/grailbio/go-dicom/dicomio"
-	"github.com/grailbio/go-dicom/dicomlog"
+	"github.com/grailbio/go-dicom/dicomuid"
 	"github.com/grailbio/go-netdicom/dimse"
-	"github.com/grailbio/go-netdicom/sopclass"
 )
 
 // CMoveResult is an object streamed by CMove implementation.
@@ -22,19 +26,52 @@ type CMoveResult struct {
 	DataSet   *dicom.DataSet // Contents of the file.
 }
 
+// StatusError is an error that carries a DIMSE status. A CFind, CMove or CGet
+// callback can send it as CFindResult.Err or CMoveResult.Err to make the
+// provider respond with that status, instead of CFindUnableToProcess or
+// CMoveUnableToProcess.
+//
+// The CStore and CGet methods of ServiceUser, and the final CFindResult.Err
+// of its C-FIND methods, return an error that wraps a StatusError when the
+// provider responds with a non-success status. Use errors.As to extract it.
+type StatusError struct {
+	Status dimse.Status
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("dicom.StatusError: status %v: %s", e.Status.Status, e.Status.ErrorComment)
+}
+
+// errorStatus converts an error reported by a callback into the status of the
+// final response.
+func errorStatus(err error) dimse.Status {
+	var e *StatusError
+	if errors.As(err, &e) {
+		return e.Status
+	}
+	return dimse.Status{
+		Status:       dimse.CFindUnableToProcess,
+		ErrorComment: err.Error(),
+	}
+}
+
 func handleCStore(
-	cb CStoreCallback,
+	params ServiceProviderParams,
 	connState ConnectionState,
 	c *dimse.CStoreRq, data []byte,
 	cs *serviceCommandState) {
-	status := dimse.Status{Status: dimse.StatusUnrecognizedOperation}
-	if cb != nil {
-		status = cb(
+	var status dimse.Status
+	if cs.dataStream != nil {
+		status = handleCStoreStream(params, connState, c, cs)
+	} else if params.CStore != nil {
+		status = params.CStore(
 			connState,
 			cs.context.transferSyntaxUID,
 			c.AffectedSOPClassUID,
 			c.AffectedSOPInstanceUID,
 			data)
+	} else {
+		status = dimse.Status{Status: dimse.StatusUnrecognizedOperation}
 	}
 	resp := &dimse.CStoreRsp{
 		AffectedSOPClassUID:       c.AffectedSOPClassUID,
@@ -46,12 +83,57 @@ func handleCStore(
 	cs.sendMessage(resp, nil)
 }
 
+// handleCStoreStream runs the C-STORE callback on the dataset streamed
+// through cs.dataStream. It returns after the whole dataset is received.
+func handleCStoreStream(
+	params ServiceProviderParams,
+	connState ConnectionState,
+	c *dimse.CStoreRq,
+	cs *serviceCommandState) dimse.Status {
+	stream := cs.dataStream
+	var status dimse.Status
+	switch {
+	case params.CStoreStream != nil:
+		status = params.CStoreStream(
+			connState,
+			cs.context.transferSyntaxUID,
+			c.AffectedSOPClassUID,
+			c.AffectedSOPInstanceUID,
+			stream)
+	case params.CStore != nil:
+		data, err := ioutil.ReadAll(stream)
+		if err == nil {
+			status = params.CStore(
+				connState,
+				cs.context.transferSyntaxUID,
+				c.AffectedSOPClassUID,
+				c.AffectedSOPInstanceUID,
+				data)
+		} else {
+			status = dimse.Status{Status: dimse.CStoreOutOfResources, ErrorComment: err.Error()}
+		}
+	default:
+		status = dimse.Status{Status: dimse.StatusUnrecognizedOperation}
+	}
+	stream.release()
+	// The response must follow the whole dataset.
+	size, tooLarge, err := stream.wait()
+	if tooLarge {
+		cs.logger.warn("C-STORE dataset exceeds the max object size",
+			"sop_instance", c.AffectedSOPInstanceUID, "bytes", size, "max_bytes", params.CStoreMaxObjectSize)
+		status = dimse.Status{Status: dimse.CStoreOutOfResources, ErrorComment: ErrCStoreTooLarge.Error()}
+	} else if err != nil {
+		cs.logger.error("Failed to receive C-STORE dataset", "sop_instance", c.AffectedSOPInstanceUID, LogKeyError, err)
+	}
+	return status
+}
+
 func handleCFind(
 	params ServiceProviderParams,
 	connState ConnectionState,
 	c *dimse.CFindRq, data []byte,
 	cs *serviceCommandState) {
-	if params.CFind == nil {
+	if params.CFind == nil && params.CFindQuery == nil {
 		cs.sendMessage(&dimse.CFindRsp{
 			AffectedSOPClassUID:       c.AffectedSOPClassUID,
 			MessageIDBeingRespondedTo: c.MessageID,
@@ -70,25 +152,41 @@ func handleCFind(
 		}, nil)
 		return
 	}
-	dicomlog.Vprintf(1, "dicom.serviceProvider: C-FIND-RQ payload: %s", elementsString(elems))
+	cs.logger.info("Received C-FIND request", "sop_class", c.AffectedSOPClassUID, "payload", cs.logger.elementsString(elems))
+	var query QRQuery
+	if params.CFindQuery != nil {
+		if query, err = decodeQRQuery(qrOpCFind, c.AffectedSOPClassUID, elems); err != nil {
+			cs.logger.error("Invalid C-FIND identifier", LogKeyError, err)
+			cs.sendMessage(&dimse.CFindRsp{
+				AffectedSOPClassUID:       c.AffectedSOPClassUID,
+				MessageIDBeingRespondedTo: c.MessageID,
+				CommandDataSetType:        dimse.CommandDataSetTypeNull,
+				Status:                    dimse.Status{Status: dimse.CFindIdentifierDoesNotMatchSOPClass, ErrorComment: err.Error()},
+			}, nil)
+			return
+		}
+	}
 
 	status := dimse.Status{Status: dimse.StatusSuccess}
 	responseCh := make(chan CFindResult, 128)
 	go func() {
+		defer recoverCFindCallback(responseCh)
+		if params.CFindQuery != nil {
+			params.CFindQuery(connState, cs.context.transferSyntaxUID, c.AffectedSOPClassUID, query, responseCh)
+			return
+		}
 		params.CFind(connState, cs.context.transferSyntaxUID, c.AffectedSOPClassUID, elems, responseCh)
 	}()
 	for resp := range responseCh {
 		if resp.Err != nil {
-			status = dimse.Status{
-				Status:       dimse.CFindUnableToProcess,
-				ErrorComment: resp.Err.Error(),
-			}
+			repanic(resp.Err)
+			status = errorStatus(resp.Err)
 			break
 		}
-		dicomlog.Vprintf(1, "dicom.serviceProvider: C-FIND-RSP: %s", elementsString(resp.Elements))
-		payload, err := writeElementsToBytes(resp.Elements, cs.context.transferSyntaxUID)
+		cs.logger.debug("Sending C-FIND match", "payload", cs.logger.elementsString(resp.Elements))
+		payload, err := writeElementsToBytes(resp.Elements, cs.context.transferSyntaxUID, cs.cm.deflateLevel)
 		if err != nil {
-			dicomlog.Vprintf(0, "dicom.serviceProvider: C-FIND: encode error %v", err)
+			cs.logger.error("Failed to encode C-FIND response", LogKeyError, err)
 			status = dimse.Status{
 				Status:       dimse.CFindUnableToProcess,
 				ErrorComment: err.Error(),
@@ -125,7 +223,7 @@ func handleCMove(
 			Status:                    dimse.Status{Status: dimse.StatusUnrecognizedOperation, ErrorComment: err.Error()},
 		}, nil)
 	}
-	if params.CMove == nil {
+	if params.CMove == nil && params.CMoveQuery == nil {
 		cs.sendMessage(&dimse.CMoveRsp{
 			AffectedSOPClassUID:       c.AffectedSOPClassUID,
 			MessageIDBeingRespondedTo: c.MessageID,
@@ -134,57 +232,124 @@ func handleCMove(
 		}, nil)
 		return
 	}
-	remoteHostPort, ok := params.RemoteAEs[c.MoveDestination]
-	if !ok {
-		sendError(fmt.Errorf("C-MOVE destination '%v' not registered in the server", c.MoveDestination))
+	dest, err := resolveMoveDestination(params, connState, c.MoveDestination)
+	if err != nil {
+		cs.logger.error("C-MOVE: destination refused", "move_destination", c.MoveDestination, LogKeyError, err)
+		status := dimse.Status{Status: dimse.CMoveMoveDestinationUnknown, ErrorComment: err.Error()}
+		var e *StatusError
+		if errors.As(err, &e) {
+			status = e.Status
+		}
+		cs.sendMessage(&dimse.CMoveRsp{
+			AffectedSOPClassUID:       c.AffectedSOPClassUID,
+			MessageIDBeingRespondedTo: c.MessageID,
+			CommandDataSetType:        dimse.CommandDataSetTypeNull,
+			Status:                    status,
+		}, nil)
 		return
 	}
+	remoteHostPort := dest.HostPort
 	elems, err := readElementsInBytes(data, cs.context.transferSyntaxUID)
 	if err != nil {
 		sendError(err)
 		return
 	}
-	dicomlog.Vprintf(1, "dicom.serviceProvider: C-MOVE-RQ payload: %s", elementsString(elems))
+	cs.logger.info("Received C-MOVE request", "sop_class", c.AffectedSOPClassUID,
+		"move_destination", c.MoveDestination, "payload", cs.logger.elementsString(elems))
+	var query QRQuery
+	if params.CMoveQuery != nil {
+		if query, err = decodeQRQuery(qrOpCMove, c.AffectedSOPClassUID, elems); err != nil {
+			cs.logger.error("Invalid C-MOVE identifier", LogKeyError, err)
+			cs.sendMessage(&dimse.CMoveRsp{
+				AffectedSOPClassUID:       c.AffectedSOPClassUID,
+				MessageIDBeingRespondedTo: c.MessageID,
+				CommandDataSetType:        dimse.CommandDataSetTypeNull,
+				Status:                    dimse.Status{Status: dimse.CMoveDataSetDoesNotMatchSOPClass, ErrorComment: err.Error()},
+			}, nil)
+			return
+		}
+	}
 	responseCh := make(chan CMoveResult, 128)
 	go func() {
+		defer recoverCMoveCallback(responseCh)
+		if params.CMoveQuery != nil {
+			params.CMoveQuery(connState, cs.context.transferSyntaxUID, c.AffectedSOPClassUID, query, responseCh)
+			return
+		}
 		params.CMove(connState, cs.context.transferSyntaxUID, c.AffectedSOPClassUID, elems, responseCh)
 	}()
-	// responseCh :=
-	status := dimse.Status{Status: dimse.StatusSuccess}
-	var numSuccesses, numFailures uint16
-	for resp := range responseCh {
-		if resp.Err != nil {
-			status = dimse.Status{
-				Status:       dimse.CFindUnableToProcess,
-				ErrorComment: resp.Err.Error(),
-			}
-			break
-		}
-		dicomlog.Vprintf(0, "dicom.serviceProvider: C-MOVE: Sending %v to %v(%s)", resp.Path, c.MoveDestination, remoteHostPort)
-		err := runCStoreOnNewAssociation(params.AETitle, c.MoveDestination, remoteHostPort, resp.DataSet)
-		if err != nil {
-			dicomlog.Vprintf(0, "dicom.serviceProvider: C-MOVE: C-store of %v to %v(%v) failed: %v", resp.Path, c.MoveDestination, remoteHostPort, err)
-			numFailures++
-		} else {
-			numSuccesses++
+	ops := newCMoveSubOps(cs.traceContext(), params, c.MoveDestination, dest,
+		moveOriginator{aeTitle: connState.CallingAETitle, messageID: c.MessageID})
+	defer ops.close()
+	type subOpResult struct {
+		path string
+		ds   *dicom.DataSet
+		err  error
+	}
+	doneCh := make(chan subOpResult, ops.maxAssocs)
+	var stats subOpStats
+	var opErr error
+	numInFlight := 0
+	// finishSubOp waits for a sub-operation to finish, and reports the
+	// progress.
+	finishSubOp := func() {
+		r := <-doneCh
+		numInFlight--
+		if r.err != nil {
+			cs.logger.error("C-MOVE: C-STORE sub-operation failed", "path", r.path,
+				"move_destination", c.MoveDestination, LogKeyRemoteAddr, remoteHostPort, LogKeyError, r.err)
 		}
+		stats.add(r.ds, r.err)
 		cs.sendMessage(&dimse.CMoveRsp{
 			AffectedSOPClassUID:            c.AffectedSOPClassUID,
 			MessageIDBeingRespondedTo:      c.MessageID,
 			CommandDataSetType:             dimse.CommandDataSetTypeNull,
-			NumberOfRemainingSuboperations: uint16(resp.Remaining),
-			NumberOfCompletedSuboperations: numSuccesses,
-			NumberOfFailedSuboperations:    numFailures,
+			NumberOfRemainingSuboperations: stats.numRemaining(numInFlight),
+			NumberOfCompletedSuboperations: stats.completed,
+			NumberOfFailedSuboperations:    stats.failed,
+			NumberOfWarningSuboperations:   stats.warning,
 			Status:                         dimse.Status{Status: dimse.StatusPending},
 		}, nil)
 	}
-	cs.sendMessage(&dimse.CMoveRsp{
+	for resp := range responseCh {
+		if resp.Err != nil {
+			opErr = resp.Err
+			break
+		}
+		if numInFlight == ops.maxAssocs {
+			finishSubOp()
+		}
+		cs.logger.info("C-MOVE: sending dataset", "path", resp.Path,
+			"move_destination", c.MoveDestination, LogKeyRemoteAddr, remoteHostPort)
+		numInFlight++
+		stats.remaining = resp.Remaining
+		go func(resp CMoveResult) {
+			doneCh <- subOpResult{path: resp.Path, ds: resp.DataSet, err: ops.store(resp.DataSet)}
+		}(resp)
+	}
+	for numInFlight > 0 {
+		finishSubOp()
+	}
+	repanic(opErr)
+	final := &dimse.CMoveRsp{
 		AffectedSOPClassUID:            c.AffectedSOPClassUID,
 		MessageIDBeingRespondedTo:      c.MessageID,
 		CommandDataSetType:             dimse.CommandDataSetTypeNull,
-		NumberOfCompletedSuboperations: numSuccesses,
-		NumberOfFailedSuboperations:    numFailures,
-		Status:                         status}, nil)
+		NumberOfCompletedSuboperations: stats.completed,
+		NumberOfFailedSuboperations:    stats.failed,
+		NumberOfWarningSuboperations:   stats.warning,
+		Status:                         stats.finalStatus(opErr),
+	}
+	if opErr != nil {
+		final.NumberOfRemainingSuboperations = stats.numRemaining(0)
+	}
+	payload, err := stats.finalPayload(cs.context.transferSyntaxUID, cs.cm.deflateLevel)
+	if err != nil {
+		cs.logger.error("Failed to encode Failed SOP Instance UID List", LogKeyError, err)
+	} else if payload != nil {
+		final.CommandDataSetType = dimse.CommandDataSetTypeNonNull
+	}
+	cs.sendMessage(final, payload)
 	// Drain the responses in case of errors
 	for range responseCh {
 	}
@@ -202,7 +367,7 @@ func handleCGet(
 			Status:                    dimse.Status{Status: dimse.StatusUnrecognizedOperation, ErrorComment: err.Error()},
 		}, nil)
 	}
-	if params.CGet == nil {
+	if params.CGet == nil && params.CGetQuery == nil {
 		cs.sendMessage(&dimse.CGetRsp{
 			AffectedSOPClassUID:       c.AffectedSOPClassUID,
 			MessageIDBeingRespondedTo: c.MessageID,
@@ -216,55 +381,84 @@ func handleCGet(
 		sendError(err)
 		return
 	}
-	dicomlog.Vprintf(1, "dicom.serviceProvider: C-GET-RQ payload: %s", elementsString(elems))
+	cs.logger.info("Received C-GET request", "sop_class", c.AffectedSOPClassUID, "payload", cs.logger.elementsString(elems))
+	var query QRQuery
+	if params.CGetQuery != nil {
+		if query, err = decodeQRQuery(qrOpCGet, c.AffectedSOPClassUID, elems); err != nil {
+			cs.logger.error("Invalid C-GET identifier", LogKeyError, err)
+			cs.sendMessage(&dimse.CGetRsp{
+				AffectedSOPClassUID:       c.AffectedSOPClassUID,
+				MessageIDBeingRespondedTo: c.MessageID,
+				CommandDataSetType:        dimse.CommandDataSetTypeNull,
+				Status:                    dimse.Status{Status: dimse.CMoveDataSetDoesNotMatchSOPClass, ErrorComment: err.Error()},
+			}, nil)
+			return
+		}
+	}
 	responseCh := make(chan CMoveResult, 128)
 	go func() {
+		defer recoverCMoveCallback(responseCh)
+		if params.CGetQuery != nil {
+			params.CGetQuery(connState, cs.context.transferSyntaxUID, c.AffectedSOPClassUID, query, responseCh)
+			return
+		}
 		params.CGet(connState, cs.context.transferSyntaxUID, c.AffectedSOPClassUID, elems, responseCh)
 	}()
-	status := dimse.Status{Status: dimse.StatusSuccess}
-	var numSuccesses, numFailures uint16
+	var stats subOpStats
+	var opErr error
 	for resp := range responseCh {
 		if resp.Err != nil {
-			status = dimse.Status{
-				Status:       dimse.CFindUnableToProcess,
-				ErrorComment: resp.Err.Error(),
-			}
+			opErr = resp.Err
 			break
 		}
+		stats.remaining = resp.Remaining
 		subCs, err := cs.disp.newCommand(cs.cm, cs.context /*not used*/)
 		if err != nil {
-			status = dimse.Status{
-				Status:       dimse.CFindUnableToProcess,
+			opErr = &StatusError{Status: dimse.Status{
+				Status:       dimse.CMoveOutOfResourcesUnableToPerformSubOperations,
 				ErrorComment: err.Error(),
-			}
+			}}
 			break
 		}
-		err = runCStoreOnAssociation(subCs.upcallCh, subCs.disp.downcallCh, subCs.cm, subCs.messageID, resp.DataSet)
+		err = runCStoreOnAssociation(cs.traceContext(), subCs, resp.DataSet)
 		if err != nil {
-			dicomlog.Vprintf(0, "dicom.serviceProvider: C-GET: C-store of %v failed: %v", resp.Path, err)
-			numFailures++
+			cs.logger.error("C-GET: C-STORE sub-operation failed", "path", resp.Path, LogKeyError, err)
 		} else {
-			dicomlog.Vprintf(0, "dicom.serviceProvider: C-GET: Sent %v", resp.Path)
-			numSuccesses++
+			cs.logger.info("C-GET: sent dataset", "path", resp.Path)
 		}
+		stats.add(resp.DataSet, err)
 		cs.sendMessage(&dimse.CGetRsp{
 			AffectedSOPClassUID:            c.AffectedSOPClassUID,
 			MessageIDBeingRespondedTo:      c.MessageID,
 			CommandDataSetType:             dimse.CommandDataSetTypeNull,
-			NumberOfRemainingSuboperations: uint16(resp.Remaining),
-			NumberOfCompletedSuboperations: numSuccesses,
-			NumberOfFailedSuboperations:    numFailures,
+			NumberOfRemainingSuboperations: stats.numRemaining(0),
+			NumberOfCompletedSuboperations: stats.completed,
+			NumberOfFailedSuboperations:    stats.failed,
+			NumberOfWarningSuboperations:   stats.warning,
 			Status:                         dimse.Status{Status: dimse.StatusPending},
 		}, nil)
 		cs.disp.deleteCommand(subCs)
 	}
-	cs.sendMessage(&dimse.CGetRsp{
+	repanic(opErr)
+	final := &dimse.CGetRsp{
 		AffectedSOPClassUID:            c.AffectedSOPClassUID,
 		MessageIDBeingRespondedTo:      c.MessageID,
 		CommandDataSetType:             dimse.CommandDataSetTypeNull,
-		NumberOfCompletedSuboperations: numSuccesses,
-		NumberOfFailedSuboperations:    numFailures,
-		Status:                         status}, nil)
+		NumberOfCompletedSuboperations: stats.completed,
+		NumberOfFailedSuboperations:    stats.failed,
+		NumberOfWarningSuboperations:   stats.warning,
+		Status:                         stats.finalStatus(opErr),
+	}
+	if opErr != nil {
+		final.NumberOfRemainingSuboperations = stats.numRemaining(0)
+	}
+	payload, err := stats.finalPayload(cs.context.transferSyntaxUID, cs.cm.deflateLevel)
+	if err != nil {
+		cs.logger.error("Failed to encode Failed SOP Instance UID List", LogKeyError, err)
+	} else if payload != nil {
+		final.CommandDataSetType = dimse.CommandDataSetTypeNonNull
+	}
+	cs.sendMessage(final, payload)
 	// Drain the responses in case of errors
 	for range responseCh {
 	}
@@ -279,7 +473,7 @@ func handleCEcho(
 	if params.CEcho != nil {
 		status = params.CEcho(connState)
 	}
-	dicomlog.Vprintf(0, "dicom.serviceProvider: Received E-ECHO: context: %+v, status: %+v", cs.context, status)
+	cs.logger.info("Received C-ECHO request", "context", cs.context.contextID, "status", status.Status)
 	resp := &dimse.CEchoRsp{
 		MessageIDBeingRespondedTo: c.MessageID,
 		CommandDataSetType:        dimse.CommandDataSetTypeNull,
@@ -297,6 +491,10 @@ type ServiceProviderParams struct {
 	// map should be nonempty iff the server supports CMove.
 	RemoteAEs map[string]string
 
+	// ResolveMoveDestination, if non-nil, is called on C-MOVE request to
+	// find the move destination, instead of looking it up in RemoteAEs.
+	ResolveMoveDestination MoveDestinationResolver
+
 	// Called on C_ECHO request. If nil, a C-ECHO call will produce an error response.
 	//
 	// TODO(saito) Support a default C-ECHO callback?
@@ -309,19 +507,103 @@ type ServiceProviderParams struct {
 	// CMove is called on C_MOVE request.
 	CMove CMoveCallback
 
+	// CMoveMaxAssociations is the max number of associations that a C-MOVE
+	// opens in parallel to the move destination. The C-STORE
+	// sub-operations share them. If <= 0, 1 is used, and the datasets are
+	// sent in the order the CMove callback produces them.
+	CMoveMaxAssociations int
+
 	// CGet is called on C_GET request. The only difference between cmove
 	// and cget is that cget uses the same connection to send images back to
 	// the requester. Generally you shuold set the same function to CMove
 	// and CGet.
 	CGet CMoveCallback
 
+	// CFindQuery, CMoveQuery and CGetQuery, if non-nil, are called instead of
+	// CFind, CMove and CGet, respectively. They receive the request decoded
+	// into a QRQuery. A request whose identifier is invalid for its QR model,
+	// e.g., one that lacks QueryRetrieveLevel or the unique keys of the
+	// higher levels, is answered with status 0xA900 without calling them.
+	CFindQuery CFindQueryCallback
+	CMoveQuery CMoveQueryCallback
+	CGetQuery  CMoveQueryCallback
+
 	// If CStoreCallback=nil, a C-STORE call will produce an error response.
 	CStore CStoreCallback
 
+	// CStoreStream, if non-nil, is called on C-STORE request instead of
+	// CStore. It receives the dataset as it arrives from the network, so
+	// the dataset need not fit in memory.
+	CStoreStream CStoreStreamCallback
+
+	// CStoreMemoryThreshold is the max number of bytes of a C-STORE dataset
+	// received but not yet read by the callback, per object. When the
+	// callback falls behind by more, the data is spilled to a temp file in
+	// CStoreSpillDir, or if CStoreSpillDir is empty, the provider stops
+	// reading the network, a few PDUs later, until the callback catches up.
+	// If <= 0, DefaultCStoreMemoryThreshold is used.
+	CStoreMemoryThreshold int64
+
+	// CStoreSpillDir is the directory of the spill files. See
+	// CStoreMemoryThreshold.
+	CStoreSpillDir string
+
+	// CStoreMaxObjectSize, if > 0, is the max size of a C-STORE dataset, in
+	// bytes. Larger datasets are discarded, and the provider responds with
+	// dimse.CStoreOutOfResources.
+	CStoreMaxObjectSize int64
+
 	// TLSConfig, if non-nil, enables TLS on the connection. See
 	// https://gist.github.com/michaljemala/d6f4e01c4834bf47a9c4 for an
 	// example for creating a TLS config from x509 cert files.
 	TLSConfig *tls.Config
+
+	// Logger receives log entries for this provider and the associations it
+	// accepts. If nil, entries are sent to dicomlog.
+	Logger Logger
+
+	// Redaction, if non-nil, masks the values of DICOM elements in log
+	// entries. Set it to NewDefaultRedactionPolicy() to keep PHI out of logs.
+	Redaction *RedactionPolicy
+
+	// Metrics, if non-nil, receives association, PDU and DIMSE stats. The
+	// C-STORE sub-operations of C-MOVE are reported too.
+	Metrics MetricsObserver
+
+	// Tracer, if non-nil, creates a span for each handler invocation, with
+	// child spans for C-GET and C-MOVE sub-operations.
+	Tracer Tracer
+
+	// WireTap, if non-nil, is called for each accepted connection. The
+	// WireTap it returns receives every PDU sent and received on the
+	// association.
+	WireTap WireTapFactory
+
+	// TransferSyntaxes, if nonempty, lists the transfer syntaxes preferred
+	// by the provider, most preferred first. For each presentation context,
+	// the provider accepts the first of them that the user proposes. If the
+	// user proposes none of them, or if TransferSyntaxes is empty, the
+	// provider accepts the first syntax proposed by the user. The list is
+	// also proposed on the associations that C-MOVE opens, along with the
+	// transfer syntaxes of the datasets moved.
+	TransferSyntaxes []string
+
+	// DeflateLevel is the compression level, as defined in compress/flate,
+	// of the datasets sent when Deflated Explicit VR Little Endian is
+	// negotiated. If zero, flate.DefaultCompression is used.
+	DeflateLevel int
+
+	// Mux, if non-nil, routes the requests to the handlers registered in it
+	// by SOP class. CEcho, CFind, CMove, CGet, CStore, CStoreStream and the
+	// QRQuery callbacks are then ignored; register their counterparts in Mux
+	// instead. Only the presentation contexts of the SOP classes registered
+	// in Mux are accepted.
+	Mux *ServiceMux
+
+	// Interceptors run around the handling of each request, the first one
+	// outermost. See ProviderInterceptor. Put RecoveryInterceptor first to
+	// turn panics in the callbacks into error responses.
+	Interceptors []ProviderInterceptor
 }
 
 // DefaultMaxPDUSize is the the PDU size advertized by go-netdicom.
@@ -337,7 +619,9 @@ const DefaultMaxPDUSize = 4 << 20
 // objects in transferSyntaxUID.  "data" does not contain metadata elements
 // (elements whose Tag.Group=2 -- e.g., TransferSyntaxUID and
 // MediaStorageSOPClassUID), since they are stripped by the requster (two key
-// metadata are passed as sop{Class,Instance)UID).
+// metadata are passed as sop{Class,Instance)UID). If transferSyntaxUID is
+// Deflated Explicit VR Little Endian, "data" is compressed, as it would be in a
+// DICOM file.
 //
 // The function should store encode the sop{Class,InstanceUID} as the DICOM
 // header, followed by data. It should return either dimse.Success0 on success,
@@ -349,6 +633,19 @@ type CStoreCallback func(
 	sopInstanceUID string,
 	data []byte) dimse.Status
 
+// CStoreStreamCallback is similar to CStoreCallback, but "data" streams the
+// payload as it arrives from the network. The callback may return before
+// reading all of "data"; the rest is discarded. Reading "data" fails with
+// ErrCStoreTooLarge if the dataset exceeds
+// ServiceProviderParams.CStoreMaxObjectSize. "data" must not be used after the
+// callback returns.
+type CStoreStreamCallback func(
+	conn ConnectionState,
+	transferSyntaxUID string,
+	sopClassUID string,
+	sopInstanceUID string,
+	data io.Reader) dimse.Status
+
 // CFindCallback implements a C-FIND handler.  sopClassUID is the data type
 // requested (e.g.,"1.2.840.10008.5.1.4.1.1.1.2"), and transferSyntaxUID is the
 // data encoding requested (e.g., "1.2.840.10008.1.2.1").  These args are
@@ -382,11 +679,69 @@ type CMoveCallback func(
 	filters []*dicom.Element,
 	ch chan CMoveResult)
 
+// CFindQueryCallback is similar to CFindCallback, but receives the request as
+// a QRQuery. query.Keys lacks the QueryRetrieveLevel element.
+type CFindQueryCallback func(
+	conn ConnectionState,
+	transferSyntaxUID string,
+	sopClassUID string,
+	query QRQuery,
+	ch chan CFindResult)
+
+// CMoveQueryCallback is similar to CMoveCallback, but receives the request as
+// a QRQuery. query.Keys lacks the QueryRetrieveLevel element.
+type CMoveQueryCallback func(
+	conn ConnectionState,
+	transferSyntaxUID string,
+	sopClassUID string,
+	query QRQuery,
+	ch chan CMoveResult)
+
+// MoveDestination is where the C-STORE sub-operations of a C-MOVE are sent.
+type MoveDestination struct {
+	// HostPort is the address of the destination, e.g., "pacs:11112".
+	HostPort string
+	// TLSConfig, if non-nil, enables TLS on the connection.
+	TLSConfig *tls.Config
+	// CallingAETitle, if nonempty, is sent as the calling AE title, instead
+	// of ServiceProviderParams.AETitle.
+	CallingAETitle string
+}
+
+// MoveDestinationResolver finds the destination of a C-MOVE request.
+// "moveDestination" is the AE title named in the request, and "conn" is the
+// state of the association the request arrived on. To deny the request, the
+// resolver returns an error. The provider responds with the status of a
+// *StatusError, e.g., dimse.StatusNotAuthorized, and with
+// dimse.CMoveMoveDestinationUnknown for other errors.
+type MoveDestinationResolver func(conn ConnectionState, moveDestination string) (MoveDestination, error)
+
+// resolveMoveDestination finds the destination of a C-MOVE request, using
+// either the resolver or RemoteAEs.
+func resolveMoveDestination(params ServiceProviderParams, conn ConnectionState, moveDestination string) (MoveDestination, error) {
+	if params.ResolveMoveDestination != nil {
+		dest, err := params.ResolveMoveDestination(conn, moveDestination)
+		if err == nil && dest.HostPort == "" {
+			err = fmt.Errorf("C-MOVE destination '%v' has no address", moveDestination)
+		}
+		return dest, err
+	}
+	hostPort, ok := params.RemoteAEs[moveDestination]
+	if !ok {
+		return MoveDestination{}, fmt.Errorf("C-MOVE destination '%v' not registered in the server", moveDestination)
+	}
+	return MoveDestination{HostPort: hostPort}, nil
+}
+
 // ConnectionState informs session state to callbacks.
 type ConnectionState struct {
 	// TLS connection state. It is nonempty only when the connection is set up
 	// over TLS.
 	TLS tls.ConnectionState
+	// AE titles sent by the peer in the A-ASSOCIATE-RQ. CallingAETitle is the
+	// peer's own title.
+	CallingAETitle string
+	CalledAETitle  string
 }
 
 // CEchoCallback implements C-ECHO callback. It typically just returns
@@ -398,10 +753,21 @@ type ServiceProvider struct {
 	params   ServiceProviderParams
 	listener net.Listener
 	// Label is a unique string used in log messages to identify this provider.
-	label string
+	label  string
+	logger *logger
+
+	mu     sync.Mutex
+	closed bool
 }
 
-func writeElementsToBytes(elems []*dicom.Element, transferSyntaxUID string) ([]byte, error) {
+// writeElementsToBytes encodes "elems" in the transfer syntax. If the syntax is
+// Deflated Explicit VR Little Endian, the result is compressed with the given
+// flate level.
+func writeElementsToBytes(elems []*dicom.Element, transferSyntaxUID string, deflateLevel int) ([]byte, error) {
+	deflated := isDeflatedTransferSyntax(transferSyntaxUID)
+	if deflated {
+		transferSyntaxUID = dicomuid.ExplicitVRLittleEndian
+	}
 	dataEncoder := dicomio.NewBytesEncoderWithTransferSyntax(transferSyntaxUID)
 	for _, elem := range elems {
 		dicom.WriteElement(dataEncoder, elem)
@@ -409,15 +775,24 @@ func writeElementsToBytes(elems []*dicom.Element, transferSyntaxUID string) ([]b
 	if err := dataEncoder.Error(); err != nil {
 		return nil, err
 	}
+	if deflated {
+		return deflateDataSet(dataEncoder.Bytes(), deflateLevel)
+	}
 	return dataEncoder.Bytes(), nil
 }
 
 func readElementsInBytes(data []byte, transferSyntaxUID string) ([]*dicom.Element, error) {
+	if isDeflatedTransferSyntax(transferSyntaxUID) {
+		inflated, err := inflateDataSet(data)
+		if err != nil {
+			return nil, err
+		}
+		data, transferSyntaxUID = inflated, dicomuid.ExplicitVRLittleEndian
+	}
 	decoder := dicomio.NewBytesDecoderWithTransferSyntax(data, transferSyntaxUID)
 	var elems []*dicom.Element
 	for !decoder.EOF() {
 		elem := dicom.ReadElement(decoder, dicom.ReadOptions{})
-		dicomlog.Vprintf(1, "dicom.serviceProvider: C-FIND: Read elem: %v, err %v", elem, decoder.Error())
 		if decoder.Error() != nil {
 			break
 		}
@@ -429,41 +804,19 @@ func readElementsInBytes(data []byte, transferSyntaxUID string) ([]*dicom.Elemen
 	return elems, nil
 }
 
-func elementsString(elems []*dicom.Element) string {
-	s := "["
-	for i, elem := range elems {
-		if i > 0 {
-			s += ", "
-		}
-		s += elem.String()
-	}
-	return s + "]"
-}
-
-// Send "ds" to remoteHostPort using C-STORE. Called as part of C-MOVE.
-func runCStoreOnNewAssociation(myAETitle, remoteAETitle, remoteHostPort string, ds *dicom.DataSet) error {
-	su, err := NewServiceUser(ServiceUserParams{
-		CalledAETitle:  remoteAETitle,
-		CallingAETitle: myAETitle,
-		SOPClasses:     sopclass.StorageClasses})
-	if err != nil {
-		return err
-	}
-	defer su.Release()
-	su.Connect(remoteHostPort)
-	err = su.CStore(ds)
-	dicomlog.Vprintf(1, "dicom.serviceProvider: C-STORE subop done: %v", err)
-	return err
-}
-
 // NewServiceProvider creates a new DICOM server object.  "listenAddr" is the
 // TCP address to listen to. E.g., ":1234" will listen to port 1234 at all the
 // IP address that this machine can bind to.  Run() will actually start running
 // the service.
 func NewServiceProvider(params ServiceProviderParams, port string) (*ServiceProvider, error) {
+	if _, err := validateDeflateLevel(params.DeflateLevel); err != nil {
+		return nil, err
+	}
+	label := newUID("sp")
 	sp := &ServiceProvider{
 		params: params,
-		label:  newUID("sp"),
+		label:  label,
+		logger: newLogger(params.Logger, params.Redaction, "provider", label, "ae", params.AETitle),
 	}
 	var err error
 	if params.TLSConfig != nil {
@@ -477,62 +830,111 @@ func NewServiceProvider(params ServiceProviderParams, port string) (*ServiceProv
 	return sp, nil
 }
 
-func getConnState(conn net.Conn) (cs ConnectionState) {
+func getConnState(conn net.Conn, cm *contextManager) (cs ConnectionState) {
 	tlsConn, ok := conn.(*tls.Conn)
 	if ok {
 		cs.TLS = tlsConn.ConnectionState()
 	}
+	cs.CallingAETitle, cs.CalledAETitle = cm.aeTitles()
 	return
 }
 
+// withHandlerSpan wraps "cb" so that each invocation is covered by a span. The
+// span records an error if the final response reports a failure.
+func withHandlerSpan(cb serviceCallback) serviceCallback {
+	return func(msg dimse.Message, data []byte, cs *serviceCommandState) {
+		cs.startSpan(context.Background(), "dicom.handle."+operationName(msg))
+		cs.setSpanContext(cs.context.abstractSyntaxUID)
+		defer func() { cs.endSpan(cs.finalStatusError()) }()
+		cb(msg, data, cs)
+	}
+}
+
 // RunProviderForConn starts threads for running a DICOM server on "conn". This
 // function returns immediately; "conn" will be cleaned up in the background.
 func RunProviderForConn(conn net.Conn, params ServiceProviderParams) {
+	if params.Mux != nil {
+		params = params.Mux.providerParams(params)
+	}
 	upcallCh := make(chan upcallEvent, 128)
 	label := newUID("sc")
-	disp := newServiceDispatcher(label)
+	logger := newLogger(params.Logger, params.Redaction, LogKeyAssociation, label)
+	disp := newServiceDispatcher(logger, metricsObserverOrDefault(params.Metrics), tracerOrDefault(params.Tracer))
 	disp.registerCallback(dimse.CommandFieldCStoreRq,
-		func(msg dimse.Message, data []byte, cs *serviceCommandState) {
-			handleCStore(params.CStore, getConnState(conn), msg.(*dimse.CStoreRq), data, cs)
-		})
+		withHandlerSpan(withInterceptors(conn, params.Interceptors, func(req *ProviderRequest, cs *serviceCommandState) {
+			handleCStore(params, req.Conn, req.Command.(*dimse.CStoreRq), req.Data, cs)
+		})))
 	disp.registerCallback(dimse.CommandFieldCFindRq,
-		func(msg dimse.Message, data []byte, cs *serviceCommandState) {
-			handleCFind(params, getConnState(conn), msg.(*dimse.CFindRq), data, cs)
-		})
+		withHandlerSpan(withInterceptors(conn, params.Interceptors, func(req *ProviderRequest, cs *serviceCommandState) {
+			handleCFind(params, req.Conn, req.Command.(*dimse.CFindRq), req.Data, cs)
+		})))
 	disp.registerCallback(dimse.CommandFieldCMoveRq,
-		func(msg dimse.Message, data []byte, cs *serviceCommandState) {
-			handleCMove(params, getConnState(conn), msg.(*dimse.CMoveRq), data, cs)
-		})
+		withHandlerSpan(withInterceptors(conn, params.Interceptors, func(req *ProviderRequest, cs *serviceCommandState) {
+			handleCMove(params, req.Conn, req.Command.(*dimse.CMoveRq), req.Data, cs)
+		})))
 	disp.registerCallback(dimse.CommandFieldCGetRq,
-		func(msg dimse.Message, data []byte, cs *serviceCommandState) {
-			handleCGet(params, getConnState(conn), msg.(*dimse.CGetRq), data, cs)
-		})
+		withHandlerSpan(withInterceptors(conn, params.Interceptors, func(req *ProviderRequest, cs *serviceCommandState) {
+			handleCGet(params, req.Conn, req.Command.(*dimse.CGetRq), req.Data, cs)
+		})))
 	disp.registerCallback(dimse.CommandFieldCEchoRq,
-		func(msg dimse.Message, data []byte, cs *serviceCommandState) {
-			handleCEcho(params, getConnState(conn), msg.(*dimse.CEchoRq), data, cs)
-		})
-	go runStateMachineForServiceProvider(conn, upcallCh, disp.downcallCh, label)
+		withHandlerSpan(withInterceptors(conn, params.Interceptors, func(req *ProviderRequest, cs *serviceCommandState) {
+			handleCEcho(params, req.Conn, req.Command.(*dimse.CEchoRq), req.Data, cs)
+		})))
+	_, assocSpan := disp.tracer.Start(context.Background(), "dicom.handle.Associate")
+	assocSpan.SetAttribute(TraceAttrRemoteAddr, remoteAddrString(conn))
+	go runStateMachineForServiceProvider(conn, params, upcallCh, disp.downcallCh, label, logger, disp.metrics)
 	for event := range upcallCh {
+		if event.eventType == upcallEventHandshakeCompleted {
+			// Tag the subsequent DIMSE log entries with the peer info.
+			disp.setLogger(event.cm.logger)
+			callingAE, calledAE := event.cm.aeTitles()
+			assocSpan.SetAttribute(TraceAttrCallingAE, callingAE)
+			assocSpan.SetAttribute(TraceAttrCalledAE, calledAE)
+			assocSpan.End()
+			assocSpan = nil
+		}
 		disp.handleEvent(event)
 	}
-	dicomlog.Vprintf(0, "dicom.serviceProvider(%s): Finished connection %p (remote: %+v)", label, conn, conn.RemoteAddr())
+	if assocSpan != nil {
+		assocSpan.RecordError(fmt.Errorf("dicom.serviceProvider: association failed"))
+		assocSpan.End()
+	}
+	logger.info("Finished connection", LogKeyRemoteAddr, remoteAddrString(conn))
 	disp.close()
 }
 
 // Run listens to incoming connections, accepts them, and runs the DICOM
-// protocol. This function never returns.
+// protocol. This function returns only after Close is called.
 func (sp *ServiceProvider) Run() {
 	for {
 		conn, err := sp.listener.Accept()
 		if err != nil {
-			dicomlog.Vprintf(0, "dicom.serviceProvider(%s): Accept error: %v", sp.label, err)
+			if sp.isClosed() {
+				return
+			}
+			sp.logger.error("Accept error", LogKeyError, err)
 			continue
 		}
-		dicomlog.Vprintf(0, "dicom.serviceProvider(%s): Accepted connection %p (remote: %+v)", sp.label, conn, conn.RemoteAddr())
+		sp.logger.info("Accepted connection", LogKeyRemoteAddr, remoteAddrString(conn))
 		go func() { RunProviderForConn(conn, sp.params) }()
 	}
 }
 
+// Close stops accepting connections, and causes Run to return. The
+// connections already accepted are left running.
+func (sp *ServiceProvider) Close() error {
+	sp.mu.Lock()
+	sp.closed = true
+	sp.mu.Unlock()
+	return sp.listener.Close()
+}
+
+func (sp *ServiceProvider) isClosed() bool {
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	return sp.closed
+}
+
 // ListenAddr returns the TCP address that the server is listening on. It is the
 // address passed to the NewServiceProvider(), except that if value was of form
 // <name>:0, the ":0" part is replaced by the actual port numwber.
@@ -5,13 +5,17 @@ package netdicom
 //go:generate stringer -type QRLevel
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"os"
 	"sync"
 
 	"github.com/grailbio/go-dicom"
 	"github.com/grailbio/go-dicom/dicomio"
-	"github.com/grailbio/go-dicom/dicomlog"
 	"github.com/grailbio/go-dicom/dicomtag"
 	"github.com/grailbio/go-dicom/dicomuid"
 	"github.com/grailbio/go-netdicom/dimse"
@@ -40,7 +44,9 @@ const (
 // methods - say CStore and CFind requests - concurrently from two goroutines.
 // You must wait for CStore to finish before issuing CFind.
 type ServiceUser struct {
+	params   ServiceUserParams
 	label    string // For  logging
+	logger   *logger
 	upcallCh chan upcallEvent
 
 	mu   *sync.Mutex
@@ -50,6 +56,8 @@ type ServiceUser struct {
 	// Following fields are guarded by mu.
 	status serviceUserStatus
 	cm     *contextManager // Set only after the handshake completes.
+	// Span for the association setup. Ended when the handshake completes.
+	assocSpan Span
 	// activeCommands map[uint16]*userCommandState // List of commands running
 }
 
@@ -74,6 +82,36 @@ type ServiceUserParams struct {
 	// spec is particularly moronic here, since we could just have specified
 	// the transfer syntax per data sent.
 	TransferSyntaxes []string
+
+	// TLSConfig, if non-nil, makes Connect set up TLS on the connection. If
+	// TLSConfig.ServerName is empty, the host part of the address is used.
+	TLSConfig *tls.Config
+
+	// Logger receives log entries for this ServiceUser. If nil, entries are
+	// sent to dicomlog.
+	Logger Logger
+
+	// Redaction, if non-nil, masks the values of DICOM elements in log
+	// entries. Set it to NewDefaultRedactionPolicy() to keep PHI out of logs.
+	Redaction *RedactionPolicy
+
+	// Metrics, if non-nil, receives association, PDU and DIMSE stats.
+	Metrics MetricsObserver
+
+	// Tracer, if non-nil, creates spans for the association setup and for
+	// each operation.
+	Tracer Tracer
+
+	// WireTap, if non-nil, is called once the connection is established. The
+	// WireTap it returns receives every PDU sent and received.
+	WireTap WireTapFactory
+
+	// DeflateLevel is the compression level, as defined in compress/flate,
+	// of the datasets sent when Deflated Explicit VR Little Endian is
+	// negotiated. If zero, flate.DefaultCompression is used. To prefer the
+	// deflated syntax, list dicomuid.DeflatedExplicitVRLittleEndian first in
+	// TransferSyntaxes.
+	DeflateLevel int
 }
 
 func validateServiceUserParams(params *ServiceUserParams) error {
@@ -89,14 +127,20 @@ func validateServiceUserParams(params *ServiceUserParams) error {
 	if len(params.TransferSyntaxes) == 0 {
 		params.TransferSyntaxes = dicomio.StandardTransferSyntaxes
 	} else {
-		for i, uid := range params.TransferSyntaxes {
-			canonicalUID, err := dicomio.CanonicalTransferSyntaxUID(uid)
-			if err != nil {
+		// The UIDs are proposed as given. Canonicalizing them would turn
+		// compressed syntaxes into Explicit VR Little Endian, and the
+		// compressed data would then be sent under the wrong syntax.
+		for _, uid := range params.TransferSyntaxes {
+			if _, err := dicomio.CanonicalTransferSyntaxUID(uid); err != nil {
 				return err
 			}
-			params.TransferSyntaxes[i] = canonicalUID
 		}
 	}
+	level, err := validateDeflateLevel(params.DeflateLevel)
+	if err != nil {
+		return err
+	}
+	params.DeflateLevel = level
 	return nil
 }
 
@@ -108,15 +152,21 @@ func NewServiceUser(params ServiceUserParams) (*ServiceUser, error) {
 	}
 	mu := &sync.Mutex{}
 	label := newUID("user")
+	logger := newLogger(params.Logger, params.Redaction,
+		LogKeyAssociation, label,
+		LogKeyCallingAE, params.CallingAETitle,
+		LogKeyCalledAE, params.CalledAETitle)
 	su := &ServiceUser{
+		params:   params,
 		label:    label,
+		logger:   logger,
 		upcallCh: make(chan upcallEvent, 128),
-		disp:     newServiceDispatcher(label),
+		disp:     newServiceDispatcher(logger, metricsObserverOrDefault(params.Metrics), tracerOrDefault(params.Tracer)),
 		mu:       mu,
 		cond:     sync.NewCond(mu),
 		status:   serviceUserInitial,
 	}
-	go runStateMachineForServiceUser(params, su.upcallCh, su.disp.downcallCh, label)
+	go runStateMachineForServiceUser(params, su.upcallCh, su.disp.downcallCh, label, logger, su.disp.metrics)
 	go func() {
 		for event := range su.upcallCh {
 			if event.eventType == upcallEventHandshakeCompleted {
@@ -126,15 +176,17 @@ func NewServiceUser(params ServiceUserParams) (*ServiceUser, error) {
 				su.cond.Broadcast()
 				su.cm = event.cm
 				doassert(su.cm != nil)
+				su.endAssociationSpan(nil)
 				su.mu.Unlock()
 				continue
 			}
 			doassert(event.eventType == upcallEventData)
 			su.disp.handleEvent(event)
 		}
-		dicomlog.Vprintf(1, "dicom.serviceUser: dispatcher finished")
+		su.logger.info("Dispatcher finished")
 		su.disp.close()
 		su.mu.Lock()
+		su.endAssociationSpan(fmt.Errorf("dicom.serviceUser: association failed"))
 		su.cond.Broadcast()
 		su.status = serviceUserClosed
 		su.mu.Unlock()
@@ -150,21 +202,82 @@ func (su *ServiceUser) waitUntilReady() error {
 	}
 	if su.status != serviceUserAssociationActive {
 		// Will get an error when waiting for a response.
-		dicomlog.Vprintf(0, "dicom.serviceUser: Connection failed")
-		return fmt.Errorf("dicom.serviceUser: Connection failed")
+		su.logger.error("Connection failed")
+		return &associationError{msg: "dicom.serviceUser: Connection failed"}
 	}
 	return nil
 }
 
+// associationError is returned by ServiceUser operations that failed because
+// the association couldn't be established, or ended before the response
+// arrived. Unlike other errors, these say nothing about the request itself,
+// so the request may succeed on a new association.
+type associationError struct {
+	msg string
+}
+
+func (e *associationError) Error() string { return e.msg }
+
+// IsAssociationError checks if "err", returned by a ServiceUser operation,
+// means that the association couldn't be established, or ended before the
+// response arrived. Such an operation may succeed on a new association,
+// whereas other errors, e.g., a failure status, a presentation context that
+// the provider rejected, or a dataset that can't be read, would recur.
+func IsAssociationError(err error) bool {
+	var e *associationError
+	return errors.As(err, &e)
+}
+
+// startAssociationSpan starts the span that covers the association setup.
+func (su *ServiceUser) startAssociationSpan(ctx context.Context, serverAddr string) {
+	_, span := su.disp.tracer.Start(ctx, "dicom.Associate")
+	span.SetAttribute(TraceAttrCallingAE, su.params.CallingAETitle)
+	span.SetAttribute(TraceAttrCalledAE, su.params.CalledAETitle)
+	span.SetAttribute(TraceAttrRemoteAddr, serverAddr)
+	su.mu.Lock()
+	su.assocSpan = span
+	su.mu.Unlock()
+}
+
+// endAssociationSpan ends the span started by startAssociationSpan, if it's
+// still running.
+//
+// REQUIRES: su.mu is locked.
+func (su *ServiceUser) endAssociationSpan(err error) {
+	if su.assocSpan == nil {
+		return
+	}
+	if err != nil {
+		su.assocSpan.RecordError(err)
+	}
+	su.assocSpan.End()
+	su.assocSpan = nil
+}
+
 // Connect connects to the server at the given "host:port". Either Connect or
 // SetConn must be before calling CStore, etc.
 func (su *ServiceUser) Connect(serverAddr string) {
+	su.ConnectContext(context.Background(), serverAddr)
+}
+
+// ConnectContext is similar to Connect, but "ctx" can be used to cancel
+// dialing, and it becomes the parent of the association setup span.
+func (su *ServiceUser) ConnectContext(ctx context.Context, serverAddr string) {
 	if su.status != serviceUserInitial {
 		panic(fmt.Sprintf("dicom.serviceUser: Connect called with wrong state: %v", su.status))
 	}
-	conn, err := net.Dial("tcp", serverAddr)
+	su.startAssociationSpan(ctx, serverAddr)
+	var conn net.Conn
+	var err error
+	if su.params.TLSConfig != nil {
+		dialer := tls.Dialer{Config: su.params.TLSConfig}
+		conn, err = dialer.DialContext(ctx, "tcp", serverAddr)
+	} else {
+		var dialer net.Dialer
+		conn, err = dialer.DialContext(ctx, "tcp", serverAddr)
+	}
 	if err != nil {
-		dicomlog.Vprintf(0, "dicom.serviceUser: Connect(%s): %v", serverAddr, err)
+		su.logger.error("Failed to connect", LogKeyRemoteAddr, serverAddr, LogKeyError, err)
 		su.disp.downcallCh <- stateEvent{event: evt17, pdu: nil, err: err}
 	} else {
 		su.disp.downcallCh <- stateEvent{event: evt02, pdu: nil, err: nil, conn: conn}
@@ -175,13 +288,20 @@ func (su *ServiceUser) Connect(serverAddr string) {
 // the server. Either Connect or SetConn must be before calling CStore, etc.
 func (su *ServiceUser) SetConn(conn net.Conn) {
 	doassert(su.status == serviceUserInitial)
+	su.startAssociationSpan(context.Background(), remoteAddrString(conn))
 	su.disp.downcallCh <- stateEvent{event: evt02, pdu: nil, err: nil, conn: conn}
 }
 
 // CEcho send a C-ECHO request to the remote AE and waits for a
 // response. Returns nil iff the remote AE responds ok.
 func (su *ServiceUser) CEcho() error {
-	err := su.waitUntilReady()
+	return su.CEchoContext(context.Background())
+}
+
+// CEchoContext is similar to CEcho. "ctx" becomes the parent of the C-ECHO
+// span. Cancelling ctx doesn't abort the operation.
+func (su *ServiceUser) CEchoContext(ctx context.Context) (err error) {
+	err = su.waitUntilReady()
 	if err != nil {
 		return err
 	}
@@ -194,6 +314,9 @@ func (su *ServiceUser) CEcho() error {
 		return err
 	}
 	defer su.disp.deleteCommand(cs)
+	cs.startSpan(ctx, "dicom.C-ECHO")
+	cs.setSpanContext(context.abstractSyntaxUID)
+	defer func() { cs.endSpan(err) }()
 	cs.sendMessage(
 		&dimse.CEchoRq{MessageID: cs.messageID,
 			CommandDataSetType: dimse.CommandDataSetTypeNull,
@@ -217,6 +340,18 @@ func (su *ServiceUser) CEcho() error {
 //
 // REQUIRES: Connect() or SetConn has been called.
 func (su *ServiceUser) CStore(ds *dicom.DataSet) error {
+	return su.CStoreContext(context.Background(), ds)
+}
+
+// CStoreContext is similar to CStore. "ctx" becomes the parent of the C-STORE
+// span. Cancelling ctx doesn't abort the operation.
+func (su *ServiceUser) CStoreContext(ctx context.Context, ds *dicom.DataSet) error {
+	return su.cstore(ctx, ds, moveOriginator{})
+}
+
+// cstore runs C-STORE. If the C-STORE is a sub-operation of C-MOVE,
+// "originator" identifies the C-MOVE request.
+func (su *ServiceUser) cstore(ctx context.Context, ds *dicom.DataSet, originator moveOriginator) error {
 	err := su.waitUntilReady()
 	if err != nil {
 		return err
@@ -229,28 +364,92 @@ func (su *ServiceUser) CStore(ds *dicom.DataSet) error {
 	} else if sopClassUID, err = sopClassUIDElem.GetString(); err != nil {
 		return err
 	}
-	context, err := su.cm.lookupByAbstractSyntaxUID(sopClassUID)
+	cs, err := su.newCStoreCommand(sopClassUID)
 	if err != nil {
 		return err
 	}
-	cs, err := su.disp.newCommand(su.cm, context)
+	defer su.disp.deleteCommand(cs)
+	cs.moveOriginator = originator
+	return runCStoreOnAssociation(ctx, cs, ds)
+}
+
+// CStoreFile issues a C-STORE request to transfer the DICOM file at "path".
+// Unlike CStore, it doesn't parse the dataset. If the file's transfer syntax
+// matches the one negotiated for its SOP class, the dataset is streamed from
+// the file into P-DATA-TF PDUs, so the file need not fit in memory. Otherwise
+// the dataset is read into memory and re-encoded in the negotiated transfer
+// syntax. It blocks until the operation finishes.
+//
+// REQUIRES: Connect() or SetConn has been called.
+func (su *ServiceUser) CStoreFile(path string) error {
+	return su.CStoreFileContext(context.Background(), path)
+}
+
+// CStoreFileContext is similar to CStoreFile. "ctx" becomes the parent of the
+// C-STORE span. Cancelling ctx doesn't abort the operation.
+func (su *ServiceUser) CStoreFileContext(ctx context.Context, path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	meta, err := readPart10Header(in)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return su.CStoreReaderContext(ctx, meta, in)
+}
+
+// CStoreReader is similar to CStoreFile, but it reads the dataset from "body".
+// "meta" are the metadata elements (group 2). They must contain
+// TransferSyntaxUID, MediaStorageSOPClassUID and MediaStorageSOPInstanceUID.
+// "body" yields the rest of the dataset, encoded in TransferSyntaxUID.
+//
+// REQUIRES: Connect() or SetConn has been called.
+func (su *ServiceUser) CStoreReader(meta []*dicom.Element, body io.Reader) error {
+	return su.CStoreReaderContext(context.Background(), meta, body)
+}
+
+// CStoreReaderContext is similar to CStoreReader. "ctx" becomes the parent of
+// the C-STORE span. Cancelling ctx doesn't abort the operation.
+func (su *ServiceUser) CStoreReaderContext(ctx context.Context, meta []*dicom.Element, body io.Reader) error {
+	err := su.waitUntilReady()
 	if err != nil {
 		return err
 	}
+	doassert(su.cm != nil)
+	sopClassUID, err := getMetaString(meta, dicomtag.MediaStorageSOPClassUID)
+	if err != nil {
+		return err
+	}
+	cs, err := su.newCStoreCommand(sopClassUID)
 	if err != nil {
-		dicomlog.Vprintf(0, "dicom.serviceUser: C-STORE: sop class %v not found in context %v", sopClassUID, err)
 		return err
 	}
 	defer su.disp.deleteCommand(cs)
-	return runCStoreOnAssociation(cs.upcallCh, su.disp.downcallCh, su.cm, cs.messageID, ds)
+	return runCStoreStreamOnAssociation(ctx, cs, meta, body)
+}
+
+// newCStoreCommand allocates a command for sending a dataset of the given
+// SOP class.
+func (su *ServiceUser) newCStoreCommand(sopClassUID string) (*serviceCommandState, error) {
+	context, err := su.cm.lookupByAbstractSyntaxUID(sopClassUID)
+	if err != nil {
+		su.logger.error("SOP class not found in context", LogKeyCommand, "C-STORE-RQ", "sop_class", sopClassUID, LogKeyError, err)
+		return nil, err
+	}
+	return su.disp.newCommand(su.cm, context)
 }
 
 // QRLevel is used to specify the element hierarchy assumed during C-FIND,
 // C-GET, and C-MOVE. P3.4, C.3.
 //
 // http://dicom.nema.org/Dicom/2013/output/chtml/part04/sect_C.3.html
+//
+// When passed to CFind or CGet, the level also chooses the QR model: Patient
+// Root for QRLevelPatient, and Study Root otherwise. Use CFindQuery or
+// CGetQuery to choose the model explicitly.
 type QRLevel int
-type qrOpType int
 
 const (
 	// QRLevelPatient chooses Patient-Root QR model.  P3.4, C.3.1
@@ -262,6 +461,13 @@ const (
 	// QRLevelSeries chooses Study-Root QR model, but using "SERIES" QueryRetrieveLevel.  P3.4, C.3.2
 	QRLevelSeries
 
+	// QRLevelImage chooses Study-Root QR model, but using "IMAGE" QueryRetrieveLevel.  P3.4, C.3.2
+	QRLevelImage
+)
+
+type qrOpType int
+
+const (
 	qrOpCFind qrOpType = iota
 	qrOpCGet
 	qrOpCMove
@@ -274,39 +480,26 @@ type CFindResult struct {
 	Elements []*dicom.Element // Elements belonging to one dataset.
 }
 
-func encodeQRPayload(opType qrOpType, qrLevel QRLevel, filter []*dicom.Element, cm *contextManager) (contextManagerEntry, []byte, error) {
-	var sopClassUID string
-	var qrLevelString string
+// legacyQRQuery returns the query for CFind and CGet. The level chooses the
+// model. The filter may contain a QueryRetrieveLevel element, which overrides
+// the level.
+func legacyQRQuery(qrLevel QRLevel, filter []*dicom.Element) (QRQuery, error) {
+	q := QRQuery{Model: QRModelStudyRoot, Level: qrLevel, Keys: filter}
 	switch qrLevel {
 	case QRLevelPatient:
-		switch opType {
-		case qrOpCFind:
-			sopClassUID = dicomuid.PatientRootQRFind
-		case qrOpCGet:
-			sopClassUID = dicomuid.PatientRootQRGet
-		case qrOpCMove:
-			sopClassUID = dicomuid.PatientRootQRMove
-		}
-		qrLevelString = "PATIENT"
-	case QRLevelStudy, QRLevelSeries:
-		switch opType {
-		case qrOpCFind:
-			sopClassUID = dicomuid.StudyRootQRFind
-		case qrOpCGet:
-			sopClassUID = dicomuid.StudyRootQRGet
-		case qrOpCMove:
-			sopClassUID = dicomuid.StudyRootQRMove
-		}
-		qrLevelString = "STUDY"
-		if qrLevel == QRLevelSeries {
-			qrLevelString = "SERIES"
-		}
+		q.Model = QRModelPatientRoot
+	case QRLevelStudy, QRLevelSeries, QRLevelImage:
 	default:
-		return contextManagerEntry{}, nil, fmt.Errorf("Invalid C-FIND QR lever: %d", qrLevel)
+		return q, fmt.Errorf("Invalid C-FIND QR lever: %d", qrLevel)
 	}
+	return q, nil
+}
 
-	// Translate qrLevel to the sopclass and QRLevel elem.
-	// Encode the C-FIND DIMSE command.
+func encodeQRPayload(opType qrOpType, query QRQuery, cm *contextManager, logger *logger) (contextManagerEntry, []byte, error) {
+	sopClassUID, err := qrSOPClassUID(query.Model, opType)
+	if err != nil {
+		return contextManagerEntry{}, nil, err
+	}
 	context, err := cm.lookupByAbstractSyntaxUID(sopClassUID)
 	if err != nil {
 		// This happens when the user passed a wrong sopclass list in
@@ -315,24 +508,15 @@ func encodeQRPayload(opType qrOpType, qrLevel QRLevel, filter []*dicom.Element,
 	}
 
 	// Encode the data payload containing the filtering conditions.
-	dataEncoder := dicomio.NewBytesEncoderWithTransferSyntax(context.transferSyntaxUID)
-	foundQRLevel := false
-	for _, elem := range filter {
-		if elem.Tag == dicomtag.QueryRetrieveLevel {
-			foundQRLevel = true
-		}
-		dicom.WriteElement(dataEncoder, elem)
-		dicomlog.Vprintf(2, "dicom.serviceUser: Add QR payload: %v", elem)
-	}
-	if !foundQRLevel {
-		elem := dicom.MustNewElement(dicomtag.QueryRetrieveLevel, qrLevelString)
-		dicomlog.Vprintf(2, "dicom.serviceUser: Add QR payload: %v", elem)
-		dicom.WriteElement(dataEncoder, elem)
+	elems := query.Identifier()
+	for _, elem := range elems {
+		logger.debug("Add QR payload", "element", logger.elementString(elem))
 	}
-	if err := dataEncoder.Error(); err != nil {
+	payload, err := writeElementsToBytes(elems, context.transferSyntaxUID, cm.deflateLevel)
+	if err != nil {
 		return context, nil, err
 	}
-	return context, dataEncoder.Bytes(), err
+	return context, payload, nil
 }
 
 // CFind issues a C-FIND request. Returns a channel that streams sequence of
@@ -344,14 +528,39 @@ func encodeQRPayload(opType qrOpType, qrLevel QRLevel, filter []*dicom.Element,
 //
 // REQUIRES: Connect() or SetConn has been called.
 func (su *ServiceUser) CFind(qrLevel QRLevel, filter []*dicom.Element) chan CFindResult {
+	return su.CFindContext(context.Background(), qrLevel, filter)
+}
+
+// CFindContext is similar to CFind. "ctx" becomes the parent of the C-FIND
+// span. Cancelling ctx doesn't abort the operation.
+func (su *ServiceUser) CFindContext(ctx context.Context, qrLevel QRLevel, filter []*dicom.Element) chan CFindResult {
+	query, err := legacyQRQuery(qrLevel, filter)
+	return su.cfind(ctx, query, err)
+}
+
+// CFindQuery is similar to CFindContext, but the query also chooses the QR
+// model. The query is validated before it is sent: the level must be in the
+// model, and the keys must contain the unique keys of the levels above, each
+// with a single value. P3.4, C.4.1.2.1.
+func (su *ServiceUser) CFindQuery(ctx context.Context, query QRQuery) chan CFindResult {
+	return su.cfind(ctx, query, validateQRQuery(qrOpCFind, query))
+}
+
+// cfind runs C-FIND. If queryErr is set, it is reported instead.
+func (su *ServiceUser) cfind(ctx context.Context, query QRQuery, queryErr error) chan CFindResult {
 	ch := make(chan CFindResult, 128)
+	if queryErr != nil {
+		ch <- CFindResult{Err: queryErr}
+		close(ch)
+		return ch
+	}
 	err := su.waitUntilReady()
 	if err != nil {
 		ch <- CFindResult{Err: err}
 		close(ch)
 		return ch
 	}
-	context, payload, err := encodeQRPayload(qrOpCFind, qrLevel, filter, su.cm)
+	context, payload, err := encodeQRPayload(qrOpCFind, query, su.cm, su.logger)
 	if err != nil {
 		ch <- CFindResult{Err: err}
 		close(ch)
@@ -363,9 +572,13 @@ func (su *ServiceUser) CFind(qrLevel QRLevel, filter []*dicom.Element) chan CFin
 		close(ch)
 		return ch
 	}
+	cs.startSpan(ctx, "dicom.C-FIND")
+	cs.setSpanContext(context.abstractSyntaxUID)
 	go func() {
+		var err error
 		defer close(ch)
 		defer su.disp.deleteCommand(cs)
+		defer func() { cs.endSpan(err) }()
 		cs.sendMessage(
 			&dimse.CFindRq{
 				AffectedSOPClassUID: context.abstractSyntaxUID,
@@ -377,27 +590,30 @@ func (su *ServiceUser) CFind(qrLevel QRLevel, filter []*dicom.Element) chan CFin
 			event, ok := <-cs.upcallCh
 			if !ok {
 				su.status = serviceUserClosed
-				ch <- CFindResult{Err: fmt.Errorf("Connection closed while waiting for C-FIND response")}
+				err = &associationError{msg: "Connection closed while waiting for C-FIND response"}
+				ch <- CFindResult{Err: err}
 				break
 			}
 			doassert(event.eventType == upcallEventData)
 			doassert(event.command != nil)
 			resp, ok := event.command.(*dimse.CFindRsp)
 			if !ok {
-				ch <- CFindResult{Err: fmt.Errorf("Found wrong response for C-FIND: %v", event.command)}
+				err = fmt.Errorf("Found wrong response for C-FIND: %v", event.command)
+				ch <- CFindResult{Err: err}
 				break
 			}
-			elems, err := readElementsInBytes(event.data, context.transferSyntaxUID)
-			if err != nil {
-				dicomlog.Vprintf(0, "dicom.serviceUser: Failed to decode C-FIND response: %v %v", resp.String(), err)
+			elems, decodeErr := readElementsInBytes(event.data, context.transferSyntaxUID)
+			if decodeErr != nil {
+				err = decodeErr
+				cs.logger.error("Failed to decode C-FIND response", LogKeyCommand, commandName(resp), "detail", resp.String(), LogKeyError, err)
 				ch <- CFindResult{Err: err}
 			} else {
 				ch <- CFindResult{Elements: elems}
 			}
 			if resp.Status.Status != dimse.StatusPending {
-				if resp.Status.Status != 0 {
-					// TODO: report error if status!= 0
-					panic(resp)
+				if resp.Status.Status != dimse.StatusSuccess {
+					err = fmt.Errorf("Non-OK status in C-FIND response: %+v: %w", resp.Status, &StatusError{Status: resp.Status})
+					ch <- CFindResult{Err: err}
 				}
 				break
 			}
@@ -412,16 +628,44 @@ func (su *ServiceUser) CFind(qrLevel QRLevel, filter []*dicom.Element) chan CFin
 // server.
 //
 // The "data" arg to "cb" is the serialized dataset, encoded according to
-// transferSyntaxUID.
-//
-// TODO(saito) We should parse the data into DataSet before passing to "cb".
+// transferSyntaxUID. See CGetDataSets and CGetToDir for variants that parse
+// the datasets, or write them to files.
 func (su *ServiceUser) CGet(qrLevel QRLevel, filter []*dicom.Element,
 	cb func(transferSyntaxUID, sopClassUID, sopInstanceUID string, data []byte) dimse.Status) error {
-	err := su.waitUntilReady()
+	return su.CGetContext(context.Background(), qrLevel, filter, cb)
+}
+
+// CGetContext is similar to CGet. "ctx" becomes the parent of the C-GET
+// span. Each C-STORE sub-operation gets its own child span. Cancelling ctx
+// doesn't abort the operation.
+func (su *ServiceUser) CGetContext(ctx context.Context, qrLevel QRLevel, filter []*dicom.Element,
+	cb func(transferSyntaxUID, sopClassUID, sopInstanceUID string, data []byte) dimse.Status) error {
+	query, err := legacyQRQuery(qrLevel, filter)
 	if err != nil {
 		return err
 	}
-	context, payload, err := encodeQRPayload(qrOpCGet, qrLevel, filter, su.cm)
+	return su.cget(ctx, query, nil, cb)
+}
+
+// CGetQuery is similar to CGetContext, but the query also chooses the QR
+// model. The query is validated as in CFindQuery. In addition, the keys must
+// contain the unique key of the level itself. P3.4, C.4.2.2.1.
+func (su *ServiceUser) CGetQuery(ctx context.Context, query QRQuery,
+	cb func(transferSyntaxUID, sopClassUID, sopInstanceUID string, data []byte) dimse.Status) error {
+	if err := validateQRQuery(qrOpCGet, query); err != nil {
+		return err
+	}
+	return su.cget(ctx, query, nil, cb)
+}
+
+// cget runs a C-GET. If non-nil, "progress" is called for every C-GET-RSP.
+func (su *ServiceUser) cget(ctx context.Context, query QRQuery, progress func(CGetProgress),
+	cb func(transferSyntaxUID, sopClassUID, sopInstanceUID string, data []byte) dimse.Status) (err error) {
+	err = su.waitUntilReady()
+	if err != nil {
+		return err
+	}
+	context, payload, err := encodeQRPayload(qrOpCGet, query, su.cm, su.logger)
 	if err != nil {
 		return err
 	}
@@ -430,11 +674,20 @@ func (su *ServiceUser) CGet(qrLevel QRLevel, filter []*dicom.Element,
 		return err
 	}
 	defer su.disp.deleteCommand(cs)
+	getCtx := cs.startSpan(ctx, "dicom.C-GET")
+	cs.setSpanContext(context.abstractSyntaxUID)
+	defer func() { cs.endSpan(err) }()
 
 	handleCStore := func(msg dimse.Message, data []byte, cs *serviceCommandState) {
 		c := msg.(*dimse.CStoreRq)
+		cs.startSpan(getCtx, "dicom.handle.C-STORE")
+		cs.setSpanContext(c.AffectedSOPClassUID)
+		cs.setSpanAttribute(TraceAttrSOPInstance, c.AffectedSOPInstanceUID)
+		defer func() { cs.endSpan(cs.finalStatusError()) }()
+		// The sub-operation may use another presentation context than
+		// the C-GET.
 		status := cb(
-			context.transferSyntaxUID,
+			cs.context.transferSyntaxUID,
 			c.AffectedSOPClassUID,
 			c.AffectedSOPInstanceUID,
 			data)
@@ -460,7 +713,7 @@ func (su *ServiceUser) CGet(qrLevel QRLevel, filter []*dicom.Element,
 		event, ok := <-cs.upcallCh
 		if !ok {
 			su.status = serviceUserClosed
-			return fmt.Errorf("Connection closed while waiting for C-GET response")
+			return &associationError{msg: "Connection closed while waiting for C-GET response"}
 		}
 		doassert(event.eventType == upcallEventData)
 		doassert(event.command != nil)
@@ -468,10 +721,19 @@ func (su *ServiceUser) CGet(qrLevel QRLevel, filter []*dicom.Element,
 		if !ok {
 			return fmt.Errorf("Found wrong response for C-GET: %v", event.command)
 		}
+		if progress != nil {
+			progress(CGetProgress{
+				Remaining: int(resp.NumberOfRemainingSuboperations),
+				Completed: int(resp.NumberOfCompletedSuboperations),
+				Failed:    int(resp.NumberOfFailedSuboperations),
+				Warning:   int(resp.NumberOfWarningSuboperations),
+				Final:     resp.Status.Status != dimse.StatusPending,
+			})
+		}
 		if resp.Status.Status != dimse.StatusPending {
 			if resp.Status.Status != 0 {
-				e := fmt.Errorf("Received C-GET error: %+v", resp)
-				dicomlog.Vprintf(0, "dicom.serviceUser: C-GET: %v", e)
+				e := fmt.Errorf("Received C-GET error: %+v: %w", resp, &StatusError{Status: resp.Status})
+				cs.logger.error("C-GET failed", LogKeyCommand, commandName(resp), "status", resp.Status.Status, LogKeyError, e)
 				return e
 			}
 			break
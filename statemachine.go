@@ -11,8 +11,6 @@ import (
 	"time"
 
 	"github.com/grailbio/go-dicom/dicomio"
-	"github.com/grailbio/go-dicom/dicomlog"
-	"github.com/grailbio/go-dicom/dicomuid"
 	"github.com/grailbio/go-netdicom/dimse"
 	"github.com/grailbio/go-netdicom/pdu"
 )
@@ -68,6 +66,12 @@ func (s *stateType) String() string {
 	return fmt.Sprintf("sta%02d(%s)", *s, description)
 }
 
+// shortName returns the state name without description, e.g., "sta06". Used
+// as a log attribute.
+func (s stateType) shortName() string {
+	return fmt.Sprintf("sta%02d", int(s))
+}
+
 type eventType int
 
 const (
@@ -139,6 +143,12 @@ func (e *eventType) String() string {
 	return fmt.Sprintf("evt%02d(%s)", *e, description)
 }
 
+// shortName returns the event name without description, e.g., "evt09". Used
+// as a log attribute.
+func (e eventType) shortName() string {
+	return fmt.Sprintf("evt%02d", int(e))
+}
+
 type stateAction struct {
 	Name        string
 	Description string
@@ -161,7 +171,9 @@ var actionAe2 = &stateAction{"AE-2", "Connection established on the user side. S
 	func(sm *stateMachine, event stateEvent) stateType {
 		doassert(event.conn != nil)
 		sm.conn = event.conn
-		go networkReaderThread(sm.netCh, event.conn, DefaultMaxPDUSize, sm.label)
+		sm.logger = sm.logger.with(LogKeyRemoteAddr, remoteAddrString(event.conn))
+		startWireTap(sm)
+		go networkReaderThread(sm.netCh, event.conn, DefaultMaxPDUSize, sm.logger, sm.metrics, sm.tap)
 		items := sm.contextManager.generateAssociateRequest(
 			sm.userParams.SOPClasses,
 			sm.userParams.TransferSyntaxes)
@@ -184,18 +196,20 @@ var actionAe3 = &stateAction{"AE-3", "Issue A-ASSOCIATE confirmation (accept) pr
 		doassert(v.Type == pdu.TypeAAssociateAc)
 		err := sm.contextManager.onAssociateResponse(v.Items)
 		if err == nil {
+			sm.metrics.ObserveAssociation(AssociationOpened)
 			sm.upcallCh <- upcallEvent{
 				eventType: upcallEventHandshakeCompleted,
 				cm:        sm.contextManager,
 			}
 			return sta06
 		}
-		dicomlog.Vprintf(0, "dicom.stateMachine: AE-3: %v", err)
+		sm.logger.error("Failed to process A-ASSOCIATE-AC", LogKeyError, err)
 		return actionAa8.Callback(sm, event)
 	}}
 
 var actionAe4 = &stateAction{"AE-4", "Issue A-ASSOCIATE confirmation (reject) primitive and close transport connection",
 	func(sm *stateMachine, event stateEvent) stateType {
+		observeAssociationEnd(sm, AssociationRejected)
 		closeConnection(sm)
 		return sta01
 	}}
@@ -204,9 +218,10 @@ var actionAe5 = &stateAction{"AE-5", "Issue Transport connection response primit
 	func(sm *stateMachine, event stateEvent) stateType {
 		doassert(event.conn != nil)
 		startTimer(sm)
-		go func(ch chan stateEvent, conn net.Conn) {
-			networkReaderThread(ch, conn, DefaultMaxPDUSize, sm.label)
-		}(sm.netCh, event.conn)
+		startWireTap(sm)
+		go func(ch chan stateEvent, conn net.Conn, logger *logger, metrics MetricsObserver, tap WireTap) {
+			networkReaderThread(ch, conn, DefaultMaxPDUSize, logger, metrics, tap)
+		}(sm.netCh, event.conn, sm.logger, sm.metrics, sm.tap)
 		return sta02
 	}}
 
@@ -226,10 +241,18 @@ otherwise issue A-ASSOCIATE-RJ-PDU and start ARTIM timer`,
 	func(sm *stateMachine, event stateEvent) stateType {
 		stopTimer(sm)
 		v := event.pdu.(*pdu.AAssociate)
+		// AE titles are padded with spaces to 16 bytes on the wire.
+		callingAETitle := strings.TrimSpace(v.CallingAETitle)
+		calledAETitle := strings.TrimSpace(v.CalledAETitle)
+		sm.logger = sm.logger.with(LogKeyCallingAE, callingAETitle, LogKeyCalledAE, calledAETitle)
+		sm.contextManager.logger = sm.logger
+		sm.contextManager.callingAETitle = callingAETitle
+		sm.contextManager.calledAETitle = calledAETitle
 		if v.ProtocolVersion != 0x0001 {
-			dicomlog.Vprintf(0, "dicom.stateMachine(%s): Wrong remote protocol version 0x%x", sm.label, v.ProtocolVersion)
+			sm.logger.error("Wrong remote protocol version", "version", v.ProtocolVersion)
 			rj := pdu.AAssociateRj{Result: 1, Source: 2, Reason: 2}
 			sendPDU(sm, &rj)
+			observeAssociationEnd(sm, AssociationRejected)
 			startTimer(sm)
 			return sta13
 		}
@@ -264,6 +287,7 @@ otherwise issue A-ASSOCIATE-RJ-PDU and start ARTIM timer`,
 var actionAe7 = &stateAction{"AE-7", "Send A-ASSOCIATE-AC PDU",
 	func(sm *stateMachine, event stateEvent) stateType {
 		sendPDU(sm, event.pdu.(*pdu.AAssociate))
+		sm.metrics.ObserveAssociation(AssociationOpened)
 		sm.upcallCh <- upcallEvent{
 			eventType: upcallEventHandshakeCompleted,
 			cm:        sm.contextManager,
@@ -274,42 +298,32 @@ var actionAe7 = &stateAction{"AE-7", "Send A-ASSOCIATE-AC PDU",
 var actionAe8 = &stateAction{"AE-8", "Send A-ASSOCIATE-RJ PDU and start ARTIM timer",
 	func(sm *stateMachine, event stateEvent) stateType {
 		sendPDU(sm, event.pdu.(*pdu.AAssociateRj))
+		observeAssociationEnd(sm, AssociationRejected)
 		startTimer(sm)
 		return sta13
 	}}
 
-// Produce a list of P_DATA_TF PDUs that collective store "data".
-func splitDataIntoPDUs(sm *stateMachine, abstractSyntaxName string, command bool, data []byte) []pdu.PDataTf {
-	doassert(len(data) > 0)
-	context, err := sm.contextManager.lookupByAbstractSyntaxUID(abstractSyntaxName)
-	if err != nil {
-		// TODO(saito) Don't crash here.
-		panic(fmt.Sprintf("dicom.stateMachine(%s): Illegal syntax name %s: %s", sm.label, dicomuid.UIDString(abstractSyntaxName), err))
-	}
-	var pdus []pdu.PDataTf
-	// two byte header overhead.
-	//
-	// TODO(saito) move the magic number elsewhere.
-	var maxChunkSize = sm.contextManager.peerMaxPDUSize - 8
-	for len(data) > 0 {
-		chunkSize := len(data)
-		if chunkSize > maxChunkSize {
-			chunkSize = maxChunkSize
-		}
-		chunk := data[0:chunkSize]
-		data = data[chunkSize:]
-		pdus = append(pdus, pdu.PDataTf{Items: []pdu.PresentationDataValueItem{
-			pdu.PresentationDataValueItem{
-				ContextID: context.contextID,
-				Command:   command,
-				Last:      false, // Set later.
-				Value:     chunk,
-			}}})
+// newCStoreDataSink streams the dataset of a C-STORE request to the handler.
+// It delivers the command to the dispatcher right away, along with the spool
+// that receives the data fragments.
+func newCStoreDataSink(sm *stateMachine, contextID byte, command dimse.Message) io.WriteCloser {
+	if _, ok := command.(*dimse.CStoreRq); !ok {
+		return nil
 	}
-	if len(pdus) > 0 {
-		pdus[len(pdus)-1].Items[0].Last = true
+	if sm.logger.debugEnabled() {
+		sm.logger.debug("Received DIMSE message; streaming data",
+			LogKeyMessageID, command.GetMessageID(),
+			LogKeyCommand, commandName(command),
+			"detail", command.String())
 	}
-	return pdus
+	sm.cstoreSpool = newCStoreSpool(sm.cstoreSpoolOptions)
+	sm.upcallCh <- upcallEvent{
+		eventType:  upcallEventData,
+		cm:         sm.contextManager,
+		contextID:  contextID,
+		command:    command,
+		dataStream: sm.cstoreSpool}
+	return sm.cstoreSpool
 }
 
 // Data transfer related actions
@@ -323,17 +337,38 @@ var actionDt1 = &stateAction{"DT-1", "Send P-DATA-TF PDU",
 		if e.Error() != nil {
 			panic(fmt.Sprintf("Failed to encode DIMSE cmd %v: %v", command, e.Error()))
 		}
-		dicomlog.Vprintf(1, "dicom.stateMachine(%s): Send DIMSE msg: %v", sm.label, command)
-		pdus := splitDataIntoPDUs(sm, event.dimsePayload.abstractSyntaxName, true /*command*/, e.Bytes())
-		for _, pdu := range pdus {
-			sendPDU(sm, &pdu)
+		// This runs for every DIMSE message, so the detail is formatted only
+		// if Debug entries are wanted.
+		if sm.logger.debugEnabled() {
+			sm.logger.debug("Send DIMSE message",
+				LogKeyMessageID, command.GetMessageID(),
+				LogKeyCommand, commandName(command),
+				"detail", command.String())
 		}
-		if command.HasData() {
-			dicomlog.Vprintf(1, "dicom.stateMachine(%s): Send DIMSE data of %db, command: %v", sm.label, len(event.dimsePayload.data), command)
-			pdus := splitDataIntoPDUs(sm, event.dimsePayload.abstractSyntaxName, false /*data*/, event.dimsePayload.data)
-			for _, pdu := range pdus {
-				sendPDU(sm, &pdu)
+		sendDataPDUs(sm, event.dimsePayload.abstractSyntaxName, true /*command*/, e.Bytes())
+		if event.dimsePayload.onSent != nil {
+			defer event.dimsePayload.onSent()
+		}
+		if command.HasData() && event.dimsePayload.dataReader != nil {
+			n, err := streamDataPDUs(sm, event.dimsePayload.abstractSyntaxName, event.dimsePayload.dataReader)
+			sm.logger.debug("Streamed DIMSE data",
+				LogKeyMessageID, command.GetMessageID(),
+				LogKeyCommand, commandName(command),
+				"bytes", n)
+			if err != nil {
+				sm.logger.error("Failed to stream DIMSE data; aborting association",
+					LogKeyMessageID, command.GetMessageID(), LogKeyError, err)
+				if event.dimsePayload.onDataError != nil {
+					event.dimsePayload.onDataError(err)
+				}
+				return actionAa1.Callback(sm, event)
 			}
+		} else if command.HasData() {
+			sm.logger.debug("Send DIMSE data",
+				LogKeyMessageID, command.GetMessageID(),
+				LogKeyCommand, commandName(command),
+				"bytes", len(event.dimsePayload.data))
+			sendDataPDUs(sm, event.dimsePayload.abstractSyntaxName, false /*data*/, event.dimsePayload.data)
 		} else if len(event.dimsePayload.data) > 0 {
 			panic(fmt.Sprintf("dicom.stateMachine(%s): Found DIMSE data of %db, command: %v", sm.label, len(event.dimsePayload.data), command))
 		}
@@ -345,7 +380,12 @@ var actionDt2 = &stateAction{"DT-2", "Send P-DATA indication primitive",
 		contextID, command, data, err := sm.commandAssembler.AddDataPDU(event.pdu.(*pdu.PDataTf))
 		if err == nil {
 			if command != nil { // All fragments received
-				dicomlog.Vprintf(1, "dicom.stateMachine(%s): DIMSE request: %v", sm.label, command)
+				if sm.logger.debugEnabled() {
+					sm.logger.debug("Received DIMSE message",
+						LogKeyMessageID, command.GetMessageID(),
+						LogKeyCommand, commandName(command),
+						"detail", command.String())
+				}
 				sm.upcallCh <- upcallEvent{
 					eventType: upcallEventData,
 					cm:        sm.contextManager,
@@ -355,7 +395,7 @@ var actionDt2 = &stateAction{"DT-2", "Send P-DATA indication primitive",
 			}
 			return sta06
 		}
-		dicomlog.Vprintf(0, "dicom.stateMachine(%s): Failed to assemble data: %v", sm.label, err) // TODO(saito)
+		sm.logger.error("Failed to assemble data", LogKeyError, err) // TODO(saito)
 		return actionAa8.Callback(sm, event)
 	}}
 
@@ -375,12 +415,14 @@ var actionAr2 = &stateAction{"AR-2", "Issue A-RELEASE indication primitive",
 var actionAr3 = &stateAction{"AR-3", "Issue A-RELEASE confirmation primitive and close transport connection",
 	func(sm *stateMachine, event stateEvent) stateType {
 		sendPDU(sm, &pdu.AReleaseRp{})
+		observeAssociationEnd(sm, AssociationReleased)
 		closeConnection(sm)
 		return sta01
 	}}
 var actionAr4 = &stateAction{"AR-4", "Issue A-RELEASE-RP PDU and start ARTIM timer",
 	func(sm *stateMachine, event stateEvent) stateType {
 		sendPDU(sm, &pdu.AReleaseRp{})
+		observeAssociationEnd(sm, AssociationReleased)
 		startTimer(sm)
 		return sta13
 	}}
@@ -406,18 +448,15 @@ var actionAr7 = &stateAction{"AR-7", "Issue P-DATA-TF PDU",
 		if e.Error() != nil {
 			panic(fmt.Sprintf("dicom.StateMachine %s: Failed to encode DIMSE cmd %v: %v", sm.label, command, e.Error()))
 		}
-		pdus := splitDataIntoPDUs(sm, event.dimsePayload.abstractSyntaxName, true /*command*/, e.Bytes())
-		for _, pdu := range pdus {
-			sendPDU(sm, &pdu)
-		}
+		sendDataPDUs(sm, event.dimsePayload.abstractSyntaxName, true /*command*/, e.Bytes())
 		if command.HasData() {
-			pdus := splitDataIntoPDUs(sm, event.dimsePayload.abstractSyntaxName, false /*data*/, event.dimsePayload.data)
-			for _, pdu := range pdus {
-				sendPDU(sm, &pdu)
-			}
+			sendDataPDUs(sm, event.dimsePayload.abstractSyntaxName, false /*data*/, event.dimsePayload.data)
 		} else {
 			doassert(len(event.dimsePayload.data) == 0)
 		}
+		if event.dimsePayload.onSent != nil {
+			event.dimsePayload.onSent()
+		}
 		sm.downcallCh <- stateEvent{event: evt14}
 		return sta08
 	}}
@@ -449,6 +488,7 @@ var actionAa1 = &stateAction{"AA-1", "Send A-ABORT PDU (service-user source) and
 			diagnostic = pdu.AbortReasonUnexpectedPDU
 		}
 		sendPDU(sm, &pdu.AAbort{Source: 0, Reason: diagnostic})
+		observeAssociationEnd(sm, AssociationAborted)
 		restartTimer(sm)
 		return sta13
 	}}
@@ -462,12 +502,14 @@ var actionAa2 = &stateAction{"AA-2", "Stop ARTIM timer if running. Close transpo
 
 var actionAa3 = &stateAction{"AA-3", "If (service-user initiated abort): issue A-ABORT indication and close transport connection, otherwise (service-dul initiated abort): issue A-P-ABORT indication and close transport connection",
 	func(sm *stateMachine, event stateEvent) stateType {
+		observeAssociationEnd(sm, AssociationAborted)
 		closeConnection(sm)
 		return sta01
 	}}
 
 var actionAa4 = &stateAction{"AA-4", "Issue A-P-ABORT indication primitive",
 	func(sm *stateMachine, event stateEvent) stateType {
+		observeAssociationEnd(sm, AssociationAborted)
 		return sta01
 	}}
 
@@ -485,16 +527,29 @@ var actionAa6 = &stateAction{"AA-6", "Ignore PDU",
 var actionAa7 = &stateAction{"AA-7", "Send A-ABORT PDU",
 	func(sm *stateMachine, event stateEvent) stateType {
 		sendPDU(sm, &pdu.AAbort{Source: 0, Reason: 0})
+		observeAssociationEnd(sm, AssociationAborted)
 		return sta13
 	}}
 
 var actionAa8 = &stateAction{"AA-8", "Send A-ABORT PDU (service-dul source), issue an A-P-ABORT indication and start ARTIM timer",
 	func(sm *stateMachine, event stateEvent) stateType {
 		sendPDU(sm, &pdu.AAbort{Source: 2, Reason: 0})
+		observeAssociationEnd(sm, AssociationAborted)
 		startTimer(sm)
 		return sta13
 	}}
 
+// observeAssociationEnd reports the way the association ended to the
+// MetricsObserver. Only the first call for an association is reported, since
+// e.g. an abort may be followed by further abort actions.
+func observeAssociationEnd(sm *stateMachine, event AssociationEvent) {
+	if sm.associationEnded {
+		return
+	}
+	sm.associationEnded = true
+	sm.metrics.ObserveAssociation(event)
+}
+
 type upcallEventType int
 
 const (
@@ -537,6 +592,10 @@ type upcallEvent struct {
 
 	command dimse.Message
 	data    []byte
+
+	// If non-nil, the data payload of "command" is streamed through it, and
+	// "data" is nil. Set only for C-STORE requests received by a provider.
+	dataStream *cstoreSpool
 }
 
 type stateEventDIMSEPayload struct {
@@ -550,6 +609,16 @@ type stateEventDIMSEPayload struct {
 	// Ditto, but for the data payload. The data PDU is sent iff.
 	// command.HasData()==true.
 	data []byte
+
+	// If non-nil, the data payload is read from this reader instead of
+	// "data", and sent as it is read. If reading fails, onDataError is
+	// called and the association is aborted.
+	dataReader  io.Reader
+	onDataError func(err error)
+
+	// If non-nil, called after the command and data are written to the
+	// network.
+	onSent func()
 }
 
 type stateEventDebugInfo struct {
@@ -754,42 +823,73 @@ type stateMachine struct {
 	// For assembling DIMSE command from multiple P_DATA_TF fragments.
 	commandAssembler dimse.CommandAssembler
 
+	// Controls streaming of C-STORE datasets. Only for providers.
+	cstoreSpoolOptions cstoreSpoolOptions
+	// The spool receiving the C-STORE dataset being assembled, if any.
+	cstoreSpool *cstoreSpool
+
 	// Only for testing.
 	faults FaultInjector
+
+	// Receives association and PDU stats. Never nil.
+	metrics MetricsObserver
+	// Set once the end of the association is reported to metrics.
+	associationEnded bool
+
+	// Creates the wire tap once the connection is established. May be nil.
+	newWireTap WireTapFactory
+	// The wire tap, if any. Set by startWireTap.
+	tap WireTap
+
+	// Tagged with the association ID, and the peer info once known.
+	logger *logger
 }
 
 func closeConnection(sm *stateMachine) {
 	close(sm.upcallCh)
-	dicomlog.Vprintf(1, "dicom.StateMachine %s: Closing connection %v", sm.label, sm.conn)
+	sm.logger.info("Closing connection")
 	if sm.conn != nil {
 		sm.conn.Close()
 	}
 }
 
-func sendPDU(sm *stateMachine, v pdu.PDU) {
+// sendPDU encodes and writes the PDU. On error, it closes the connection and
+// reports evt17, so callers usually can ignore the returned error.
+func sendPDU(sm *stateMachine, v pdu.PDU) error {
 	doassert(sm.conn != nil)
 	data, err := pdu.EncodePDU(v)
 	if err != nil {
-		dicomlog.Vprintf(0, "dicom.StateMachine %s: Failed to encode: %v; closing connection %v", sm.label, err, sm.conn)
+		sm.logger.error("Failed to encode PDU; closing connection", LogKeyError, err)
 		sm.conn.Close()
 		sm.errorCh <- stateEvent{event: evt17, err: err}
-		return
+		return err
 	}
 	if sm.faults != nil {
 		action := sm.faults.onSend(data)
 		if action == faultInjectorDisconnect {
-			dicomlog.Vprintf(0, "dicom.StateMachine %s: FAULT: closing connection for test", sm.label)
+			sm.logger.warn("FAULT: closing connection for test")
 			sm.conn.Close()
 		}
 	}
 	n, err := sm.conn.Write(data)
 	if n != len(data) || err != nil {
-		dicomlog.Vprintf(0, "dicom.StateMachine %s: Failed to write %d bytes. Actual %d bytes : %v; closing connection %v", sm.label, len(data), n, err, sm.conn)
+		sm.logger.error("Failed to write PDU; closing connection",
+			"bytes", len(data), "written", n, LogKeyError, err)
 		sm.conn.Close()
 		sm.errorCh <- stateEvent{event: evt17, err: err}
-		return
+		if err == nil {
+			err = io.ErrShortWrite
+		}
+		return err
+	}
+	sm.metrics.ObservePDU(PDUSent, pdu.Type(data[0]), len(data))
+	if sm.tap != nil {
+		sm.tap.TapPDU(PDUSent, data)
 	}
-	dicomlog.Vprintf(2, "dicom.StateMachine %s: sendPDU: %v", sm.label, v.String())
+	if sm.logger.debugEnabled() {
+		sm.logger.debug("Sent PDU", "pdu", v.String())
+	}
+	return nil
 }
 
 func startTimer(sm *stateMachine) {
@@ -811,13 +911,43 @@ func stopTimer(sm *stateMachine) {
 	sm.timerCh = make(chan stateEvent, 1)
 }
 
-func networkReaderThread(ch chan stateEvent, conn net.Conn, maxPDUSize int, smName string) {
-	dicomlog.Vprintf(2, "dicom.StateMachine %s: Starting network reader, maxPDU %d", smName, maxPDUSize)
+// countingReader counts the number of bytes read through it. If keep is
+// true, it also keeps the bytes in buf.
+type countingReader struct {
+	r    io.Reader
+	n    int
+	keep bool
+	buf  []byte
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	if c.keep {
+		c.buf = append(c.buf, p[:n]...)
+	}
+	return n, err
+}
+
+// reset clears the count and the bytes kept.
+func (c *countingReader) reset() {
+	c.n = 0
+	c.buf = nil
+}
+
+func networkReaderThread(ch chan stateEvent, conn net.Conn, maxPDUSize int, logger *logger, metrics MetricsObserver, tap WireTap) {
+	logger.debug("Starting network reader", "max_pdu", maxPDUSize)
 	doassert(maxPDUSize > 16*1024)
+	in := &countingReader{r: conn, keep: tap != nil}
 	for {
-		v, err := pdu.ReadPDU(conn, maxPDUSize)
+		in.reset()
+		v, err := pdu.ReadPDU(in, maxPDUSize)
 		if err != nil {
-			dicomlog.Vprintf(0, "dicom.StateMachine %s: Failed to read PDU: %v", smName, err)
+			if err == io.EOF {
+				logger.info("Connection closed by peer")
+			} else {
+				logger.error("Failed to read PDU", LogKeyError, err)
+			}
 			if err == io.EOF {
 				ch <- stateEvent{event: evt17, pdu: nil, err: nil}
 			} else {
@@ -827,7 +957,13 @@ func networkReaderThread(ch chan stateEvent, conn net.Conn, maxPDUSize int, smNa
 			break
 		}
 		doassert(v != nil)
-		dicomlog.Vprintf(2, "dicom.StateMachine %s: read PDU: %v", smName, v.String())
+		if logger.debugEnabled() {
+			logger.debug("Read PDU", "pdu", v.String())
+		}
+		metrics.ObservePDU(PDUReceived, pduType(v), in.n)
+		if tap != nil {
+			tap.TapPDU(PDUReceived, in.buf)
+		}
 		switch n := v.(type) {
 		case *pdu.AAssociate:
 			if n.Type == pdu.TypeAAssociateRq {
@@ -838,7 +974,7 @@ func networkReaderThread(ch chan stateEvent, conn net.Conn, maxPDUSize int, smNa
 			}
 			continue
 		case *pdu.AAssociateRj:
-			dicomlog.Vprintf(0, "dicom.StateMachine %s: Association rejected: %v", smName, v.String())
+			logger.warn("Association rejected", "pdu", v.String())
 			ch <- stateEvent{event: evt04, pdu: n, err: nil}
 			continue
 		case *pdu.PDataTf:
@@ -851,17 +987,17 @@ func networkReaderThread(ch chan stateEvent, conn net.Conn, maxPDUSize int, smNa
 			ch <- stateEvent{event: evt13, pdu: n, err: nil}
 			continue
 		case *pdu.AAbort:
-			dicomlog.Vprintf(0, "dicom.StateMachine %s: Association aborted: %v", smName, v.String())
+			logger.warn("Association aborted", "pdu", v.String())
 			ch <- stateEvent{event: evt16, pdu: n, err: nil}
 			continue
 		default:
-			err := fmt.Errorf("dicom.StateMachine %s: Unknown PDU type: %v", v.String(), smName)
+			err := fmt.Errorf("dicom.StateMachine: Unknown PDU type: %v", v.String())
 			ch <- stateEvent{event: evt19, pdu: v, err: err}
-			dicomlog.Vprintf(0, "dicom.StateMachine: %v", err)
+			logger.error("Unknown PDU type", LogKeyError, err)
 			continue
 		}
 	}
-	dicomlog.Vprintf(2, "dicom.StateMachine %s: Exiting network reader", smName)
+	logger.debug("Exiting network reader")
 }
 
 func getNextEvent(sm *stateMachine) stateEvent {
@@ -896,7 +1032,7 @@ func getNextEvent(sm *stateMachine) stateEvent {
 	return event
 }
 
-func findAction(currentState stateType, event *stateEvent, smName string) *stateAction {
+func findAction(currentState stateType, event *stateEvent) *stateAction {
 	for _, t := range stateTransitions {
 		if t.current == currentState && t.event == event.event {
 			return t.action
@@ -907,79 +1043,168 @@ func findAction(currentState stateType, event *stateEvent, smName string) *state
 
 func runOneStep(sm *stateMachine) {
 	event := getNextEvent(sm)
-	dicomlog.Vprintf(2, "dicom.StateMachine %s: Current state: %v, Event %v", sm.label, sm.currentState.String(), event)
-	action := findAction(sm.currentState, &event, sm.label)
+	// This runs for every PDU, so the Debug entries are built only if they
+	// are wanted.
+	debug := sm.logger.debugEnabled()
+	state := sm.currentState
+	if debug {
+		sm.logger.debug("Received event", LogKeyState, state.shortName(), LogKeyEvent, event.event.shortName(),
+			"detail", event.String())
+	}
+	action := findAction(sm.currentState, &event)
 	if action == nil {
-		msg := fmt.Sprintf("dicom.StateMachine %s: No action found for state %v, event %v", sm.label, sm.currentState.String(), event.String())
+		args := []interface{}{LogKeyState, state.shortName(), LogKeyEvent, event.event.shortName(), "detail", event.String()}
 		if sm.faults != nil {
-			msg += " FIhistory: " + sm.faults.String()
+			args = append(args, "fault_history", sm.faults.String())
 		}
-		dicomlog.Vprintf(0, "dicom.StateMachine: Unknown state transition:")
-		for _, s := range strings.Split(msg, "\n") {
-			dicomlog.Vprintf(0, s)
-		}
-		dicomlog.Vprintf(0, msg)
-
+		sm.logger.error("No action found for state transition", args...)
 		action = actionAa2 // This will force connection abortion
 	}
-	dicomlog.Vprintf(2, "dicom.StateMachine %s: Running action %v", sm.label, action)
+	if debug {
+		sm.logger.debug("Running action", LogKeyState, state.shortName(), LogKeyEvent, event.event.shortName(),
+			"action", action.Name)
+	}
 	newState := action.Callback(sm, event)
 	if sm.faults != nil {
 		sm.faults.onStateTransition(sm.currentState, &event, action, newState)
 	}
 	sm.currentState = newState
-	dicomlog.Vprintf(2, "dicom.StateMachine Next state: %v", sm.currentState.String())
+	if debug {
+		sm.logger.debug("Next state", LogKeyState, state.shortName(), LogKeyEvent, event.event.shortName(),
+			"next_state", sm.currentState.shortName())
+	}
 }
 
 func runStateMachineForServiceUser(
 	params ServiceUserParams,
 	upcallCh chan upcallEvent,
 	downcallCh chan stateEvent,
-	label string) {
+	label string,
+	logger *logger,
+	metrics MetricsObserver) {
 	doassert(params.CallingAETitle != "")
 	doassert(len(params.SOPClasses) > 0)
 	doassert(len(params.TransferSyntaxes) > 0)
 	sm := &stateMachine{
 		label:          label,
 		isUser:         true,
-		contextManager: newContextManager(label),
+		contextManager: newContextManager(label, logger),
 		userParams:     params,
 		netCh:          make(chan stateEvent, 128),
 		errorCh:        make(chan stateEvent, 128),
 		downcallCh:     downcallCh,
 		upcallCh:       upcallCh,
 		faults:         getUserFaultInjector(),
+		logger:         logger,
+		metrics:        metrics,
+		newWireTap:     params.WireTap,
 	}
+	sm.contextManager.callingAETitle = params.CallingAETitle
+	sm.contextManager.calledAETitle = params.CalledAETitle
+	sm.contextManager.deflateLevel = params.DeflateLevel
 	event := stateEvent{event: evt01}
-	action := findAction(sta01, &event, sm.label)
+	action := findAction(sta01, &event)
 	sm.currentState = action.Callback(sm, event)
 	for sm.currentState != sta01 {
 		runOneStep(sm)
 	}
-	dicomlog.Vprintf(1, "dicom.StateMachine(%s): statemachine finished", sm.label)
+	closeWireTap(sm)
+	sm.logger.info("Statemachine finished")
 }
 
+// spoolingNetChSize is the capacity of the provider's netCh when C-STORE data
+// is streamed to the handlers. It is small, so that the network reader stops
+// soon after the state machine blocks on a C-STORE handler that falls behind.
+// See ServiceProviderParams.CStoreMemoryThreshold.
+const spoolingNetChSize = 2
+
 func runStateMachineForServiceProvider(
 	conn net.Conn,
+	params ServiceProviderParams,
 	upcallCh chan upcallEvent,
 	downcallCh chan stateEvent,
-	label string) {
+	label string,
+	logger *logger,
+	metrics MetricsObserver) {
+	logger = logger.with(LogKeyRemoteAddr, remoteAddrString(conn))
+	cstoreSpoolOptions := newCStoreSpoolOptions(params)
+	netChSize := 128
+	if cstoreSpoolOptions.enabled {
+		netChSize = spoolingNetChSize
+	}
 	sm := &stateMachine{
-		label:          label,
-		isUser:         false,
-		contextManager: newContextManager(label),
-		conn:           conn,
-		netCh:          make(chan stateEvent, 128),
-		errorCh:        make(chan stateEvent, 128),
-		downcallCh:     downcallCh,
-		upcallCh:       upcallCh,
-		faults:         getProviderFaultInjector(),
+		label:              label,
+		isUser:             false,
+		contextManager:     newContextManager(label, logger),
+		conn:               conn,
+		netCh:              make(chan stateEvent, netChSize),
+		errorCh:            make(chan stateEvent, 128),
+		downcallCh:         downcallCh,
+		upcallCh:           upcallCh,
+		faults:             getProviderFaultInjector(),
+		logger:             logger,
+		metrics:            metrics,
+		newWireTap:         params.WireTap,
+		cstoreSpoolOptions: cstoreSpoolOptions,
+	}
+	sm.contextManager.preferredTransferSyntaxes = params.TransferSyntaxes
+	if params.Mux != nil {
+		sm.contextManager.acceptAbstractSyntax = params.Mux.acceptor()
+	}
+	if level, err := validateDeflateLevel(params.DeflateLevel); err != nil {
+		logger.warn("Ignoring invalid DeflateLevel", LogKeyError, err)
+	} else {
+		sm.contextManager.deflateLevel = level
+	}
+	if cstoreSpoolOptions.enabled {
+		sm.commandAssembler.NewDataSink = func(contextID byte, command dimse.Message) io.WriteCloser {
+			return newCStoreDataSink(sm, contextID, command)
+		}
 	}
 	event := stateEvent{event: evt05, conn: conn}
-	action := findAction(sta01, &event, sm.label)
+	action := findAction(sta01, &event)
 	sm.currentState = action.Callback(sm, event)
 	for sm.currentState != sta01 {
 		runOneStep(sm)
 	}
-	dicomlog.Vprintf(1, "dicom.StateMachine %s: statemachine finished", sm.label)
+	if sm.cstoreSpool != nil {
+		sm.cstoreSpool.abort(fmt.Errorf("dicom.stateMachine(%s): association ended while receiving C-STORE data", sm.label))
+	}
+	// Let the network reader exit, since netCh may be too small to hold its
+	// remaining events. netCh is nil if the reader closed it.
+	if sm.netCh != nil {
+		go func(ch chan stateEvent) {
+			for range ch {
+			}
+		}(sm.netCh)
+	}
+	closeWireTap(sm)
+	sm.logger.info("Statemachine finished")
+}
+
+// pduType returns the type byte of "v".
+func pduType(v pdu.PDU) pdu.Type {
+	switch n := v.(type) {
+	case *pdu.AAssociate:
+		return n.Type
+	case *pdu.AAssociateRj:
+		return pdu.TypeAAssociateRj
+	case *pdu.PDataTf:
+		return pdu.TypePDataTf
+	case *pdu.AReleaseRq:
+		return pdu.TypeAReleaseRq
+	case *pdu.AReleaseRp:
+		return pdu.TypeAReleaseRp
+	case *pdu.AAbort:
+		return pdu.TypeAAbort
+	}
+	return 0
+}
+
+// remoteAddrString returns the peer address of "conn", or "" if unknown.
+func remoteAddrString(conn net.Conn) string {
+	if conn == nil || conn.RemoteAddr() == nil {
+		return ""
+	}
+	return conn.RemoteAddr().String()
 }
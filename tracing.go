@@ -0,0 +1,156 @@
+package netdicom
+
+// This file defines the tracing interface used by ServiceUser and
+// ServiceProvider.
+
+import (
+	"context"
+	"fmt"
+)
+
+// Tracer creates spans for associations and DIMSE operations. It follows the
+// shape of OpenTelemetry's trace.Tracer, so an adapter is a few lines:
+//
+//	type otelTracer struct{ t trace.Tracer }
+//
+//	func (o otelTracer) Start(ctx context.Context, name string) (context.Context, netdicom.Span) {
+//	  ctx, span := o.t.Start(ctx, name)
+//	  return ctx, otelSpan{span}
+//	}
+//
+//	type otelSpan struct{ s trace.Span }
+//
+//	func (o otelSpan) SetAttribute(key string, value interface{}) {
+//	  o.s.SetAttributes(attribute.String(key, fmt.Sprint(value)))
+//	}
+//	func (o otelSpan) RecordError(err error) { o.s.RecordError(err); o.s.SetStatus(codes.Error, err.Error()) }
+//	func (o otelSpan) End()                  { o.s.End() }
+//
+// The spans created are:
+//
+//	dicom.Associate          ServiceUser association setup, from connect to A-ASSOCIATE-AC.
+//	dicom.C-ECHO, etc        A ServiceUser operation. Also a C-STORE sub-operation of a C-GET or C-MOVE.
+//	dicom.handle.Associate   ServiceProvider association setup.
+//	dicom.handle.C-FIND, etc A ServiceProvider handler invocation.
+//	dicom.WritePDUs          Child of an operation span; covers writing one DIMSE message to the network.
+//
+// An operation span records an error if the operation fails, or if its final
+// response reports a failure status.
+type Tracer interface {
+	// Start creates a span that is a child of the span in "ctx", if any, and
+	// returns a context that carries the new span.
+	Start(ctx context.Context, spanName string) (context.Context, Span)
+}
+
+// Span is a unit of work created by Tracer.
+type Span interface {
+	// SetAttribute sets a key/value attribute. The value is a string or an
+	// int.
+	SetAttribute(key string, value interface{})
+	// RecordError marks the span as failed.
+	RecordError(err error)
+	// End completes the span.
+	End()
+}
+
+// Keys of the span attributes.
+const (
+	TraceAttrCallingAE      = "dicom.calling_ae"
+	TraceAttrCalledAE       = "dicom.called_ae"
+	TraceAttrRemoteAddr     = "dicom.remote_addr"
+	TraceAttrSOPClass       = "dicom.sop_class_uid"
+	TraceAttrSOPInstance    = "dicom.sop_instance_uid"
+	TraceAttrTransferSyntax = "dicom.transfer_syntax_uid"
+	TraceAttrMessageID      = "dicom.message_id"
+	TraceAttrCommand        = "dicom.command"
+	TraceAttrStatus         = "dicom.status" // Final DIMSE status in hex, e.g., "A700".
+)
+
+type nopTracer struct{}
+type nopSpan struct{}
+
+func (nopTracer) Start(ctx context.Context, spanName string) (context.Context, Span) {
+	return ctx, nopSpan{}
+}
+
+func (nopSpan) SetAttribute(key string, value interface{}) {}
+func (nopSpan) RecordError(err error)                      {}
+func (nopSpan) End()                                       {}
+
+func tracerOrDefault(t Tracer) Tracer {
+	if t == nil {
+		return nopTracer{}
+	}
+	return t
+}
+
+// statusString formats a DIMSE status code for TraceAttrStatus.
+func statusString(status uint16) string {
+	return fmt.Sprintf("%04X", status)
+}
+
+// startSpan starts the span for the operation run by "cs" and stores it in
+// cs. "parent" is the caller's context.
+func (cs *serviceCommandState) startSpan(parent context.Context, spanName string) context.Context {
+	if parent == nil {
+		parent = context.Background()
+	}
+	ctx, span := cs.disp.tracer.Start(parent, spanName)
+	callingAE, calledAE := cs.cm.aeTitles()
+	span.SetAttribute(TraceAttrCallingAE, callingAE)
+	span.SetAttribute(TraceAttrCalledAE, calledAE)
+	span.SetAttribute(TraceAttrMessageID, int(cs.messageID))
+	cs.setContext(ctx, span)
+	return ctx
+}
+
+// setContext updates the span that covers the command.
+func (cs *serviceCommandState) setContext(ctx context.Context, span Span) {
+	cs.disp.mu.Lock()
+	cs.ctx, cs.span = ctx, span
+	cs.disp.mu.Unlock()
+}
+
+// traceContext returns the context that carries the command's span. It
+// returns context.Background() if the command isn't traced.
+func (cs *serviceCommandState) traceContext() context.Context {
+	cs.disp.mu.Lock()
+	defer cs.disp.mu.Unlock()
+	if cs.ctx == nil {
+		return context.Background()
+	}
+	return cs.ctx
+}
+
+// setSpanAttribute sets an attribute of the command's span, if any. Like the
+// other accesses to the span, it holds disp.mu, since the statemachine
+// goroutine sets the status attribute concurrently.
+func (cs *serviceCommandState) setSpanAttribute(key string, value interface{}) {
+	cs.disp.mu.Lock()
+	defer cs.disp.mu.Unlock()
+	if cs.span != nil {
+		cs.span.SetAttribute(key, value)
+	}
+}
+
+// setSpanContext records the presentation context of the command in its span.
+func (cs *serviceCommandState) setSpanContext(sopClassUID string) {
+	cs.setSpanAttribute(TraceAttrSOPClass, sopClassUID)
+	cs.setSpanAttribute(TraceAttrTransferSyntax, cs.context.transferSyntaxUID)
+}
+
+// endSpan ends the span created by startSpan. "err" is the result of the
+// operation.
+func (cs *serviceCommandState) endSpan(err error) {
+	cs.disp.mu.Lock()
+	span := cs.span
+	cs.span = nil
+	cs.disp.mu.Unlock()
+	if span == nil {
+		return
+	}
+	if err != nil {
+		span.RecordError(err)
+	}
+	span.End()
+}
@@ -0,0 +1,200 @@
+package netdicom
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-netdicom/dimse"
+	"github.com/grailbio/go-netdicom/sopclass"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeTracer records the spans it creates.
+type fakeTracer struct {
+	mu    sync.Mutex
+	spans []*fakeSpan
+}
+
+type fakeSpan struct {
+	tracer *fakeTracer
+	name   string
+	parent *fakeSpan // nil for a root span.
+	attrs  map[string]interface{}
+	err    error
+	ended  bool
+}
+
+type fakeSpanKey struct{}
+
+func (tr *fakeTracer) Start(ctx context.Context, spanName string) (context.Context, Span) {
+	parent, _ := ctx.Value(fakeSpanKey{}).(*fakeSpan)
+	span := &fakeSpan{tracer: tr, name: spanName, parent: parent, attrs: map[string]interface{}{}}
+	tr.mu.Lock()
+	tr.spans = append(tr.spans, span)
+	tr.mu.Unlock()
+	return context.WithValue(ctx, fakeSpanKey{}, span), span
+}
+
+func (s *fakeSpan) SetAttribute(key string, value interface{}) {
+	s.tracer.mu.Lock()
+	s.attrs[key] = value
+	s.tracer.mu.Unlock()
+}
+
+func (s *fakeSpan) RecordError(err error) {
+	s.tracer.mu.Lock()
+	s.err = err
+	s.tracer.mu.Unlock()
+}
+
+func (s *fakeSpan) End() {
+	s.tracer.mu.Lock()
+	s.ended = true
+	s.tracer.mu.Unlock()
+}
+
+// find returns the spans with the name.
+func (tr *fakeTracer) find(name string) []*fakeSpan {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	var spans []*fakeSpan
+	for _, s := range tr.spans {
+		if s.name == name {
+			spans = append(spans, s)
+		}
+	}
+	return spans
+}
+
+// checkEnded checks that all the spans have ended, and that the parent of
+// every dicom.WritePDUs span is an operation span.
+func (tr *fakeTracer) checkEnded(t *testing.T) {
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	for _, s := range tr.spans {
+		assert.True(t, s.ended, "span %s", s.name)
+		if s.name == "dicom.WritePDUs" {
+			require.NotNil(t, s.parent)
+			assert.NotEqual(t, "dicom.WritePDUs", s.parent.name)
+		}
+	}
+}
+
+func TestTraceCGet(t *testing.T) {
+	userTracer := &fakeTracer{}
+	providerTracer := &fakeTracer{}
+	p, err := NewServiceProvider(ServiceProviderParams{
+		AETitle: "ARCHIVE",
+		Tracer:  providerTracer,
+		CGet: func(conn ConnectionState, transferSyntaxUID, sopClassUID string, filters []*dicom.Element, ch chan CMoveResult) {
+			for i := 0; i < 2; i++ {
+				ch <- CMoveResult{Remaining: 1 - i, DataSet: newCMoveDataSet(ctImageStorage, fmt.Sprintf("1.2.3.%d", i))}
+			}
+			close(ch)
+		},
+		CFind: func(conn ConnectionState, transferSyntaxUID, sopClassUID string, filters []*dicom.Element, ch chan CFindResult) {
+			ch <- CFindResult{Err: errors.New("database unavailable")}
+			close(ch)
+		},
+	}, "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { p.Close() })
+	go p.Run()
+	su, err := NewServiceUser(ServiceUserParams{
+		CalledAETitle: "ARCHIVE",
+		SOPClasses:    append(append([]string(nil), sopclass.QRGetClasses...), sopclass.QRFindClasses...),
+		Tracer:        userTracer,
+	})
+	require.NoError(t, err)
+	su.Connect(p.ListenAddr().String())
+
+	// The user fails the second sub-operation.
+	err = su.CGetQuery(context.Background(), cgetTestQuery,
+		func(transferSyntaxUID, sopClassUID, sopInstanceUID string, data []byte) dimse.Status {
+			if sopInstanceUID == "1.2.3.1" {
+				return dimse.Status{Status: dimse.CStoreOutOfResources}
+			}
+			return dimse.Success
+		})
+	require.Error(t, err)
+	for range su.CFindQuery(context.Background(), cgetTestQuery) {
+	}
+	su.Release()
+
+	assoc := userTracer.find("dicom.Associate")
+	require.Equal(t, 1, len(assoc))
+	assert.Nil(t, assoc[0].parent)
+	assert.Equal(t, "ARCHIVE", assoc[0].attrs[TraceAttrCalledAE])
+
+	get := userTracer.find("dicom.C-GET")
+	require.Equal(t, 1, len(get))
+	assert.Error(t, get[0].err)
+	subOps := userTracer.find("dicom.handle.C-STORE")
+	require.Equal(t, 2, len(subOps))
+	for _, s := range subOps {
+		assert.Equal(t, get[0], s.parent)
+		assert.Equal(t, ctImageStorage, s.attrs[TraceAttrSOPClass])
+		if s.attrs[TraceAttrSOPInstance] == "1.2.3.1" {
+			assert.Equal(t, statusString(uint16(dimse.CStoreOutOfResources)), s.attrs[TraceAttrStatus])
+			var statusErr *StatusError
+			require.True(t, errors.As(s.err, &statusErr), "error: %v", s.err)
+			assert.Equal(t, dimse.CStoreOutOfResources, statusErr.Status.Status)
+		} else {
+			assert.Equal(t, "0000", s.attrs[TraceAttrStatus])
+			assert.NoError(t, s.err)
+		}
+	}
+	userTracer.checkEnded(t)
+
+	// The provider's C-STORE sub-operations are children of the handler.
+	handleGet := providerTracer.find("dicom.handle.C-GET")
+	require.Equal(t, 1, len(handleGet))
+	assert.Nil(t, handleGet[0].parent)
+	assert.NoError(t, handleGet[0].err) // Partial failures are a warning.
+	stores := providerTracer.find("dicom.C-STORE")
+	require.Equal(t, 2, len(stores))
+	for _, s := range stores {
+		assert.Equal(t, handleGet[0], s.parent)
+	}
+	handleFind := providerTracer.find("dicom.handle.C-FIND")
+	require.Equal(t, 1, len(handleFind))
+	assert.Error(t, handleFind[0].err)
+	assert.Equal(t, statusString(uint16(dimse.CFindUnableToProcess)), handleFind[0].attrs[TraceAttrStatus])
+	require.Equal(t, 1, len(providerTracer.find("dicom.handle.Associate")))
+	providerTracer.checkEnded(t)
+}
+
+func TestTraceCMove(t *testing.T) {
+	tracer := &fakeTracer{}
+	var datasets []*dicom.DataSet
+	for i := 0; i < 3; i++ {
+		datasets = append(datasets, newCMoveDataSet(ctImageStorage, fmt.Sprintf("1.2.3.%d", i)))
+	}
+	r := testCMoveSubOps(t, datasets, "DEST", nil, func(params *ServiceProviderParams) {
+		params.Tracer = tracer
+	})
+	require.Equal(t, dimse.StatusSuccess, r.resp.Status.Status)
+
+	// The association to the destination and the sub-operations are
+	// children of the C-MOVE handler.
+	move := tracer.find("dicom.handle.C-MOVE")
+	require.Equal(t, 1, len(move))
+	assert.NoError(t, move[0].err)
+	assert.Equal(t, "0000", move[0].attrs[TraceAttrStatus])
+	assoc := tracer.find("dicom.Associate")
+	require.Equal(t, 1, len(assoc))
+	assert.Equal(t, move[0], assoc[0].parent)
+	assert.Equal(t, "DEST", assoc[0].attrs[TraceAttrCalledAE])
+	stores := tracer.find("dicom.C-STORE")
+	require.Equal(t, 3, len(stores))
+	for _, s := range stores {
+		assert.Equal(t, move[0], s.parent)
+		assert.Equal(t, "0000", s.attrs[TraceAttrStatus])
+	}
+	assert.NotEmpty(t, tracer.find("dicom.WritePDUs"))
+}
@@ -0,0 +1,72 @@
+package netdicom
+
+// This file defines the hook for recording the PDUs exchanged on an
+// association.
+
+// WireTapInfo describes the association a WireTap is attached to.
+type WireTapInfo struct {
+	// Association is the unique ID of the association, e.g., "user-3". It
+	// matches the LogKeyAssociation attribute in log entries.
+	Association string
+	// IsUser is true if the local side is the ServiceUser (requestor).
+	IsUser bool
+	// AE titles. For a ServiceProvider, they are empty; they can be found
+	// in the A-ASSOCIATE-RQ PDU.
+	CallingAETitle string
+	CalledAETitle  string
+	LocalAddr      string
+	RemoteAddr     string
+}
+
+// WireTap receives every PDU sent or received on one association. Package
+// github.com/grailbio/go-netdicom/wiretap provides an implementation that
+// writes a capture file.
+type WireTap interface {
+	// TapPDU is called with the encoded PDU, including its 6-byte header.
+	// It is called concurrently for sent and received PDUs, and it may be
+	// called after Close, in which case the call should be ignored. The
+	// callee must not modify or retain "data".
+	TapPDU(dir PDUDirection, data []byte)
+	// Close is called when the association ends.
+	Close() error
+}
+
+// WireTapFactory creates a WireTap for a new association. It is called once
+// the network connection is established.
+type WireTapFactory func(info WireTapInfo) (WireTap, error)
+
+// startWireTap creates the tap for the association, if the application
+// requested one.
+func startWireTap(sm *stateMachine) {
+	if sm.newWireTap == nil || sm.conn == nil {
+		return
+	}
+	info := WireTapInfo{
+		Association: sm.label,
+		IsUser:      sm.isUser,
+		RemoteAddr:  remoteAddrString(sm.conn),
+	}
+	if sm.conn.LocalAddr() != nil {
+		info.LocalAddr = sm.conn.LocalAddr().String()
+	}
+	if sm.isUser {
+		info.CallingAETitle = sm.userParams.CallingAETitle
+		info.CalledAETitle = sm.userParams.CalledAETitle
+	}
+	tap, err := sm.newWireTap(info)
+	if err != nil {
+		sm.logger.error("Failed to create wire tap", LogKeyError, err)
+		return
+	}
+	sm.tap = tap
+}
+
+// closeWireTap closes the tap created by startWireTap, if any.
+func closeWireTap(sm *stateMachine) {
+	if sm.tap == nil {
+		return
+	}
+	if err := sm.tap.Close(); err != nil {
+		sm.logger.error("Failed to close wire tap", LogKeyError, err)
+	}
+}
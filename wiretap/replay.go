@@ -0,0 +1,90 @@
+package wiretap
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/grailbio/go-netdicom"
+)
+
+// ReplayOptions controls Replay.
+type ReplayOptions struct {
+	// Strict requires the PDUs read from the connection to match the
+	// capture byte for byte. Otherwise, only the PDU types are compared,
+	// since message IDs and such often differ between runs.
+	Strict bool
+
+	// Realtime reproduces the delays between the PDUs in the capture.
+	Realtime bool
+
+	// ReadTimeout is the max time to wait for each PDU from the
+	// connection. If zero, 10 seconds is used.
+	ReadTimeout time.Duration
+}
+
+// Replay acts as the peer of the side that recorded the capture. For each
+// record, in order, it writes the PDU to "conn" if the recording side
+// received it, or reads a PDU from "conn" and checks it against the record if
+// the recording side sent it. So to reproduce what a remote SCP did to a
+// ServiceUser, connect the ServiceUser to "conn" and rerun the operations.
+//
+// Replay returns nil once all records are processed, or an error on the
+// first mismatch. It doesn't close conn.
+func Replay(conn net.Conn, r *Reader, opts ReplayOptions) error {
+	if opts.ReadTimeout == 0 {
+		opts.ReadTimeout = 10 * time.Second
+	}
+	var lastTime time.Time
+	for i := 0; ; i++ {
+		rec, err := r.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if opts.Realtime && !lastTime.IsZero() {
+			time.Sleep(rec.Time.Sub(lastTime))
+		}
+		lastTime = rec.Time
+		if rec.Direction == netdicom.PDUReceived {
+			if _, err := conn.Write(rec.Data); err != nil {
+				return fmt.Errorf("wiretap: record %d: write: %v", i, err)
+			}
+			continue
+		}
+		conn.SetReadDeadline(time.Now().Add(opts.ReadTimeout))
+		got, err := readRawPDU(conn)
+		if err != nil {
+			return fmt.Errorf("wiretap: record %d: expect PDU type %d, but read failed: %v", i, rec.Data[0], err)
+		}
+		if got[0] != rec.Data[0] {
+			return fmt.Errorf("wiretap: record %d: expect PDU type %d, got %d", i, rec.Data[0], got[0])
+		}
+		if opts.Strict && !bytes.Equal(got, rec.Data) {
+			return fmt.Errorf("wiretap: record %d: PDU mismatch: expect %x, got %x", i, rec.Data, got)
+		}
+	}
+}
+
+// readRawPDU reads one PDU, including its header, without parsing it.
+func readRawPDU(in io.Reader) ([]byte, error) {
+	var header [6]byte
+	if _, err := io.ReadFull(in, header[:]); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(header[2:6])
+	if length > maxRecordSize {
+		return nil, fmt.Errorf("PDU too large (%d bytes)", length)
+	}
+	data := make([]byte, 6+int(length))
+	copy(data, header[:])
+	if _, err := io.ReadFull(in, data[6:]); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
@@ -0,0 +1,100 @@
+// A tool for replaying a capture file written by wiretap.
+//
+// Usage: ./replaymain [-listen :port | -connect host:port] <capture file>
+//
+// If the capture was recorded by a ServiceUser, the tool plays the remote
+// SCP: it listens on -listen and replays to the first client that connects.
+//
+// If the capture was recorded by a ServiceProvider, the tool plays the remote
+// SCU. It connects to -connect, or if -connect is empty, runs against an
+// in-process ServiceProvider whose handlers accept everything.
+package main
+
+import (
+	"flag"
+	"log"
+	"net"
+	"os"
+
+	"github.com/grailbio/go-dicom"
+	"github.com/grailbio/go-netdicom"
+	"github.com/grailbio/go-netdicom/dimse"
+	"github.com/grailbio/go-netdicom/wiretap"
+)
+
+var (
+	listenFlag   = flag.String("listen", ":10000", "Address to listen to, when replaying the SCP side of a ServiceUser capture.")
+	connectFlag  = flag.String("connect", "", "host:port of the SCP to replay a ServiceProvider capture against. If empty, use an in-process provider.")
+	aeFlag       = flag.String("ae", "replayae", "AE title of the in-process provider.")
+	strictFlag   = flag.Bool("strict", false, "Require the PDUs to match the capture byte for byte.")
+	realtimeFlag = flag.Bool("realtime", false, "Reproduce the delays between PDUs.")
+)
+
+func newInProcessProvider() net.Conn {
+	params := netdicom.ServiceProviderParams{
+		AETitle: *aeFlag,
+		CEcho: func(connState netdicom.ConnectionState) dimse.Status {
+			return dimse.Success
+		},
+		CStore: func(connState netdicom.ConnectionState, transferSyntaxUID string,
+			sopClassUID string,
+			sopInstanceUID string,
+			data []byte) dimse.Status {
+			log.Printf("C-STORE: %s, %d bytes", sopInstanceUID, len(data))
+			return dimse.Success
+		},
+		CFind: func(connState netdicom.ConnectionState, transferSyntaxUID string, sopClassUID string,
+			filter []*dicom.Element, ch chan netdicom.CFindResult) {
+			close(ch)
+		},
+	}
+	providerConn, conn := net.Pipe()
+	go netdicom.RunProviderForConn(providerConn, params)
+	return conn
+}
+
+func main() {
+	flag.Parse()
+	if flag.NArg() != 1 {
+		log.Fatal("Usage: replaymain [flags] <capture file>")
+	}
+	in, err := os.Open(flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer in.Close()
+	r, err := wiretap.NewReader(in)
+	if err != nil {
+		log.Fatal(err)
+	}
+	info := r.Info()
+	log.Printf("Capture of %s: calling AE %q, called AE %q, local %s, remote %s, user: %v",
+		info.Association, info.CallingAETitle, info.CalledAETitle, info.LocalAddr, info.RemoteAddr, info.IsUser)
+
+	var conn net.Conn
+	switch {
+	case info.IsUser:
+		listener, err := net.Listen("tcp", *listenFlag)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Listening on %s", listener.Addr())
+		conn, err = listener.Accept()
+		if err != nil {
+			log.Fatal(err)
+		}
+		listener.Close()
+	case *connectFlag != "":
+		conn, err = net.Dial("tcp", *connectFlag)
+		if err != nil {
+			log.Fatal(err)
+		}
+	default:
+		conn = newInProcessProvider()
+	}
+	defer conn.Close()
+	if err := wiretap.Replay(conn, r, wiretap.ReplayOptions{Strict: *strictFlag, Realtime: *realtimeFlag}); err != nil {
+		log.Fatalf("Replay failed: %v", err)
+	}
+	log.Printf("Replay finished")
+}
@@ -0,0 +1,222 @@
+// Package wiretap records the PDUs exchanged on an association to a capture
+// file, and replays a capture against a netdicom state machine.
+//
+// To record every association of a provider under /tmp/captures:
+//
+//	params := netdicom.ServiceProviderParams{
+//		...
+//		WireTap: wiretap.NewFileTap("/tmp/captures"),
+//	}
+//
+// Capture file format:
+//
+//	File   := Magic Record*
+//	Magic  := "NETDICOM-CAPTURE-1\n"
+//	Record := Kind(1 byte) UnixNanos(int64) Length(uint32) Payload(Length bytes)
+//
+// Integers are big endian. Kind is 'M' for the first record, whose payload is
+// netdicom.WireTapInfo in JSON; 'S' for a PDU sent by the recording side; and
+// 'R' for a PDU received by the recording side. PDU payloads include the
+// 6-byte PDU header.
+package wiretap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/grailbio/go-netdicom"
+)
+
+const magic = "NETDICOM-CAPTURE-1\n"
+
+const (
+	kindMetadata = 'M'
+	kindSent     = 'S'
+	kindReceived = 'R'
+)
+
+// maxRecordSize guards against reading a corrupt file.
+const maxRecordSize = 1 << 30
+
+// Record is one PDU in a capture.
+type Record struct {
+	Time      time.Time
+	Direction netdicom.PDUDirection // Relative to the side that recorded the capture.
+	Data      []byte                // Encoded PDU, including the header.
+}
+
+// Writer writes a capture. It implements netdicom.WireTap.
+type Writer struct {
+	mu     sync.Mutex
+	out    io.WriteCloser
+	w      *bufio.Writer
+	err    error // First error encountered.
+	closed bool
+}
+
+var _ netdicom.WireTap = (*Writer)(nil)
+
+// NewWriter creates a Writer that writes to "out". It writes the header and
+// "info" immediately. Close closes "out".
+func NewWriter(out io.WriteCloser, info netdicom.WireTapInfo) (*Writer, error) {
+	w := &Writer{out: out, w: bufio.NewWriter(out)}
+	meta, err := json.Marshal(info)
+	if err != nil {
+		return nil, err
+	}
+	w.w.WriteString(magic)
+	w.writeRecord(kindMetadata, time.Now(), meta)
+	if w.err != nil {
+		return nil, w.err
+	}
+	return w, nil
+}
+
+// REQUIRES: w.mu is locked, or w isn't shared yet.
+func (w *Writer) writeRecord(kind byte, t time.Time, payload []byte) {
+	if w.err != nil {
+		return
+	}
+	var header [13]byte
+	header[0] = kind
+	binary.BigEndian.PutUint64(header[1:9], uint64(t.UnixNano()))
+	binary.BigEndian.PutUint32(header[9:13], uint32(len(payload)))
+	if _, err := w.w.Write(header[:]); err != nil {
+		w.err = err
+		return
+	}
+	if _, err := w.w.Write(payload); err != nil {
+		w.err = err
+	}
+}
+
+// TapPDU implements netdicom.WireTap.
+func (w *Writer) TapPDU(dir netdicom.PDUDirection, data []byte) {
+	kind := byte(kindReceived)
+	if dir == netdicom.PDUSent {
+		kind = kindSent
+	}
+	now := time.Now()
+	w.mu.Lock()
+	if !w.closed {
+		w.writeRecord(kind, now, data)
+	}
+	w.mu.Unlock()
+}
+
+// Close flushes the capture and closes the underlying file. It returns the
+// first error encountered while writing.
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return w.err
+	}
+	w.closed = true
+	if err := w.w.Flush(); err != nil && w.err == nil {
+		w.err = err
+	}
+	if err := w.out.Close(); err != nil && w.err == nil {
+		w.err = err
+	}
+	return w.err
+}
+
+// NewFileTap creates a netdicom.WireTapFactory that writes one capture file
+// per association under "dir". The file is named
+// <time>-<association>.dcmcap, e.g., "20180102T150405-user-3.dcmcap".
+func NewFileTap(dir string) netdicom.WireTapFactory {
+	return func(info netdicom.WireTapInfo) (netdicom.WireTap, error) {
+		name := fmt.Sprintf("%s-%s.dcmcap", time.Now().Format("20060102T150405"), info.Association)
+		f, err := os.Create(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		w, err := NewWriter(f, info)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		return w, nil
+	}
+}
+
+// Reader reads a capture written by Writer.
+type Reader struct {
+	in   *bufio.Reader
+	info netdicom.WireTapInfo
+}
+
+// NewReader creates a Reader. It reads the header and the association
+// metadata immediately.
+func NewReader(in io.Reader) (*Reader, error) {
+	r := &Reader{in: bufio.NewReader(in)}
+	var m [len(magic)]byte
+	if _, err := io.ReadFull(r.in, m[:]); err != nil {
+		return nil, fmt.Errorf("wiretap: failed to read header: %v", err)
+	}
+	if string(m[:]) != magic {
+		return nil, fmt.Errorf("wiretap: not a capture file")
+	}
+	kind, _, payload, err := r.readRecord()
+	if err != nil {
+		return nil, fmt.Errorf("wiretap: failed to read metadata: %v", err)
+	}
+	if kind != kindMetadata {
+		return nil, fmt.Errorf("wiretap: first record has kind %q, expect %q", kind, kindMetadata)
+	}
+	if err := json.Unmarshal(payload, &r.info); err != nil {
+		return nil, fmt.Errorf("wiretap: failed to parse metadata: %v", err)
+	}
+	return r, nil
+}
+
+// Info returns the metadata of the recorded association.
+func (r *Reader) Info() netdicom.WireTapInfo {
+	return r.info
+}
+
+// Next reads the next PDU record. It returns io.EOF at the end of the capture.
+func (r *Reader) Next() (Record, error) {
+	kind, t, payload, err := r.readRecord()
+	if err != nil {
+		return Record{}, err
+	}
+	rec := Record{Time: t, Data: payload}
+	switch kind {
+	case kindSent:
+		rec.Direction = netdicom.PDUSent
+	case kindReceived:
+		rec.Direction = netdicom.PDUReceived
+	default:
+		return Record{}, fmt.Errorf("wiretap: unknown record kind %q", kind)
+	}
+	return rec, nil
+}
+
+func (r *Reader) readRecord() (byte, time.Time, []byte, error) {
+	var header [13]byte
+	if _, err := io.ReadFull(r.in, header[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = fmt.Errorf("wiretap: truncated record header")
+		}
+		return 0, time.Time{}, nil, err
+	}
+	t := time.Unix(0, int64(binary.BigEndian.Uint64(header[1:9])))
+	n := binary.BigEndian.Uint32(header[9:13])
+	if n > maxRecordSize {
+		return 0, time.Time{}, nil, fmt.Errorf("wiretap: record too large (%d bytes)", n)
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r.in, payload); err != nil {
+		return 0, time.Time{}, nil, fmt.Errorf("wiretap: truncated record: %v", err)
+	}
+	return header[0], t, payload, nil
+}
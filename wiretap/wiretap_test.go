@@ -0,0 +1,100 @@
+package wiretap_test
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+
+	"github.com/grailbio/go-netdicom"
+	"github.com/grailbio/go-netdicom/pdu"
+	"github.com/grailbio/go-netdicom/wiretap"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type nopCloser struct{ io.Writer }
+
+func (nopCloser) Close() error { return nil }
+
+func mustEncode(t *testing.T, v pdu.PDU) []byte {
+	data, err := pdu.EncodePDU(v)
+	require.NoError(t, err)
+	return data
+}
+
+func TestRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	info := netdicom.WireTapInfo{Association: "user-1", IsUser: true, CallingAETitle: "foo", CalledAETitle: "bar"}
+	w, err := wiretap.NewWriter(nopCloser{&buf}, info)
+	require.NoError(t, err)
+	rq := mustEncode(t, &pdu.AReleaseRq{})
+	rp := mustEncode(t, &pdu.AReleaseRp{})
+	w.TapPDU(netdicom.PDUSent, rq)
+	w.TapPDU(netdicom.PDUReceived, rp)
+	require.NoError(t, w.Close())
+	w.TapPDU(netdicom.PDUSent, rq) // ignored
+
+	r, err := wiretap.NewReader(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, info, r.Info())
+	rec, err := r.Next()
+	require.NoError(t, err)
+	assert.Equal(t, netdicom.PDUSent, rec.Direction)
+	assert.Equal(t, rq, rec.Data)
+	rec, err = r.Next()
+	require.NoError(t, err)
+	assert.Equal(t, netdicom.PDUReceived, rec.Direction)
+	assert.Equal(t, rp, rec.Data)
+	_, err = r.Next()
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestBadFile(t *testing.T) {
+	_, err := wiretap.NewReader(bytes.NewReader([]byte("garbage")))
+	assert.Error(t, err)
+}
+
+func TestReplay(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := wiretap.NewWriter(nopCloser{&buf}, netdicom.WireTapInfo{Association: "user-1", IsUser: true})
+	require.NoError(t, err)
+	rq := mustEncode(t, &pdu.AReleaseRq{})
+	rp := mustEncode(t, &pdu.AReleaseRp{})
+	w.TapPDU(netdicom.PDUSent, rq)
+	w.TapPDU(netdicom.PDUReceived, rp)
+	require.NoError(t, w.Close())
+	capture := buf.Bytes()
+
+	// The local side behaves as recorded.
+	r, err := wiretap.NewReader(bytes.NewReader(capture))
+	require.NoError(t, err)
+	local, peer := net.Pipe()
+	go func() {
+		local.Write(rq)
+	}()
+	errCh := make(chan error, 1)
+	go func() { errCh <- wiretap.Replay(peer, r, wiretap.ReplayOptions{Strict: true}) }()
+	got := make([]byte, len(rp))
+	_, err = io.ReadFull(local, got)
+	require.NoError(t, err)
+	assert.Equal(t, rp, got)
+	require.NoError(t, <-errCh)
+	local.Close()
+	peer.Close()
+
+	// The local side sends an unexpected PDU.
+	r, err = wiretap.NewReader(bytes.NewReader(capture))
+	require.NoError(t, err)
+	abort := mustEncode(t, &pdu.AAbort{})
+	local, peer = net.Pipe()
+	go func() {
+		local.Write(abort)
+		io.Copy(ioutil.Discard, local)
+	}()
+	err = wiretap.Replay(peer, r, wiretap.ReplayOptions{})
+	assert.Error(t, err)
+	local.Close()
+	peer.Close()
+}
@@ -0,0 +1,121 @@
+package netdicom
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/grailbio/go-netdicom/dimse"
+	"github.com/grailbio/go-netdicom/pdu"
+	"github.com/grailbio/go-netdicom/sopclass"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingTap is a WireTap that keeps the PDUs in memory.
+type recordingTap struct {
+	info   WireTapInfo
+	closed chan struct{}
+
+	mu       sync.Mutex
+	sent     [][]byte
+	received [][]byte
+}
+
+func (tap *recordingTap) TapPDU(dir PDUDirection, data []byte) {
+	data = append([]byte(nil), data...) // The caller may reuse data.
+	tap.mu.Lock()
+	defer tap.mu.Unlock()
+	if dir == PDUSent {
+		tap.sent = append(tap.sent, data)
+	} else {
+		tap.received = append(tap.received, data)
+	}
+}
+
+func (tap *recordingTap) Close() error {
+	close(tap.closed)
+	return nil
+}
+
+// pduTypes returns the types of the PDUs.
+func pduTypes(pdus [][]byte) []pdu.Type {
+	var types []pdu.Type
+	for _, data := range pdus {
+		types = append(types, pdu.Type(data[0]))
+	}
+	return types
+}
+
+// recordingTapFactory returns a WireTapFactory that sends the taps it
+// creates to the channel.
+func recordingTapFactory(ch chan *recordingTap) WireTapFactory {
+	return func(info WireTapInfo) (WireTap, error) {
+		tap := &recordingTap{info: info, closed: make(chan struct{})}
+		ch <- tap
+		return tap, nil
+	}
+}
+
+func TestWireTap(t *testing.T) {
+	userTaps := make(chan *recordingTap, 1)
+	providerTaps := make(chan *recordingTap, 1)
+	p, err := NewServiceProvider(ServiceProviderParams{
+		AETitle: "PROVIDER",
+		CEcho:   func(ConnectionState) dimse.Status { return dimse.Success },
+		WireTap: recordingTapFactory(providerTaps),
+	}, "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { p.Close() })
+	go p.Run()
+	su, err := NewServiceUser(ServiceUserParams{
+		CalledAETitle:  "PROVIDER",
+		CallingAETitle: "USER",
+		SOPClasses:     sopclass.VerificationClasses,
+		WireTap:        recordingTapFactory(userTaps),
+	})
+	require.NoError(t, err)
+	su.Connect(p.ListenAddr().String())
+	require.NoError(t, su.CEcho())
+	su.Release()
+
+	userTap, providerTap := <-userTaps, <-providerTaps
+	<-userTap.closed
+	<-providerTap.closed
+
+	assert.True(t, userTap.info.IsUser)
+	assert.Equal(t, "USER", userTap.info.CallingAETitle)
+	assert.Equal(t, "PROVIDER", userTap.info.CalledAETitle)
+	assert.Equal(t, p.ListenAddr().String(), userTap.info.RemoteAddr)
+	assert.NotEmpty(t, userTap.info.Association)
+	assert.False(t, providerTap.info.IsUser)
+	assert.Empty(t, providerTap.info.CallingAETitle)
+	assert.Equal(t, userTap.info.LocalAddr, providerTap.info.RemoteAddr)
+
+	userTap.mu.Lock()
+	defer userTap.mu.Unlock()
+	providerTap.mu.Lock()
+	defer providerTap.mu.Unlock()
+	// The provider may also request the release, so the release PDUs that
+	// follow vary.
+	userSent, userReceived := pduTypes(userTap.sent), pduTypes(userTap.received)
+	require.True(t, len(userSent) >= 3 && len(userReceived) >= 3, "sent %v, received %v", userSent, userReceived)
+	assert.Equal(t, []pdu.Type{pdu.TypeAAssociateRq, pdu.TypePDataTf, pdu.TypeAReleaseRq}, userSent[:3])
+	assert.Equal(t, []pdu.Type{pdu.TypeAAssociateAc, pdu.TypePDataTf}, userReceived[:2])
+	assert.Contains(t, userReceived[2:], pdu.Type(pdu.TypeAReleaseRp))
+
+	// Each side receives what the other sends, byte for byte, headers
+	// included.
+	require.Equal(t, len(userTap.sent), len(providerTap.received))
+	for i := range userTap.sent {
+		assert.True(t, bytes.Equal(userTap.sent[i], providerTap.received[i]), "PDU %d", i)
+	}
+	require.Equal(t, len(providerTap.sent), len(userTap.received))
+	for i := range providerTap.sent {
+		assert.True(t, bytes.Equal(providerTap.sent[i], userTap.received[i]), "PDU %d", i)
+	}
+	v, err := pdu.ReadPDU(bytes.NewReader(userTap.sent[0]), DefaultMaxPDUSize)
+	require.NoError(t, err)
+	assert.Equal(t, "PROVIDER", strings.TrimSpace(v.(*pdu.AAssociate).CalledAETitle))
+}